@@ -1,91 +1,214 @@
 package cache
 
 import (
-	"ckv/sstable"
-	"fmt"
+	"container/list"
 	"sync"
+	"sync/atomic"
 )
 
+// Policy decide which entries are kept when the cache is full
+type Policy int
+
+const (
+	// PolicyWinTinyLFU put new entries in a small LRU window, and admit the
+	// ones evicted from it to a segmented LRU if they are used more often
+	// than the entries they replace. It's the default policy
+	PolicyWinTinyLFU Policy = iota
+	// PolicyTinyLFU admit a new entry only if it's used more often than the
+	// least recently used entries it replaces
+	PolicyTinyLFU
+	// PolicyLRU evict the least recently used entries
+	PolicyLRU
+)
+
+const (
+	defaultNumShards = 16
+	// minShardCapacity is the capacity of shard at least when the number of
+	// shards is not set, so that a small cache can still hold large entries
+	minShardCapacity = 512 << 10
+)
+
+// Options to control the behavior of Cache
+type Options struct {
+	Capacity int64 // the max total charge of entries
+	Policy   Policy
+
+	// NumShards is the number of lock-striped shards, rounded up to a power
+	// of 2. Each shard has an equal part of Capacity, so it should hold the
+	// largest entry. By default it's 16, or fewer to keep minShardCapacity
+	// in each shard
+	NumShards int
+
+	// OnEvict is called with each value that leaves the cache, either
+	// evicted, deleted, replaced by Set or rejected by the policy. It's
+	// called after the shard is unlocked, so it may use the cache
+	OnEvict func(key uint64, value interface{})
+}
+
+// Cache is a cache of uint64 keys bounded by the total charge of entries,
+// e.g. their size in bytes. The keys are spread to shards, each of them has
+// its own lock and an equal part of the capacity. It's safe for concurrent use
 type Cache struct {
-	//index Replacer
-	//index sync.Map
-	index     map[uint64]*sstable.IndexBlock
-	table     Replacer
-	block     Replacer
-	indexLock sync.RWMutex
-	tableLock sync.RWMutex
+	shards  []*shard
+	mask    uint64
+	onEvict func(key uint64, value interface{})
+	hits    uint64
+	misses  uint64
+}
+
+type entry struct {
+	key    uint64
+	hash   uint64
+	value  interface{}
+	charge int64
+	status int // the segment of winTinyLFUPolicy
+	elem   *list.Element
 }
 
-func NewCache(nblock, nindex int) *Cache {
-	return &Cache{
-		//index: NewLRUReplacer(nindex),
-		index: make(map[uint64]*sstable.IndexBlock),
-		//index: sync.Map{},
-		//table: NewLRUReplacer(100),
-		table: NewWinTinyLFU(nblock),
-		block: NewWinTinyLFU(nblock),
+type shard struct {
+	sync.Mutex
+	entries map[uint64]*entry
+	policy  policy
+}
+
+// NewCache return a cache with the options
+func NewCache(opt Options) *Cache {
+	numShards := defaultNumShards
+	if opt.NumShards > 0 {
+		numShards = int(next2Power(int64(opt.NumShards)))
+	} else {
+		for numShards > 1 && opt.Capacity/int64(numShards) < minShardCapacity {
+			numShards /= 2
+		}
+	}
+	c := &Cache{
+		shards:  make([]*shard, numShards),
+		mask:    uint64(numShards - 1),
+		onEvict: opt.OnEvict,
+	}
+	capacity := opt.Capacity / int64(numShards)
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			entries: make(map[uint64]*entry),
+			policy:  newPolicy(opt.Policy, capacity),
+		}
 	}
+	return c
 }
 
-func (cache Cache) AddBlock(fid uint64, b *sstable.Block) {
-	cache.tableLock.Lock()
-	defer cache.tableLock.Unlock()
-	cache.table.Put(fmt.Sprintf("%d", fid), b)
+// hash mix the bits of key, so that the keys close to each other are spread
+func hash(key uint64) uint64 {
+	key ^= key >> 33
+	key *= 0xff51afd7ed558ccd
+	key ^= key >> 33
+	key *= 0xc4ceb9fe1a85ec53
+	key ^= key >> 33
+	return key
 }
 
-func (cache Cache) GetBlock(fid uint64) *sstable.Block {
-	cache.tableLock.RLock()
-	defer cache.tableLock.RUnlock()
-	t := cache.table.Get(fmt.Sprintf("%d", fid))
-	if t == nil {
-		return nil
+// shard return the shard of the hashed key. The high bits are used, since
+// the low bits index the frequency sketch of the shard
+func (c *Cache) shard(h uint64) *shard {
+	return c.shards[(h>>32)&c.mask]
+}
+
+// Get return the value of key, and whether it's found
+func (c *Cache) Get(key uint64) (interface{}, bool) {
+	h := hash(key)
+	s := c.shard(h)
+	s.Lock()
+	e, ok := s.entries[key]
+	if !ok {
+		s.policy.miss(h)
+		s.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
 	}
-	return t.(*sstable.Block)
+	s.policy.access(e)
+	value := e.value
+	s.Unlock()
+	atomic.AddUint64(&c.hits, 1)
+	return value, true
 }
 
-func (cache Cache) AddTable(fid uint64, t *sstable.Table) {
-	cache.tableLock.Lock()
-	defer cache.tableLock.Unlock()
-	cache.table.Put(fmt.Sprintf("%d", fid), t)
+// Set add or replace the value of key. It returns false if the value is
+// rejected by the policy, e.g. its charge is larger than the shard
+func (c *Cache) Set(key uint64, value interface{}, charge int64) bool {
+	h := hash(key)
+	s := c.shard(h)
+	e := &entry{key: key, hash: h, value: value, charge: charge}
+	var evicted []*entry
+	s.Lock()
+	if old, ok := s.entries[key]; ok {
+		s.policy.remove(old)
+		evicted = append(evicted, old)
+	}
+	s.entries[key] = e
+	admitted := true
+	for _, victim := range s.policy.add(e) {
+		if victim == e {
+			admitted = false
+		}
+		delete(s.entries, victim.key)
+		evicted = append(evicted, victim)
+	}
+	s.Unlock()
+	c.evict(evicted)
+	return admitted
 }
 
-func (cache Cache) GetTable(fid uint64) *sstable.Table {
-	cache.tableLock.RLock()
-	defer cache.tableLock.RUnlock()
-	t := cache.table.Get(fmt.Sprintf("%d", fid))
-	if t == nil {
-		return nil
+// Delete remove key from the cache
+func (c *Cache) Delete(key uint64) {
+	s := c.shard(hash(key))
+	s.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		s.policy.remove(e)
+		delete(s.entries, key)
+	}
+	s.Unlock()
+	if ok {
+		c.evict([]*entry{e})
 	}
-	return t.(*sstable.Table)
 }
 
-func (cache Cache) AddIndex(fid uint64, index *sstable.IndexBlock) {
-	//cache.index.Put(fmt.Sprintf("%d", fid), b)
-	cache.indexLock.Lock()
-	defer cache.indexLock.Unlock()
-	//cache.index.Store(fid, index)
-	cache.index[fid] = index
+func (c *Cache) evict(entries []*entry) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, e := range entries {
+		c.onEvict(e.key, e.value)
+	}
 }
 
-func (cache Cache) DeleteIndex(fid uint64) {
-	//cache.index.Put(fmt.Sprintf("%d", fid), b)
-	cache.indexLock.Lock()
-	defer cache.indexLock.Unlock()
-	delete(cache.index, fid)
+// Len return the number of entries
+func (c *Cache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.Lock()
+		n += len(s.entries)
+		s.Unlock()
+	}
+	return n
 }
 
-func (cache Cache) GetIndex(fid uint64) *sstable.IndexBlock {
-	cache.indexLock.RLock()
-	defer cache.indexLock.RUnlock()
-	//index, ok := cache.index.Load(fid)
-	index, ok := cache.index[fid]
-	if ok {
-		return index
+// UsedBytes return the total charge of entries
+func (c *Cache) UsedBytes() int64 {
+	var used int64
+	for _, s := range c.shards {
+		s.Lock()
+		used += s.policy.used()
+		s.Unlock()
 	}
-	return nil
-	//index := cache.index.Get(fmt.Sprintf("%d", fid))
-	//if index == nil {
-	//	return nil
-	//}
-	//return index.(*sstable.IndexBlock)
+	return used
+}
+
+// Hits return the number of Get that found the key
+func (c *Cache) Hits() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+// Misses return the number of Get that didn't find the key
+func (c *Cache) Misses() uint64 {
+	return atomic.LoadUint64(&c.misses)
 }
@@ -1,161 +1,132 @@
 package cache
 
 import (
-	"ckv/utils"
 	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLRU(t *testing.T) {
-	lru := NewLRUReplacer(5)
-	for i := 0; i < 5; i++ {
-		lru.Put(fmt.Sprintf("%d", i), i)
+	c := NewCache(Options{Capacity: 5, NumShards: 1, Policy: PolicyLRU})
+	for i := uint64(0); i < 5; i++ {
+		c.Set(i, i, 1)
 	}
-	lru.Put("1", 11)
-	lru.Put("6", 6)
+	c.Set(1, 11, 1)
+	c.Set(6, 6, 1)
 
-	v := lru.Get("5")
-	utils.AssertTrue(v == nil)
+	// the least recently used one is evicted
+	_, ok := c.Get(0)
+	assert.False(t, ok)
+	v, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, 11, v)
 }
 
 func TestTinyLFU(t *testing.T) {
-	lru := NewTinyLFU(5)
-	lru.Put(fmt.Sprintf("%d", 0), 0)
-
+	c := NewCache(Options{Capacity: 5, NumShards: 1, Policy: PolicyTinyLFU})
+	c.Set(0, 0, 1)
 	for i := 0; i < 3; i++ {
-		lru.Get(fmt.Sprintf("%d", 0))
+		c.Get(0)
 	}
-	for i := 0; i < 5; i++ {
-		lru.Put(fmt.Sprintf("%d", i), i)
-		lru.Get(fmt.Sprintf("%d", i))
+	for i := uint64(1); i < 5; i++ {
+		c.Set(i, i, 1)
 	}
-	//lru.Put("1", 11)
-	lru.Put("5", 5)
-	lru.Get(fmt.Sprintf("%d", 5))
-
-	v := lru.Get("1")
-	fmt.Println(v)
-	utils.AssertTrue(v == nil)
 
+	// the new key is rejected, since it's used less often than the least
+	// recently used one
+	assert.False(t, c.Set(5, 5, 1))
+	_, ok := c.Get(0)
+	assert.True(t, ok)
 }
 
 func TestWinTinyLFUFlood(t *testing.T) {
-	rand.Seed(time.Now().Unix())
 	n := 1000
-	data := make([]string, 0)
+	data := make([]uint64, 0)
 	for i := 0; i < 100; i++ {
 		for i := 0; i < n; i++ {
-			data = append(data, fmt.Sprintf("%d", i))
+			data = append(data, uint64(i))
 		}
 	}
-
-	lru := NewLRUReplacer(n / 10)
-	lfu := NewTinyLFU(n / 10)
-	tiny := NewWinTinyLFU(n / 10)
-
-	execute(data, tiny, "W-TinyLFU")
-	execute(data, lfu, "TinyLFU")
-	execute(data, lru, "LRU")
+	executeAll(data, n/10)
 }
 
 func TestSparseBursts(t *testing.T) {
-	rand.Seed(time.Now().Unix())
 	n := 10000
-	data := make([]string, 0)
+	data := make([]uint64, 0)
 	for i := 0; i < 10; i++ {
 		for j := 0; j < n/10; j++ {
-			data = append(data, fmt.Sprintf("%d", j))
+			data = append(data, uint64(j))
 		}
 	}
 
 	for i := 0; i < 5; i++ {
 		for j := n; j < n+n/10; j++ {
-			data = append(data, fmt.Sprintf("%d", j))
-
+			data = append(data, uint64(j))
 		}
 	}
-
-	lru := NewLRUReplacer(n / 10)
-	lfu := NewTinyLFU(n / 10)
-	tiny := NewWinTinyLFU(n / 10)
-
-	execute(data, tiny, "W-TinyLFU")
-	execute(data, lfu, "TinyLFU")
-	execute(data, lru, "LRU")
+	executeAll(data, n/10)
 }
 
 func TestSparseBursts2(t *testing.T) {
-	rand.Seed(time.Now().Unix())
 	n := 1000
-	data := make([]string, 0)
+	data := make([]uint64, 0)
 	for i := 0; i < 10; i++ {
 		for j := 0; j < 10; j++ {
 			for k := i * n; k < (i+1)*n; k++ {
-				data = append(data, fmt.Sprintf("%d", k))
+				data = append(data, uint64(k))
 			}
 			for k := 0; i < 3; i++ {
 				for m := 0; k < m/2; k++ {
-					data = append(data, fmt.Sprintf("%d", m))
+					data = append(data, uint64(m))
 				}
 			}
 		}
 	}
-
-	lru := NewLRUReplacer(n)
-	lfu := NewTinyLFU(n)
-	tiny := NewWinTinyLFU(n)
-
-	execute(data, tiny, "W-TinyLFU")
-	execute(data, lfu, "TinyLFU")
-	execute(data, lru, "LRU")
+	executeAll(data, n)
 }
 
 func TestWinTinyLFUHotChange(t *testing.T) {
-	rand.Seed(time.Now().Unix())
 	n := 1000
-	data := make([]string, 0)
+	data := make([]uint64, 0)
 	for i := 0; i < 10; i++ {
 		for j := 0; j < 10; j++ {
 			for k := i * n; k < (i+1)*n; k++ {
-				data = append(data, fmt.Sprintf("%d", k))
+				data = append(data, uint64(k))
 			}
 		}
 	}
-
-	lru := NewLRUReplacer(n)
-	lfu := NewTinyLFU(n)
-	tiny := NewWinTinyLFU(n)
-
-	execute(data, tiny, "W-TinyLFU")
-	execute(data, lfu, "TinyLFU")
-	execute(data, lru, "LRU")
+	executeAll(data, n)
 }
 
 func TestWinTinyLFU(t *testing.T) {
 	rand.Seed(time.Now().Unix())
 	n := 10000
-	data := make([]string, 0)
+	data := make([]uint64, 0)
 	for i := 0; i < n; i++ {
-		num := rand.Intn(n)
-		data = append(data, fmt.Sprintf("%d", num))
+		data = append(data, uint64(rand.Intn(n)))
 	}
+	executeAll(data, n/10)
+}
 
-	tiny := NewWinTinyLFU(n / 10)
-	lru := NewLRUReplacer(n / 10)
-	lfu := NewTinyLFU(n / 10)
-
-	execute(data, tiny, "W-TinyLFU")
-	execute(data, lfu, "TinyLFU")
-	execute(data, lru, "LRU")
+// executeAll replay the keys on a cache of each policy that holds capacity
+// entries, and print the hit rates
+func executeAll(data []uint64, capacity int) {
+	execute(data, capacity, PolicyWinTinyLFU, "W-TinyLFU")
+	execute(data, capacity, PolicyTinyLFU, "TinyLFU")
+	execute(data, capacity, PolicyLRU, "LRU")
 }
 
-func execute(data []string, replacer Replacer, str string) {
+func execute(data []uint64, capacity int, policy Policy, str string) {
+	c := NewCache(Options{Capacity: int64(capacity), NumShards: 1, Policy: policy})
 	miss, hit := 0, 0
 	for _, key := range data {
-		if replacer.Get(key) == nil {
-			replacer.Put(key, key)
+		if _, ok := c.Get(key); !ok {
+			c.Set(key, key, 1)
 			miss++
 		} else {
 			hit++
@@ -164,3 +135,144 @@ func execute(data []string, replacer Replacer, str string) {
 	hitRate := float64(hit) / float64(miss+hit)
 	fmt.Printf("%s: miss: %d, hit: %d,  hit rate: %f\n", str, miss, hit, hitRate)
 }
+
+func TestCache(t *testing.T) {
+	for _, policy := range []Policy{PolicyWinTinyLFU, PolicyTinyLFU, PolicyLRU} {
+		evicted := make(map[uint64]interface{})
+		c := NewCache(Options{
+			Capacity:  1000,
+			NumShards: 1,
+			Policy:    policy,
+			OnEvict: func(key uint64, value interface{}) {
+				evicted[key] = value
+			},
+		})
+		assert.True(t, c.Set(1, "a", 100))
+		assert.True(t, c.Set(2, "b", 200))
+		v, ok := c.Get(1)
+		assert.True(t, ok)
+		assert.Equal(t, "a", v)
+		_, ok = c.Get(3)
+		assert.False(t, ok)
+		assert.Equal(t, uint64(1), c.Hits())
+		assert.Equal(t, uint64(1), c.Misses())
+		assert.Equal(t, 2, c.Len())
+		assert.Equal(t, int64(300), c.UsedBytes())
+
+		// the replaced and deleted values are passed to OnEvict
+		assert.True(t, c.Set(1, "c", 50))
+		assert.Equal(t, "a", evicted[1])
+		assert.Equal(t, int64(250), c.UsedBytes())
+		c.Delete(2)
+		assert.Equal(t, "b", evicted[2])
+		_, ok = c.Get(2)
+		assert.False(t, ok)
+		assert.Equal(t, 1, c.Len())
+
+		// an entry larger than the cache is rejected
+		assert.False(t, c.Set(4, "d", 2000))
+		assert.Equal(t, "d", evicted[4])
+		_, ok = c.Get(4)
+		assert.False(t, ok)
+
+		// the total charge never exceeds the capacity
+		for i := uint64(100); i < 1100; i++ {
+			c.Set(i, i, int64(i%7+1)*10)
+			assert.LessOrEqual(t, c.UsedBytes(), int64(1000))
+		}
+		var used int64
+		for i := uint64(100); i < 1100; i++ {
+			if _, ok := c.Get(i); ok {
+				used += int64(i%7+1) * 10
+			} else {
+				assert.Equal(t, i, evicted[i])
+			}
+		}
+		_, ok = c.Get(1)
+		if ok {
+			used += 50
+		}
+		assert.Equal(t, used, c.UsedBytes())
+	}
+}
+
+func TestCacheScanResistance(t *testing.T) {
+	hitRate := func(policy Policy) float64 {
+		c := NewCache(Options{Capacity: 1000, NumShards: 4, Policy: policy})
+		var hits, total int
+		scan := uint64(1 << 20)
+		for round := 0; round < 50; round++ {
+			// the hot keys are read repeatedly
+			for i := uint64(0); i < 500; i++ {
+				if _, ok := c.Get(i); ok {
+					hits++
+				} else {
+					c.Set(i, i, 1)
+				}
+				total++
+			}
+			// a scan reads many keys once
+			for i := 0; i < 2000; i++ {
+				if _, ok := c.Get(scan); !ok {
+					c.Set(scan, scan, 1)
+				}
+				scan++
+			}
+		}
+		return float64(hits) / float64(total)
+	}
+	lru, tinyLFU, winTinyLFU := hitRate(PolicyLRU), hitRate(PolicyTinyLFU), hitRate(PolicyWinTinyLFU)
+	assert.Less(t, lru, 0.1)
+	assert.Greater(t, tinyLFU, 0.8)
+	assert.Greater(t, winTinyLFU, 0.8)
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	var evictions int64
+	c := NewCache(Options{
+		Capacity: 1 << 12,
+		OnEvict: func(key uint64, value interface{}) {
+			atomic.AddInt64(&evictions, 1)
+		},
+	})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 10000; i++ {
+				key := uint64(r.Intn(1000))
+				if v, ok := c.Get(key); ok {
+					assert.Equal(t, key, v)
+				} else {
+					c.Set(key, key, int64(r.Intn(16)+1))
+				}
+				if i%100 == 0 {
+					c.Delete(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, c.UsedBytes(), int64(1<<12))
+	assert.Equal(t, uint64(80000), c.Hits()+c.Misses())
+	assert.Greater(t, atomic.LoadInt64(&evictions), int64(0))
+}
+
+func TestCacheSmallCapacity(t *testing.T) {
+	// the shards are fewer than default, so that each of them can hold a
+	// block even if the cache is small
+	c := NewCache(Options{Capacity: 1 << 20})
+	assert.Equal(t, 2, len(c.shards))
+	for i := uint64(0); i < 100; i++ {
+		assert.True(t, c.Set(i, i, 4<<10))
+	}
+	assert.Greater(t, c.Len(), 0)
+
+	c = NewCache(Options{Capacity: 64 << 10})
+	assert.Equal(t, 1, len(c.shards))
+	assert.True(t, c.Set(1, 1, 4<<10))
+	_, ok := c.Get(1)
+	assert.True(t, ok)
+}
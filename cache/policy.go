@@ -0,0 +1,271 @@
+package cache
+
+import "container/list"
+
+// policy track the entries of a shard and pick the ones to evict. It's
+// called with the shard locked
+type policy interface {
+	// add track e, and return the entries evicted to make room for it. e is
+	// among them if it's rejected
+	add(e *entry) []*entry
+	// access record a hit of e
+	access(e *entry)
+	// miss record a miss of the hashed key
+	miss(h uint64)
+	// remove stop tracking e
+	remove(e *entry)
+	// used return the total charge of the entries tracked
+	used() int64
+}
+
+// the segments of winTinyLFUPolicy, recorded in entry.status
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+func newPolicy(p Policy, capacity int64) policy {
+	switch p {
+	case PolicyLRU:
+		return newLRUList(capacity)
+	case PolicyTinyLFU:
+		return &tinyLFUPolicy{lruList: newLRUList(capacity), freq: newFrequency(capacity)}
+	default:
+		return newWinTinyLFUPolicy(capacity)
+	}
+}
+
+// lruList is a list of entries from the most recently used to the least,
+// it's the LRU policy
+type lruList struct {
+	list     *list.List
+	capacity int64
+	size     int64
+}
+
+func newLRUList(capacity int64) *lruList {
+	return &lruList{list: list.New(), capacity: capacity}
+}
+
+func (l *lruList) push(e *entry) {
+	e.elem = l.list.PushFront(e)
+	l.size += e.charge
+}
+
+func (l *lruList) back() *entry {
+	if elem := l.list.Back(); elem != nil {
+		return elem.Value.(*entry)
+	}
+	return nil
+}
+
+func (l *lruList) add(e *entry) []*entry {
+	l.push(e)
+	var evicted []*entry
+	for l.size > l.capacity {
+		victim := l.back()
+		l.remove(victim)
+		evicted = append(evicted, victim)
+	}
+	return evicted
+}
+
+func (l *lruList) access(e *entry) {
+	l.list.MoveToFront(e.elem)
+}
+
+func (l *lruList) miss(uint64) {}
+
+func (l *lruList) remove(e *entry) {
+	l.list.Remove(e.elem)
+	l.size -= e.charge
+}
+
+func (l *lruList) used() int64 {
+	return l.size
+}
+
+// frequency estimate how often a key is used recently. The counters are
+// halved after a number of samples, so that the old hits fade out
+type frequency struct {
+	sketch    *cmSketch
+	samples   int64
+	threshold int64
+}
+
+// newFrequency return a frequency for a cache of capacity, which is
+// expected to hold capacity/1KB entries. The counters are 4096 at least, so
+// that a burst of new keys doesn't saturate them
+func newFrequency(capacity int64) *frequency {
+	counters := capacity >> 10
+	if counters < 4096 {
+		counters = 4096
+	}
+	return &frequency{sketch: newCmSketch(counters), threshold: 10 * counters}
+}
+
+func (f *frequency) increment(h uint64) {
+	f.sketch.Increment(h)
+	if f.samples++; f.samples >= f.threshold {
+		f.sketch.Reset()
+		f.samples = 0
+	}
+}
+
+func (f *frequency) estimate(h uint64) int64 {
+	return f.sketch.Estimate(h)
+}
+
+// admit return the entries to evict from victims, which are ordered by
+// eviction priority, to make room of need for e. nil is returned if any of
+// them is used more often than e, in which case e is rejected
+func (f *frequency) admit(e *entry, need int64, victims ...*lruList) []*entry {
+	var evicted []*entry
+	freq := f.estimate(e.hash)
+	for _, l := range victims {
+		for elem := l.list.Back(); elem != nil && need > 0; elem = elem.Prev() {
+			victim := elem.Value.(*entry)
+			if f.estimate(victim.hash) > freq {
+				return nil
+			}
+			evicted = append(evicted, victim)
+			need -= victim.charge
+		}
+	}
+	if need > 0 {
+		return nil
+	}
+	return evicted
+}
+
+// tinyLFUPolicy is a LRU list that admits a new entry only if it's used
+// more often than the entries it replaces
+type tinyLFUPolicy struct {
+	*lruList
+	freq *frequency
+}
+
+func (p *tinyLFUPolicy) add(e *entry) []*entry {
+	p.freq.increment(e.hash)
+	need := p.size + e.charge - p.capacity
+	var evicted []*entry
+	if need > 0 {
+		if evicted = p.freq.admit(e, need, p.lruList); evicted == nil {
+			return []*entry{e}
+		}
+	}
+	for _, victim := range evicted {
+		p.remove(victim)
+	}
+	p.push(e)
+	return evicted
+}
+
+func (p *tinyLFUPolicy) access(e *entry) {
+	p.freq.increment(e.hash)
+	p.lruList.access(e)
+}
+
+func (p *tinyLFUPolicy) miss(h uint64) {
+	p.freq.increment(h)
+}
+
+// winTinyLFUPolicy put new entries in a window LRU of 1% capacity. The
+// entries evicted from window are admitted to the main segmented LRU by
+// TinyLFU. In main, the new entries are on probation, and they are promoted
+// to protected, which takes 80% of main, when they are accessed again
+type winTinyLFUPolicy struct {
+	window    *lruList
+	probation *lruList
+	protected *lruList
+	capacity  int64
+	freq      *frequency
+}
+
+func newWinTinyLFUPolicy(capacity int64) *winTinyLFUPolicy {
+	windowCap := capacity / 100
+	mainCap := capacity - windowCap
+	return &winTinyLFUPolicy{
+		window:    newLRUList(windowCap),
+		probation: newLRUList(mainCap),
+		protected: newLRUList(mainCap * 8 / 10),
+		capacity:  mainCap,
+		freq:      newFrequency(capacity),
+	}
+}
+
+func (p *winTinyLFUPolicy) list(e *entry) *lruList {
+	switch e.status {
+	case segmentWindow:
+		return p.window
+	case segmentProbation:
+		return p.probation
+	default:
+		return p.protected
+	}
+}
+
+func (p *winTinyLFUPolicy) add(e *entry) []*entry {
+	p.freq.increment(e.hash)
+	e.status = segmentWindow
+	p.window.push(e)
+	var evicted []*entry
+	for p.window.size > p.window.capacity {
+		candidate := p.window.back()
+		p.window.remove(candidate)
+		evicted = append(evicted, p.admit(candidate)...)
+	}
+	return evicted
+}
+
+// admit move the candidate evicted from window to probation if it wins the
+// entries it replaces, and return the entries evicted
+func (p *winTinyLFUPolicy) admit(candidate *entry) []*entry {
+	need := p.probation.size + p.protected.size + candidate.charge - p.capacity
+	var evicted []*entry
+	if need > 0 {
+		if evicted = p.freq.admit(candidate, need, p.probation, p.protected); evicted == nil {
+			return []*entry{candidate}
+		}
+	}
+	for _, victim := range evicted {
+		p.list(victim).remove(victim)
+	}
+	candidate.status = segmentProbation
+	p.probation.push(candidate)
+	return evicted
+}
+
+func (p *winTinyLFUPolicy) access(e *entry) {
+	p.freq.increment(e.hash)
+	switch e.status {
+	case segmentWindow:
+		p.window.access(e)
+	case segmentProbation:
+		p.probation.remove(e)
+		e.status = segmentProtected
+		p.protected.push(e)
+		// demote the least recently used protected entries
+		for p.protected.size > p.protected.capacity {
+			victim := p.protected.back()
+			p.protected.remove(victim)
+			victim.status = segmentProbation
+			p.probation.push(victim)
+		}
+	case segmentProtected:
+		p.protected.access(e)
+	}
+}
+
+func (p *winTinyLFUPolicy) miss(h uint64) {
+	p.freq.increment(h)
+}
+
+func (p *winTinyLFUPolicy) remove(e *entry) {
+	p.list(e).remove(e)
+}
+
+func (p *winTinyLFUPolicy) used() int64 {
+	return p.window.size + p.probation.size + p.protected.size
+}
@@ -4,32 +4,254 @@ import (
 	"ckv/lsm"
 	"ckv/utils"
 	"ckv/utils/errs"
+	"os"
 	"sync"
 )
 
+// WriteBatch holds a collection of updates that are applied atomically
+type WriteBatch = lsm.WriteBatch
+
+// NewWriteBatch _
+func NewWriteBatch() *WriteBatch {
+	return lsm.NewWriteBatch()
+}
+
+// ColumnFamily is the handle of a column family, nil is the default one
+type ColumnFamily = lsm.ColumnFamily
+
+// Txn is an optimistic transaction, its writes are applied at commit if no
+// key it read or wrote is written by others in between
+type Txn = lsm.Txn
+
 type DB struct {
 	sync.RWMutex
 	opt *utils.Options
 	lsm *lsm.LSM
 }
 
+// Open open the database in opt.WorkDir, the directory will be created if
+// it doesn't exist
+func Open(opt *utils.Options) (*DB, error) {
+	if err := os.MkdirAll(opt.WorkDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	l, err := lsm.NewLSM(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{opt: opt, lsm: l}, nil
+}
+
+// Close stop all background goroutines, flush data in memory to disk and
+// release all files. The DB can't be used after closed
+func (db *DB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	if db.lsm == nil {
+		return nil
+	}
+	err := db.lsm.Close()
+	db.lsm = nil
+	return err
+}
+
+// CreateColumnFamily create a column family with its own key space and
+// options. opt nil means the options in Options.ColumnFamilies, or the
+// options of the db. The column family is reopened with the db
+func (db *DB) CreateColumnFamily(name string, opt *utils.Options) (*ColumnFamily, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return nil, errs.ErrDBClosed
+	}
+	return db.lsm.CreateColumnFamily(name, opt)
+}
+
+// DropColumnFamily drop the column family and all its keys
+func (db *DB) DropColumnFamily(cf *ColumnFamily) error {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return errs.ErrDBClosed
+	}
+	return db.lsm.DropColumnFamily(cf)
+}
+
+// ColumnFamily return the handle of the column family named name, nil is
+// returned if it doesn't exist
+func (db *DB) ColumnFamily(name string) *ColumnFamily {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return nil
+	}
+	return db.lsm.ColumnFamily(name)
+}
+
 func (db *DB) Set(data *utils.Entry) error {
+	return db.SetCF(nil, data)
+}
+
+// SetCF set the entry in column family cf
+func (db *DB) SetCF(cf *ColumnFamily, data *utils.Entry) error {
 	if data == nil || len(data.Key) == 0 {
 		return errs.ErrEmptyKey
 	}
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return errs.ErrDBClosed
+	}
 
 	//data.Key = codec.KeyWithTs(data.Key, uint64(time.Now().Unix()))
-
+	data.ColumnFamily = cf.ID()
 	return db.lsm.Set(data)
 }
+
+// Write apply all updates in the batch atomically
+func (db *DB) Write(batch *WriteBatch) error {
+	return db.WriteWithOptions(batch, nil)
+}
+
+// WriteWithOptions apply all updates in the batch atomically. If opt.Sync is
+// set, the wal is flushed to disk before returning
+func (db *DB) WriteWithOptions(batch *WriteBatch, opt *utils.WriteOptions) error {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return errs.ErrDBClosed
+	}
+	return db.lsm.WriteWithOptions(batch, opt)
+}
+
+// Delete delete the key. It's not an error if the key doesn't exist
+func (db *DB) Delete(key []byte) error {
+	return db.DeleteCF(nil, key)
+}
+
+// DeleteCF delete the key in column family cf
+func (db *DB) DeleteCF(cf *ColumnFamily, key []byte) error {
+	if len(key) == 0 {
+		return errs.ErrEmptyKey
+	}
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return errs.ErrDBClosed
+	}
+	return db.lsm.DeleteCF(cf, key)
+}
+
+// Merge merge operand into the value of key with Options.MergeOperator,
+// without reading the value
+func (db *DB) Merge(key, operand []byte) error {
+	return db.MergeCF(nil, key, operand)
+}
+
+// MergeCF merge operand into the value of key in column family cf
+func (db *DB) MergeCF(cf *ColumnFamily, key, operand []byte) error {
+	if len(key) == 0 {
+		return errs.ErrEmptyKey
+	}
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return errs.ErrDBClosed
+	}
+	return db.lsm.MergeCF(cf, key, operand)
+}
+
+// DeleteRange delete all keys in [start, end)
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.DeleteRangeCF(nil, start, end)
+}
+
+// DeleteRangeCF delete all keys in [start, end) in column family cf
+func (db *DB) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	if len(start) == 0 || len(end) == 0 {
+		return errs.ErrEmptyKey
+	}
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return errs.ErrDBClosed
+	}
+	return db.lsm.DeleteRangeCF(cf, start, end)
+}
+
+// NewIterator return an iterator over all keys in the db. The iterator must
+// be closed before the db is closed
+func (db *DB) NewIterator(opt *utils.ReadOptions) utils.Iterator {
+	return db.NewIteratorCF(nil, opt)
+}
+
+// NewIteratorCF return an iterator over all keys in column family cf
+func (db *DB) NewIteratorCF(cf *ColumnFamily, opt *utils.ReadOptions) utils.Iterator {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return lsm.NewErrorIterator(errs.ErrDBClosed)
+	}
+	return db.lsm.NewIteratorCF(cf, opt)
+}
+
+// GetSnapshot return a snapshot of the current state of the db. Reads with
+// the snapshot see the db as of the time it was taken. The snapshot must be
+// released by ReleaseSnapshot
+func (db *DB) GetSnapshot() *utils.Snapshot {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return nil
+	}
+	return db.lsm.GetSnapshot()
+}
+
+// BeginTxn begin a transaction that reads from a snapshot of the db. It must
+// be committed or discarded. nil is returned if the db is closed
+func (db *DB) BeginTxn() *Txn {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return nil
+	}
+	return db.lsm.BeginTxn()
+}
+
+// ReleaseSnapshot _
+func (db *DB) ReleaseSnapshot(s *utils.Snapshot) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return
+	}
+	db.lsm.ReleaseSnapshot(s)
+}
+
 func (db *DB) Get(key []byte) (*utils.Entry, error) {
+	return db.GetWithOptions(key, nil)
+}
+
+// GetWithOptions get the value of key. If opt.Snapshot is set, the value
+// as of the snapshot is returned
+func (db *DB) GetWithOptions(key []byte, opt *utils.ReadOptions) (*utils.Entry, error) {
+	return db.GetCF(nil, key, opt)
+}
+
+// GetCF get the value of key in column family cf like GetWithOptions
+func (db *DB) GetCF(cf *ColumnFamily, key []byte, opt *utils.ReadOptions) (*utils.Entry, error) {
 	if len(key) == 0 {
 		return nil, errs.ErrEmptyKey
 	}
+	db.RLock()
+	defer db.RUnlock()
+	if db.lsm == nil {
+		return nil, errs.ErrDBClosed
+	}
 
 	var entry *utils.Entry
 	var err error
-	if entry, err = db.lsm.Get(key); err != nil {
+	if entry, err = db.lsm.GetCF(cf, key, opt); err != nil {
 		return entry, err
 	}
 
@@ -0,0 +1,1320 @@
+package SimpleKV
+
+import (
+	"bytes"
+	"ckv/lsm"
+	"ckv/utils"
+	"ckv/utils/compress"
+	"ckv/utils/errs"
+	"ckv/version"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOptions(dir string) *utils.Options {
+	return &utils.Options{
+		WorkDir:            dir,
+		SSTableMaxSz:       1 << 14, // 16K
+		MemTableSize:       1 << 14, // 16K
+		BlockSize:          1 << 10, // 1K
+		BloomFalsePositive: 0,
+		MaxLevelNum:        7,
+	}
+}
+
+func TestDB_OpenClose(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		e := utils.NewEntry([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, db.Set(e))
+	}
+	assert.Nil(t, db.Close())
+	// close twice is ok
+	assert.Nil(t, db.Close())
+
+	_, err = db.Get([]byte("1"))
+	assert.Equal(t, errs.ErrDBClosed, err)
+	assert.Equal(t, errs.ErrDBClosed, db.Set(utils.NewEntry([]byte("1"), []byte("1"))))
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%d", i)), v.Value)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_CloseStopGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		db, err := Open(newTestOptions(t.TempDir()))
+		assert.Nil(t, err)
+		assert.Nil(t, db.Set(utils.NewEntry([]byte("key"), []byte("value"))))
+		assert.Nil(t, db.Close())
+	}
+	// goroutines may need a little time to be cleaned by runtime
+	time.Sleep(100 * time.Millisecond)
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestDB_Delete(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))))
+	}
+	// delete the even keys, the old values are flushed to sst files
+	for i := 0; i < n; i += 2 {
+		assert.Nil(t, db.Delete([]byte(fmt.Sprintf("%d", i))))
+	}
+	check := func() {
+		for i := 0; i < n; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("%d", i)))
+			if i%2 == 0 {
+				assert.Equal(t, errs.ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("%d", i)), v.Value)
+		}
+	}
+	check()
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check()
+
+	// set again after deleted
+	assert.Nil(t, db.Set(utils.NewEntry([]byte("0"), []byte("new"))))
+	v, err := db.Get([]byte("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), v.Value)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	n := 1000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), key(i))))
+	}
+	assert.Nil(t, db.DeleteRange(key(100), key(300)))
+	// keys written after the tombstone are visible
+	assert.Nil(t, db.Set(utils.NewEntry(key(200), []byte("new"))))
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			v, err := db.Get(key(i))
+			switch {
+			case i == 200:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("new"), v.Value)
+			case i >= 100 && i < 300:
+				assert.Equal(t, errs.ErrKeyNotFound, err, string(key(i)))
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, key(i), v.Value)
+			}
+		}
+	}
+	check()
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_WriteBatch(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), key(i))))
+	}
+
+	batch := NewWriteBatch()
+	batch.Put(key(100), []byte("100"))
+	batch.Put(key(0), []byte("new"))
+	batch.Delete(key(1))
+	batch.DeleteRange(key(5), key(8))
+	// the later record in the batch wins
+	batch.Put(key(6), []byte("6"))
+	assert.Equal(t, 5, batch.Count())
+	assert.Nil(t, db.Write(batch))
+
+	check := func() {
+		for i := 0; i < 10; i++ {
+			v, err := db.Get(key(i))
+			switch {
+			case i == 0:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("new"), v.Value)
+			case i == 6:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("6"), v.Value)
+			case i == 1 || (i >= 5 && i < 8):
+				assert.Equal(t, errs.ErrKeyNotFound, err, string(key(i)))
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, key(i), v.Value)
+			}
+		}
+		v, err := db.Get(key(100))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("100"), v.Value)
+	}
+	check()
+
+	// empty key is rejected, and nothing in the batch is applied
+	batch.Clear()
+	batch.Put(key(200), key(200))
+	batch.Put(nil, []byte("empty"))
+	assert.Equal(t, errs.ErrEmptyKey, db.Write(batch))
+	_, err = db.Get(key(200))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// recover from wal
+	assert.Nil(t, db.Close())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_WriteBatchConcurrent(t *testing.T) {
+	db, err := Open(newTestOptions(t.TempDir()))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// each batch updates a and b to the same value, readers should never see
+	// them differ
+	n := 500
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			batch := NewWriteBatch()
+			v := []byte(fmt.Sprintf("%d", i))
+			batch.Put([]byte("a"), v)
+			batch.Put([]byte("b"), v)
+			assert.Nil(t, db.Write(batch))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		a, errA := db.Get([]byte("a"))
+		b, errB := db.Get([]byte("b"))
+		if errA != nil || errB != nil {
+			continue
+		}
+		// b is read after a, so it's never older than a
+		va, _ := strconv.Atoi(string(a.Value))
+		vb, _ := strconv.Atoi(string(b.Value))
+		assert.LessOrEqual(t, va, vb)
+	}
+}
+
+func TestDB_Iterator(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	n := 1000
+	// keys that should be visible, in order
+	var want []int
+	for i := 0; i < n; i += 2 {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), key(i))))
+	}
+	// overwrite and delete, some of the old versions are in sst files
+	for i := 0; i < n; i += 2 {
+		switch {
+		case i%10 == 0:
+			assert.Nil(t, db.Delete(key(i)))
+		case i >= 500 && i < 600:
+		default:
+			assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("new%d", i)))))
+		}
+	}
+	assert.Nil(t, db.DeleteRange(key(500), key(600)))
+	for i := 0; i < n; i += 2 {
+		if i%10 != 0 && (i < 500 || i >= 600) {
+			want = append(want, i)
+		}
+	}
+
+	check := func(opt *utils.ReadOptions, want []int) {
+		iter := db.NewIterator(opt)
+		defer iter.Close()
+		var got []int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			e := iter.Item().Entry()
+			var i int
+			fmt.Sscanf(string(e.Key), "%d", &i)
+			assert.Equal(t, []byte(fmt.Sprintf("new%d", i)), e.Value)
+			got = append(got, i)
+		}
+		assert.Equal(t, want, got)
+
+		got = got[:0]
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			var i int
+			fmt.Sscanf(string(iter.Item().Entry().Key), "%d", &i)
+			got = append(got, i)
+		}
+		for i := range got {
+			assert.Equal(t, want[len(want)-1-i], got[i])
+		}
+	}
+	check(nil, want)
+
+	iter := db.NewIterator(nil)
+	iter.Seek(key(499))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, key(602), iter.Item().Entry().Key)
+	// change direction
+	iter.Prev()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, key(498), iter.Item().Entry().Key)
+	iter.Next()
+	assert.Equal(t, key(602), iter.Item().Entry().Key)
+	iter.SeekForPrev(key(599))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, key(498), iter.Item().Entry().Key)
+	iter.SeekForPrev(key(498))
+	assert.Equal(t, key(498), iter.Item().Entry().Key)
+	iter.Seek(key(n))
+	assert.False(t, iter.Valid())
+	assert.Nil(t, iter.Close())
+
+	// bounds
+	var bounded []int
+	for _, i := range want {
+		if i >= 100 && i < 702 {
+			bounded = append(bounded, i)
+		}
+	}
+	check(&utils.ReadOptions{LowerBound: key(100), UpperBound: key(702)}, bounded)
+
+	// writes after the iterator is created are invisible
+	iter = db.NewIterator(nil)
+	assert.Nil(t, db.Set(utils.NewEntry(key(1), []byte("new1"))))
+	iter.Rewind()
+	assert.Equal(t, key(2), iter.Item().Entry().Key)
+	assert.Nil(t, iter.Close())
+	assert.Nil(t, db.Close())
+
+	// the seq is restored after reopen, so that old entries are visible and
+	// new writes hide them
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	want = append([]int{1}, want...)
+	check(nil, want)
+	assert.Nil(t, db.Delete(key(2)))
+	check(nil, append([]int{1}, want[2:]...))
+	assert.Nil(t, db.Close())
+
+	iter = db.NewIterator(nil)
+	iter.Rewind()
+	assert.False(t, iter.Valid())
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	n := 500
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), key(i))))
+	}
+	snap := db.GetSnapshot()
+	assert.NotNil(t, snap)
+
+	// overwrite, delete and range delete after the snapshot is taken
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			assert.Nil(t, db.Delete(key(i)))
+		} else {
+			assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("new%d", i)))))
+		}
+	}
+	assert.Nil(t, db.DeleteRange(key(100), key(200)))
+
+	ropt := &utils.ReadOptions{Snapshot: snap}
+	for i := 0; i < n; i++ {
+		e, err := db.GetWithOptions(key(i), ropt)
+		assert.Nil(t, err)
+		assert.Equal(t, key(i), e.Value)
+
+		e, err = db.Get(key(i))
+		if i%3 == 0 || (i >= 100 && i < 200) {
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("new%d", i)), e.Value)
+		}
+	}
+
+	iter := db.NewIterator(ropt)
+	var i int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, key(i), iter.Item().Entry().Key)
+		assert.Equal(t, key(i), iter.Item().Entry().Value)
+		i++
+	}
+	assert.Equal(t, n, i)
+	assert.Nil(t, iter.Close())
+
+	db.ReleaseSnapshot(snap)
+	// releasing twice is harmless
+	db.ReleaseSnapshot(snap)
+}
+
+// tenantFilter remove the keys of deleted tenant and rewrite the values of
+// changed tenant
+type tenantFilter struct{}
+
+func (tenantFilter) Filter(level int, key []byte, value func() ([]byte, error), seq uint64) (utils.CompactionDecision, []byte) {
+	switch {
+	case bytes.HasPrefix(key, []byte("deleted-")):
+		return utils.CompactionRemove, nil
+	case bytes.HasPrefix(key, []byte("changed-")):
+		v, err := value()
+		if err != nil {
+			return utils.CompactionKeep, nil
+		}
+		return utils.CompactionChangeValue, bytes.ToUpper(v)
+	}
+	return utils.CompactionKeep, nil
+}
+
+func TestDB_CompactionFilter(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	opt.CompactionFilter = tenantFilter{}
+	opt.FilterOnFlush = true
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	n, m := 200, 20
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value-%032d", i)) }
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			for _, tenant := range []string{"deleted", "changed", "kept"} {
+				assert.Nil(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("%s-%04d", tenant, i)), value(i))))
+			}
+		}
+	}
+	// the versions visible to the snapshot are not filtered, they are still
+	// in memtable when the snapshot is taken
+	put(0, m)
+	snap := db.GetSnapshot()
+	put(m, n)
+	assert.Nil(t, db.Close())
+	assert.NotNil(t, snap)
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < n; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("deleted-%04d", i)))
+		if i < m {
+			assert.Nil(t, err)
+			assert.Equal(t, value(i), e.Value)
+		} else {
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+		}
+
+		e, err = db.Get([]byte(fmt.Sprintf("changed-%04d", i)))
+		assert.Nil(t, err)
+		if i < m {
+			assert.Equal(t, value(i), e.Value)
+		} else {
+			assert.Equal(t, bytes.ToUpper(value(i)), e.Value)
+		}
+
+		e, err = db.Get([]byte(fmt.Sprintf("kept-%04d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, value(i), e.Value)
+	}
+}
+
+// counterMerge add the operands, which are decimal numbers, to the counter
+type counterMerge struct {
+	name string
+}
+
+func (m counterMerge) Name() string {
+	return m.name
+}
+
+func (counterMerge) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int
+	if existing != nil {
+		n, err := strconv.Atoi(string(existing))
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+	for _, op := range operands {
+		n, err := strconv.Atoi(string(op))
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+func (m counterMerge) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	v, err := m.FullMerge(key, left, [][]byte{right})
+	return v, err == nil
+}
+
+func TestDB_Merge(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	// merge is not allowed without operator
+	assert.Equal(t, errs.ErrNoMergeOperator, db.Merge([]byte("a"), []byte("1")))
+	assert.Nil(t, db.Close())
+
+	opt.MergeOperator = counterMerge{name: "counter"}
+	db, err = Open(opt)
+	assert.Nil(t, err)
+
+	n, rounds := 200, 20
+	key := func(i int) []byte { return []byte(fmt.Sprintf("counter-%04d", i)) }
+	// the counters ending with 1 start from 1000, the counters ending with 2
+	// are reset by delete in the middle
+	var snap *utils.Snapshot
+	for r := 0; r < rounds; r++ {
+		if r == rounds/2 {
+			snap = db.GetSnapshot()
+			for i := 2; i < n; i += 10 {
+				assert.Nil(t, db.Delete(key(i)))
+			}
+		}
+		batch := NewWriteBatch()
+		for i := 0; i < n; i++ {
+			if r == 0 && i%10 == 1 {
+				batch.Put(key(i), []byte("1000"))
+			}
+			batch.Merge(key(i), []byte(strconv.Itoa(i)))
+		}
+		assert.Nil(t, db.Write(batch))
+	}
+	expected := func(i, rounds int) []byte {
+		sum := i * rounds
+		switch {
+		case i%10 == 1:
+			sum += 1000
+		case i%10 == 2 && rounds > 10:
+			sum = i * (rounds - 10)
+		}
+		return []byte(strconv.Itoa(sum))
+	}
+	check := func() {
+		for i := 0; i < n; i++ {
+			e, err := db.Get(key(i))
+			assert.Nil(t, err)
+			assert.Equal(t, expected(i, rounds), e.Value)
+		}
+		iter := db.NewIterator(nil)
+		var i int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, key(i), iter.Item().Entry().Key)
+			assert.Equal(t, expected(i, rounds), iter.Item().Entry().Value)
+			i++
+		}
+		assert.Equal(t, n, i)
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			i--
+			assert.Equal(t, key(i), iter.Item().Entry().Key)
+			assert.Equal(t, expected(i, rounds), iter.Item().Entry().Value)
+		}
+		assert.Equal(t, 0, i)
+		assert.Nil(t, iter.Close())
+	}
+	check()
+	for i := 0; i < n; i++ {
+		e, err := db.GetWithOptions(key(i), &utils.ReadOptions{Snapshot: snap})
+		assert.Nil(t, err)
+		assert.Equal(t, expected(i, rounds/2), e.Value)
+	}
+	db.ReleaseSnapshot(snap)
+
+	// the operands in memtable are flushed
+	assert.Nil(t, db.Close())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, db.Close())
+
+	// the name of operator is recorded
+	opt.MergeOperator = counterMerge{name: "other"}
+	_, err = Open(opt)
+	assert.Equal(t, errs.ErrMergeOperatorMismatch, err)
+}
+
+func TestDB_TTL(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	// long values are stored in vlog
+	value := func(i int) []byte { return []byte(fmt.Sprintf("%032d", i)) }
+	n := 1000
+	past := uint64(time.Now().Unix()) - 1
+	for i := 0; i < n; i++ {
+		e := utils.NewEntry(key(i), value(i))
+		if i%2 == 0 {
+			e.WithTTL(time.Hour)
+		} else {
+			e.ExpiresAt = past
+		}
+		assert.Nil(t, db.Set(e))
+	}
+	batch := NewWriteBatch()
+	batch.PutWithTTL(key(n), value(n), time.Hour)
+	batch.PutWithTTL(key(n+1), value(n+1), -time.Hour)
+	assert.Nil(t, db.Write(batch))
+
+	check := func() {
+		for i := 0; i < n+2; i++ {
+			e, err := db.Get(key(i))
+			if i%2 == 1 {
+				assert.Equal(t, errs.ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, value(i), e.Value)
+			assert.Greater(t, e.ExpiresAt, past)
+		}
+	}
+	checkIter := func() {
+		iter := db.NewIterator(nil)
+		var i int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, key(i), iter.Item().Entry().Key)
+			i += 2
+		}
+		assert.Equal(t, n+2, i)
+		assert.Nil(t, iter.Close())
+	}
+	check()
+	checkIter()
+
+	// the expiration time is persisted in sst files
+	assert.Nil(t, db.Close())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check()
+	checkIter()
+
+	// an expired version hides the older versions
+	assert.Nil(t, db.Set(&utils.Entry{Key: key(0), Value: value(0), ExpiresAt: past}))
+	_, err = db.Get(key(0))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	for _, mode := range []utils.WALSyncMode{utils.WALSyncNone, utils.WALSyncAlways, utils.WALSyncInterval} {
+		opt := newTestOptions(t.TempDir())
+		opt.WALSyncMode = mode
+		opt.WALSyncInterval = 10 * time.Millisecond
+		db, err := Open(opt)
+		assert.Nil(t, err)
+
+		// concurrent writers share wal appends, but each write still gets
+		// its own seqs
+		workers, n := 8, 200
+		seqs := make(chan uint64, workers*n)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					key := []byte(fmt.Sprintf("%d-%d", w, i))
+					if i%2 == 0 {
+						e := utils.NewEntry(key, key)
+						assert.Nil(t, db.Set(e))
+						seqs <- e.Seq
+						continue
+					}
+					batch := NewWriteBatch()
+					batch.Put(key, key)
+					assert.Nil(t, db.WriteWithOptions(batch, &utils.WriteOptions{Sync: i%3 == 0}))
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(seqs)
+		seen := make(map[uint64]bool)
+		for seq := range seqs {
+			assert.False(t, seen[seq])
+			seen[seq] = true
+		}
+
+		check := func() {
+			for w := 0; w < workers; w++ {
+				for i := 0; i < n; i++ {
+					key := []byte(fmt.Sprintf("%d-%d", w, i))
+					e, err := db.Get(key)
+					assert.Nil(t, err)
+					assert.Equal(t, key, e.Value)
+				}
+			}
+		}
+		check()
+		assert.Nil(t, db.Close())
+		db, err = Open(opt)
+		assert.Nil(t, err)
+		check()
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDB_LargeValue(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	// the values are much larger than the memtable size
+	value := func(i int) []byte {
+		v := make([]byte, (i+1)<<20)
+		for j := range v {
+			v[j] = byte(i + j)
+		}
+		return v
+	}
+	n := 3
+	batch := NewWriteBatch()
+	for i := 0; i < n; i++ {
+		batch.Put([]byte(fmt.Sprintf("%d", i)), value(i))
+	}
+	assert.Nil(t, db.Write(batch))
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			e, err := db.Get([]byte(fmt.Sprintf("%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, value(i), e.Value)
+		}
+	}
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_VLogGroupRecovery(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	value := func(i, round int) []byte { return []byte(fmt.Sprintf("%064d-%d", i, round)) }
+	n := 2000
+	put := func(round int) {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, db.Set(utils.NewEntry(key(i), value(i, round))))
+		}
+	}
+	check := func(round int) {
+		for i := 0; i < n; i++ {
+			e, err := db.Get(key(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value(i, round), e.Value)
+		}
+	}
+	put(0)
+	assert.Nil(t, db.Close())
+
+	// an orphaned vlog and a torn record at the end of vmanifest
+	orphan := filepath.Join(opt.WorkDir, fmt.Sprintf("%05d%s", 99999, utils.VLOG_FILE_EXT))
+	assert.Nil(t, os.WriteFile(orphan, []byte("orphan"), 0666))
+	current, err := os.ReadFile(filepath.Join(opt.WorkDir, version.CurrentFilename))
+	assert.Nil(t, err)
+	vmanifest := filepath.Join(opt.WorkDir, "V"+strings.TrimSpace(string(current)))
+	f, err := os.OpenFile(vmanifest, os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err))
+	check(0)
+	put(1)
+	assert.Nil(t, db.Close())
+
+	// the groups written after the torn record are restored
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	check(1)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ManifestRecovery(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	manifest := filepath.Join(opt.WorkDir, version.ManifestFilename)
+
+	// the manifest in the old format is replayed and rewritten
+	var legacy []byte
+	legacy = append(legacy, version.VersionEdit_BEGIN)
+	legacy = append(legacy, version.VersionEdit_BEGIN_MAGIC...)
+	legacy = append(legacy, version.VersionEdit_LAST_SEQUENCE)
+	legacy = append(legacy, 0, 0, 0, 0, 0, 0, 0, 100)
+	legacy = append(legacy, version.VersionEdit_END)
+	legacy = append(legacy, version.VersionEdit_END_MAGIC...)
+	assert.Nil(t, os.WriteFile(manifest, legacy, 0666))
+
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	e := utils.NewEntry([]byte("key"), []byte("value"))
+	assert.Nil(t, db.Set(e))
+	assert.Equal(t, uint64(101), e.Seq)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(manifest)
+	assert.True(t, os.IsNotExist(err))
+	current, err := os.ReadFile(filepath.Join(opt.WorkDir, version.CurrentFilename))
+	assert.Nil(t, err)
+	data, err := os.ReadFile(filepath.Join(opt.WorkDir, strings.TrimSpace(string(current))))
+	assert.Nil(t, err)
+	assert.False(t, bytes.HasPrefix(data, legacy[:1+len(version.VersionEdit_BEGIN_MAGIC)]))
+
+	// a torn record at the end is dropped
+	f, err := os.OpenFile(filepath.Join(opt.WorkDir, strings.TrimSpace(string(current))), os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	for i := 0; i < 2; i++ {
+		db, err = Open(opt)
+		assert.Nil(t, err)
+		got, err := db.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), got.Value)
+		assert.Nil(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%d", i)), []byte("value"))))
+		assert.Nil(t, db.Close())
+	}
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ManifestRotation(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	opt.MaxManifestSize = 256
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	n := 3000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("%064d", i)))))
+	}
+	assert.Nil(t, db.Close())
+
+	// only the current manifest files are left
+	current, err := os.ReadFile(filepath.Join(opt.WorkDir, version.CurrentFilename))
+	assert.Nil(t, err)
+	name := strings.TrimSpace(string(current))
+	assert.NotEqual(t, version.ManifestFilename+"-000001", name)
+	var manifests []string
+	files, err := os.ReadDir(opt.WorkDir)
+	assert.Nil(t, err)
+	for _, f := range files {
+		if strings.Contains(f.Name(), version.ManifestFilename) || strings.HasPrefix(f.Name(), version.CurrentFilename) {
+			manifests = append(manifests, f.Name())
+		}
+	}
+	assert.ElementsMatch(t, []string{version.CurrentFilename, name, "V" + name}, manifests)
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		e, err := db.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%064d", i)), e.Value)
+	}
+	assert.Nil(t, db.Close())
+}
+
+// reverseComparator order keys in descending order
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func TestDB_ColumnFamilies(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	opt.MaxManifestSize = 256
+	db, err := Open(opt)
+	assert.Nil(t, err)
+
+	cf, err := db.CreateColumnFamily("reverse", &utils.Options{Comparable: reverseComparator{}})
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("reverse", nil)
+	assert.Equal(t, errs.ErrColumnFamilyExists, err)
+	_, err = db.CreateColumnFamily(version.DefaultColumnFamilyName, nil)
+	assert.Equal(t, errs.ErrColumnFamilyExists, err)
+
+	// the same key in different column families
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	n := 2000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte("default"))))
+		assert.Nil(t, db.SetCF(cf, utils.NewEntry(key(i), []byte(fmt.Sprintf("%032d", i)))))
+	}
+	batch := NewWriteBatch()
+	batch.Put([]byte("batch"), []byte("default"))
+	batch.PutCF(cf, []byte("batch"), []byte("reverse"))
+	batch.DeleteCF(cf, key(0))
+	assert.Nil(t, db.Write(batch))
+
+	check := func(cf *ColumnFamily) {
+		e, err := db.GetCF(cf, []byte("batch"), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("reverse"), e.Value)
+		_, err = db.GetCF(cf, key(0), nil)
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		e, err = db.Get(key(0))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("default"), e.Value)
+
+		// keys are ordered by the comparator of the column family
+		iter := db.NewIteratorCF(cf, nil)
+		var keys [][]byte
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			keys = append(keys, iter.Item().Entry().Key)
+		}
+		assert.Nil(t, iter.Close())
+		assert.Equal(t, n, len(keys))
+		assert.Equal(t, []byte("batch"), keys[0])
+		assert.Equal(t, key(n-1), keys[1])
+		assert.Equal(t, key(1), keys[len(keys)-1])
+	}
+	check(cf)
+	assert.Nil(t, db.Close())
+
+	// the column family is reopened with the options in ColumnFamilies
+	opt.ColumnFamilies = map[string]*utils.Options{"reverse": {Comparable: reverseComparator{}}}
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	cf = db.ColumnFamily("reverse")
+	assert.NotNil(t, cf)
+	check(cf)
+
+	assert.Equal(t, errs.ErrDropDefaultColumnFamily, db.DropColumnFamily(nil))
+	assert.Nil(t, db.DropColumnFamily(cf))
+	_, err = db.GetCF(cf, []byte("batch"), nil)
+	assert.Equal(t, errs.ErrColumnFamilyNotFound, err)
+	assert.Equal(t, errs.ErrColumnFamilyNotFound, db.SetCF(cf, utils.NewEntry([]byte("key"), []byte("value"))))
+	assert.Nil(t, db.ColumnFamily("reverse"))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	assert.Nil(t, db.ColumnFamily("reverse"))
+	// a new column family of the same name is empty
+	cf, err = db.CreateColumnFamily("reverse", nil)
+	assert.Nil(t, err)
+	_, err = db.GetCF(cf, []byte("batch"), nil)
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	e, err := db.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), e.Value)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Txn(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, k := range []string{"a", "c", "e"} {
+		assert.Nil(t, db.Set(utils.NewEntry([]byte(k), []byte("db"))))
+	}
+
+	// the writes are seen by the transaction only
+	txn := db.BeginTxn()
+	assert.Nil(t, txn.Set(utils.NewEntry([]byte("b"), []byte("txn"))))
+	assert.Nil(t, txn.Set(utils.NewEntry([]byte("c"), []byte("txn"))))
+	assert.Nil(t, txn.Delete([]byte("e")))
+	e, err := txn.Get([]byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn"), e.Value)
+	_, err = txn.Get([]byte("e"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	iter := txn.NewIterator(nil)
+	var got []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Item().Entry().Key)+"="+string(iter.Item().Entry().Value))
+	}
+	assert.Equal(t, []string{"a=db", "b=txn", "c=txn"}, got)
+	got = got[:0]
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		got = append(got, string(iter.Item().Entry().Key))
+	}
+	assert.Equal(t, []string{"c", "b", "a"}, got)
+	iter.Seek([]byte("b"))
+	iter.Prev()
+	assert.Equal(t, []byte("a"), iter.Item().Entry().Key)
+	iter.Next()
+	assert.Equal(t, []byte("b"), iter.Item().Entry().Key)
+	assert.Nil(t, iter.Close())
+
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, errs.ErrTxnDone, txn.Commit())
+	assert.Equal(t, errs.ErrTxnDone, txn.Set(utils.NewEntry([]byte("b"), []byte("txn"))))
+	e, err = db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn"), e.Value)
+	_, err = db.Get([]byte("e"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// the key read is written by others
+	txn = db.BeginTxn()
+	_, err = txn.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Set(utils.NewEntry([]byte("x"), []byte("txn"))))
+	assert.Nil(t, db.Set(utils.NewEntry([]byte("a"), []byte("other"))))
+	assert.Equal(t, errs.ErrConflict, txn.Commit())
+	_, err = db.Get([]byte("x"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// the key written is deleted by others
+	txn = db.BeginTxn()
+	assert.Nil(t, txn.Set(utils.NewEntry([]byte("c"), []byte("txn2"))))
+	assert.Nil(t, db.Delete([]byte("c")))
+	assert.Equal(t, errs.ErrConflict, txn.Commit())
+
+	// transactions on different keys don't conflict
+	txn1, txn2 := db.BeginTxn(), db.BeginTxn()
+	_, err = txn1.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn1.Set(utils.NewEntry([]byte("a"), []byte("txn1"))))
+	assert.Nil(t, txn2.Set(utils.NewEntry([]byte("b"), []byte("txn2"))))
+	assert.Nil(t, txn2.Commit())
+	assert.Nil(t, txn1.Commit())
+
+	// concurrent check-and-set on a counter, the conflicted ones retry
+	assert.Nil(t, db.Set(utils.NewEntry([]byte("counter"), []byte("0"))))
+	var wg sync.WaitGroup
+	workers, rounds := 8, 50
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; {
+				txn := db.BeginTxn()
+				e, err := txn.Get([]byte("counter"))
+				assert.Nil(t, err)
+				n, _ := strconv.Atoi(string(e.Value))
+				assert.Nil(t, txn.Set(utils.NewEntry([]byte("counter"), []byte(strconv.Itoa(n+1)))))
+				if err := txn.Commit(); err == nil {
+					j++
+				} else {
+					assert.Equal(t, errs.ErrConflict, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	e, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, strconv.Itoa(workers*rounds), string(e.Value))
+}
+
+func TestDB_Compression(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	value := func(i, round int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"round":%d,"name":"user%d","tags":["a","b","c"]}`, i, round, i%10))
+	}
+	n := 2000
+	// the tables built without compression remain readable after the codecs
+	// change, and they are compressed when compacted
+	for round, compression := range [][]compress.Type{nil, {compress.LZ4, compress.Flate}, {compress.Flate}} {
+		opt.Compression = compression
+		db, err := Open(opt)
+		assert.Nil(t, err)
+		for i := 0; i < n; i++ {
+			if round > 0 {
+				e, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+				assert.Nil(t, err)
+				want := round - 1
+				if i%2 == 1 {
+					want = 0
+				}
+				assert.Equal(t, value(i, want), e.Value)
+			}
+			if round == 0 || i%2 == 0 {
+				assert.Nil(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%05d", i)), value(i, round))))
+			}
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	// the codecs that are not registered are refused before any table is
+	// built with them
+	opt.Compression = []compress.Type{compress.LZ4, compress.Type(100)}
+	_, err := Open(opt)
+	assert.Equal(t, errs.ErrUnknownCompression, err)
+	opt.Compression = nil
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("cf", &utils.Options{Compression: []compress.Type{compress.Type(100)}})
+	assert.Equal(t, errs.ErrUnknownCompression, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_TableCache(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	opt.TableCacheSize = 4
+	// openedTables return the number of sst files opened by the db
+	openedTables := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("the opened files are unknown")
+		}
+		n := 0
+		for _, fd := range fds {
+			name, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+			if err == nil && strings.HasPrefix(name, opt.WorkDir) && strings.Contains(name, ".sst") {
+				n++
+			}
+		}
+		return n
+	}
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%05d", i))
+	}
+	n := 3000
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("value%d", i)))))
+	}
+	assert.Nil(t, db.Close())
+	tables, err := filepath.Glob(filepath.Join(opt.WorkDir, "*.sst"))
+	assert.Nil(t, err)
+	assert.Greater(t, len(tables), 2*int(opt.TableCacheSize))
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		e, err := db.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), e.Value)
+	}
+	assert.LessOrEqual(t, openedTables(), int(opt.TableCacheSize))
+
+	// the tables evicted are readable by the iterator, and they are closed
+	// after it's closed
+	iter := db.NewIterator(nil)
+	i := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, key(i), iter.Item().Entry().Key)
+		if i%100 == 0 {
+			_, err := db.Get(key(n - 1 - i))
+			assert.Nil(t, err)
+		}
+		i++
+	}
+	assert.Equal(t, n, i)
+	assert.Nil(t, iter.Close())
+	assert.LessOrEqual(t, openedTables(), int(opt.TableCacheSize))
+
+	// the tables closed are compacted, and no file is left opened
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("new%d", i)))))
+	}
+	assert.Nil(t, db.Close())
+	assert.Equal(t, 0, openedTables())
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i += 7 {
+		e, err := db.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("new%d", i)), e.Value)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_FlushError(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	// the memtable of the current wal can't be flushed, since its vlog path
+	// is taken by a directory
+	wals, err := filepath.Glob(filepath.Join(opt.WorkDir, "*.wal"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(wals))
+	assert.Nil(t, os.Mkdir(strings.TrimSuffix(wals[0], ".wal")+utils.VLOG_FILE_EXT, os.ModePerm))
+
+	// the writes fail once the immutable blocks the memtable, instead of
+	// waiting for the flush forever
+	var werr error
+	for i := 0; i < 10000 && werr == nil; i++ {
+		werr = db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%05d", i)), []byte("value")))
+	}
+	assert.NotNil(t, werr)
+	assert.Equal(t, werr, db.Set(utils.NewEntry([]byte("key"), []byte("value"))))
+	_, err = db.Get([]byte("key00000"))
+	assert.Nil(t, err)
+	assert.NotNil(t, db.Close())
+
+	// the data is recovered from the wal kept
+	assert.Nil(t, os.Remove(strings.TrimSuffix(wals[0], ".wal")+utils.VLOG_FILE_EXT))
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	e, err := db.Get([]byte("key00000"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), e.Value)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_MissingTable(t *testing.T) {
+	opt := newTestOptions(t.TempDir())
+	opt.TableCacheSize = 4
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%05d", i))
+	}
+	n := 3000
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("value%d", i)))))
+	}
+	assert.Nil(t, db.Close())
+
+	// the tables that are not opened can't be read after their files are
+	// removed, the error is returned instead of panicking
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	tables, err := filepath.Glob(filepath.Join(opt.WorkDir, "*.sst"))
+	assert.Nil(t, err)
+	assert.Greater(t, len(tables), int(opt.TableCacheSize))
+	for _, name := range tables {
+		assert.Nil(t, os.Remove(name))
+	}
+	var failed int
+	for i := 0; i < n; i++ {
+		if _, err := db.Get(key(i)); err != nil && err != errs.ErrKeyNotFound {
+			failed++
+		}
+	}
+	assert.Greater(t, failed, 0)
+	iter := db.NewIterator(nil)
+	iter.Rewind()
+	assert.False(t, iter.Valid())
+	assert.NotNil(t, iter.(*lsm.DBIterator).Err())
+	assert.Nil(t, iter.Close())
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_LegacyWAL(t *testing.T) {
+	// the wal written before the block format, each record is
+	// checksum | key len | value len | type | key | seq | value, and the
+	// rest of the file is preallocated with zeros
+	opt := newTestOptions(t.TempDir())
+	data := make([]byte, opt.MemTableSize)
+	var off int
+	n := 100
+	for i := 0; i < n; i++ {
+		key, value := []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))
+		record := make([]byte, 9+len(key)+8+len(value))
+		binary.BigEndian.PutUint16(record[4:6], uint16(len(key)))
+		binary.BigEndian.PutUint16(record[6:8], uint16(len(value)))
+		record[8] = 1
+		copy(record[9:], key)
+		binary.BigEndian.PutUint64(record[9+len(key):], uint64(i+1))
+		copy(record[9+len(key)+8:], value)
+		binary.BigEndian.PutUint32(record[:4], crc32.Checksum(record[4:], crc32.MakeTable(crc32.Castagnoli)))
+		off += copy(data[off:], record)
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(opt.WorkDir, "00001.wal"), data, 0666))
+
+	db, err := Open(opt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), e.Value)
+	}
+	// the new writes follow the seqs replayed
+	e := utils.NewEntry([]byte("key050"), []byte("new"))
+	assert.Nil(t, db.Set(e))
+	assert.Equal(t, uint64(n+1), e.Seq)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opt)
+	assert.Nil(t, err)
+	got, err := db.Get([]byte("key050"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), got.Value)
+	assert.Nil(t, db.Close())
+
+	// the wal in an unknown format is kept, instead of being replayed as empty
+	opt = newTestOptions(t.TempDir())
+	wal := filepath.Join(opt.WorkDir, "00001.wal")
+	assert.Nil(t, os.WriteFile(wal, []byte("not a wal"), 0666))
+	_, err = Open(opt)
+	assert.Equal(t, errs.ErrUnknownWALFormat, err)
+	_, err = os.Stat(wal)
+	assert.Nil(t, err)
+}
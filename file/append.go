@@ -0,0 +1,91 @@
+package file
+
+import (
+	"os"
+)
+
+// defaultAppendFileSize is the initial size of an append file if no size
+// is specified
+const defaultAppendFileSize = 64 << 10
+
+// AppendFile is an append-only file backed by mmap. The mapping grows when
+// it's full, and the file is truncated to the written size on close, so that
+// there is no preallocated space left behind.
+//
+// A file left by a crash keeps the preallocated zeros, and its real length is
+// only known to the format of the records. Such files are only reopened to be
+// read, wal and vlog always append to new files after recovery
+type AppendFile struct {
+	*MmapFile
+	size    int // the written size
+	written bool
+}
+
+// OpenAppendFile open the file for appending. opt.MaxSz is the initial size
+// of a new file. An existing file is opened with its own size, and appends
+// start from the end of it, which is the written size only if the file was
+// closed. The file is opened with opt.Flag, a file opened by os.O_RDONLY is
+// only read and never created
+func OpenAppendFile(opt *Options) (*AppendFile, error) {
+	sz := opt.MaxSz
+	if sz <= 0 {
+		sz = defaultAppendFileSize
+	}
+	fileInfo, err := os.Stat(opt.FileName)
+	exist := err == nil && fileInfo.Size() > 0
+	mf, err := OpenMmapFile(opt.FileName, opt.Flag, sz)
+	if err != nil {
+		return nil, err
+	}
+	f := &AppendFile{MmapFile: mf}
+	if exist {
+		f.size = len(mf.Data)
+	}
+	return f, nil
+}
+
+// Append write buf at the end of the file, and return the offset of it
+func (f *AppendFile) Append(buf []byte) (int, error) {
+	offset := f.size
+	if err := f.grow(len(buf)); err != nil {
+		return 0, err
+	}
+	copy(f.Data[offset:], buf)
+	f.size += len(buf)
+	f.written = true
+	return offset, nil
+}
+
+// grow make sure there is space for need bytes. The mapping is doubled until
+// it's big enough, the data is synced by Sync and Close rather than here
+func (f *AppendFile) grow(need int) error {
+	if f.size+need <= len(f.Data) {
+		return nil
+	}
+	sz := len(f.Data)
+	if sz == 0 {
+		sz = defaultAppendFileSize
+	}
+	for sz < f.size+need {
+		sz *= 2
+	}
+	return f.Resize(int64(sz))
+}
+
+// Size return the written size
+func (f *AppendFile) Size() int {
+	return f.size
+}
+
+// Close truncate the file to the written size and close it
+func (f *AppendFile) Close() error {
+	if f.Fd == nil {
+		return nil
+	}
+	if f.written && f.size < len(f.Data) {
+		if err := f.Truncature(int64(f.size)); err != nil {
+			return err
+		}
+	}
+	return f.MmapFile.Close()
+}
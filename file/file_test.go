@@ -2,6 +2,10 @@ package file
 
 import (
 	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -34,6 +38,46 @@ var (
 //
 //}
 
+func TestAppendFile(t *testing.T) {
+	clearDir()
+	defer os.RemoveAll(opt.Dir)
+
+	f, err := OpenAppendFile(&Options{FileName: opt.Dir + "00001.vlog", Flag: os.O_CREATE | os.O_RDWR, MaxSz: 100})
+	assert.Nil(t, err)
+	// grow beyond the initial size
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for i := 0; i < 10; i++ {
+		off, err := f.Append(data)
+		assert.Nil(t, err)
+		assert.Equal(t, i*len(data), off)
+	}
+	assert.Equal(t, 10*len(data), f.Size())
+	assert.Equal(t, data, f.Data[9000:10000])
+	assert.Nil(t, f.Close())
+
+	// truncated to the written size
+	info, err := os.Stat(opt.Dir + "00001.vlog")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10*len(data)), info.Size())
+
+	// appends start from the end of the existing file
+	f, err = OpenAppendFile(&Options{FileName: opt.Dir + "00001.vlog", Flag: os.O_CREATE | os.O_RDWR})
+	assert.Nil(t, err)
+	off, err := f.Append(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 10*len(data), off)
+	assert.Nil(t, f.Close())
+
+	// a missing file isn't created by read only open
+	_, err = OpenAppendFile(&Options{FileName: opt.Dir + "00002.vlog", Flag: os.O_RDONLY})
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
+	_, err = os.Stat(opt.Dir + "00002.vlog")
+	assert.True(t, os.IsNotExist(err))
+}
+
 func clearDir() {
 	_, err := os.Stat(opt.Dir)
 	if err == nil {
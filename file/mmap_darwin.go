@@ -278,6 +278,20 @@ func (m *MmapFile) Truncature(maxSz int64) error {
 	return err
 }
 
+// Resize change the size of the file and remap it. Unlike Truncature, the
+// data is not synced, the mapping is shared so nothing written is lost
+func (m *MmapFile) Resize(maxSz int64) error {
+	if err := Munmap(m.Data); err != nil {
+		return fmt.Errorf("while munmap file: %s, error: %v\n", m.Fd.Name(), err)
+	}
+	if err := m.Fd.Truncate(maxSz); err != nil {
+		return fmt.Errorf("while truncate file: %s, error: %v\n", m.Fd.Name(), err)
+	}
+	var err error
+	m.Data, err = Mmap(m.Fd, true, maxSz)
+	return err
+}
+
 // ReName 兼容接口
 func (m *MmapFile) ReName(name string) error {
 	return nil
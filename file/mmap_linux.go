@@ -58,6 +58,17 @@ func (m *MmapFile) Truncature(maxSz int64) error {
 	return err
 }
 
+// Resize change the size of the file and remap it. Unlike Truncature, the
+// data is not synced, the mapping is shared so nothing written is lost
+func (m *MmapFile) Resize(maxSz int64) error {
+	if err := m.Fd.Truncate(maxSz); err != nil {
+		return fmt.Errorf("while truncate file: %s, error: %v\n", m.Fd.Name(), err)
+	}
+	var err error
+	m.Data, err = Mremap(m.Data, int(maxSz))
+	return err
+}
+
 func (m *MmapFile) Delete() error {
 	if m.Fd == nil {
 		return nil
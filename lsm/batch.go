@@ -0,0 +1,233 @@
+package lsm
+
+import (
+	"ckv/utils"
+	"ckv/utils/convert"
+	"ckv/utils/errs"
+	"encoding/binary"
+	"time"
+)
+
+// batchHeaderSize seq(8) + count(4)
+const batchHeaderSize = 12
+
+// batchColumnFamilyFlag is set in the type of the records that don't belong
+// to the default column family, the type is followed by the varint id
+const batchColumnFamilyFlag = 0x80
+
+// WriteBatch holds a collection of updates that are applied atomically.
+// The updates are applied in the order they are added, and get consecutive
+// sequence numbers starting from the seq of the batch
+//
+//	+-------------------------------------------+
+//	| seq | count | record | record | ... |
+//	+-------------------------------------------+
+//	record := type | [varint column family] | varint key len | key | [varint expires at] | [varint value len | value]
+//
+// the column family is present if batchColumnFamilyFlag is set in type. The
+// expiration time is only present in value records. The value is absent for
+// deletion records, it is the end key for range deletion records, and the
+// operand for merge records
+type WriteBatch struct {
+	rep []byte
+}
+
+// NewWriteBatch _
+func NewWriteBatch() *WriteBatch {
+	b := &WriteBatch{}
+	b.Clear()
+	return b
+}
+
+// Put add a record that set key to value
+func (b *WriteBatch) Put(key, value []byte) {
+	b.PutCF(nil, key, value)
+}
+
+// PutWithTTL add a record that set key to value, the key expires after ttl
+func (b *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.add(0, utils.TypeValue, key, value, uint64(time.Now().Add(ttl).Unix()))
+}
+
+// Delete add a record that delete key
+func (b *WriteBatch) Delete(key []byte) {
+	b.DeleteCF(nil, key)
+}
+
+// DeleteRange add a record that delete all keys in [start, end)
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.DeleteRangeCF(nil, start, end)
+}
+
+// Merge add a record that merge operand into the value of key
+func (b *WriteBatch) Merge(key, operand []byte) {
+	b.MergeCF(nil, key, operand)
+}
+
+// PutCF add a record that set key to value in column family cf, nil means
+// the default one
+func (b *WriteBatch) PutCF(cf *ColumnFamily, key, value []byte) {
+	b.add(cf.ID(), utils.TypeValue, key, value, 0)
+}
+
+// DeleteCF add a record that delete key in column family cf
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) {
+	b.add(cf.ID(), utils.TypeDeletion, key, nil, 0)
+}
+
+// DeleteRangeCF add a record that delete all keys in [start, end) in column
+// family cf
+func (b *WriteBatch) DeleteRangeCF(cf *ColumnFamily, start, end []byte) {
+	b.add(cf.ID(), utils.TypeRangeDeletion, start, end, 0)
+}
+
+// MergeCF add a record that merge operand into the value of key in column
+// family cf
+func (b *WriteBatch) MergeCF(cf *ColumnFamily, key, operand []byte) {
+	b.add(cf.ID(), utils.TypeMerge, key, operand, 0)
+}
+
+// Count return the number of records in the batch
+func (b *WriteBatch) Count() int {
+	return int(convert.BytesToU32(b.rep[8:batchHeaderSize]))
+}
+
+// Clear remove all records in the batch
+func (b *WriteBatch) Clear() {
+	b.rep = make([]byte, batchHeaderSize)
+}
+
+// Repr return the serialized content of the batch
+func (b *WriteBatch) Repr() []byte {
+	return b.rep
+}
+
+func (b *WriteBatch) seq() uint64 {
+	return convert.BytesToU64(b.rep[:8])
+}
+
+func (b *WriteBatch) setSeq(seq uint64) {
+	copy(b.rep[:8], convert.U64ToBytes(seq))
+}
+
+// put add the entry to the batch, the type of the record depends on the meta
+// of the entry
+func (b *WriteBatch) put(entry *utils.Entry) {
+	b.add(entry.ColumnFamily, entry.ValueType(), entry.Key, entry.Value, entry.ExpiresAt)
+}
+
+func (b *WriteBatch) add(cf uint32, typ byte, key, value []byte, expiresAt uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	if cf != 0 {
+		b.rep = append(b.rep, typ|batchColumnFamilyFlag)
+		n := binary.PutUvarint(buf[:], uint64(cf))
+		b.rep = append(b.rep, buf[:n]...)
+	} else {
+		b.rep = append(b.rep, typ)
+	}
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	b.rep = append(b.rep, buf[:n]...)
+	b.rep = append(b.rep, key...)
+	if typ == utils.TypeValue {
+		n = binary.PutUvarint(buf[:], expiresAt)
+		b.rep = append(b.rep, buf[:n]...)
+	}
+	if typ != utils.TypeDeletion {
+		n = binary.PutUvarint(buf[:], uint64(len(value)))
+		b.rep = append(b.rep, buf[:n]...)
+		b.rep = append(b.rep, value...)
+	}
+	copy(b.rep[8:batchHeaderSize], convert.U32ToBytes(uint32(b.Count()+1)))
+}
+
+// append append the records of other to the batch
+func (b *WriteBatch) append(other *WriteBatch) {
+	b.rep = append(b.rep, other.rep[batchHeaderSize:]...)
+	copy(b.rep[8:batchHeaderSize], convert.U32ToBytes(uint32(b.Count()+other.Count())))
+}
+
+// lastSeq return the seq of the last record in the batch
+func (b *WriteBatch) lastSeq() uint64 {
+	return b.seq() + uint64(b.Count()) - 1
+}
+
+// Iterate call fn for each record in the batch. The whole batch is decoded
+// before fn is called, so that a corrupted batch is applied all or nothing
+func (b *WriteBatch) Iterate(fn func(e *utils.Entry) error) error {
+	entries, err := b.entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *WriteBatch) entries() ([]*utils.Entry, error) {
+	if len(b.rep) < batchHeaderSize {
+		return nil, errs.ErrBatchCorrupted
+	}
+	seq, count := b.seq(), b.Count()
+	entries := make([]*utils.Entry, 0, count)
+	data := b.rep[batchHeaderSize:]
+	for len(data) > 0 {
+		typ := data[0]
+		data = data[1:]
+		var cf uint64
+		if typ&batchColumnFamilyFlag != 0 {
+			typ &^= batchColumnFamilyFlag
+			var n int
+			if cf, n = binary.Uvarint(data); n <= 0 {
+				return nil, errs.ErrBatchCorrupted
+			}
+			data = data[n:]
+		}
+		if typ > utils.TypeMerge {
+			return nil, errs.ErrBatchCorrupted
+		}
+		key, n := readLengthPrefixed(data)
+		if n <= 0 {
+			return nil, errs.ErrBatchCorrupted
+		}
+		data = data[n:]
+		var expiresAt uint64
+		if typ == utils.TypeValue {
+			if expiresAt, n = binary.Uvarint(data); n <= 0 {
+				return nil, errs.ErrBatchCorrupted
+			}
+			data = data[n:]
+		}
+		var value []byte
+		if typ != utils.TypeDeletion {
+			if value, n = readLengthPrefixed(data); n <= 0 {
+				return nil, errs.ErrBatchCorrupted
+			}
+			data = data[n:]
+		}
+		entries = append(entries, &utils.Entry{
+			Key:          key,
+			Value:        value,
+			Seq:          seq + uint64(len(entries)),
+			Meta:         utils.MetaOfType(typ),
+			ExpiresAt:    expiresAt,
+			ColumnFamily: uint32(cf),
+		})
+	}
+	if len(entries) != count {
+		return nil, errs.ErrBatchCorrupted
+	}
+	return entries, nil
+}
+
+// readLengthPrefixed read a varint length prefixed slice from buf, and return
+// the slice and the number of bytes read. n <= 0 means buf is too short
+func readLengthPrefixed(buf []byte) ([]byte, int) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return nil, 0
+	}
+	return buf[n : n+int(l)], n + int(l)
+}
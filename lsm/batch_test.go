@@ -0,0 +1,75 @@
+package lsm
+
+import (
+	"ckv/utils"
+	"ckv/utils/errs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	b := NewWriteBatch()
+	assert.Equal(t, 0, b.Count())
+
+	b.Put([]byte("a"), []byte("1"))
+	b.Delete([]byte("b"))
+	b.DeleteRange([]byte("c"), []byte("d"))
+	b.Put([]byte("e"), nil)
+	b.setSeq(10)
+	assert.Equal(t, 4, b.Count())
+
+	// decode from the serialized content
+	var entries []*utils.Entry
+	err := (&WriteBatch{rep: b.Repr()}).Iterate(func(e *utils.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, []byte("a"), entries[0].Key)
+	assert.Equal(t, []byte("1"), entries[0].Value)
+	assert.Equal(t, uint64(10), entries[0].Seq)
+	assert.True(t, entries[1].IsDeleted())
+	assert.Equal(t, uint64(11), entries[1].Seq)
+	assert.True(t, entries[2].IsRangeDeleted())
+	assert.Equal(t, []byte("d"), entries[2].Value)
+	assert.Equal(t, utils.TypeValue, entries[3].ValueType())
+	assert.Equal(t, uint64(13), b.lastSeq())
+
+	// the expiration time is kept in value records
+	ttl := NewWriteBatch()
+	ttl.put(&utils.Entry{Key: []byte("a"), Value: []byte("1"), ExpiresAt: 1 << 40})
+	err = ttl.Iterate(func(e *utils.Entry) error {
+		assert.Equal(t, uint64(1<<40), e.ExpiresAt)
+		assert.Equal(t, []byte("1"), e.Value)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// the column family is kept in the records of other column families
+	cf := &ColumnFamily{id: 300}
+	cfBatch := NewWriteBatch()
+	cfBatch.PutCF(cf, []byte("a"), []byte("1"))
+	cfBatch.Merge([]byte("b"), []byte("2"))
+	entries = entries[:0]
+	err = cfBatch.Iterate(func(e *utils.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(300), entries[0].ColumnFamily)
+	assert.Equal(t, []byte("1"), entries[0].Value)
+	assert.Equal(t, uint32(0), entries[1].ColumnFamily)
+	assert.True(t, entries[1].IsMerge())
+
+	// truncated batch
+	err = (&WriteBatch{rep: b.Repr()[:len(b.Repr())-1]}).Iterate(func(e *utils.Entry) error {
+		return nil
+	})
+	assert.Equal(t, errs.ErrBatchCorrupted, err)
+
+	b.Clear()
+	assert.Equal(t, 0, b.Count())
+	assert.Equal(t, batchHeaderSize, len(b.Repr()))
+}
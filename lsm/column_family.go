@@ -0,0 +1,140 @@
+package lsm
+
+import (
+	"ckv/utils"
+	"ckv/utils/errs"
+	"ckv/version"
+)
+
+// ColumnFamily is the handle of a column family. A column family is a key
+// space with its own memtable, levels, comparator and options, the column
+// families of a db share the wal, file numbers and manifest
+type ColumnFamily struct {
+	id   uint32
+	name string
+	opt  *utils.Options
+}
+
+func newColumnFamily(v *version.Version) *ColumnFamily {
+	return &ColumnFamily{id: v.ID(), name: v.Name(), opt: v.Options()}
+}
+
+// ID return the id of the column family, nil is the default one
+func (cf *ColumnFamily) ID() uint32 {
+	if cf == nil {
+		return 0
+	}
+	return cf.id
+}
+
+// Name _
+func (cf *ColumnFamily) Name() string {
+	if cf == nil {
+		return version.DefaultColumnFamilyName
+	}
+	return cf.name
+}
+
+// CreateColumnFamily create a column family named name. opt nil means the
+// options in Options.ColumnFamilies, the settings of files, wal and background
+// work are taken from the options of the db
+func (lsm *LSM) CreateColumnFamily(name string, opt *utils.Options) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, errs.ErrEmptyColumnFamilyName
+	}
+	if opt != nil {
+		if err := opt.CheckCompression(); err != nil {
+			return nil, err
+		}
+	}
+	lsm.lock.Lock()
+	defer lsm.lock.Unlock()
+	if lsm.closed {
+		return nil, errs.ErrDBClosed
+	}
+	v, err := lsm.verSet.CreateColumnFamily(name, opt)
+	if err != nil {
+		return nil, err
+	}
+	cf := newColumnFamily(v)
+	lsm.families[cf.id] = cf
+	lsm.memTable.addFamily(cf)
+	return cf, nil
+}
+
+// DropColumnFamily drop the column family and delete its data. The handle
+// can't be used after dropped
+func (lsm *LSM) DropColumnFamily(cf *ColumnFamily) error {
+	if cf.ID() == 0 {
+		return errs.ErrDropDefaultColumnFamily
+	}
+	lsm.lock.Lock()
+	defer lsm.lock.Unlock()
+	if lsm.closed {
+		return errs.ErrDBClosed
+	}
+	if _, err := lsm.columnFamily(cf); err != nil {
+		return err
+	}
+	if err := lsm.verSet.DropColumnFamily(cf.id); err != nil {
+		return err
+	}
+	// the entries in memtables are released with the memtables, they are
+	// skipped by flush
+	delete(lsm.families, cf.id)
+	return nil
+}
+
+// ColumnFamily return the handle of the column family named name, nil is
+// returned if it doesn't exist
+func (lsm *LSM) ColumnFamily(name string) *ColumnFamily {
+	lsm.lock.RLock()
+	defer lsm.lock.RUnlock()
+	for _, cf := range lsm.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// columnFamily return the live column family of the handle, nil means the
+// default one. It's called with lsm.lock held
+func (lsm *LSM) columnFamily(cf *ColumnFamily) (*ColumnFamily, error) {
+	live, ok := lsm.families[cf.ID()]
+	if !ok || (cf != nil && live != cf) {
+		return nil, errs.ErrColumnFamilyNotFound
+	}
+	return live, nil
+}
+
+// loadColumnFamilies create the handles of the column families recorded in
+// manifest
+func (lsm *LSM) loadColumnFamilies() {
+	lsm.families = make(map[uint32]*ColumnFamily)
+	for _, v := range lsm.verSet.ColumnFamilies() {
+		lsm.families[v.ID()] = newColumnFamily(v)
+	}
+}
+
+// newMemTable create a memtable that has a child for each column family
+func (lsm *LSM) newMemTable(wal *WalFile) *MemTable {
+	mem := NewMemTable(lsm.option.Comparable, wal)
+	for id, cf := range lsm.families {
+		if id != 0 {
+			mem.addFamily(cf)
+		}
+	}
+	return mem
+}
+
+// memTableFull return whether the memtable of any column family is full. It's
+// called with lsm.lock held
+func (lsm *LSM) memTableFull() bool {
+	for id, cf := range lsm.families {
+		if m := lsm.memTable.family(id); m != nil && m.Size() > cf.opt.MemTableSize {
+			return true
+		}
+	}
+	return false
+}
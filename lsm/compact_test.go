@@ -19,7 +19,9 @@ import (
 func TestCreateSSTable(t *testing.T) {
 	clearDir()
 	opt.Comparable = cmp.IntComparator{}
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 	for i := 0; i < 3; i++ {
 		for j := 0; j <= 200; j++ {
 			e := &utils.Entry{
@@ -47,7 +49,9 @@ func TestMerge(t *testing.T) {
 
 	opt.Comparable = cmp.IntComparator{}
 
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 	for i := 0; i < 4; i++ {
 		for j := 0; j <= 200; j++ {
 			e := &utils.Entry{
@@ -73,11 +77,19 @@ func TestMerge(t *testing.T) {
 	//}
 	//lsm.Set(e)
 
+	// reopen so that all data in memory is flushed to sst files
+	assert.Nil(t, lsm.Close())
+	lsm, err = NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
+
 	var iters []sstable.TableIterator
 
-	table1 := lsm.verSet.FindTable(uint64(1))
+	table1, err := lsm.verSet.FindTable(uint64(1))
+	assert.Nil(t, err)
 	iters = append(iters, table1.NewIterator(lsm.option))
-	table2 := lsm.verSet.FindTable(uint64(2))
+	table2, err := lsm.verSet.FindTable(uint64(2))
+	assert.Nil(t, err)
 	iters = append(iters, table2.NewIterator(lsm.option))
 
 	iter := version.NewMergeIterator(iters, opt.Comparable)
@@ -92,11 +104,62 @@ func TestMerge(t *testing.T) {
 	iter.Close()
 }
 
-func TestMerge2(t *testing.T) {
+func TestMergeWithSnapshots(t *testing.T) {
+	clearDir()
+	opt.Comparable = cmp.IntComparator{}
+
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	n := 50
+	for i := 0; i < 2; i++ {
+		for j := 0; j < n; j++ {
+			lsm.Set(utils.NewEntry([]byte(fmt.Sprintf("%d", j)), []byte(fmt.Sprintf("%d", j+i*100))))
+		}
+	}
+	snap := lsm.GetSnapshot()
+	assert.Equal(t, uint64(n*2), snap.Seq())
+	lsm.ReleaseSnapshot(snap)
+	// reopen so that all data in memory is flushed to sst files
+	assert.Nil(t, lsm.Close())
+	lsm, err = NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
+
+	count := func(snapshots []uint64) int {
+		table, err := lsm.verSet.FindTable(uint64(1))
+		assert.Nil(t, err)
+		iter := version.NewMergeIterator([]sstable.TableIterator{table.NewIterator(lsm.option)}, opt.Comparable)
+		iter.SetSnapshots(snapshots)
+		defer iter.Close()
+		var i int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			i++
+		}
+		return i
+	}
+	// the first round is visible to the snapshot taken after it
+	assert.Equal(t, n, count(nil))
+	assert.Equal(t, n*2, count([]uint64{uint64(n)}))
+	assert.Equal(t, n, count([]uint64{uint64(n * 2)}))
+}
 
+func TestMerge2(t *testing.T) {
+	clearDir()
 	opt.Comparable = cmp.IntComparator{}
 
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	for i := 0; i <= 200; i++ {
+		e := &utils.Entry{
+			Key:   []byte(fmt.Sprintf("%d", i)),
+			Value: []byte(fmt.Sprintf("%0128d", i)),
+		}
+		lsm.Set(e)
+	}
+	assert.Nil(t, lsm.Close())
+	lsm, err = NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 
 	var iters []sstable.TableIterator
 
@@ -113,7 +176,8 @@ func TestMerge2(t *testing.T) {
 	//table9 := lsm.verSet.FindTable(uint64(11))
 	//table10 := lsm.verSet.FindTable(uint64(12))
 	//table11 := lsm.verSet.FindTable(uint64(13))
-	table15 := lsm.verSet.FindTable(uint64(15))
+	table15, err := lsm.verSet.FindTable(uint64(1))
+	assert.Nil(t, err)
 	//iters = append(iters, table2.NewIterator(lsm.option))
 	//iters = append(iters, table3.NewIterator(lsm.option))
 	//iters = append(iters, table4.NewIterator(lsm.option))
@@ -137,13 +201,16 @@ func TestMerge2(t *testing.T) {
 		if entry.Value[0] == utils.VAL_PTR {
 			fid := convert.BytesToU64(entry.Value[1:])
 			pos := convert.BytesToU32(entry.Value[9:])
-			vlog := vlog.OpenVLogFile(&file.Options{
+			vlog, err := vlog.OpenVLogFile(&file.Options{
 				Path:     "../work_test",
 				FID:      fid,
 				MaxSz:    1 << 14,
 				Flag:     os.O_CREATE | os.O_RDWR,
 				FileName: mtvFilePath("../work_test", fid),
 			})
+			if err != nil {
+				panic(err)
+			}
 			v, err := vlog.ReadAt(pos)
 			if err != nil {
 				panic(err)
@@ -164,7 +231,9 @@ func TestLSM_CRUD_Compact(t *testing.T) {
 	clearDir()
 	comparable := cmp.IntComparator{}
 	opt.Comparable = comparable
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 
 	n := 2000
 
@@ -206,7 +275,9 @@ func TestSearchMerge(t *testing.T) {
 
 	opt.Comparable = cmp.IntComparator{}
 
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 	n := 2000
 	//for i := 0; i < n; i++ {
 	//	e := &utils.Entry{
@@ -0,0 +1,516 @@
+package lsm
+
+import (
+	"ckv/sstable"
+	"ckv/utils"
+	"ckv/utils/cmp"
+	"ckv/utils/errs"
+	"sync/atomic"
+)
+
+const (
+	forward = iota
+	reverse
+)
+
+// mergingIterator merge the entries of children in order of key asc and seq
+// desc. Entries with the same key and seq are ordered by the index of the
+// children, so newer children should come first
+type mergingIterator struct {
+	cmp      cmp.Comparator
+	children []utils.Iterator
+	current  int
+	dir      int
+}
+
+func newMergingIterator(cmp cmp.Comparator, children []utils.Iterator) *mergingIterator {
+	return &mergingIterator{cmp: cmp, children: children, current: -1}
+}
+
+// compare compare the entries of children i and j
+func (iter *mergingIterator) compare(i, j int) int {
+	a, b := iter.children[i].Item().Entry(), iter.children[j].Item().Entry()
+	if r := iter.cmp.Compare(a.Key, b.Key); r != 0 {
+		return r
+	} else if a.Seq > b.Seq {
+		return -1
+	} else if a.Seq < b.Seq {
+		return 1
+	}
+	return i - j
+}
+
+// compareCurrent compare the entry of child i with the current entry
+func (iter *mergingIterator) compareCurrent(i int) int {
+	return iter.compare(i, iter.current)
+}
+
+func (iter *mergingIterator) findSmallest() {
+	iter.current = -1
+	for i, child := range iter.children {
+		if child.Valid() && (iter.current < 0 || iter.compare(i, iter.current) < 0) {
+			iter.current = i
+		}
+	}
+}
+
+func (iter *mergingIterator) findLargest() {
+	iter.current = -1
+	for i, child := range iter.children {
+		if child.Valid() && (iter.current < 0 || iter.compare(i, iter.current) > 0) {
+			iter.current = i
+		}
+	}
+}
+
+func (iter *mergingIterator) Valid() bool {
+	return iter.current >= 0
+}
+
+func (iter *mergingIterator) Rewind() {
+	for _, child := range iter.children {
+		child.Rewind()
+	}
+	iter.findSmallest()
+	iter.dir = forward
+}
+
+func (iter *mergingIterator) Last() {
+	for _, child := range iter.children {
+		child.Last()
+	}
+	iter.findLargest()
+	iter.dir = reverse
+}
+
+func (iter *mergingIterator) Seek(key []byte) {
+	for _, child := range iter.children {
+		child.Seek(key)
+	}
+	iter.findSmallest()
+	iter.dir = forward
+}
+
+func (iter *mergingIterator) SeekForPrev(key []byte) {
+	for _, child := range iter.children {
+		child.SeekForPrev(key)
+	}
+	iter.findLargest()
+	iter.dir = reverse
+}
+
+func (iter *mergingIterator) Next() {
+	if iter.dir != forward {
+		// make sure all children are positioned after the current entry
+		key := iter.Item().Entry().Key
+		for i, child := range iter.children {
+			if i == iter.current {
+				continue
+			}
+			child.Seek(key)
+			for child.Valid() && iter.compareCurrent(i) <= 0 {
+				child.Next()
+			}
+		}
+		iter.dir = forward
+	}
+	iter.children[iter.current].Next()
+	iter.findSmallest()
+}
+
+func (iter *mergingIterator) Prev() {
+	if iter.dir != reverse {
+		// make sure all children are positioned before the current entry
+		key := iter.Item().Entry().Key
+		for i, child := range iter.children {
+			if i == iter.current {
+				continue
+			}
+			child.SeekForPrev(key)
+			for child.Valid() && iter.compareCurrent(i) >= 0 {
+				child.Prev()
+			}
+		}
+		iter.dir = reverse
+	}
+	iter.children[iter.current].Prev()
+	iter.findLargest()
+}
+
+func (iter *mergingIterator) Item() utils.Item {
+	return iter.children[iter.current].Item()
+}
+
+func (iter *mergingIterator) Close() error {
+	var err error
+	for _, child := range iter.children {
+		if e := child.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// DBIterator iterate the user keys of the db. Only the newest version of each
+// key is visible, and deleted keys are skipped
+//
+// In forward direction, the internal iterator is positioned at a version of
+// the current key, or after all of them if merge operands are resolved. In
+// reverse direction, it is positioned before all versions of the current key.
+// The current entry is saved in both directions
+type DBIterator struct {
+	lsm       *LSM
+	opt       *utils.Options // the options of the column family
+	iter      *mergingIterator
+	cmp       cmp.Comparator
+	seq       uint64
+	numMems   int // children before numMems are memtables, the rest are tables
+	rangeDels []*utils.RangeTombstone
+	lower     []byte
+	upper     []byte
+
+	dir   int
+	valid bool
+	entry *utils.Entry
+	err   error
+}
+
+// NewIterator return an iterator over the memtables and all tables. The
+// iterator must be closed before the LSM is closed
+func (lsm *LSM) NewIterator(opt *utils.ReadOptions) *DBIterator {
+	return lsm.NewIteratorCF(nil, opt)
+}
+
+// NewIteratorCF return an iterator over column family cf, nil means the
+// default one
+func (lsm *LSM) NewIteratorCF(cf *ColumnFamily, opt *utils.ReadOptions) *DBIterator {
+	if opt == nil {
+		opt = utils.NewReadOptions()
+	}
+	// hold the memtables so that they won't be released by minor compaction
+	lsm.lock.RLock()
+	if lsm.closed {
+		lsm.lock.RUnlock()
+		return NewErrorIterator(errs.ErrDBClosed)
+	}
+	cf, err := lsm.columnFamily(cf)
+	if err != nil {
+		lsm.lock.RUnlock()
+		return NewErrorIterator(err)
+	}
+	seq := atomic.LoadUint64(&lsm.seq)
+	if opt.Snapshot != nil {
+		seq = opt.Snapshot.Seq()
+	}
+	var children []utils.Iterator
+	var rangeDels []*utils.RangeTombstone
+	mems := []*MemTable{lsm.memTable}
+	for i := len(lsm.immutables) - 1; i >= 0; i-- {
+		mems = append(mems, lsm.immutables[i])
+	}
+	for _, mem := range mems {
+		if mem = mem.family(cf.id); mem == nil {
+			continue
+		}
+		children = append(children, mem.NewMemTableIterator())
+		rangeDels = append(rangeDels, mem.RangeDels()...)
+	}
+	numMems := len(children)
+	// hold the tables before releasing lock, so that the tables flushed
+	// from immutables won't be missed
+	tables, tableRangeDels, err := lsm.verSet.NewIterators(cf.id, opt.FillCache)
+	lsm.lock.RUnlock()
+	if err != nil {
+		for _, child := range children {
+			child.Close()
+		}
+		return NewErrorIterator(err)
+	}
+
+	return &DBIterator{
+		lsm:       lsm,
+		opt:       cf.opt,
+		iter:      newMergingIterator(cf.opt.Comparable, append(children, tables...)),
+		cmp:       cf.opt.Comparable,
+		seq:       seq,
+		numMems:   numMems,
+		rangeDels: append(rangeDels, tableRangeDels...),
+		lower:     opt.LowerBound,
+		upper:     opt.UpperBound,
+	}
+}
+
+// NewErrorIterator return an empty iterator whose Err return err
+func NewErrorIterator(err error) *DBIterator {
+	return &DBIterator{iter: newMergingIterator(nil, nil), err: err}
+}
+
+func (iter *DBIterator) Valid() bool {
+	return iter.valid
+}
+
+// Err return the error occurred while reading value
+func (iter *DBIterator) Err() error {
+	return iter.err
+}
+
+// Item return the current entry, the key and value must not be modified
+func (iter *DBIterator) Item() utils.Item {
+	return iter.entry
+}
+
+func (iter *DBIterator) Rewind() {
+	iter.dir = forward
+	if iter.lower != nil {
+		iter.iter.Seek(iter.lower)
+	} else {
+		iter.iter.Rewind()
+	}
+	iter.findNextUserEntry(false, nil)
+}
+
+// Last move to the last key
+func (iter *DBIterator) Last() {
+	iter.dir = reverse
+	if iter.upper != nil {
+		iter.iter.SeekForPrev(iter.upper)
+		// the upper bound is exclusive
+		for iter.iter.Valid() && iter.cmp.Compare(iter.iter.Item().Entry().Key, iter.upper) >= 0 {
+			iter.iter.Prev()
+		}
+	} else {
+		iter.iter.Last()
+	}
+	iter.findPrevUserEntry()
+}
+
+// Seek move to the first key >= key
+func (iter *DBIterator) Seek(key []byte) {
+	if iter.lower != nil && iter.cmp.Compare(key, iter.lower) < 0 {
+		key = iter.lower
+	}
+	iter.dir = forward
+	iter.iter.Seek(key)
+	iter.findNextUserEntry(false, nil)
+}
+
+// SeekForPrev move to the last key <= key
+func (iter *DBIterator) SeekForPrev(key []byte) {
+	if iter.upper != nil && iter.cmp.Compare(key, iter.upper) >= 0 {
+		iter.Last()
+		return
+	}
+	iter.dir = reverse
+	iter.iter.SeekForPrev(key)
+	iter.findPrevUserEntry()
+}
+
+func (iter *DBIterator) Next() {
+	if !iter.valid {
+		return
+	}
+	skip := iter.entry.Key
+	if iter.dir == reverse {
+		iter.dir = forward
+		// the internal iterator is before all versions of the current key,
+		// move into them and skip them
+		if iter.iter.Valid() {
+			iter.iter.Next()
+		} else {
+			iter.iter.Rewind()
+		}
+	}
+	// the versions of the current key are skipped, the internal iterator
+	// may have been moved after them by merge
+	iter.findNextUserEntry(true, skip)
+}
+
+// Prev move to the previous key
+func (iter *DBIterator) Prev() {
+	if !iter.valid {
+		return
+	}
+	if iter.dir == forward {
+		// move before all versions of the current key
+		key := iter.entry.Key
+		if !iter.iter.Valid() {
+			iter.iter.Last()
+		}
+		for iter.iter.Valid() && iter.cmp.Compare(iter.iter.Item().Entry().Key, key) >= 0 {
+			iter.iter.Prev()
+		}
+		iter.dir = reverse
+	}
+	iter.findPrevUserEntry()
+}
+
+func (iter *DBIterator) Close() error {
+	return iter.iter.Close()
+}
+
+// hidden return whether the entry is expired or deleted by a point or range
+// tombstone
+func (iter *DBIterator) hidden(e *utils.Entry) bool {
+	return e.IsDeleted() || e.IsExpired() || utils.MaxCoveringSeq(iter.rangeDels, iter.cmp, e.Key, iter.seq) > e.Seq
+}
+
+// findNextUserEntry move forward to the newest visible version of the next
+// key. The versions of skip are skipped if skipping is true
+func (iter *DBIterator) findNextUserEntry(skipping bool, skip []byte) {
+	for ; iter.iter.Valid(); iter.iter.Next() {
+		e := iter.iter.Item().Entry()
+		if e.Seq > iter.seq {
+			continue
+		}
+		if skipping && iter.cmp.Compare(e.Key, skip) <= 0 {
+			continue
+		}
+		if iter.upper != nil && iter.cmp.Compare(e.Key, iter.upper) >= 0 {
+			break
+		}
+		// older versions of the key are hidden by this version
+		skipping, skip = true, e.Key
+		if iter.hidden(e) {
+			continue
+		}
+		if e.IsMerge() {
+			iter.mergeForward(e)
+			return
+		}
+		iter.setEntry(e, iter.iter.current >= iter.numMems)
+		return
+	}
+	iter.valid = false
+}
+
+// mergeForward resolve the merge operand e with the older versions of its
+// key. The internal iterator ends after the versions that are merged
+func (iter *DBIterator) mergeForward(e *utils.Entry) {
+	key := e.Key
+	merge := &utils.MergeContext{}
+	var base *utils.Entry
+	for ; iter.iter.Valid(); iter.iter.Next() {
+		e = iter.iter.Item().Entry()
+		if iter.cmp.Compare(e.Key, key) != 0 {
+			break
+		}
+		if e.Seq > iter.seq {
+			continue
+		}
+		if e, iter.err = iter.readValue(e, iter.iter.current >= iter.numMems); iter.err != nil {
+			iter.valid = false
+			return
+		}
+		if iter.hidden(e) || !e.IsMerge() {
+			base = e
+			break
+		}
+		merge.Push(e)
+	}
+	iter.resolve(key, base, merge)
+}
+
+// resolve set the current entry to the result of merge
+func (iter *DBIterator) resolve(key []byte, base *utils.Entry, merge *utils.MergeContext) {
+	if base != nil && iter.hidden(base) {
+		base = nil
+	}
+	entry, err := merge.Resolve(iter.opt.MergeOperator, key, base)
+	if err != nil {
+		iter.err = err
+		iter.valid = false
+		return
+	}
+	iter.entry = entry
+	iter.valid = true
+}
+
+// findPrevUserEntry move backward to the previous visible key. The internal
+// iterator ends before all versions of the key
+func (iter *DBIterator) findPrevUserEntry() {
+	var saved *utils.Entry
+	var table bool
+	// the merge operands on top of saved, newest last
+	var operands []*utils.Entry
+	for ; iter.iter.Valid(); iter.iter.Prev() {
+		e := iter.iter.Item().Entry()
+		if e.Seq > iter.seq {
+			continue
+		}
+		if (saved != nil || len(operands) > 0) && iter.cmp.Compare(e.Key, iter.prevKey(saved, operands)) < 0 {
+			// all versions of saved key have been checked
+			break
+		}
+		if iter.hidden(e) {
+			saved, operands = nil, nil
+			continue
+		}
+		if e.IsMerge() {
+			if e, iter.err = iter.readValue(e, iter.iter.current >= iter.numMems); iter.err != nil {
+				iter.valid = false
+				return
+			}
+			operands = append(operands, e)
+			continue
+		}
+		// newer version of the key overwrite the saved one
+		saved, table, operands = e, iter.iter.current >= iter.numMems, nil
+	}
+	key := iter.prevKey(saved, operands)
+	if key == nil || (iter.lower != nil && iter.cmp.Compare(key, iter.lower) < 0) {
+		iter.valid = false
+		iter.dir = forward
+		return
+	}
+	if len(operands) == 0 {
+		iter.setEntry(saved, table)
+		return
+	}
+	if saved != nil {
+		if saved, iter.err = iter.readValue(saved, table); iter.err != nil {
+			iter.valid = false
+			return
+		}
+	}
+	merge := &utils.MergeContext{}
+	for i := len(operands) - 1; i >= 0; i-- {
+		merge.Push(operands[i])
+	}
+	iter.resolve(key, saved, merge)
+}
+
+// prevKey return the key of the version found by findPrevUserEntry
+func (iter *DBIterator) prevKey(saved *utils.Entry, operands []*utils.Entry) []byte {
+	if len(operands) > 0 {
+		return operands[0].Key
+	}
+	if saved != nil {
+		return saved.Key
+	}
+	return nil
+}
+
+// readValue return a copy of e whose value is read if it's stored in table
+func (iter *DBIterator) readValue(e *utils.Entry, table bool) (*utils.Entry, error) {
+	entry := &utils.Entry{Key: e.Key, Value: e.Value, Seq: e.Seq, Meta: e.Meta, ExpiresAt: e.ExpiresAt}
+	if table {
+		value, err := sstable.ReadValue(iter.opt, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = value
+	}
+	return entry, nil
+}
+
+// setEntry set the current entry, the value stored in table is read
+func (iter *DBIterator) setEntry(e *utils.Entry, table bool) {
+	entry, err := iter.readValue(e, table)
+	if err != nil {
+		iter.err = err
+		iter.valid = false
+		return
+	}
+	iter.entry = entry
+	iter.valid = true
+}
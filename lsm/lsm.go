@@ -10,12 +10,15 @@ import (
 	"ckv/version"
 	"ckv/vlog"
 	"io/ioutil"
+	"log"
+	"math"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -38,29 +41,104 @@ type LSM struct {
 	seq    uint64
 	//maxFID uint64
 	lock                  *sync.RWMutex
+	writeLock             sync.Mutex // protect writers
+	writers               []*writer  // the queue of pending writers, the first one is the leader
 	cond                  *sync.Cond
 	bgCompactionScheduled bool
 	compactState          *version.CompactStatus
+	closer                *utils.Closer
+	closed                bool
+	bgErr                 error                    // the first error of background flush, writes fail with it
+	families              map[uint32]*ColumnFamily // the live column families
 }
 
-// NewLSM _
-func NewLSM(opt *utils.Options) *LSM {
+// NewLSM open the lsm tree in opt.WorkDir, recover it from manifest and wal
+// files, and start background compaction and gc
+func NewLSM(opt *utils.Options) (*LSM, error) {
+	if err := opt.CheckCompression(); err != nil {
+		return nil, err
+	}
 	if opt.Comparable != nil {
 		comparator = opt.Comparable
 	} else {
 		opt.Comparable = cmp.ByteComparator{}
 	}
-	lsm := &LSM{option: opt, lock: &sync.RWMutex{}}
+	lsm := &LSM{option: opt, lock: &sync.RWMutex{}, closer: utils.NewCloser()}
 	lsm.cond = sync.NewCond(lsm.lock)
-	lsm.verSet, _ = version.Open(lsm.option)
+	var err error
+	if lsm.verSet, err = version.Open(lsm.option); err != nil {
+		return nil, err
+	}
+	lsm.loadColumnFamilies()
+	// the seq of entries in the wal files is restored by recovery
+	lsm.seq = lsm.verSet.LastSequence()
 	//lsm.compactState = version.NewCompactStatus(lsm.option)
 	//lsm.lm = lsm.newLevelManager()
 	// recovery
-	lsm.memTable, lsm.immutables = lsm.recovery()
+	if lsm.memTable, lsm.immutables, err = lsm.recovery(); err != nil {
+		lsm.verSet.Close()
+		return nil, err
+	}
 	//lsm.memTable = lsm.NewMemTable()
-	go lsm.verSet.RunCompact()
-	go lsm.verSet.RunGC()
-	return lsm
+	lsm.closer.Add(2)
+	go lsm.verSet.RunCompact(lsm.closer)
+	go lsm.verSet.RunGC(lsm.closer)
+	if opt.WALSyncMode == utils.WALSyncInterval {
+		lsm.closer.Add(1)
+		go lsm.runSyncWAL(lsm.closer)
+	}
+	return lsm, nil
+}
+
+// Close stop background compaction and gc, flush the memtable and immutables
+// to sst files, and close the wal, vlog and manifest files
+func (lsm *LSM) Close() error {
+	lsm.lock.Lock()
+	if lsm.closed {
+		lsm.lock.Unlock()
+		return nil
+	}
+	lsm.closed = true
+	// wait for the running minor compaction
+	for lsm.bgCompactionScheduled {
+		lsm.cond.Wait()
+	}
+	lsm.lock.Unlock()
+
+	lsm.closer.Close()
+
+	lsm.lock.Lock()
+	defer lsm.lock.Unlock()
+	var err error
+	if !lsm.memTable.Empty() {
+		lsm.immutables = append(lsm.immutables, lsm.memTable)
+	} else if e := lsm.memTable.close(); e != nil {
+		err = e
+	}
+	lsm.memTable = nil
+	var flushErr error
+	for _, imm := range lsm.immutables {
+		// the newer immutables aren't flushed after a failure, or their
+		// log number would make the older wal obsolete
+		if flushErr == nil {
+			flushErr = lsm.WriteLevel0Table(imm)
+		}
+		if flushErr != nil {
+			if err == nil {
+				err = flushErr
+			}
+			// keep the wal so that data can be recovered next time
+			imm.wal.f.Close()
+			continue
+		}
+		imm.DecrRef()
+	}
+	lsm.immutables = nil
+
+	if e := lsm.verSet.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
 func (lsm *LSM) IncreaseFid(delta uint64) uint64 {
@@ -74,24 +152,246 @@ func (lsm *LSM) Set(entry *utils.Entry) (err error) {
 	if entry == nil || len(entry.Key) == 0 {
 		return errs.ErrEmptyKey
 	}
+	batch := NewWriteBatch()
+	batch.put(entry)
+	if err = lsm.Write(batch); err != nil {
+		return err
+	}
+	entry.Seq = batch.seq()
+	return nil
+}
 
-	// write wal first
+// writer is a pending write in the write queue
+type writer struct {
+	batch *WriteBatch
+	sync  bool
+	check func() error // called before the batch is written, nil means no check
+	done  bool
+	err   error
+	cond  *sync.Cond
+}
 
-	// TODO 计算内存大小
-	if lsm.memTable.Size() > lsm.option.MemTableSize {
-		lsm.rotate()
+const (
+	// maxGroupSize is the max size of batches written by one leader
+	maxGroupSize = 1 << 20
+	// smallBatchSize limit the group size of a small leader batch, so that
+	// the small write won't be slowed down too much
+	smallBatchSize = 128 << 10
+)
+
+// Write apply the batch atomically. The records get consecutive seqs, and
+// they are written to wal as one record. The seqs are published after all
+// records are inserted into memtable, so readers see all or none of them
+func (lsm *LSM) Write(batch *WriteBatch) error {
+	return lsm.WriteWithOptions(batch, nil)
+}
+
+// WriteWithOptions apply the batch atomically like Write. Concurrent writers
+// are queued, and the first one, the leader, writes the batches of the
+// following writers together with its own, so that they share one wal
+// append and one sync
+func (lsm *LSM) WriteWithOptions(batch *WriteBatch, opt *utils.WriteOptions) error {
+	return lsm.write(batch, opt, nil)
+}
+
+// write apply the batch like WriteWithOptions. If check is not nil, the batch
+// is written alone, and check is called by the leader right before the write.
+// No other batch is written in between, so that check sees the latest state
+func (lsm *LSM) write(batch *WriteBatch, opt *utils.WriteOptions, check func() error) error {
+	if batch == nil || batch.Count() == 0 {
+		return nil
 	}
-	sequence := atomic.AddUint64(&lsm.seq, 1)
-	entry.Seq = sequence
-	if err = lsm.memTable.Set(entry); err != nil {
+	if err := lsm.checkBatch(batch); err != nil {
 		return err
 	}
 
+	w := &writer{
+		batch: batch,
+		sync:  lsm.option.WALSyncMode == utils.WALSyncAlways || (opt != nil && opt.Sync),
+		check: check,
+		cond:  sync.NewCond(&lsm.writeLock),
+	}
+	lsm.writeLock.Lock()
+	defer lsm.writeLock.Unlock()
+	lsm.writers = append(lsm.writers, w)
+	for !w.done && lsm.writers[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		// written by the leader
+		return w.err
+	}
+
+	// only the leader makes room for the write, so that the followers
+	// won't be written to a full memtable
+	lsm.writeLock.Unlock()
+	err := lsm.makeRoomForWrite()
+	lsm.writeLock.Lock()
+
+	group := lsm.buildBatchGroup()
+	if err == nil {
+		// new writers can be queued while the group is written
+		lsm.writeLock.Unlock()
+		if w.check != nil {
+			err = w.check()
+		}
+		if err == nil {
+			err = lsm.writeGroup(group, w.sync)
+		}
+		lsm.writeLock.Lock()
+	}
+
+	for _, follower := range group {
+		lsm.writers = lsm.writers[1:]
+		if follower == w {
+			continue
+		}
+		follower.err = err
+		follower.done = true
+		follower.cond.Signal()
+	}
+	// wake up the next leader
+	if len(lsm.writers) > 0 {
+		lsm.writers[0].cond.Signal()
+	}
 	return err
 }
 
+// buildBatchGroup return the writers whose batches are written by the
+// leader, the leader is the first one
+func (lsm *LSM) buildBatchGroup() []*writer {
+	leader := lsm.writers[0]
+	size := len(leader.batch.Repr())
+	maxSize := maxGroupSize
+	if size <= smallBatchSize {
+		maxSize = size + smallBatchSize
+	}
+	group := []*writer{leader}
+	if leader.check != nil {
+		return group
+	}
+	for _, w := range lsm.writers[1:] {
+		// the sync write can't be acknowledged by a write without sync, and
+		// the checked write must see the writes before it
+		if (w.sync && !leader.sync) || w.check != nil {
+			break
+		}
+		if size += len(w.batch.Repr()); size > maxSize {
+			break
+		}
+		group = append(group, w)
+	}
+	return group
+}
+
+// makeRoomForWrite rotate the memtable if it's full. The error of background
+// flush is returned, since the memtables can't be flushed any more
+func (lsm *LSM) makeRoomForWrite() error {
+	lsm.lock.RLock()
+	defer lsm.lock.RUnlock()
+	if lsm.bgErr != nil {
+		return lsm.bgErr
+	}
+	// TODO 计算内存大小
+	for !lsm.closed && lsm.memTableFull() {
+		lsm.lock.RUnlock()
+		err := lsm.rotate()
+		lsm.lock.RLock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeGroup write the batches of the group as one batch, and set the seq
+// of each batch
+func (lsm *LSM) writeGroup(group []*writer, sync bool) error {
+	batch := group[0].batch
+	if len(group) > 1 {
+		batch = NewWriteBatch()
+		for _, w := range group {
+			batch.append(w.batch)
+		}
+	}
+
+	lsm.lock.RLock()
+	defer lsm.lock.RUnlock()
+	if lsm.closed {
+		return errs.ErrDBClosed
+	}
+	seq := atomic.LoadUint64(&lsm.seq) + 1
+	batch.setSeq(seq)
+	if err := lsm.memTable.Write(batch, sync); err != nil {
+		return err
+	}
+	for _, w := range group {
+		w.batch.setSeq(seq)
+		seq += uint64(w.batch.Count())
+	}
+	atomic.StoreUint64(&lsm.seq, batch.lastSeq())
+	return nil
+}
+
+// runSyncWAL sync the wal periodically in WALSyncInterval mode
+func (lsm *LSM) runSyncWAL(closer *utils.Closer) {
+	defer closer.Done()
+	interval := lsm.option.WALSyncInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lsm.lock.RLock()
+			if !lsm.closed {
+				if err := lsm.memTable.wal.Sync(); err != nil {
+					log.Printf("sync wal %d failed: %v\n", lsm.memTable.wal.Fid(), err)
+				}
+			}
+			lsm.lock.RUnlock()
+		case <-closer.CloseSignal:
+			return
+		}
+	}
+}
+
+// checkBatch check that keys in the batch are not empty, the column families
+// exist, and the merge records can be resolved
+func (lsm *LSM) checkBatch(batch *WriteBatch) error {
+	lsm.lock.RLock()
+	defer lsm.lock.RUnlock()
+	return batch.Iterate(func(e *utils.Entry) error {
+		if len(e.Key) == 0 || (e.IsRangeDeleted() && len(e.Value) == 0) {
+			return errs.ErrEmptyKey
+		}
+		cf, ok := lsm.families[e.ColumnFamily]
+		if !ok {
+			return errs.ErrColumnFamilyNotFound
+		}
+		if e.IsMerge() && cf.opt.MergeOperator == nil {
+			return errs.ErrNoMergeOperator
+		}
+		return nil
+	})
+}
+
 // Get _
 func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
+	return lsm.GetWithOptions(key, nil)
+}
+
+// GetWithOptions return the newest version of key. If opt.Snapshot is set,
+// the newest version visible to the snapshot is returned
+func (lsm *LSM) GetWithOptions(key []byte, opt *utils.ReadOptions) (*utils.Entry, error) {
+	return lsm.GetCF(nil, key, opt)
+}
+
+// GetCF return the newest version of key in column family cf like
+// GetWithOptions, nil means the default column family
+func (lsm *LSM) GetCF(cf *ColumnFamily, key []byte, opt *utils.ReadOptions) (*utils.Entry, error) {
 	if len(key) == 0 {
 		return nil, errs.ErrEmptyKey
 	}
@@ -99,52 +399,243 @@ func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
 	var (
 		entry *utils.Entry
 		err   error
-		seq   = atomic.LoadUint64(&lsm.seq)
 	)
-	// serach from memtable first
-	if entry, err = lsm.memTable.Get(key, seq); entry != nil && entry.Value != nil {
-		return entry, err
+	// hold the memtables so that they won't be released by minor compaction
+	lsm.lock.RLock()
+	if lsm.closed {
+		lsm.lock.RUnlock()
+		return nil, errs.ErrDBClosed
+	}
+	if cf, err = lsm.columnFamily(cf); err != nil {
+		lsm.lock.RUnlock()
+		return nil, err
+	}
+	seq := atomic.LoadUint64(&lsm.seq)
+	// versions newer than seq in sst files are written after the memtables
+	// are searched, it's ok to see them without snapshot
+	tableSeq := uint64(math.MaxUint64)
+	if opt != nil && opt.Snapshot != nil {
+		seq, tableSeq = opt.Snapshot.Seq(), opt.Snapshot.Seq()
+	}
+	mems := lsm.refMemTables()
+	lsm.lock.RUnlock()
+	defer func() {
+		for _, mem := range mems {
+			mem.DecrRef()
+		}
+	}()
+
+	// serach from memtable first. The merge operands are collected until
+	// the older version they are applied to is found
+	merge := &utils.MergeContext{}
+	for _, mem := range mems {
+		// the memtables created before the column family don't have it
+		if mem = mem.family(cf.id); mem == nil {
+			continue
+		}
+		for entry, err = mem.Get(key, seq); err == nil; entry, err = mem.Get(key, seq) {
+			if !entry.IsMerge() {
+				return lsm.resolve(cf, key, entry, merge)
+			}
+			merge.Push(entry)
+			seq, tableSeq = entry.Seq-1, entry.Seq-1
+		}
 	}
+	if entry, err = lsm.verSet.Get(cf.id, key, tableSeq, merge); err != nil && err != errs.ErrKeyNotFound {
+		return nil, err
+	}
+	return lsm.resolve(cf, key, entry, merge)
+	//return lsm.lm.Get(key)
+}
 
+// refMemTables return the memtable and immutables, the newest comes first.
+// They are held until released by the caller. It's called with lsm.lock held
+func (lsm *LSM) refMemTables() []*MemTable {
+	mems := make([]*MemTable, 0, len(lsm.immutables)+1)
+	mems = append(mems, lsm.memTable)
 	// search from immutable, beginning at the newest immutable
 	for i := len(lsm.immutables) - 1; i >= 0; i-- {
-		if entry, err = lsm.immutables[i].Get(key, seq); entry != nil && entry.Value != nil {
-			return entry, err
+		mems = append(mems, lsm.immutables[i])
+	}
+	for _, mem := range mems {
+		mem.IncrRef()
+	}
+	return mems
+}
+
+// latestSeq return the seq of the newest version of key in the default column
+// family, tombstones included. 0 is returned if the key is never written
+func (lsm *LSM) latestSeq(key []byte) (uint64, error) {
+	lsm.lock.RLock()
+	if lsm.closed {
+		lsm.lock.RUnlock()
+		return 0, errs.ErrDBClosed
+	}
+	mems := lsm.refMemTables()
+	lsm.lock.RUnlock()
+	defer func() {
+		for _, mem := range mems {
+			mem.DecrRef()
+		}
+	}()
+
+	for _, mem := range mems {
+		if entry, err := mem.Get(key, maxSeq); err == nil {
+			return entry.Seq, nil
 		}
 	}
-	return lsm.verSet.Get(key)
-	//return lsm.lm.Get(key)
+	merge := &utils.MergeContext{}
+	entry, err := lsm.verSet.Get(0, key, math.MaxUint64, merge)
+	if !merge.Empty() {
+		return merge.Seq(), nil
+	}
+	if err == errs.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return entry.Seq, nil
+}
+
+// resolve apply the merge operands of cf to entry, which is nil if the key is
+// not found. ErrKeyNotFound is returned if the key doesn't exist
+func (lsm *LSM) resolve(cf *ColumnFamily, key []byte, entry *utils.Entry, merge *utils.MergeContext) (*utils.Entry, error) {
+	if !merge.Empty() {
+		return merge.Resolve(cf.opt.MergeOperator, key, entry)
+	}
+	if entry == nil {
+		return nil, errs.ErrKeyNotFound
+	}
+	return checkDeleted(entry)
+}
+
+// GetSnapshot return a snapshot of the current state. The snapshot should
+// be released by ReleaseSnapshot when it's no longer needed
+func (lsm *LSM) GetSnapshot() *utils.Snapshot {
+	return lsm.verSet.Snapshots().New(atomic.LoadUint64(&lsm.seq))
+}
+
+// ReleaseSnapshot _
+func (lsm *LSM) ReleaseSnapshot(s *utils.Snapshot) {
+	lsm.verSet.Snapshots().Release(s)
+}
+
+// checkDeleted return ErrKeyNotFound if the entry is a tombstone or has
+// expired
+func checkDeleted(entry *utils.Entry) (*utils.Entry, error) {
+	if entry.IsDeleted() || entry.IsExpired() {
+		return nil, errs.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+// Delete write a tombstone for key
+func (lsm *LSM) Delete(key []byte) error {
+	return lsm.DeleteCF(nil, key)
 }
 
-// WriteLevel0Table write immutable to sst file
+// DeleteCF write a tombstone for key in column family cf
+func (lsm *LSM) DeleteCF(cf *ColumnFamily, key []byte) error {
+	return lsm.Set(&utils.Entry{Key: key, Meta: utils.BitDelete, ColumnFamily: cf.ID()})
+}
+
+// Merge write a merge operand for key, it's applied to the value of key by
+// Options.MergeOperator when the key is read
+func (lsm *LSM) Merge(key, operand []byte) error {
+	return lsm.MergeCF(nil, key, operand)
+}
+
+// MergeCF write a merge operand for key in column family cf, it's applied by
+// the merge operator of cf
+func (lsm *LSM) MergeCF(cf *ColumnFamily, key, operand []byte) error {
+	return lsm.Set(&utils.Entry{Key: key, Value: operand, Meta: utils.BitMerge, ColumnFamily: cf.ID()})
+}
+
+// DeleteRange write a range tombstone that deletes keys in [start, end)
+func (lsm *LSM) DeleteRange(start, end []byte) error {
+	return lsm.DeleteRangeCF(nil, start, end)
+}
+
+// DeleteRangeCF write a range tombstone that deletes keys in [start, end) in
+// column family cf
+func (lsm *LSM) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	if len(start) == 0 || len(end) == 0 {
+		return errs.ErrEmptyKey
+	}
+	lsm.lock.RLock()
+	cf, err := lsm.columnFamily(cf)
+	lsm.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if cf.opt.Comparable.Compare(start, end) >= 0 {
+		return nil
+	}
+	return lsm.Set(&utils.Entry{Key: start, Value: end, Meta: utils.BitRangeDelete, ColumnFamily: cf.id})
+}
+
+func (lsm *LSM) isClosed() bool {
+	lsm.lock.RLock()
+	defer lsm.lock.RUnlock()
+	return lsm.closed
+}
+
+// WriteLevel0Table write immutable to sst files, one for each column family.
+// The other column families are written first, since the wal is recorded
+// obsolete by the table of the default one
 func (lsm *LSM) WriteLevel0Table(immutable *MemTable) (err error) {
+	fid := immutable.wal.Fid()
+	for _, child := range immutable.children() {
+		if child.Empty() {
+			continue
+		}
+		if err := lsm.writeLevel0Table(child.cf.id, child.cf.opt, child, lsm.IncreaseFid(1), 0); err != nil {
+			return err
+		}
+	}
+	if immutable.familyEmpty() {
+		lsm.verSet.SetLastSequence(atomic.LoadUint64(&lsm.seq))
+		return lsm.verSet.SetLogNumber(fid + 1)
+	}
+	return lsm.writeLevel0Table(0, lsm.option, immutable, fid, fid+1)
+}
+
+// writeLevel0Table write the memtable of column family cf to the sst file fid
+func (lsm *LSM) writeLevel0Table(cf uint32, opt *utils.Options, immutable *MemTable, fid, logNumber uint64) (err error) {
 	//if !atomic.CompareAndSwapInt32(&immutable.state, IMMUTABLE, COMPACTING) {
 	//	return nil
 	//}
-	// 分配一个fid
-	//fid := mem.wal.Fid()
-	fid := immutable.wal.Fid()
-	sstName := file.FileNameSSTable(lsm.option.WorkDir, fid)
+	sstName := file.FileNameSSTable(opt.WorkDir, fid)
 	//fmt.Println(fid)
 	// 构建一个 builder
-	builder := sstable.NewTableBuiler(lsm.option)
+	builder := sstable.NewTableBuiler(opt)
 	//iter := immutable.table.NewIterator()
 	iter := immutable.NewMemTableIterator()
 	defer iter.Close()
 
-	vlog := lsm.openVLog(fid, true)
+	vlog, err := lsm.openVLog(fid, true)
+	if err != nil {
+		return err
+	}
+	filter := opt.CompactionFilter
+	if !opt.FilterOnFlush {
+		filter = nil
+	}
+	snapshots := lsm.verSet.Snapshots().Seqs()
 
-	var entry *utils.Entry
-	var firstEntry *utils.Entry
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		if firstEntry == nil {
-			firstEntry = iter.Item().Entry()
+		entry := iter.Item().Entry()
+		// the versions visible to snapshots are not filtered
+		if filter != nil && !entry.IsDeleted() && !entry.IsMerge() && !entry.IsExpired() &&
+			(len(snapshots) == 0 || entry.Seq > snapshots[len(snapshots)-1]) {
+			entry = filterFlushEntry(filter, entry)
 		}
-		entry = iter.Item().Entry()
 		var val []byte
 		if len(entry.Value) > utils.SP_THRESHOLD {
 			pos := vlog.Pos()
 			if err := vlog.Write(entry); err != nil {
+				vlog.Close()
 				return err
 			}
 			val = make([]byte, 1+8+4) // tag + fid + off
@@ -161,47 +652,86 @@ func (lsm *LSM) WriteLevel0Table(immutable *MemTable) (err error) {
 		builder.Add(entry, false)
 	}
 
-	vlog.Close()
+	for _, t := range immutable.RangeDels() {
+		builder.AddRangeTombstone(t)
+	}
+
+	if err = vlog.Close(); err != nil {
+		return err
+	}
 	t, err := builder.Flush(sstName)
-	t.MaxKey = entry.Key
-	//t.MinKey = firstEntry.Key
 	if err != nil {
-		errs.Panic(err)
+		return err
 	}
 
 	//level := 0
-	level := lsm.verSet.PickLevelForMemTableOutput(t.MinKey, t.MaxKey)
-
-	lsm.verSet.AddFileMetaWithGroup(level, t)
-
+	level := lsm.verSet.PickLevelForMemTableOutput(cf, t.MinKey, t.MaxKey)
+
+	// the entries in the wal files whose fid < logNumber are all in sst
+	// files now
+	lsm.verSet.SetLastSequence(atomic.LoadUint64(&lsm.seq))
+	if err = lsm.verSet.AddFileMetaWithGroup(cf, level, t, logNumber); err != nil {
+		// the memtable is flushed again with the same fid
+		os.Remove(sstName)
+		os.Remove(file.FileNameVLog(opt.WorkDir, fid))
+	}
 	return
 }
 
+// filterFlushEntry apply the compaction filter to the entry flushed to level
+// 0. The removed entry becomes a tombstone, since the older versions may be in
+// sst files
+func filterFlushEntry(filter utils.CompactionFilter, e *utils.Entry) *utils.Entry {
+	value := func() ([]byte, error) {
+		return e.Value, nil
+	}
+	switch decision, newValue := filter.Filter(0, e.Key, value, e.Seq); decision {
+	case utils.CompactionRemove:
+		return &utils.Entry{Key: e.Key, Seq: e.Seq, Meta: utils.BitDelete}
+	case utils.CompactionChangeValue:
+		return &utils.Entry{Key: e.Key, Value: newValue, Seq: e.Seq, ExpiresAt: e.ExpiresAt, Meta: e.Meta}
+	}
+	return e
+}
+
 // rotate append MemTable to immutable, and create a new MemTable
-func (lsm *LSM) rotate() {
+func (lsm *LSM) rotate() error {
 	lsm.lock.Lock()
 	defer lsm.lock.Unlock()
 
 	for true {
-		if lsm.memTable.Size() <= lsm.option.MemTableSize {
+		if lsm.closed {
+			return errs.ErrDBClosed
+		} else if lsm.bgErr != nil {
+			return lsm.bgErr
+		} else if !lsm.memTableFull() {
 			break
 		} else if len(lsm.immutables) != 0 {
+			lsm.maybeScheduleCompaction()
 			lsm.cond.Wait()
 		} else {
+			if lsm.option.WALSyncMode == utils.WALSyncInterval {
+				// the wal won't be synced by background any more
+				if err := lsm.memTable.wal.Sync(); err != nil {
+					return err
+				}
+			}
+			wal, err := lsm.openWal()
+			if err != nil {
+				return err
+			}
 			lsm.immutables = append(lsm.immutables, lsm.memTable)
-			wal := lsm.openWal()
-			lsm.memTable = NewMemTable(lsm.option.Comparable, wal)
+			lsm.memTable = lsm.newMemTable(wal)
 			lsm.maybeScheduleCompaction()
 		}
 	}
-
+	return nil
 }
 
-func (lsm *LSM) recovery() (*MemTable, []*MemTable) {
+func (lsm *LSM) recovery() (*MemTable, []*MemTable, error) {
 	files, err := ioutil.ReadDir(lsm.option.WorkDir)
 	if err != nil {
-		errs.Panic(err)
-		return nil, nil
+		return nil, nil, err
 	}
 	var fids []uint64
 	maxFID := lsm.verSet.NextFileNumber
@@ -212,12 +742,20 @@ func (lsm *LSM) recovery() (*MemTable, []*MemTable) {
 		}
 		sz := len(file.Name())
 		fid, err := strconv.ParseUint(file.Name()[:sz-len(walFileExt)], 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
 		if maxFID < fid {
 			maxFID = fid
 		}
-		if err != nil {
-			errs.Panic(err)
-			return nil, nil
+		if fid < lsm.verSet.LogNumber() {
+			// the wal has been flushed to sst file, but it's not removed
+			// before crash. the vlog file is kept since it's referenced by
+			// the sst file
+			if err := os.Remove(mtFilePath(lsm.option.WorkDir, fid)); err != nil {
+				return nil, nil, err
+			}
+			continue
 		}
 		fids = append(fids, fid)
 	}
@@ -228,8 +766,14 @@ func (lsm *LSM) recovery() (*MemTable, []*MemTable) {
 	imms := []*MemTable{}
 	for _, fid := range fids {
 		mt, err := lsm.openMemTable(fid)
-		errs.CondPanic(err != nil, err)
-		if mt.table.Size() == 0 {
+		if err != nil {
+			return nil, nil, err
+		}
+		if mt.Empty() {
+			// nothing to recover, remove the wal
+			if err := mt.close(); err != nil {
+				return nil, nil, err
+			}
 			continue
 		}
 		imms = append(imms, mt)
@@ -239,14 +783,20 @@ func (lsm *LSM) recovery() (*MemTable, []*MemTable) {
 		lsm.verSet.NextFileNumber = maxFID
 	}
 	for _, imm := range imms {
-		lsm.WriteLevel0Table(imm)
+		if err := lsm.WriteLevel0Table(imm); err != nil {
+			return nil, nil, err
+		}
+		imm.DecrRef()
 	}
 	lsm.immutables = lsm.immutables[:0]
-	wal := lsm.openWal()
-	return NewMemTable(lsm.option.Comparable, wal), imms[:0]
+	wal, err := lsm.openWal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return lsm.newMemTable(wal), imms[:0], nil
 }
 
-func (lsm *LSM) openWal() *WalFile {
+func (lsm *LSM) openWal() (*WalFile, error) {
 	newFid := lsm.IncreaseFid(1)
 	fileOpt := &file.Options{
 		FID:      newFid,
@@ -258,14 +808,13 @@ func (lsm *LSM) openWal() *WalFile {
 	return OpenWalFile(fileOpt)
 }
 
-func (lsm *LSM) openVLog(fid uint64, delete bool) *vlog.VLogFile {
+func (lsm *LSM) openVLog(fid uint64, delete bool) (*vlog.VLogFile, error) {
 
 	fileOpt := &file.Options{
 		FID:      fid,
 		FileName: mtvFilePath(lsm.option.WorkDir, fid),
 		Dir:      lsm.option.WorkDir,
 		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(lsm.option.MemTableSize),
 	}
 	return vlog.OpenVLogFile(fileOpt)
 }
@@ -278,17 +827,18 @@ func (lsm *LSM) openMemTable(fid uint64) (*MemTable, error) {
 		FID:      fid,
 		FileName: mtFilePath(lsm.option.WorkDir, fid),
 	}
-	//mt := lsm.NewMemTable()
-	arena := utils.NewArena()
-	mt := &MemTable{
-		table: utils.NewSkipListWithComparator(arena, lsm.option.Comparable),
-	}
-	mt.wal = OpenWalFile(fileOpt)
-	//oldSeq := lsm.seq
-	seq, _ := mt.wal.Iterate(mt.recoveryMemTable(lsm.option))
-	//atomic.CompareAndSwapUint64(&lsm.seq, oldSeq, seq)
-	//atomic.AddUint64(&lsm.seq, seq - lsm.seq)
-	lsm.seq = seq
+	wal, err := OpenWalFile(fileOpt)
+	if err != nil {
+		return nil, err
+	}
+	mt := lsm.newMemTable(wal)
+	seq, err := mt.wal.Iterate(mt.recoveryMemTable(lsm.option))
+	if err != nil {
+		return nil, err
+	}
+	if seq > lsm.seq {
+		lsm.seq = seq
+	}
 	return mt, nil
 }
 
@@ -297,15 +847,18 @@ func Compare(a, b []byte) int {
 }
 
 func (lsm *LSM) maybeScheduleCompaction() {
-	if lsm.bgCompactionScheduled {
+	// the failed flush isn't retried until the db is reopened
+	if lsm.bgCompactionScheduled || lsm.bgErr != nil {
 		return
 	}
 	lsm.bgCompactionScheduled = true
+	lsm.closer.Add(1)
 	go lsm.backgroundCall()
 
 }
 
 func (lsm *LSM) backgroundCall() {
+	defer lsm.closer.Done()
 	lsm.lock.Lock()
 	defer lsm.lock.Unlock()
 	lsm.backgroundCompaction()
@@ -316,13 +869,26 @@ func (lsm *LSM) backgroundCall() {
 func (lsm *LSM) backgroundCompaction() {
 	imms := lsm.immutables
 	lsm.lock.Unlock()
+	var n int
+	var err error
 	for _, imm := range imms {
-		lsm.WriteLevel0Table(imm)
-		imm.DecrRef()
+		if err = lsm.WriteLevel0Table(imm); err != nil {
+			// keep the immutable and its wal, it will be flushed again on close
+			log.Printf("write level0 table %d failed: %v\n", imm.wal.Fid(), err)
+			break
+		}
+		n++
 	}
-	lsm.immutables = lsm.immutables[:0]
 
 	lsm.lock.Lock()
+	if err != nil && lsm.bgErr == nil {
+		lsm.bgErr = err
+	}
+	lsm.immutables = lsm.immutables[n:]
+	// release the immutables after they are invisible to readers
+	for _, imm := range imms[:n] {
+		imm.DecrRef()
+	}
 }
 
 func (lsm *LSM) compactMem() {
@@ -3,11 +3,15 @@ package lsm
 import (
 	"ckv/utils"
 	"ckv/utils/cmp"
+	"ckv/utils/errs"
+	"ckv/version"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -24,7 +28,9 @@ var (
 
 func TestLSM_Set(t *testing.T) {
 	clearDir()
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 
 	e := &utils.Entry{
 		Key:       []byte("TBS😁数据库🐧🐧🐧🐂🍃🐎🏀🍎"),
@@ -49,7 +55,9 @@ func TestLSM_CRUD(t *testing.T) {
 	clearDir()
 	comparable := cmp.ByteComparator{}
 	opt.Comparable = comparable
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 
 	n := 1000
 
@@ -86,7 +94,9 @@ func TestLSM_CRUD_DUP(t *testing.T) {
 	clearDir()
 	comparable := cmp.ByteComparator{}
 	opt.Comparable = comparable
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 
 	n := 1000
 
@@ -125,7 +135,9 @@ func TestLSM_C(t *testing.T) {
 	clearDir()
 	comparable := cmp.IntComparator{}
 	opt.Comparable = comparable
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 	var wg sync.WaitGroup
 	wg.Add(5)
 
@@ -161,7 +173,9 @@ func TestLSM_C(t *testing.T) {
 
 func TestWAL(t *testing.T) {
 	clearDir()
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 
 	for i := 0; i < 5000; i++ {
 		e := &utils.Entry{
@@ -187,7 +201,9 @@ func TestWAL(t *testing.T) {
 func TestLWAL_Read(t *testing.T) {
 	clearDir()
 	TestWAL(t)
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 	ee := &utils.Entry{
 		Key:   []byte(fmt.Sprintf("%d", 1111)),
 		Value: []byte(fmt.Sprintf("%d", 1111)),
@@ -214,11 +230,294 @@ func TestLWAL_Read(t *testing.T) {
 	assert.Equal(t, ee.Value, v.Value)
 }
 
+func TestLSM_Recovery(t *testing.T) {
+	clearDir()
+	defer clearDir()
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))))
+	}
+	seq, next := lsm.seq, lsm.verSet.NextFileNumber
+	assert.Nil(t, lsm.Close())
+
+	// a wal that has been flushed but not removed before crash
+	wal, err := OpenWalFile(initOpt())
+	assert.Nil(t, err)
+	b := NewWriteBatch()
+	b.Put([]byte("stale"), []byte("stale"))
+	b.setSeq(1)
+	assert.Nil(t, wal.WriteBatch(b))
+	// close without removing it
+	assert.Nil(t, wal.f.Close())
+
+	lsm, err = NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
+	assert.Equal(t, seq, lsm.seq)
+	assert.GreaterOrEqual(t, lsm.verSet.NextFileNumber, next)
+	assert.Less(t, uint64(1), lsm.verSet.LogNumber())
+	_, err = os.Stat(mtFilePath(opt.WorkDir, 1))
+	assert.True(t, os.IsNotExist(err))
+	_, err = lsm.Get([]byte("stale"))
+	assert.NotNil(t, err)
+
+	e := utils.NewEntry([]byte("0"), []byte("new"))
+	assert.Nil(t, lsm.Set(e))
+	assert.Equal(t, seq+1, e.Seq)
+	v, err := lsm.Get([]byte("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), v.Value)
+}
+
+func TestLSM_CompactScheduler(t *testing.T) {
+	clearDir()
+	defer clearDir()
+	o := *opt
+	o.Comparable = cmp.IntComparator{}
+	o.NumCompactors = 2
+	lsm, err := NewLSM(&o)
+	assert.Nil(t, err)
+	defer lsm.Close()
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		// interleave the keys so that the flushed tables overlap
+		k := i%2*n + i
+		assert.Nil(t, lsm.Set(utils.NewEntry([]byte(fmt.Sprintf("%064d", k)), []byte(fmt.Sprintf("%064d", i)))))
+	}
+	// compactions keep running until level 0 is below the trigger
+	deadline := time.Now().Add(10 * time.Second)
+	for lsm.verSet.NumLevelFiles(0) >= version.L0_CompactionTrigger && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Less(t, lsm.verSet.NumLevelFiles(0), version.L0_CompactionTrigger)
+	for i := 0; i < n; i++ {
+		k := i%2*n + i
+		v, err := lsm.Get([]byte(fmt.Sprintf("%064d", k)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%064d", i)), v.Value)
+	}
+}
+
+func TestLSM_CompactionSplit(t *testing.T) {
+	clearDir()
+	defer clearDir()
+	o := *opt
+	o.Comparable = cmp.IntComparator{}
+	o.MaxTableSize = 1 << 14
+	lsm, err := NewLSM(&o)
+	assert.Nil(t, err)
+
+	n := 20000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%064d", i%2*n+i)) }
+	for round := 0; round < 2; round++ {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, lsm.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("%064d", i+round)))))
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for lsm.verSet.NumLevelFiles(0) >= version.L0_CompactionTrigger && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, lsm.Close())
+
+	lsm, err = NewLSM(&o)
+	assert.Nil(t, err)
+	defer lsm.Close()
+	// the outputs are cut by size and don't overlap in the level
+	var split bool
+	for level := 1; level < o.MaxLevelNum; level++ {
+		ranges := lsm.verSet.LevelKeyRanges(level)
+		split = split || len(ranges) > 1
+		for i := 1; i < len(ranges); i++ {
+			assert.Less(t, o.Comparable.Compare(ranges[i-1][1], ranges[i][0]), 0)
+		}
+	}
+	assert.True(t, split)
+	for i := 0; i < n; i++ {
+		v, err := lsm.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%064d", i+1)), v.Value)
+	}
+}
+
+func TestLSM_SeekCompaction(t *testing.T) {
+	clearDir()
+	defer clearDir()
+	o := *opt
+	o.Comparable = cmp.IntComparator{}
+	lsm, err := NewLSM(&o)
+	assert.Nil(t, err)
+	defer lsm.Close()
+
+	// each round covers the whole key range, so the flushed tables overlap
+	rounds, n := 4, 100
+	key := func(round, i int) []byte { return []byte(fmt.Sprintf("%064d", i*rounds+round)) }
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, lsm.Set(utils.NewEntry(key(round, i), key(round, i))))
+		}
+	}
+	immutables := func() int {
+		lsm.lock.RLock()
+		defer lsm.lock.RUnlock()
+		return len(lsm.immutables)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for immutables() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Greater(t, lsm.verSet.NumLevelFiles(0), 0)
+	assert.Less(t, lsm.verSet.NumLevelFiles(0), version.L0_CompactionTrigger)
+
+	// the reads of the oldest round probe the newer tables first
+	for j := 0; j < 10; j++ {
+		for i := 0; i < n; i++ {
+			v, err := lsm.Get(key(0, i))
+			assert.Nil(t, err)
+			assert.Equal(t, key(0, i), v.Value)
+		}
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for lsm.verSet.NumLevelFiles(0) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, lsm.verSet.NumLevelFiles(0))
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < n; i++ {
+			v, err := lsm.Get(key(round, i))
+			assert.Nil(t, err)
+			assert.Equal(t, key(round, i), v.Value)
+		}
+	}
+}
+
+// modFilter remove the keys whose number % 10 == 0, and change the value of
+// the keys whose number % 10 == 1
+type modFilter struct{}
+
+func (modFilter) Filter(level int, key []byte, value func() ([]byte, error), seq uint64) (utils.CompactionDecision, []byte) {
+	i, _ := strconv.Atoi(string(key))
+	switch i % 10 {
+	case 0:
+		return utils.CompactionRemove, nil
+	case 1:
+		return utils.CompactionChangeValue, []byte("changed")
+	}
+	return utils.CompactionKeep, nil
+}
+
+func TestLSM_CompactionFilter(t *testing.T) {
+	clearDir()
+	defer clearDir()
+	o := *opt
+	o.Comparable = cmp.IntComparator{}
+	o.CompactionFilter = modFilter{}
+	lsm, err := NewLSM(&o)
+	assert.Nil(t, err)
+	defer lsm.Close()
+
+	n := 20000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%064d", i%2*n+i)) }
+	for i := 0; i < n; i++ {
+		assert.Nil(t, lsm.Set(utils.NewEntry(key(i), key(i))))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for lsm.verSet.NumLevelFiles(0) >= version.L0_CompactionTrigger && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the keys that are not compacted yet are not filtered
+	var removed, changed int
+	for i := 0; i < n; i++ {
+		k := i%2*n + i
+		v, err := lsm.Get(key(i))
+		switch {
+		case k%10 == 0 && err == errs.ErrKeyNotFound:
+			removed++
+		case k%10 == 1 && err == nil && string(v.Value) == "changed":
+			changed++
+		default:
+			assert.Nil(t, err)
+			assert.Equal(t, key(i), v.Value)
+		}
+	}
+	assert.Greater(t, removed, n/20)
+	assert.Greater(t, changed, n/20)
+}
+
+// sumMerge add the operands, which are decimal numbers, to the value
+type sumMerge struct{}
+
+func (sumMerge) Name() string {
+	return "sum"
+}
+
+func (sumMerge) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	sum, _ := strconv.Atoi(string(existing))
+	for _, op := range operands {
+		n, err := strconv.Atoi(string(op))
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+func (m sumMerge) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	v, err := m.FullMerge(key, left, [][]byte{right})
+	return v, err == nil
+}
+
+func TestLSM_MergeCompaction(t *testing.T) {
+	clearDir()
+	defer clearDir()
+	o := *opt
+	o.Comparable = cmp.IntComparator{}
+	o.MergeOperator = sumMerge{}
+	lsm, err := NewLSM(&o)
+	assert.Nil(t, err)
+	defer lsm.Close()
+
+	n, rounds := 100, 100
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%064d", i)) }
+	for r := 0; r < rounds; r++ {
+		for i := 0; i < n; i++ {
+			assert.Nil(t, lsm.Merge(key(i), []byte(strconv.Itoa(i))))
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for lsm.verSet.NumLevelFiles(0) >= version.L0_CompactionTrigger && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < n; i++ {
+		v, err := lsm.Get(key(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(strconv.Itoa(i*rounds)), v.Value)
+	}
+
+	// the operands in compacted tables are combined
+	iters, _, err := lsm.verSet.NewIterators(0, true)
+	assert.Nil(t, err)
+	var count int
+	for _, iter := range iters {
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			count++
+		}
+		assert.Nil(t, iter.Close())
+	}
+	assert.Greater(t, count, 0)
+	assert.Less(t, count, n*rounds/2)
+}
+
 func TestCompactiont(t *testing.T) {
 	clearDir()
 	comparable := cmp.IntComparator{}
 	opt.Comparable = comparable
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	defer lsm.Close()
 	//go lsm.verSet.RunCompact()
 
 	for i := 0; i < 10000; i++ {
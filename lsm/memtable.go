@@ -8,11 +8,16 @@ import (
 	"ckv/utils/errs"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"sync"
 	"sync/atomic"
 )
 
 type Table = utils.SkipList
 
+// maxSeq is the max seq that can be stored in the tag of internal key
+const maxSeq = 1<<56 - 1
+
 type InternalComparator struct {
 	userComparator cmp.Comparator
 }
@@ -59,10 +64,18 @@ func getSeq(data []byte) uint64 {
 type MemTable struct {
 	table      *Table
 	comparator cmp.Comparator
-	wal        *WalFile
-	vlogCount  int32
-	ref        int32
-	state      int32
+	// range tombstones are not stored in skip list, because they would
+	// be checked by each Get
+	rangeDels []*utils.RangeTombstone
+	lock      sync.RWMutex
+	wal       *WalFile
+	vlogCount int32
+	ref       int32
+	state     int32
+	// the memtables of the other column families, they share the wal of
+	// this one and are flushed together with it
+	families map[uint32]*MemTable
+	cf       *ColumnFamily // the column family of a child memtable
 }
 
 // NewMemtable _
@@ -92,26 +105,70 @@ func NewMemTable(comparator cmp.Comparator, wal *WalFile) *MemTable {
 }
 
 func (mem *MemTable) Set(entry *utils.Entry) error {
+	batch := NewWriteBatch()
+	batch.put(entry)
+	batch.setSeq(entry.Seq)
+	return mem.Write(batch, false)
+}
 
+// Write write the batch to wal as one record, then apply all records of the
+// batch to the memtable. The wal is flushed to disk first if sync is true
+func (mem *MemTable) Write(batch *WriteBatch, sync bool) error {
 	// write wal first
 	if mem.wal != nil {
-		if err := mem.wal.Write(entry); err != nil {
+		if err := mem.wal.WriteBatch(batch); err != nil {
 			return err
 		}
+		if sync {
+			if err := mem.wal.Sync(); err != nil {
+				return err
+			}
+		}
 	}
-	mem.set(entry)
-
-	return nil
+	return batch.Iterate(mem.set)
 }
 
-//  ------------------------    ---------------------
-// |  `key_size` | key | tag |   | value_size | value |
-//  -----------------------    ---------------------
+// set add the entry to the memtable of its column family. The entries of
+// dropped column families are ignored
 func (mem *MemTable) set(entry *utils.Entry) error {
+	m := mem.family(entry.ColumnFamily)
+	if m == nil {
+		return nil
+	}
+	return m.add(entry)
+}
+
+//  ------------------------    ---------------------------------------------
+// |  `key_size` | key | tag |   | value_size | meta | expires_at | value |
+//  -----------------------    ---------------------------------------------
+func (mem *MemTable) add(entry *utils.Entry) error {
+	if entry.IsRangeDeleted() {
+		mem.lock.Lock()
+		mem.rangeDels = append(mem.rangeDels, &utils.RangeTombstone{
+			Start: append([]byte{}, entry.Key...),
+			End:   append([]byte{}, entry.Value...),
+			Seq:   entry.Seq,
+		})
+		mem.lock.Unlock()
+		return nil
+	}
 
-	mem.table.Add(buildInternalKey(entry.Key, entry.Seq), entry.Value)
+	return mem.table.Add(buildInternalKey(entry.Key, entry.Seq, entry.ValueType()), encodeValue(entry))
+}
 
-	return nil
+// encodeValue encode the value of entry with its expiration time
+func encodeValue(entry *utils.Entry) []byte {
+	vs := &utils.ValueStruct{Meta: entry.Meta, Value: entry.Value, ExpiresAt: entry.ExpiresAt}
+	buf := make([]byte, vs.EncodedSize())
+	vs.EncodeValue(buf)
+	return buf
+}
+
+// decodeValue decode the value encoded by encodeValue
+func decodeValue(buf []byte) *utils.ValueStruct {
+	vs := &utils.ValueStruct{}
+	vs.DecodeValue(buf)
+	return vs
 }
 
 // buildInterKey build internal key
@@ -121,7 +178,7 @@ func (mem *MemTable) set(entry *utils.Entry) error {
 // |  key_size | key | tag |
 //
 //	---------------------------
-func buildInternalKey(key []byte, seq uint64) []byte {
+func buildInternalKey(key []byte, seq uint64, typ byte) []byte {
 
 	key_size := len(key)
 	// val_size := len(entry.Value)
@@ -135,43 +192,129 @@ func buildInternalKey(key []byte, seq uint64) []byte {
 	copy(buf[off:], key)
 	off += len(key)
 
-	copy(buf[off:], convert.U64ToBytes(seq<<8|0x1))
+	copy(buf[off:], convert.U64ToBytes(seq<<8|uint64(typ)))
 	off += 8
 	return buf
 }
 
+// Get return the newest version of key whose seq <= seq. A deleted entry is
+// returned if the key is deleted by a tombstone in the memtable
 func (mem *MemTable) Get(key []byte, seq uint64) (*utils.Entry, error) {
 
-	buf := buildInternalKey(key, seq)
+	buf := buildInternalKey(key, seq, utils.TypeValue)
 	it := mem.table.NewIterator()
 	defer it.Close()
 	it.Seek(buf)
 
-	if it.Valid() && len(it.Key()) > 8 {
-		if mem.comparator.Compare(parseKey(buf), parseKey(it.Key())) != 0 {
-			//if mem.comparator.Compare(buf, it.Key()) != 0 {
-			return nil, errs.ErrKeyNotFound
-		}
+	mem.lock.RLock()
+	tombSeq := utils.MaxCoveringSeq(mem.rangeDels, mem.comparator, key, seq)
+	mem.lock.RUnlock()
+
+	if it.Valid() && len(it.Key()) > 8 &&
+		mem.comparator.Compare(parseKey(buf), parseKey(it.Key())) == 0 &&
+		(tombSeq == 0 || parseSeq(it.Key()) > tombSeq) {
+		vs := decodeValue(it.Value())
 		v := &utils.Entry{
-			Key:   parseKey(it.Key()),
-			Value: it.Value(),
-			Seq:   parseSeq(it.Key()),
+			Key:       parseKey(it.Key()),
+			Value:     vs.Value,
+			Seq:       parseSeq(it.Key()),
+			Meta:      utils.MetaOfType(parseType(it.Key())),
+			ExpiresAt: vs.ExpiresAt,
+		}
+		if v.IsDeleted() {
+			v.Value = nil
 		}
 
 		return v, nil
 	}
+	if tombSeq > 0 {
+		// deleted by range tombstone
+		return &utils.Entry{Key: key, Seq: tombSeq, Meta: utils.BitDelete}, nil
+	}
 	return nil, errs.ErrKeyNotFound
 }
 
+// RangeDels return range tombstones in the memtable
+func (mem *MemTable) RangeDels() []*utils.RangeTombstone {
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
+	return mem.rangeDels
+}
+
 func (m *MemTable) Size() int64 {
 	return m.table.Size()
 }
 
+// Empty return whether there is no entry in the memtable of any column family
+func (m *MemTable) Empty() bool {
+	if !m.familyEmpty() {
+		return false
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, child := range m.families {
+		if !child.familyEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+// familyEmpty return whether there is no entry in the memtable, the memtables
+// of other column families are not checked
+func (m *MemTable) familyEmpty() bool {
+	return m.table.Empty() && len(m.RangeDels()) == 0
+}
+
+// addFamily add the memtable of column family cf
+func (m *MemTable) addFamily(cf *ColumnFamily) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.families == nil {
+		m.families = make(map[uint32]*MemTable)
+	}
+	if _, ok := m.families[cf.id]; !ok {
+		child := NewMemTable(cf.opt.Comparable, nil)
+		child.cf = cf
+		m.families[cf.id] = child
+	}
+}
+
+// children return the memtables of the other column families ordered by id
+func (m *MemTable) children() []*MemTable {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	children := make([]*MemTable, 0, len(m.families))
+	for _, child := range m.families {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].cf.id < children[j].cf.id
+	})
+	return children
+}
+
+// family return the memtable of column family id, nil is returned if the
+// column family doesn't exist when the memtable is created
+func (m *MemTable) family(id uint32) *MemTable {
+	if id == 0 {
+		return m
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.families[id]
+}
+
 // Close
 func (m *MemTable) close() error {
 	// close wal first
-	if err := m.wal.Close(); err != nil {
-		return err
+	if m.wal != nil {
+		if err := m.wal.Close(); err != nil {
+			return err
+		}
+	}
+	for _, child := range m.families {
+		child.DecrRef()
 	}
 	m.table.Close()
 	m.table = nil
@@ -191,8 +334,8 @@ func (m *MemTable) recoveryMemTable(opt *utils.Options) func(*utils.Entry) error
 		//  ------------------------    ---------------------
 		// |  key_size | key | tag |   | value_size | value |
 		//  -----------------------    ---------------------
-		return m.table.Add(buildInternalKey(e.Key, e.Seq), e.Value)
-		//return m.set(e)
+		//return m.table.Add(buildInternalKey(e.Key, e.Seq), e.Value)
+		return m.set(e)
 	}
 }
 
@@ -235,8 +378,12 @@ func (m MemTableIterator) Item() utils.Item {
 	item := m.list.Item()
 	entry := item.Entry()
 
+	vs := decodeValue(entry.Value)
 	entry.Seq = parseSeq(entry.Key)
+	entry.Meta = utils.MetaOfType(parseType(entry.Key))
 	entry.Key = parseKey(entry.Key)
+	entry.Value = vs.Value
+	entry.ExpiresAt = vs.ExpiresAt
 	return entry
 }
 
@@ -246,8 +393,22 @@ func (m MemTableIterator) Close() error {
 	return nil
 }
 
+// Seek move to the newest version of the first key >= key
 func (m MemTableIterator) Seek(key []byte) {
-	m.list.Seek(key)
+	m.list.Seek(buildInternalKey(key, maxSeq, utils.TypeValue))
+}
+
+// SeekForPrev move to the oldest version of the last key <= key
+func (m MemTableIterator) SeekForPrev(key []byte) {
+	m.list.SeekForPrev(buildInternalKey(key, 0, utils.TypeDeletion))
+}
+
+func (m MemTableIterator) Prev() {
+	m.list.Prev()
+}
+
+func (m MemTableIterator) Last() {
+	m.list.Last()
 }
 
 func parseKey(internalKey []byte) []byte {
@@ -274,3 +435,10 @@ func parseSeq(internalKey []byte) uint64 {
 	}
 	return convert.BytesToU64(internalKey[len(internalKey)-8:]) >> 8
 }
+
+func parseType(internalKey []byte) byte {
+	if len(internalKey) < 8 {
+		return utils.TypeValue
+	}
+	return internalKey[len(internalKey)-1]
+}
@@ -124,6 +124,45 @@ func TestMemTableUpdate(t *testing.T) {
 	}
 }
 
+func TestMemTableDelete(t *testing.T) {
+	mem := createMemTable()
+
+	mem.Set(&utils.Entry{Key: []byte("a"), Value: []byte("1"), Seq: 1})
+	mem.Set(&utils.Entry{Key: []byte("b"), Value: []byte("2"), Seq: 2})
+	mem.Set(&utils.Entry{Key: []byte("c"), Value: []byte("3"), Seq: 3})
+	mem.Set(&utils.Entry{Key: []byte("a"), Seq: 4, Meta: utils.BitDelete})
+	mem.Set(&utils.Entry{Key: []byte("b"), Value: []byte("d"), Seq: 5, Meta: utils.BitRangeDelete})
+
+	// point tombstone
+	v, err := mem.Get([]byte("a"), 4)
+	assert.Nil(t, err)
+	assert.True(t, v.IsDeleted())
+	v, err = mem.Get([]byte("a"), 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v.Value)
+
+	// range tombstone
+	v, err = mem.Get([]byte("c"), 5)
+	assert.Nil(t, err)
+	assert.True(t, v.IsDeleted())
+	v, err = mem.Get([]byte("c"), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3"), v.Value)
+
+	// the key is not in memtable, but deleted by range tombstone
+	v, err = mem.Get([]byte("bb"), 5)
+	assert.Nil(t, err)
+	assert.True(t, v.IsDeleted())
+	_, err = mem.Get([]byte("d"), 5)
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// newer value is visible
+	mem.Set(&utils.Entry{Key: []byte("c"), Value: []byte("33"), Seq: 6})
+	v, err = mem.Get([]byte("c"), 6)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("33"), v.Value)
+}
+
 func TestMemTableUpdateDup(t *testing.T) {
 	mem := createMemTable()
 
@@ -283,7 +322,8 @@ func TestVLogIter(t *testing.T) {
 		FileName: mtvFilePath("../work_test", 15),
 	}
 
-	vlog := vlog.OpenVLogFile(opt)
+	vlog, err := vlog.OpenVLogFile(opt)
+	assert.Nil(t, err)
 	vlog.Iterate(func(e *utils.Entry) error {
 		fmt.Println(string(e.Key), string(e.Value))
 		return nil
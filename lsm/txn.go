@@ -0,0 +1,344 @@
+package lsm
+
+import (
+	"ckv/utils"
+	"ckv/utils/errs"
+	"sort"
+)
+
+// Txn is an optimistic transaction on the default column family. It reads
+// from the snapshot taken when it begins, and buffers the writes until
+// Commit, the reads see the buffered writes. Commit fails with ErrConflict if
+// any key read or written by the transaction is written by others after the
+// snapshot. A Txn is not safe for concurrent use
+type Txn struct {
+	lsm      *LSM
+	snapshot *utils.Snapshot
+	batch    *WriteBatch
+	writes   map[string]*utils.Entry // the last write of each key
+	reads    map[string]struct{}
+	done     bool
+}
+
+// BeginTxn begin a transaction, it must be committed or discarded
+func (lsm *LSM) BeginTxn() *Txn {
+	return &Txn{
+		lsm:      lsm,
+		snapshot: lsm.GetSnapshot(),
+		batch:    NewWriteBatch(),
+		writes:   make(map[string]*utils.Entry),
+		reads:    make(map[string]struct{}),
+	}
+}
+
+// Get return the value of key written by the transaction, or the value in
+// the snapshot. The key is checked for conflict at commit in the latter case
+func (txn *Txn) Get(key []byte) (*utils.Entry, error) {
+	if txn.done {
+		return nil, errs.ErrTxnDone
+	}
+	if len(key) == 0 {
+		return nil, errs.ErrEmptyKey
+	}
+	if e, ok := txn.writes[string(key)]; ok {
+		if e.IsDeleted() || e.IsExpired() {
+			return nil, errs.ErrKeyNotFound
+		}
+		return &utils.Entry{Key: e.Key, Value: e.Value, ExpiresAt: e.ExpiresAt}, nil
+	}
+	txn.reads[string(key)] = struct{}{}
+	return txn.lsm.GetWithOptions(key, &utils.ReadOptions{Snapshot: txn.snapshot})
+}
+
+// Set set key to the value of entry when the transaction is committed
+func (txn *Txn) Set(entry *utils.Entry) error {
+	if entry == nil || len(entry.Key) == 0 {
+		return errs.ErrEmptyKey
+	}
+	return txn.add(&utils.Entry{
+		Key:       append([]byte{}, entry.Key...),
+		Value:     append([]byte{}, entry.Value...),
+		ExpiresAt: entry.ExpiresAt,
+	})
+}
+
+// Delete delete key when the transaction is committed
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errs.ErrEmptyKey
+	}
+	return txn.add(&utils.Entry{Key: append([]byte{}, key...), Meta: utils.BitDelete})
+}
+
+func (txn *Txn) add(e *utils.Entry) error {
+	if txn.done {
+		return errs.ErrTxnDone
+	}
+	txn.batch.put(e)
+	txn.writes[string(e.Key)] = e
+	return nil
+}
+
+// Commit write the buffered writes atomically. ErrConflict is returned and
+// nothing is written if any key read or written by the transaction has a
+// version newer than the snapshot. The transaction is discarded anyway
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return errs.ErrTxnDone
+	}
+	defer txn.Discard()
+	// the reads of a read-only transaction are consistent in the snapshot
+	if txn.batch.Count() == 0 {
+		return nil
+	}
+	return txn.lsm.write(txn.batch, nil, txn.checkConflicts)
+}
+
+// checkConflicts return ErrConflict if any key read or written has been
+// written after the snapshot
+func (txn *Txn) checkConflicts() error {
+	check := func(key string) error {
+		seq, err := txn.lsm.latestSeq([]byte(key))
+		if err != nil {
+			return err
+		}
+		if seq > txn.snapshot.Seq() {
+			return errs.ErrConflict
+		}
+		return nil
+	}
+	for key := range txn.reads {
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	for key := range txn.writes {
+		if _, ok := txn.reads[key]; ok {
+			continue
+		}
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard drop the buffered writes and release the snapshot. It's a no-op
+// if the transaction is done
+func (txn *Txn) Discard() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.lsm.ReleaseSnapshot(txn.snapshot)
+}
+
+// NewIterator return an iterator over the snapshot and the writes of the
+// transaction, opt.Snapshot is ignored. The writes after the iterator is
+// created are not seen by it. The keys read from the snapshot are checked for
+// conflict at commit
+func (txn *Txn) NewIterator(opt *utils.ReadOptions) utils.Iterator {
+	if txn.done {
+		return NewErrorIterator(errs.ErrTxnDone)
+	}
+	readOpt := utils.NewReadOptions()
+	readOpt.Snapshot = txn.snapshot
+	if opt != nil {
+		readOpt.LowerBound, readOpt.UpperBound = opt.LowerBound, opt.UpperBound
+		readOpt.FillCache = opt.FillCache
+	}
+	iter := txn.lsm.NewIterator(readOpt)
+	cmp := txn.lsm.option.Comparable
+	writes := make([]*utils.Entry, 0, len(txn.writes))
+	for _, e := range txn.writes {
+		if readOpt.LowerBound != nil && cmp.Compare(e.Key, readOpt.LowerBound) < 0 {
+			continue
+		}
+		if readOpt.UpperBound != nil && cmp.Compare(e.Key, readOpt.UpperBound) >= 0 {
+			continue
+		}
+		writes = append(writes, e)
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return cmp.Compare(writes[i].Key, writes[j].Key) < 0
+	})
+	return &txnIterator{txn: txn, iter: iter, writes: writes}
+}
+
+// txnIterator merge the writes of the transaction into the iterator of the
+// snapshot, a write hides the key in the snapshot. In forward direction, both
+// of them are positioned after the current key, and before it in reverse
+// direction
+type txnIterator struct {
+	txn    *Txn
+	iter   *DBIterator
+	writes []*utils.Entry // sorted by key
+	idx    int
+
+	dir   int
+	valid bool
+	entry *utils.Entry
+}
+
+func (iter *txnIterator) Valid() bool {
+	return iter.valid
+}
+
+func (iter *txnIterator) Item() utils.Item {
+	return iter.entry
+}
+
+func (iter *txnIterator) Close() error {
+	return iter.iter.Close()
+}
+
+func (iter *txnIterator) Rewind() {
+	iter.iter.Rewind()
+	iter.idx = 0
+	iter.findNext()
+}
+
+func (iter *txnIterator) Last() {
+	iter.iter.Last()
+	iter.idx = len(iter.writes) - 1
+	iter.findPrev()
+}
+
+// Seek move to the first key >= key
+func (iter *txnIterator) Seek(key []byte) {
+	iter.iter.Seek(key)
+	iter.idx = iter.search(key, false)
+	iter.findNext()
+}
+
+// SeekForPrev move to the last key <= key
+func (iter *txnIterator) SeekForPrev(key []byte) {
+	iter.iter.SeekForPrev(key)
+	iter.idx = iter.search(key, true) - 1
+	iter.findPrev()
+}
+
+func (iter *txnIterator) Next() {
+	if !iter.valid {
+		return
+	}
+	if iter.dir == reverse {
+		// move after the current key
+		key := iter.entry.Key
+		iter.iter.Seek(key)
+		if iter.iter.Valid() && iter.compare(iter.iter.Item().Entry().Key, key) == 0 {
+			iter.iter.Next()
+		}
+		iter.idx = iter.search(key, true)
+	}
+	iter.findNext()
+}
+
+func (iter *txnIterator) Prev() {
+	if !iter.valid {
+		return
+	}
+	if iter.dir == forward {
+		// move before the current key
+		key := iter.entry.Key
+		iter.iter.SeekForPrev(key)
+		if iter.iter.Valid() && iter.compare(iter.iter.Item().Entry().Key, key) == 0 {
+			iter.iter.Prev()
+		}
+		iter.idx = iter.search(key, false) - 1
+	}
+	iter.findPrev()
+}
+
+// search return the index of the first write whose key >= key, or > key if
+// after is true
+func (iter *txnIterator) search(key []byte, after bool) int {
+	return sort.Search(len(iter.writes), func(i int) bool {
+		c := iter.compare(iter.writes[i].Key, key)
+		return c > 0 || (c == 0 && !after)
+	})
+}
+
+func (iter *txnIterator) compare(a, b []byte) int {
+	return iter.txn.lsm.option.Comparable.Compare(a, b)
+}
+
+// findNext move forward to the smaller key of the snapshot and the writes
+func (iter *txnIterator) findNext() {
+	iter.dir = forward
+	for {
+		var write *utils.Entry
+		if iter.idx < len(iter.writes) {
+			write = iter.writes[iter.idx]
+		}
+		if !iter.iter.Valid() && write == nil {
+			iter.valid = false
+			return
+		}
+		c := -1
+		if !iter.iter.Valid() {
+			c = 1
+		} else if write != nil {
+			c = iter.compare(iter.iter.Item().Entry().Key, write.Key)
+		}
+		if c < 0 {
+			iter.setEntry(iter.iter.Item().Entry(), false)
+			iter.iter.Next()
+			return
+		}
+		iter.idx++
+		if c == 0 {
+			iter.iter.Next()
+		}
+		if iter.setEntry(write, true) {
+			return
+		}
+	}
+}
+
+// findPrev move backward to the larger key of the snapshot and the writes
+func (iter *txnIterator) findPrev() {
+	iter.dir = reverse
+	for {
+		var write *utils.Entry
+		if iter.idx >= 0 && iter.idx < len(iter.writes) {
+			write = iter.writes[iter.idx]
+		}
+		if !iter.iter.Valid() && write == nil {
+			iter.valid = false
+			return
+		}
+		c := 1
+		if !iter.iter.Valid() {
+			c = -1
+		} else if write != nil {
+			c = iter.compare(iter.iter.Item().Entry().Key, write.Key)
+		}
+		if c > 0 {
+			iter.setEntry(iter.iter.Item().Entry(), false)
+			iter.iter.Prev()
+			return
+		}
+		iter.idx--
+		if c == 0 {
+			iter.iter.Prev()
+		}
+		if iter.setEntry(write, true) {
+			return
+		}
+	}
+}
+
+// setEntry set the current entry, and return false if it's deleted by the
+// transaction. The key read from the snapshot is recorded for conflict check
+func (iter *txnIterator) setEntry(e *utils.Entry, written bool) bool {
+	if written && (e.IsDeleted() || e.IsExpired()) {
+		return false
+	}
+	if !written {
+		iter.txn.reads[string(e.Key)] = struct{}{}
+	}
+	iter.entry = &utils.Entry{Key: e.Key, Value: e.Value, ExpiresAt: e.ExpiresAt}
+	iter.valid = true
+	return true
+}
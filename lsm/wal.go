@@ -1,14 +1,12 @@
 package lsm
 
 import (
-	"bufio"
 	"bytes"
 	"ckv/file"
 	"ckv/utils"
 	"ckv/utils/codec"
 	"ckv/utils/convert"
 	"ckv/utils/errs"
-	"io"
 	"os"
 	"sync"
 )
@@ -17,118 +15,281 @@ const walFileExt string = ".wal"
 
 // Wal
 type WalFile struct {
-	f    *file.MmapFile
+	f    *file.AppendFile
 	lock *sync.RWMutex
 
-	opt     *file.Options
-	buf     *bytes.Buffer
-	writeAt uint32
-	size    uint32
+	opt *file.Options
 }
 
-type WalHeader struct {
-	checksum uint32
-	keyLen   uint16
-	ValueLen uint16
-	types    uint8
-}
-
-// OpenWalFile _
-func OpenWalFile(opt *file.Options) *WalFile {
-	omf, err := file.OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
+// OpenWalFile open the wal file, opt.MaxSz is the initial size of the file
+// and it grows as needed
+func OpenWalFile(opt *file.Options) (*WalFile, error) {
+	af, err := file.OpenAppendFile(&file.Options{
+		FileName: opt.FileName,
+		Flag:     os.O_CREATE | os.O_RDWR,
+		MaxSz:    opt.MaxSz,
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	wf := &WalFile{f: omf, lock: &sync.RWMutex{}, opt: opt}
-	wf.buf = &bytes.Buffer{}
-	wf.size = uint32(len(wf.f.Data))
-	errs.Err(err)
-	return wf
+	return &WalFile{f: af, lock: &sync.RWMutex{}, opt: opt}, nil
 }
 
-// Write
-// +---------------------------------------------------+
-// | checksum | key len | value len | type | key:value |
-// +---------------------------------------------------+
+// The wal is a sequence of 32KiB blocks, each block holds one or more
+// physical records. A logical record, the repr of a batch, is split into
+// fragments if it doesn't fit in the rest of the block
+//
+//	+-------------------------------------------+
+//	| checksum | length | type | data           |
+//	+-------------------------------------------+
+//	checksum := crc of type and data
+//
+// The rest of a block is filled with zeros if it's smaller than the header.
+// The file begins with walMagic and walVersion, wal files without them are
+// in the legacy format that each record is an entry, see iterateLegacy
+const (
+	walBlockSize = 32 << 10
+	// walRecordHeaderSize checksum(4) + length(2) + type(1)
+	walRecordHeaderSize = 7
+	// walVersionSize magic(6) + version(2)
+	walVersionSize = 8
+	walVersion     = 1
+	// walLegacyHeaderSize checksum(4) + key len(2) + value len(2) + type(1)
+	walLegacyHeaderSize = 9
+)
+
+var walMagic = []byte("ckvwal")
+
+// record types, zero is reserved for the preallocated space of mmap file
+const (
+	walZeroType = iota
+	walFullType
+	walFirstType
+	walMiddleType
+	walLastType
+)
+
+// Write write the entry as a batch with only one record
 func (wal *WalFile) Write(entry *utils.Entry) error {
+	batch := NewWriteBatch()
+	batch.put(entry)
+	batch.setSeq(entry.Seq)
+	return wal.WriteBatch(batch)
+}
+
+// WriteBatch write the whole batch as one logical record
+func (wal *WalFile) WriteBatch(batch *WriteBatch) error {
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
+	if wal.f.Size() == 0 {
+		if err := wal.writeVersion(); err != nil {
+			return err
+		}
+	}
+	return wal.addRecord(batch.Repr())
+}
 
-	h := WalHeader{}
-	h.keyLen = uint16(len(entry.Key))
-	h.ValueLen = uint16(len(entry.Value))
-	// checksum + key len + value len + type = 4 + 2 + 2 + 1 = 9
-	total := h.keyLen + h.ValueLen + 9 + 8
-
-	buf := make([]byte, total)
-	// write key len , write len and type
-	copy(buf[4:6], convert.U16ToBytes(h.keyLen))
-	copy(buf[6:8], convert.U16ToBytes(h.ValueLen))
-	buf[8] = 1
-	wal.buf.Bytes()
-	// write key value
-	copy(buf[9:9+len(entry.Key)], entry.Key)
-	pos := 9 + len(entry.Key)
-	copy(buf[pos:pos+8], convert.U64ToBytes(entry.Seq))
-	copy(buf[pos+8:], entry.Value) // write value
-	h.checksum = codec.CalculateU32Checksum(buf[4:])
-	copy(buf[:4], convert.U32ToBytes(h.checksum)) // write checksum
-
-	dst, err := wal.f.Bytes(int(wal.writeAt), int(total))
-	if err != nil {
-		return err
+// writeVersion write the magic and version at the beginning of the wal
+func (wal *WalFile) writeVersion() error {
+	buf := make([]byte, walVersionSize)
+	copy(buf, walMagic)
+	copy(buf[len(walMagic):], convert.U16ToBytes(walVersion))
+	_, err := wal.f.Append(buf)
+	return err
+}
+
+// addRecord split data into fragments and write them. All fragments are
+// written at once, so that a failed write leaves nothing in the wal
+func (wal *WalFile) addRecord(data []byte) error {
+	var buf []byte
+	off := wal.f.Size()
+	begin := true
+	for {
+		leftover := walBlockSize - off%walBlockSize
+		if leftover < walRecordHeaderSize {
+			// switch to a new block, the trailer is filled with zeros
+			buf = append(buf, make([]byte, leftover)...)
+			off += leftover
+			leftover = walBlockSize
+		}
+		n := leftover - walRecordHeaderSize
+		if n > len(data) {
+			n = len(data)
+		}
+		end := n == len(data)
+		var typ byte
+		switch {
+		case begin && end:
+			typ = walFullType
+		case begin:
+			typ = walFirstType
+		case end:
+			typ = walLastType
+		default:
+			typ = walMiddleType
+		}
+		buf = appendPhysicalRecord(buf, typ, data[:n])
+		off += walRecordHeaderSize + n
+		data = data[n:]
+		begin = false
+		if end {
+			break
+		}
 	}
-	copy(dst, buf)
-	wal.writeAt += uint32(total)
-	return nil
+
+	_, err := wal.f.Append(buf)
+	return err
+}
+
+func appendPhysicalRecord(buf []byte, typ byte, data []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walRecordHeaderSize)...)
+	buf = append(buf, data...)
+	record := buf[start:]
+	copy(record[4:6], convert.U16ToBytes(uint16(len(data))))
+	record[6] = typ
+	copy(record[:4], convert.U32ToBytes(codec.CalculateU32Checksum(record[6:])))
+	return buf
 }
 
+// Iterate call fn for each entry in the wal, and return the max seq. A batch
+// is replayed only if the whole record is intact, and the iteration stops at
+// the first torn or corrupted record. The error of fn is returned, and
+// ErrUnknownWALFormat is returned if the wal is in neither the current format
+// nor the legacy one
 func (wal *WalFile) Iterate(fn func(e *utils.Entry) error) (uint64, error) {
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
-	reader := bufio.NewReader(wal.f.NewReader(int(0)))
+	if bytes.HasPrefix(wal.f.Data, walMagic) && !wal.isVersioned() {
+		return 0, errs.ErrUnknownWALFormat
+	}
+	if !wal.isVersioned() {
+		return wal.iterateLegacy(fn)
+	}
 
-	//data := wal.f.Data
-	//data, err := io.ReadAll(reader)
-	//if err != nil {
-	//	errs.Panic(err)
-	//}
 	var maxSeq uint64
-	for {
-		buf := make([]byte, 9)
-		if _, err := io.ReadFull(reader, buf); err != nil {
+	for off := walVersionSize; ; {
+		rep, next, ok := wal.readRecord(off)
+		if !ok {
 			break
 		}
-		h := WalHeader{}
-		h.checksum = convert.BytesToU32(buf[0:4])
-		h.keyLen = convert.BytesToU16(buf[4:6])
-		h.ValueLen = convert.BytesToU16(buf[6:8])
-		h.types = buf[8]
-		b := make([]byte, h.keyLen+h.ValueLen+8)
-
-		//io.ReadFull(reader, buf)
-		if _, err := io.ReadFull(reader, b); err != nil {
+		off = next
+		batch := &WriteBatch{rep: rep}
+		if len(rep) < batchHeaderSize || batch.Count() == 0 {
 			break
 		}
-		//total := 9 + h.keyLen + h.ValueLen
-		//key := data[9 : 9+h.keyLen]
-
-		key := b[:h.keyLen]
-		seq := convert.BytesToU64(b[h.keyLen : h.keyLen+8])
-		//value := data[9+h.keyLen : total]
-		value := b[h.keyLen+8 : h.keyLen+8+h.ValueLen]
-		//data = data[total:]
-		buf = append(buf, b...)
-		if err := codec.VerifyU32Checksum(buf[4:], h.checksum); err != nil {
+		// the batch is decoded before any entry is applied
+		entries, err := batch.entries()
+		if err != nil {
 			break
 		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return maxSeq, err
+			}
+		}
+		maxSeq = batch.lastSeq()
+	}
+	return maxSeq, nil
+}
 
-		err := fn(&utils.Entry{Key: key, Value: value, Seq: seq})
-		if err != nil {
+// isVersioned return whether the wal begins with the magic
+func (wal *WalFile) isVersioned() bool {
+	return len(wal.f.Data) >= walVersionSize &&
+		bytes.Equal(wal.f.Data[:len(walMagic)], walMagic) &&
+		convert.BytesToU16(wal.f.Data[len(walMagic):walVersionSize]) == walVersion
+}
+
+// readRecord read the logical record at off, and return it with the offset
+// of the next record. ok is false at the end of the wal or if the record is
+// torn or corrupted
+func (wal *WalFile) readRecord(off int) (rep []byte, next int, ok bool) {
+	data := wal.f.Data
+	inFragment := false
+	for {
+		if leftover := walBlockSize - off%walBlockSize; leftover < walRecordHeaderSize {
+			off += leftover
+		}
+		if off+walRecordHeaderSize > len(data) {
+			return nil, off, false
+		}
+		header := data[off : off+walRecordHeaderSize]
+		length := int(convert.BytesToU16(header[4:6]))
+		typ := header[6]
+		if typ == walZeroType || off+walRecordHeaderSize+length > len(data) {
+			return nil, off, false
+		}
+		record := data[off+6 : off+walRecordHeaderSize+length]
+		if err := codec.VerifyU32Checksum(record, convert.BytesToU32(header[:4])); err != nil {
+			return nil, off, false
+		}
+		off += walRecordHeaderSize + length
+
+		fragment := record[1:]
+		switch typ {
+		case walFullType:
+			if inFragment {
+				return nil, off, false
+			}
+			return append([]byte{}, fragment...), off, true
+		case walFirstType:
+			if inFragment {
+				return nil, off, false
+			}
+			rep = append(rep[:0], fragment...)
+			inFragment = true
+		case walMiddleType, walLastType:
+			if !inFragment {
+				return nil, off, false
+			}
+			rep = append(rep, fragment...)
+			if typ == walLastType {
+				return rep, off, true
+			}
+		default:
+			return nil, off, false
+		}
+	}
+}
+
+// iterateLegacy replay the wal written before the block format, each record
+// is a put of one entry. The iteration stops at the preallocated zeros or the
+// first torn record
+//
+//	+------------------------------------------------------------+
+//	| checksum | key len | value len | type | key | seq | value |
+//	+------------------------------------------------------------+
+//	checksum := crc of the rest of the record
+func (wal *WalFile) iterateLegacy(fn func(e *utils.Entry) error) (uint64, error) {
+	data := wal.f.Data
+
+	var maxSeq uint64
+	replayed := 0
+	for off := 0; off+walLegacyHeaderSize <= len(data); {
+		header := data[off : off+walLegacyHeaderSize]
+		keyLen := int(convert.BytesToU16(header[4:6]))
+		valueLen := int(convert.BytesToU16(header[6:8]))
+		end := off + walLegacyHeaderSize + keyLen + 8 + valueLen
+		if keyLen == 0 || end > len(data) {
+			break
+		}
+		if err := codec.VerifyU32Checksum(data[off+4:end], convert.BytesToU32(header[:4])); err != nil {
 			break
 		}
+		pos := off + walLegacyHeaderSize
+		key := append([]byte{}, data[pos:pos+keyLen]...)
+		seq := convert.BytesToU64(data[pos+keyLen : pos+keyLen+8])
+		value := append([]byte{}, data[pos+keyLen+8:end]...)
+		if err := fn(&utils.Entry{Key: key, Value: value, Seq: seq}); err != nil {
+			return maxSeq, err
+		}
 		maxSeq = seq
-		//fmt.Println(string(key), string(value))
+		off = end
+		replayed++
+	}
+	// nothing but the preallocated zeros is expected if no record is valid
+	if replayed == 0 && len(bytes.Trim(data, "\x00")) > 0 {
+		return 0, errs.ErrUnknownWALFormat
 	}
 
 	return maxSeq, nil
@@ -138,6 +299,8 @@ func (wal *WalFile) Fid() uint64 {
 	return wal.opt.FID
 }
 
+// Close close the wal file and remove it, it should be called after the
+// memtable has been written to sst
 func (wal *WalFile) Close() error {
 	if wal == nil {
 		return nil
@@ -150,10 +313,17 @@ func (wal *WalFile) Close() error {
 	return os.Remove(filename)
 }
 
+// Sync flush the wal file to disk
+func (wal *WalFile) Sync() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return wal.f.Sync()
+}
+
 func (wal *WalFile) Name() string {
 	return wal.f.Fd.Name()
 }
 
 func (wal *WalFile) Size() uint32 {
-	return wal.writeAt
+	return uint32(wal.f.Size())
 }
@@ -3,6 +3,9 @@ package lsm
 import (
 	"ckv/file"
 	"ckv/utils"
+	"ckv/utils/codec"
+	"ckv/utils/convert"
+	"ckv/utils/errs"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -31,7 +34,8 @@ func TestWalCreate(t *testing.T) {
 	clearDir()
 
 	options := initOpt()
-	wal := OpenWalFile(options)
+	wal, err := OpenWalFile(options)
+	assert.Nil(t, err)
 	assert.NotNil(t, wal)
 
 	clearDir()
@@ -41,11 +45,12 @@ func TestWalFileWrite(t *testing.T) {
 	clearDir()
 
 	options := initOpt()
-	wal := OpenWalFile(options)
+	wal, err := OpenWalFile(options)
+	assert.Nil(t, err)
 	assert.NotNil(t, wal)
 
 	ent := buildEntry()
-	err := wal.Write(ent)
+	err = wal.Write(ent)
 	assert.Nil(t, err)
 
 	wal.Iterate(func(e *utils.Entry) error {
@@ -61,7 +66,8 @@ func TestWalFileWriteManyTimes(t *testing.T) {
 	clearDir()
 
 	options := initOpt()
-	wal := OpenWalFile(options)
+	wal, err := OpenWalFile(options)
+	assert.Nil(t, err)
 	assert.NotNil(t, wal)
 
 	m := make(map[string]string)
@@ -85,3 +91,139 @@ func TestWalFileWriteManyTimes(t *testing.T) {
 
 	clearDir()
 }
+
+func TestWalFileWriteBatch(t *testing.T) {
+	clearDir()
+	defer clearDir()
+
+	options := initOpt()
+	wal, err := OpenWalFile(options)
+	assert.Nil(t, err)
+
+	b1 := NewWriteBatch()
+	b1.Put([]byte("a"), []byte("1"))
+	b1.Put([]byte("b"), []byte("2"))
+	b1.setSeq(1)
+	assert.Nil(t, wal.WriteBatch(b1))
+
+	b2 := NewWriteBatch()
+	b2.Put([]byte("c"), []byte("3"))
+	b2.Delete([]byte("a"))
+	b2.setSeq(3)
+	assert.Nil(t, wal.WriteBatch(b2))
+
+	var keys []string
+	seq, err := wal.Iterate(func(e *utils.Entry) error {
+		keys = append(keys, string(e.Key))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), seq)
+	assert.Equal(t, []string{"a", "b", "c", "a"}, keys)
+
+	// tear the last record, the second batch should be skipped entirely
+	end := int(wal.Size())
+	copy(wal.f.Data[end-2:end], []byte{0, 0})
+	keys = keys[:0]
+	seq, err = wal.Iterate(func(e *utils.Entry) error {
+		keys = append(keys, string(e.Key))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	// the error of the callback stops the replay and is returned
+	seq, err = wal.Iterate(func(e *utils.Entry) error {
+		return errs.ErrDBClosed
+	})
+	assert.Equal(t, errs.ErrDBClosed, err)
+	assert.Equal(t, uint64(0), seq)
+	assert.Nil(t, wal.Close())
+}
+
+func TestWalFileLargeRecord(t *testing.T) {
+	clearDir()
+	defer clearDir()
+
+	options := initOpt()
+	wal, err := OpenWalFile(options)
+	assert.Nil(t, err)
+
+	// the values span several blocks
+	sizes := []int{10, walBlockSize - 40, 3 * walBlockSize, 100, 70000}
+	for i, sz := range sizes {
+		b := NewWriteBatch()
+		b.Put([]byte(fmt.Sprintf("%d", i)), make([]byte, sz))
+		b.setSeq(uint64(i + 1))
+		assert.Nil(t, wal.WriteBatch(b))
+	}
+
+	var got []int
+	seq, err := wal.Iterate(func(e *utils.Entry) error {
+		got = append(got, len(e.Value))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(sizes)), seq)
+	assert.Equal(t, sizes, got)
+	assert.Nil(t, wal.Close())
+}
+
+func TestWalFileLegacy(t *testing.T) {
+	clearDir()
+	defer clearDir()
+
+	// write records in the legacy format by hand, the rest of the file is
+	// preallocated with zeros
+	options := initOpt()
+	data := make([]byte, options.MaxSz)
+	var off int
+	for i := 0; i < 3; i++ {
+		key, value := []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))
+		record := make([]byte, walLegacyHeaderSize+len(key)+8+len(value))
+		copy(record[4:6], convert.U16ToBytes(uint16(len(key))))
+		copy(record[6:8], convert.U16ToBytes(uint16(len(value))))
+		record[8] = 1
+		copy(record[walLegacyHeaderSize:], key)
+		copy(record[walLegacyHeaderSize+len(key):], convert.U64ToBytes(uint64(i+1)))
+		copy(record[walLegacyHeaderSize+len(key)+8:], value)
+		copy(record[:4], convert.U32ToBytes(codec.CalculateU32Checksum(record[4:])))
+		off += copy(data[off:], record)
+	}
+	assert.Nil(t, os.MkdirAll(options.Dir, 0755))
+	assert.Nil(t, os.WriteFile(options.FileName, data, 0666))
+
+	wal, err := OpenWalFile(options)
+	assert.Nil(t, err)
+	var got []string
+	seq, err := wal.Iterate(func(e *utils.Entry) error {
+		got = append(got, string(e.Key)+"="+string(e.Value))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, []string{"key0=value0", "key1=value1", "key2=value2"}, got)
+	assert.Nil(t, wal.Close())
+}
+
+func TestWalFileUnknownFormat(t *testing.T) {
+	clearDir()
+	defer clearDir()
+
+	options := initOpt()
+	unknown := [][]byte{
+		append(append([]byte{}, walMagic...), convert.U16ToBytes(walVersion+1)...),
+		[]byte("not a wal"),
+	}
+	for _, data := range unknown {
+		assert.Nil(t, os.WriteFile(options.FileName, data, 0666))
+		wal, err := OpenWalFile(options)
+		assert.Nil(t, err)
+		_, err = wal.Iterate(func(e *utils.Entry) error {
+			return nil
+		})
+		assert.Equal(t, errs.ErrUnknownWALFormat, err)
+		assert.Nil(t, wal.f.Close())
+	}
+}
@@ -4,50 +4,113 @@ import (
 	"ckv/utils"
 	"ckv/utils/cmp"
 	"ckv/utils/codec"
+	"ckv/utils/compress"
 	"ckv/utils/convert"
+	"ckv/utils/errs"
+	"encoding/binary"
 	"io"
+	"sort"
 	"unsafe"
 )
 
+// the format of data blocks, it's recorded in the index of table so that the
+// tables built before a format change remain readable
+const (
+	// formatLegacy blocks have no trailer. Their entries are values tagged by
+	// the plain seq, and have no expiration
+	formatLegacy = iota
+	// formatBlockTrailer blocks end with the compression type
+	formatBlockTrailer
+	// formatRestarts blocks share the key prefix with the previous entry,
+	// except at the restart points, whose offsets are stored instead of the
+	// offsets of all entries. The value length is stored in each entry
+	formatRestarts
+	// formatVarintLengths blocks store the shared and non shared key length
+	// and the value length as uvarints at the start of entry, instead of the
+	// uint16 header, so keys are not limited to 64KiB
+	formatVarintLengths
+
+	currentFormat = formatVarintLengths
+)
+
 type Block struct {
 	Offset            int
 	checksum          []byte
 	entriesIndexStart int
 	checksumLen       int
+	format            uint32
 
 	Data []byte
-	//restart []uint32
+	// restarts are the offsets of the entries whose keys are stored in full.
+	// Every entry is a restart point in the legacy formats, whose keys are
+	// prefix compressed by BaseKey
+	restarts []uint32
+	entries  int // the number of entries added by builder
 
-	BaseKey      []byte
-	EntryOffsets []uint32
-	End          int
-	EstimateSz   int64
+	BaseKey    []byte
+	End        int
+	EstimateSz int64
 }
 
-func (b *Block) readEntry(buf []byte, sz uint32) (key, value []byte, seq uint64) {
-	entryData := buf[:4] // header
-	h := &Header{}
-	h.decode(entryData)
-	overlap := h.Overlap
-	diff := h.Diff
+// readEntry read the entry at off, prevKey is the key of the previous entry
+// and end is the offset of the next restart point. It returns the offset of
+// the next entry
+func (b *Block) readEntry(off, end int, prevKey []byte) (key, value []byte, tag, expiresAt uint64, next int) {
+	buf := b.Data[off:]
+	overlap, diff, valueLen, pos := b.readHeader(buf)
+	if b.format < formatRestarts {
+		prevKey = b.BaseKey
+	}
 
-	diffKey := buf[4 : 4+diff] // read diff key
-	if len(b.BaseKey) == 0 {
-		b.BaseKey = diffKey
-		key = b.BaseKey
+	diffKey := buf[pos : pos+diff] // read diff key
+	if overlap == 0 {
+		key = diffKey
 	} else {
-		k := make([]byte, overlap+diff)
-		copy(k, b.BaseKey[:overlap])
-		copy(k[overlap:], diffKey)
-		key = k
+		key = make([]byte, overlap+diff)
+		copy(key, prevKey[:overlap])
+		copy(key[overlap:], diffKey)
+	}
+	pos += diff
+	tag = convert.BytesToU64(buf[pos : pos+8])
+	pos += 8
+	if b.format == formatLegacy {
+		tag = tag<<8 | uint64(utils.TypeValue)
+	} else {
+		var n int
+		expiresAt, n = binary.Uvarint(buf[pos:])
+		pos += n
+	}
+	switch b.format {
+	case formatLegacy, formatBlockTrailer:
+		// the value takes the rest of the entry
+		return key, buf[pos : end-off], tag, expiresAt, end
+	case formatRestarts:
+		l, n := binary.Uvarint(buf[pos:])
+		valueLen, pos = int(l), pos+n
 	}
-	seq = convert.BytesToU64(buf[4+diff : 12+diff])
-	value = buf[12+diff : sz]
-	return key, value, seq
+	value = buf[pos : pos+valueLen]
+	return key, value, tag, expiresAt, off + pos + valueLen
 }
 
-// ReadEntryOffsets return the start Offset of first entry offsets
-func (b *Block) readEntryOffsets(buf []byte) uint32 {
+// readHeader read the key lengths at the start of entry, and return the
+// offset of the diff key. The value length is only stored here since
+// formatVarintLengths
+func (b *Block) readHeader(buf []byte) (overlap, diff, valueLen, n int) {
+	if b.format < formatVarintLengths {
+		h := &Header{}
+		h.decode(buf)
+		return int(h.Overlap), int(h.Diff), 0, int(headerSize)
+	}
+	var lens [3]uint64
+	for i := range lens {
+		l, m := binary.Uvarint(buf[n:])
+		lens[i], n = l, n+m
+	}
+	return int(lens[0]), int(lens[1]), int(lens[2]), n
+}
+
+// readRestarts read the trailer of block, and return the end of entries
+func (b *Block) readRestarts(buf []byte) uint32 {
 	// read checksum and length
 	offset := len(buf) - 4
 	b.checksumLen = int(convert.BytesToU32(buf[offset:]))
@@ -57,19 +120,42 @@ func (b *Block) readEntryOffsets(buf []byte) uint32 {
 		//return nil, err
 	}
 
-	// read entry offsets and length
+	// read restarts and length
 	offset -= 4
-	numEntries := convert.BytesToU32(buf[offset : offset+4])
-	offset -= int(numEntries) * 4
-	b.EntryOffsets = convert.BytesToU32Slice(buf[offset : offset+int(numEntries)*4])
+	numRestarts := convert.BytesToU32(buf[offset : offset+4])
+	offset -= int(numRestarts) * 4
+	b.restarts = convert.BytesToU32Slice(buf[offset : offset+int(numRestarts)*4])
 
 	// read kv data
 	b.Data = buf[:offset]
+	// the first key is stored in full
+	if len(b.restarts) > 0 {
+		_, diff, _, n := b.readHeader(b.Data)
+		b.BaseKey = b.Data[n : n+diff]
+	}
 	return uint32(offset)
-	//buf = buf[:offset]
+}
 
+// decompressBlock return the raw form of a stored block, which ends with the
+// compression type
+func decompressBlock(buf []byte) ([]byte, error) {
+	if len(buf) == 0 {
+		return nil, errs.ErrCorruptBlock
+	}
+	typ := compress.Type(buf[len(buf)-1])
+	buf = buf[:len(buf)-1]
+	if typ == compress.None {
+		return buf, nil
+	}
+	codec, err := compress.Lookup(typ)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(nil, buf)
 }
 
+// Header is the key lengths of entry in the formats before
+// formatVarintLengths
 type Header struct {
 	Overlap uint16
 	Diff    uint16
@@ -89,60 +175,83 @@ func (h *Header) decode(buf []byte) {
 }
 
 type BlockIterator struct {
-	block        *Block
-	data         []byte
-	baseKey      []byte
-	entryOffsets []uint32
-	end          int
-	estimateSz   int64
-	err          error
-	idx          int
-	key          []byte
-	val          []byte
-	it           utils.Item
-	cmp          cmp.Comparator
+	block    *Block
+	data     []byte
+	restarts []uint32
+	restart  int // the restart point the current entry follows
+	offset   int // the offset of current entry, -1 before the first entry
+	next     int // the offset of the next entry
+	err      error
+	key      []byte
+	val      []byte
+	it       utils.Item
+	cmp      cmp.Comparator
 }
 
 func (iter *BlockIterator) setBlock(b *Block, cmp cmp.Comparator) {
 	iter.block = b
 	iter.err = nil
-	iter.idx = -1
-	iter.baseKey = iter.baseKey[:0]
-	//itr.prevOverlap = 0
+	iter.offset, iter.next, iter.restart = -1, 0, 0
 	iter.key = iter.key[:0]
 	iter.val = iter.val[:0]
 	// Drop the index from the block. We don't need it anymore.
 	iter.data = b.Data[:b.entriesIndexStart]
-	iter.entryOffsets = b.EntryOffsets
+	iter.restarts = b.restarts
 	iter.cmp = cmp
 }
 
-func (iter *BlockIterator) setIdx(idx int) {
-	iter.idx = idx
-	if iter.idx >= len(iter.entryOffsets) || iter.idx < 0 {
+// restartEnd return the offset of the restart point after r
+func (iter *BlockIterator) restartEnd(r int) int {
+	if r+1 < len(iter.restarts) {
+		return int(iter.restarts[r+1])
+	}
+	return len(iter.data)
+}
+
+// seekToRestart move to the entry at the restart point r
+func (iter *BlockIterator) seekToRestart(r int) {
+	if r < 0 || r >= len(iter.restarts) {
+		iter.offset = len(iter.data)
 		iter.err = io.EOF
 		return
 	}
-	var seq uint64
-	if iter.idx == len(iter.block.EntryOffsets)-1 {
-		iter.key, iter.val, seq = iter.block.readEntry(
-			iter.block.Data[iter.block.EntryOffsets[iter.idx]:],
-			uint32(iter.block.entriesIndexStart)-iter.block.EntryOffsets[iter.idx])
-	} else {
-		iter.key, iter.val, seq = iter.block.readEntry(
-			iter.block.Data[iter.block.EntryOffsets[iter.idx]:],
-			iter.block.EntryOffsets[iter.idx+1]-iter.block.EntryOffsets[iter.idx])
+	iter.restart = r
+	iter.key = nil
+	iter.readAt(int(iter.restarts[r]))
+}
+
+// readAt read the entry at off, the key of the previous entry is iter.key
+func (iter *BlockIterator) readAt(off int) {
+	iter.offset = off
+	if off >= len(iter.data) {
+		iter.err = io.EOF
+		return
 	}
+	iter.err = nil
+	if iter.restart+1 < len(iter.restarts) && off >= int(iter.restarts[iter.restart+1]) {
+		iter.restart++
+	}
+	var tag, expiresAt uint64
+	iter.key, iter.val, tag, expiresAt, iter.next = iter.block.readEntry(off, iter.restartEnd(iter.restart), iter.key)
 	e := &utils.Entry{
-		Key:   iter.key,
-		Value: iter.val,
-		Seq:   seq,
+		Key:       iter.key,
+		Value:     iter.val,
+		Seq:       tag >> 8,
+		Meta:      utils.MetaOfType(byte(tag)),
+		ExpiresAt: expiresAt,
 	}
 	iter.it = e
 }
 
 func (iter *BlockIterator) Next() {
-	iter.setIdx(iter.idx + 1)
+	if iter.offset < 0 {
+		iter.seekToFirst()
+		return
+	}
+	if iter.offset >= len(iter.data) {
+		return
+	}
+	iter.readAt(iter.next)
 }
 
 func (iter *BlockIterator) Valid() bool {
@@ -150,7 +259,7 @@ func (iter *BlockIterator) Valid() bool {
 }
 
 func (iter *BlockIterator) Rewind() {
-	iter.setIdx(-1)
+	iter.seekToFirst()
 }
 
 func (iter *BlockIterator) Item() utils.Item {
@@ -164,33 +273,82 @@ func (itr *BlockIterator) Error() error {
 	return itr.err
 }
 
+// Prev move to the previous entry, which is found by scanning from the
+// restart point before it
+func (iter *BlockIterator) Prev() {
+	if iter.offset < 0 {
+		return
+	}
+	if iter.offset >= len(iter.data) {
+		iter.seekToLast()
+		return
+	}
+	target, r := iter.offset, iter.restart
+	if target == int(iter.restarts[r]) {
+		r--
+	}
+	if r < 0 {
+		iter.offset = -1
+		iter.err = io.EOF
+		return
+	}
+	iter.seekToRestart(r)
+	for iter.next < target {
+		iter.readAt(iter.next)
+	}
+}
+
+// searchRestarts return the first restart point whose key is larger than
+// key, or >= key if inclusive
+func (iter *BlockIterator) searchRestarts(key []byte, inclusive bool) int {
+	return sort.Search(len(iter.restarts), func(r int) bool {
+		iter.seekToRestart(r)
+		c := iter.cmp.Compare(iter.key, key)
+		return c > 0 || (inclusive && c == 0)
+	})
+}
+
+// Seek move to the first entry whose key >= key
 func (iter *BlockIterator) Seek(key []byte) {
-	iter.err = nil
-	for i := 0; i < len(iter.block.EntryOffsets); i++ {
-		iter.setIdx(i)
-		if iter.cmp.Compare(iter.key, key) >= 0 {
-			break
+	// the entries before the restart point may have the same key
+	r := iter.searchRestarts(key, true) - 1
+	if r < 0 {
+		r = 0
+	}
+	for iter.seekToRestart(r); iter.Valid() && iter.cmp.Compare(iter.key, key) < 0; {
+		iter.readAt(iter.next)
+	}
+}
+
+// seekForPrev move to the last entry whose key <= key
+func (iter *BlockIterator) seekForPrev(key []byte) {
+	r := iter.searchRestarts(key, false) - 1
+	if r < 0 {
+		iter.offset = -1
+		iter.err = io.EOF
+		return
+	}
+	iter.seekToRestart(r)
+	for iter.next < iter.restartEnd(r) {
+		prev := *iter
+		if iter.readAt(iter.next); iter.cmp.Compare(iter.key, key) > 0 {
+			*iter = prev
+			return
 		}
 	}
-	//startIndex := 0 // This tells from which index we should start binary search.
-	//
-	//foundEntryIdx := sort.Search(len(iter.entryOffsets), func(idx int) bool {
-	//	// If idx is less than start index then just return false.
-	//	if idx < startIndex {
-	//		return false
-	//	}
-	//	iter.setIdx(idx)
-	//	return iter.cmp.Compare(iter.key, key) >= 0
-	//})
-	//
-	//iter.setIdx(foundEntryIdx)
 }
 
 // seekToFirst brings us to the first element.
 func (itr *BlockIterator) seekToFirst() {
-	itr.setIdx(0)
+	itr.seekToRestart(0)
 }
 
 func (itr *BlockIterator) seekToLast() {
-	itr.setIdx(len(itr.entryOffsets) - 1)
+	if itr.seekToRestart(len(itr.restarts) - 1); !itr.Valid() {
+		itr.offset = -1
+		return
+	}
+	for itr.next < len(itr.data) {
+		itr.readAt(itr.next)
+	}
 }
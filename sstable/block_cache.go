@@ -0,0 +1,67 @@
+package sstable
+
+import "ckv/cache"
+
+// blockOverhead is the charge of a cached block besides its data
+const blockOverhead = 128
+
+// BlockCache is a cache of decoded blocks shared by all tables, it's bounded
+// by the bytes of the blocks. The cached blocks own their data, so they stay
+// valid after the table is closed
+type BlockCache struct {
+	c *cache.Cache
+}
+
+// NewBlockCache return a block cache of capacity bytes, nil is returned if
+// capacity <= 0
+func NewBlockCache(capacity int64) *BlockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &BlockCache{c: cache.NewCache(cache.Options{Capacity: capacity})}
+}
+
+// blockKey return the key of the block at offset of table fid. The fids
+// never reach 1<<32 in practice
+func blockKey(fid uint64, offset uint32) uint64 {
+	return fid<<32 | uint64(offset)
+}
+
+// Get return the block at offset of table fid, nil if it's not cached
+func (c *BlockCache) Get(fid uint64, offset uint32) *Block {
+	b, ok := c.c.Get(blockKey(fid, offset))
+	if !ok {
+		return nil
+	}
+	return b.(*Block)
+}
+
+// Add cache the block at offset of table fid
+func (c *BlockCache) Add(fid uint64, offset uint32, b *Block) {
+	c.c.Set(blockKey(fid, offset), b, int64(len(b.Data)+4*len(b.restarts))+blockOverhead)
+}
+
+// Delete remove the block at offset of table fid
+func (c *BlockCache) Delete(fid uint64, offset uint32) {
+	c.c.Delete(blockKey(fid, offset))
+}
+
+// UsedBytes return the charge of the cached blocks
+func (c *BlockCache) UsedBytes() int64 {
+	return c.c.UsedBytes()
+}
+
+// Len return the number of cached blocks
+func (c *BlockCache) Len() int {
+	return c.c.Len()
+}
+
+// Hits return the number of blocks found in the cache
+func (c *BlockCache) Hits() uint64 {
+	return c.c.Hits()
+}
+
+// Misses return the number of blocks not found in the cache
+func (c *BlockCache) Misses() uint64 {
+	return c.c.Misses()
+}
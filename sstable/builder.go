@@ -4,8 +4,10 @@ import (
 	"ckv/file"
 	"ckv/utils"
 	"ckv/utils/codec"
+	"ckv/utils/compress"
 	"ckv/utils/convert"
 	"ckv/utils/errs"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
@@ -22,12 +24,23 @@ type tableBuilder struct {
 	index         *IndexBlock
 	keyCount      uint32
 	keyHashes     []uint32
+	minVersion    uint64
 	maxVersion    uint64
 	baseKey       []byte
 	staleDataSize int
 	estimateSz    int64
+	lastKey       []byte
+	rangeDels     []*RangeTombstone
+	compression   compress.Type
+	codec         compress.Codec
+	restartEvery  int
+	err           error // returned by Flush, the options are invalid
 }
 
+// defaultBlockRestartInterval is the number of keys between restart points
+// if Options.BlockRestartInterval is not set
+const defaultBlockRestartInterval = 16
+
 type buildData struct {
 	blockList []*Block
 	index     []byte
@@ -35,24 +48,57 @@ type buildData struct {
 	size      int
 }
 
+// NewTableBuiler return a builder of table compressed by the codec of level 0
 func NewTableBuiler(opt *utils.Options) *tableBuilder {
-	return &tableBuilder{
+	return NewTableBuilerForLevel(opt, 0)
+}
+
+// NewTableBuilerForLevel return a builder of table that will be put in level,
+// its blocks are compressed by the codec of the level
+func NewTableBuilerForLevel(opt *utils.Options, level int) *tableBuilder {
+	tb := &tableBuilder{
 		opt:     opt,
 		sstSize: opt.SSTableMaxSz,
 	}
+	tb.err = tb.setCompression(opt.CompressionOfLevel(level))
+	tb.setRestartInterval()
+	return tb
 }
 
 func newTableBuilerWithSSTSize(opt *utils.Options, size int64) *tableBuilder {
-	return &tableBuilder{
+	tb := &tableBuilder{
 		opt:     opt,
 		sstSize: size,
 	}
+	tb.err = tb.setCompression(opt.CompressionOfLevel(0))
+	tb.setRestartInterval()
+	return tb
+}
+
+// setCompression set the codec of blocks. The blocks are not compressed if
+// the codec is not registered, and the error is returned
+func (tb *tableBuilder) setCompression(typ compress.Type) error {
+	codec, err := compress.Lookup(typ)
+	if err != nil {
+		typ = compress.None
+		codec, _ = compress.Lookup(typ)
+	}
+	tb.compression, tb.codec = typ, codec
+	return err
+}
+
+func (tb *tableBuilder) setRestartInterval() {
+	tb.restartEvery = tb.opt.BlockRestartInterval
+	if tb.restartEvery <= 0 {
+		tb.restartEvery = defaultBlockRestartInterval
+	}
 }
 
 func (tb *tableBuilder) Add(e *utils.Entry, isStale bool) {
 	key := e.Key
 	val := e.Value
 	seq := e.Seq
+	tb.updateVersion(seq)
 	// 检查是否需要分配一个新的 Block
 	if tb.tryFinishBlock(e) {
 		if isStale {
@@ -66,44 +112,109 @@ func (tb *tableBuilder) Add(e *utils.Entry, isStale bool) {
 		}
 	}
 
-	// Append kv data
-	// +---------------------------+
-	// | header | diff key | value |
-	// +---------------------------+
+	// Append kv data, the key shares prefix with the previous key except at
+	// restart points
+	// +----------------------------------------------------------------------+
+	// | shared | non shared | value len | diff key | tag | expires at | value |
+	// +----------------------------------------------------------------------+
 
-	var differKey []byte
-	if len(tb.curBlock.BaseKey) == 0 {
+	differKey := key
+	if tb.curBlock.entries == 0 {
 		tb.curBlock.BaseKey = append(tb.curBlock.BaseKey[:0], key...)
-		differKey = key
+	}
+	if tb.curBlock.entries%tb.restartEvery == 0 {
+		tb.curBlock.restarts = append(tb.curBlock.restarts, uint32(tb.curBlock.End))
 	} else {
 		differKey = tb.keyDiff(key)
 	}
+	tb.curBlock.entries++
 
-	h := Header{
-		Overlap: uint16(len(key) - len(differKey)),
-		Diff:    uint16(len(differKey)),
-	}
-
-	tb.curBlock.EntryOffsets = append(tb.curBlock.EntryOffsets, uint32(tb.curBlock.End))
-
-	tb.append(h.encode())
+	var buf [binary.MaxVarintLen64]byte
+	tb.append(buf[:binary.PutUvarint(buf[:], uint64(len(key)-len(differKey)))])
+	tb.append(buf[:binary.PutUvarint(buf[:], uint64(len(differKey)))])
+	tb.append(buf[:binary.PutUvarint(buf[:], uint64(len(val)))])
 	tb.append(differKey)
-	tb.append(convert.U64ToBytes(seq))
+	// tag: seq | value type
+	tb.append(convert.U64ToBytes(seq<<8 | uint64(e.ValueType())))
+	tb.append(buf[:binary.PutUvarint(buf[:], e.ExpiresAt)])
+	tb.lastKey = append(tb.lastKey[:0], key...)
 	dst := tb.allocate(len(val))
 	copy(dst, val)
 }
 
+// AddRangeTombstone add a range tombstone that will be stored in index
+func (tb *tableBuilder) AddRangeTombstone(t *utils.RangeTombstone) {
+	tb.updateVersion(t.Seq)
+	tb.rangeDels = append(tb.rangeDels, &RangeTombstone{
+		Start: t.Start,
+		End:   t.End,
+		Seq:   t.Seq,
+	})
+}
+
+// updateVersion update the seq range of the table
+func (tb *tableBuilder) updateVersion(seq uint64) {
+	if tb.Empty() || seq < tb.minVersion {
+		tb.minVersion = seq
+	}
+	if seq > tb.maxVersion {
+		tb.maxVersion = seq
+	}
+}
+
+// Empty return whether nothing has been added to the builder
+func (tb *tableBuilder) Empty() bool {
+	return len(tb.blockList) == 0 && len(tb.rangeDels) == 0 &&
+		(tb.curBlock == nil || tb.curBlock.entries == 0)
+}
+
+// EstimatedSize return the size of data added to the builder
+func (tb *tableBuilder) EstimatedSize() int64 {
+	size := tb.estimateSz
+	if tb.curBlock != nil {
+		size += int64(tb.curBlock.End)
+	}
+	return size
+}
+
+// bounds return the smallest and largest key of the table, including the
+// range tombstones
+func (tb *tableBuilder) bounds() (smallest, largest []byte) {
+	if len(tb.blockList) > 0 {
+		smallest, largest = tb.blockList[0].BaseKey, tb.lastKey
+	}
+	for _, t := range tb.rangeDels {
+		if smallest == nil || tb.opt.Comparable.Compare(t.Start, smallest) < 0 {
+			smallest = t.Start
+		}
+		if largest == nil || tb.opt.Comparable.Compare(t.End, largest) > 0 {
+			largest = t.End
+		}
+	}
+	return smallest, largest
+}
+
 // flush flush data to sst file.
 func (tb *tableBuilder) Flush(tableName string) (t *Table, err error) {
+	if tb.err != nil {
+		return nil, tb.err
+	}
 	bd := tb.done()
+	if bd.size == 0 {
+		return nil, errors.New("tableBuilder.flush empty table")
+	}
 	t = newTable(tb.opt, file.FID(tableName))
 
-	t.ss = OpenSStable(&file.Options{
+	if t.ss, err = OpenSStable(&file.Options{
 		FileName: tableName,
 		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(bd.size)})
+		MaxSz:    int(bd.size)}); err != nil {
+		return nil, err
+	}
+	smallest, largest := tb.bounds()
 	t.ss.SetIndex(tb.index)
-	t.ss.SetMin(tb.blockList[0].BaseKey)
+	t.ss.SetMin(smallest)
+	t.ss.SetMax(largest)
 	buf := make([]byte, bd.size)
 
 	// copy data that needed
@@ -116,12 +227,14 @@ func (tb *tableBuilder) Flush(tableName string) (t *Table, err error) {
 		return nil, err
 	}
 	copy(dst, buf)
-	t.MinKey = tb.blockList[0].BaseKey
+	t.MinKey, t.MaxKey = smallest, largest
+	t.MinSeq, t.MaxSeq = tb.minVersion, tb.maxVersion
 	t.ss.fileSize = uint64(bd.size)
 	if err = t.ss.Close(); err != nil {
 		return t, err
 	}
-	t.ss.f.Close()
+	// the table is opened again by OpenTable to be read
+	t.ss.f = nil
 	return t, nil
 }
 
@@ -149,10 +262,12 @@ func (tb *tableBuilder) append(data []byte) {
 	errs.CondPanic(len(data) != copy(dst, data), errors.New("tableBuilder.append data"))
 }
 
+// keyDiff return the part of newKey after the prefix shared with the
+// previous key
 func (tb *tableBuilder) keyDiff(newKey []byte) []byte {
 	var i int
-	for i = 0; i < len(newKey) && i < len(tb.curBlock.BaseKey); i++ {
-		if newKey[i] != tb.curBlock.BaseKey[i] {
+	for i = 0; i < len(newKey) && i < len(tb.lastKey); i++ {
+		if newKey[i] != tb.lastKey[i] {
 			break
 		}
 	}
@@ -164,51 +279,72 @@ func (tb *tableBuilder) tryFinishBlock(e *utils.Entry) bool {
 	if tb.curBlock == nil {
 		return true
 	}
-	if len(tb.curBlock.EntryOffsets) <= 0 {
+	if tb.curBlock.entries <= 0 {
 		return false
 	}
 
-	errs.CondPanic(!((uint32(len(tb.curBlock.EntryOffsets))+1)*4+4+8+4 < math.MaxUint32), errors.New("Integer overflow"))
+	errs.CondPanic(!((uint32(len(tb.curBlock.restarts))+1)*4+4+8+4 < math.MaxUint32), errors.New("Integer overflow"))
 
-	entryOffSz := int64((len(tb.curBlock.EntryOffsets) + 1)) * 4
-	entriesOffsetsSize := entryOffSz + // entry offsets list
+	restartsSz := int64((len(tb.curBlock.restarts) + 1)) * 4
+	trailerSize := restartsSz + // restarts list
 		4 + // size of list
 		8 + // Sum64 in checksum proto
 		4 // checksum length
-	kvSize := int64(6 /*header size for entry*/) +
+	kvSize := 3*binary.MaxVarintLen32 /* lengths */ + 8 /* tag */ + binary.MaxVarintLen64 /* expires at */ +
 		int64(len(e.Key)) + int64(len(e.Value))
-	tb.curBlock.EstimateSz = int64(tb.curBlock.End) + kvSize + entriesOffsetsSize
+	tb.curBlock.EstimateSz = int64(tb.curBlock.End) + kvSize + trailerSize
 
 	errs.CondPanic(!(uint64(tb.curBlock.End)+uint64(tb.curBlock.EstimateSz) < math.MaxUint32), errors.New("Integer overflow"))
 
 	return tb.curBlock.EstimateSz > int64(tb.opt.BlockSize)
 }
 
-// finishBlock write other info to Block, e.g. entry offsets, checksum
+// finishBlock write other info to Block, e.g. restarts, checksum
 //
-//	+------------------------ --------------------------------------+
-//	|  kv_data | entryOffsets | entryOff len | checksum | check len |
-//	+---------------------------------------------------------------+
+//	+-----------------------------------------------------------+
+//	|  kv_data | restarts | restarts len | checksum | check len |
+//	+-----------------------------------------------------------+
 func (tb *tableBuilder) finishBlock() {
-	if tb.curBlock == nil || len(tb.curBlock.EntryOffsets) == 0 {
+	if tb.curBlock == nil || tb.curBlock.entries == 0 {
 		return
 	}
-	// Append the entryOffsets and its length.
-	tb.append(convert.U32SliceToBytes(tb.curBlock.EntryOffsets))
-	tb.append(convert.U32ToBytes(uint32(len(tb.curBlock.EntryOffsets))))
+	// Append the restarts and its length.
+	tb.append(convert.U32SliceToBytes(tb.curBlock.restarts))
+	tb.append(convert.U32ToBytes(uint32(len(tb.curBlock.restarts))))
 
 	// Append the Block checksum and its length.
 	checksum := tb.calculateChecksum(tb.curBlock.Data[:tb.curBlock.End])
 	tb.append(checksum)
 	tb.append(convert.U32ToBytes(uint32(len(checksum))))
+	tb.keyCount += uint32(tb.curBlock.entries)
+	tb.compressBlock(tb.curBlock)
 
-	tb.estimateSz += tb.curBlock.EstimateSz
+	tb.estimateSz += int64(tb.curBlock.End)
 	tb.blockList = append(tb.blockList, tb.curBlock)
-	tb.keyCount += uint32(len(tb.curBlock.EntryOffsets))
 	tb.curBlock = nil // 表示当前block 已经被序列化到内存
 	return
 }
 
+// compressBlock replace the data of b by its stored form, which ends with the
+// compression type. The block is stored as is if it doesn't shrink by 1/8 at
+// least, it's not worth decompressing on read
+func (tb *tableBuilder) compressBlock(b *Block) {
+	raw := b.Data[:b.End]
+	typ := tb.compression
+	var data []byte
+	if typ != compress.None {
+		data = tb.codec.Encode(make([]byte, 0, len(raw)), raw)
+		if len(data) >= len(raw)-len(raw)/8 {
+			typ = compress.None
+		}
+	}
+	if typ == compress.None {
+		data = raw
+	}
+	b.Data = append(data, byte(typ))
+	b.End = len(b.Data)
+}
+
 func (tb *tableBuilder) allocate(need int) []byte {
 	bb := tb.curBlock
 	if len(bb.Data[bb.End:]) < need {
@@ -232,7 +368,7 @@ func (tb *tableBuilder) calculateChecksum(data []byte) []byte {
 
 func (tb *tableBuilder) done() buildData {
 	tb.finishBlock()
-	if len(tb.blockList) == 0 {
+	if len(tb.blockList) == 0 && len(tb.rangeDels) == 0 {
 		return buildData{}
 	}
 
@@ -259,9 +395,12 @@ func (tb *tableBuilder) done() buildData {
 
 func (tb *tableBuilder) buildIndex(bloom []byte) ([]byte, uint32) {
 	index := &IndexBlock{
-		BlockOffsets: make([]*BlockOffset, len(tb.blockList)),
-		Filter:       nil,
-		KeyCount:     tb.keyCount,
+		BlockOffsets:  make([]*BlockOffset, len(tb.blockList)),
+		Filter:        nil,
+		KeyCount:      tb.keyCount,
+		RangeDels:     tb.rangeDels,
+		Compression:   uint32(tb.compression),
+		FormatVersion: currentFormat,
 	}
 	var indexSize int
 	if len(bloom) > 0 {
@@ -21,12 +21,15 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type IndexBlock struct {
-	BlockOffsets         []*BlockOffset `protobuf:"bytes,1,rep,name=BlockOffsets,proto3" json:"BlockOffsets,omitempty"`
-	Filter               []byte         `protobuf:"bytes,2,opt,name=Filter,proto3" json:"Filter,omitempty"`
-	KeyCount             uint32         `protobuf:"varint,3,opt,name=KeyCount,proto3" json:"KeyCount,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	BlockOffsets         []*BlockOffset    `protobuf:"bytes,1,rep,name=BlockOffsets,proto3" json:"BlockOffsets,omitempty"`
+	Filter               []byte            `protobuf:"bytes,2,opt,name=Filter,proto3" json:"Filter,omitempty"`
+	KeyCount             uint32            `protobuf:"varint,3,opt,name=KeyCount,proto3" json:"KeyCount,omitempty"`
+	RangeDels            []*RangeTombstone `protobuf:"bytes,4,rep,name=RangeDels,proto3" json:"RangeDels,omitempty"`
+	Compression          uint32            `protobuf:"varint,5,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	FormatVersion        uint32            `protobuf:"varint,6,opt,name=FormatVersion,proto3" json:"FormatVersion,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *IndexBlock) Reset()         { *m = IndexBlock{} }
@@ -75,6 +78,27 @@ func (m *IndexBlock) GetKeyCount() uint32 {
 	return 0
 }
 
+func (m *IndexBlock) GetRangeDels() []*RangeTombstone {
+	if m != nil {
+		return m.RangeDels
+	}
+	return nil
+}
+
+func (m *IndexBlock) GetCompression() uint32 {
+	if m != nil {
+		return m.Compression
+	}
+	return 0
+}
+
+func (m *IndexBlock) GetFormatVersion() uint32 {
+	if m != nil {
+		return m.FormatVersion
+	}
+	return 0
+}
+
 type BlockOffset struct {
 	Key                  []byte   `protobuf:"bytes,1,opt,name=Key,proto3" json:"Key,omitempty"`
 	Offset               uint32   `protobuf:"varint,2,opt,name=Offset,proto3" json:"Offset,omitempty"`
@@ -130,24 +154,87 @@ func (m *BlockOffset) GetLen() uint32 {
 	return 0
 }
 
+type RangeTombstone struct {
+	Start                []byte   `protobuf:"bytes,1,opt,name=Start,proto3" json:"Start,omitempty"`
+	End                  []byte   `protobuf:"bytes,2,opt,name=End,proto3" json:"End,omitempty"`
+	Seq                  uint64   `protobuf:"varint,3,opt,name=Seq,proto3" json:"Seq,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RangeTombstone) Reset()         { *m = RangeTombstone{} }
+func (m *RangeTombstone) String() string { return proto.CompactTextString(m) }
+func (*RangeTombstone) ProtoMessage()    {}
+func (*RangeTombstone) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4288c13f5d277049, []int{2}
+}
+
+func (m *RangeTombstone) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RangeTombstone.Unmarshal(m, b)
+}
+func (m *RangeTombstone) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RangeTombstone.Marshal(b, m, deterministic)
+}
+func (m *RangeTombstone) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RangeTombstone.Merge(m, src)
+}
+func (m *RangeTombstone) XXX_Size() int {
+	return xxx_messageInfo_RangeTombstone.Size(m)
+}
+func (m *RangeTombstone) XXX_DiscardUnknown() {
+	xxx_messageInfo_RangeTombstone.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RangeTombstone proto.InternalMessageInfo
+
+func (m *RangeTombstone) GetStart() []byte {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *RangeTombstone) GetEnd() []byte {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
+func (m *RangeTombstone) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*IndexBlock)(nil), "sstable.IndexBlock")
 	proto.RegisterType((*BlockOffset)(nil), "sstable.BlockOffset")
+	proto.RegisterType((*RangeTombstone)(nil), "sstable.RangeTombstone")
 }
 
 func init() { proto.RegisterFile("sstable/index.proto", fileDescriptor_4288c13f5d277049) }
 
 var fileDescriptor_4288c13f5d277049 = []byte{
-	// 172 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2e, 0x2e, 0x2e, 0x49,
-	0x4c, 0xca, 0x49, 0xd5, 0xcf, 0xcc, 0x4b, 0x49, 0xad, 0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17,
-	0x62, 0x87, 0x0a, 0x2a, 0x55, 0x71, 0x71, 0x79, 0x82, 0xc4, 0x9d, 0x72, 0xf2, 0x93, 0xb3, 0x85,
-	0x2c, 0xb8, 0x78, 0xc0, 0x0c, 0xff, 0xb4, 0xb4, 0xe2, 0xd4, 0x92, 0x62, 0x09, 0x46, 0x05, 0x66,
-	0x0d, 0x6e, 0x23, 0x11, 0x3d, 0xa8, 0x6a, 0x3d, 0x24, 0xc9, 0x20, 0x14, 0x95, 0x42, 0x62, 0x5c,
-	0x6c, 0x6e, 0x99, 0x39, 0x25, 0xa9, 0x45, 0x12, 0x4c, 0x0a, 0x8c, 0x1a, 0x3c, 0x41, 0x50, 0x9e,
-	0x90, 0x14, 0x17, 0x87, 0x77, 0x6a, 0xa5, 0x73, 0x7e, 0x69, 0x5e, 0x89, 0x04, 0xb3, 0x02, 0xa3,
-	0x06, 0x6f, 0x10, 0x9c, 0xaf, 0xe4, 0xc9, 0xc5, 0x8d, 0x64, 0x86, 0x90, 0x00, 0x17, 0xb3, 0x77,
-	0x6a, 0xa5, 0x04, 0x23, 0x58, 0x3f, 0x88, 0x09, 0x32, 0x14, 0x22, 0x07, 0x36, 0x94, 0x37, 0x88,
-	0x0d, 0xa1, 0xd2, 0x27, 0x35, 0x0f, 0x6a, 0x1e, 0x88, 0x99, 0xc4, 0x06, 0xf6, 0x96, 0x31, 0x20,
-	0x00, 0x00, 0xff, 0xff, 0x7d, 0xb5, 0x5d, 0x4f, 0xed, 0x00, 0x00, 0x00,
+	// 273 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x51, 0xc1, 0x4a, 0xc3, 0x40,
+	0x10, 0x25, 0xa6, 0x8d, 0x3a, 0x69, 0x44, 0xd6, 0xa2, 0x8b, 0xa7, 0x10, 0x3c, 0xe4, 0x14, 0x41,
+	0x11, 0x3c, 0x5b, 0x2d, 0xd4, 0x0a, 0xc2, 0x56, 0xbc, 0x27, 0x76, 0x2a, 0xc1, 0x64, 0xb7, 0xee,
+	0xae, 0x60, 0x3f, 0xdd, 0x9b, 0xec, 0x74, 0x69, 0x93, 0xdb, 0x9b, 0xf7, 0x5e, 0xde, 0xcc, 0xcb,
+	0xc2, 0x99, 0x31, 0xb6, 0xac, 0x1a, 0xbc, 0xae, 0xe5, 0x12, 0x7f, 0x8b, 0xb5, 0x56, 0x56, 0xb1,
+	0x43, 0x4f, 0x66, 0x7f, 0x01, 0xc0, 0xcc, 0x09, 0x0f, 0x8d, 0xfa, 0xf8, 0x62, 0xf7, 0x30, 0x22,
+	0xf0, 0xba, 0x5a, 0x19, 0xb4, 0x86, 0x07, 0x69, 0x98, 0xc7, 0x37, 0xe3, 0xc2, 0xdb, 0x8b, 0x8e,
+	0x28, 0x7a, 0x4e, 0x76, 0x0e, 0xd1, 0xb4, 0x6e, 0x2c, 0x6a, 0x7e, 0x90, 0x06, 0xf9, 0x48, 0xf8,
+	0x89, 0x5d, 0xc2, 0xd1, 0x1c, 0x37, 0x13, 0xf5, 0x23, 0x2d, 0x0f, 0xd3, 0x20, 0x4f, 0xc4, 0x6e,
+	0x66, 0x77, 0x70, 0x2c, 0x4a, 0xf9, 0x89, 0x8f, 0xd8, 0x18, 0x3e, 0xa0, 0x55, 0x17, 0xbb, 0x55,
+	0xa4, 0xbc, 0xa9, 0xb6, 0x32, 0x56, 0x49, 0x14, 0x7b, 0x27, 0x4b, 0x21, 0x9e, 0xa8, 0x76, 0xad,
+	0xd1, 0x98, 0x5a, 0x49, 0x3e, 0xa4, 0xd4, 0x2e, 0xc5, 0xae, 0x20, 0x99, 0x2a, 0xdd, 0x96, 0xf6,
+	0x1d, 0x35, 0x79, 0x22, 0xf2, 0xf4, 0xc9, 0x6c, 0x06, 0x71, 0xa7, 0x02, 0x3b, 0x85, 0x70, 0x8e,
+	0x1b, 0x1e, 0xd0, 0xf9, 0x0e, 0xba, 0x4e, 0x5b, 0x8d, 0x3a, 0x25, 0x22, 0xda, 0x3b, 0x5f, 0x50,
+	0xfa, 0x3a, 0x0e, 0x66, 0xcf, 0x70, 0xd2, 0xbf, 0x97, 0x8d, 0x61, 0xb8, 0xb0, 0xa5, 0xb6, 0x3e,
+	0x6f, 0x3b, 0xb8, 0x2f, 0x9f, 0xe4, 0xd2, 0xff, 0x22, 0x07, 0x1d, 0xb3, 0xc0, 0x6f, 0xca, 0x1a,
+	0x08, 0x07, 0xab, 0x88, 0x9e, 0xe8, 0xf6, 0x7f, 0x00, 0x8a, 0x4c, 0x54, 0x40, 0xb9, 0x01, 0x00,
+	0x00,
 }
@@ -4,7 +4,6 @@ import (
 	"ckv/file"
 	"ckv/utils/errs"
 	"io"
-	"os"
 	"sync"
 )
 
@@ -53,10 +52,12 @@ func (ss *SSTable) Bytes(off, sz int) ([]byte, error) {
 }
 
 // OpenSStable 打开一个 sst文件
-func OpenSStable(opt *file.Options) *SSTable {
-	omf, err := file.OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
-	errs.Err(err)
-	return &SSTable{f: omf, fid: opt.FID, lock: &sync.RWMutex{}}
+func OpenSStable(opt *file.Options) (*SSTable, error) {
+	omf, err := file.OpenMmapFile(opt.FileName, opt.Flag, opt.MaxSz)
+	if err != nil {
+		return nil, err
+	}
+	return &SSTable{f: omf, fid: opt.FID, lock: &sync.RWMutex{}}, nil
 }
 
 // Indexs _
@@ -4,6 +4,7 @@ import (
 	"ckv/file"
 	"ckv/utils"
 	"ckv/utils/codec"
+	"ckv/utils/compress"
 	"ckv/utils/convert"
 	"ckv/utils/errs"
 	"ckv/vlog"
@@ -13,6 +14,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -27,8 +29,16 @@ type Table struct {
 	opt          *utils.Options
 	MinKey       []byte
 	MaxKey       []byte
+	MinSeq       uint64 // seq range of the table, only known for new built tables
+	MaxSeq       uint64
 	ref          int32 // For file garbage collection. Atomic.
 	pendingVlogs []uint64
+	blockCache   *BlockCache
+
+	// the file is closed when all holders unpin it, e.g. the table cache
+	// and the iterators that have read blocks, and it's reopened by Pin
+	fileLock sync.Mutex
+	opens    int32
 }
 
 func newTable(opt *utils.Options, fid uint64) *Table {
@@ -38,18 +48,58 @@ func newTable(opt *utils.Options, fid uint64) *Table {
 	}
 }
 
-func OpenTable(opt *utils.Options, fid uint64) *Table {
+func OpenTable(opt *utils.Options, fid uint64) (*Table, error) {
 	fileName := file.FileNameSSTable(opt.WorkDir, fid)
 	t := &Table{fid: fid, opt: opt}
-	t.ss = OpenSStable(&file.Options{
+	ss, err := OpenSStable(&file.Options{
 		FID:      fid,
 		FileName: fileName,
 		Dir:      opt.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
+		Flag:     os.O_RDWR,
 		MaxSz:    int(opt.SSTableMaxSz),
 	})
+	if err != nil {
+		return nil, err
+	}
+	t.ss = ss
+	t.opens = 1
 	t.IncrRef()
-	return t
+	return t, nil
+}
+
+// Pin keep the file of the table opened until Unpin, it's reopened if it
+// has been closed. The file opened by OpenTable is pinned by the caller
+func (t *Table) Pin() error {
+	t.fileLock.Lock()
+	defer t.fileLock.Unlock()
+	if t.ss.f == nil {
+		f, err := file.OpenMmapFile(file.FileNameSSTable(t.opt.WorkDir, t.fid), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		t.ss.f = f
+	}
+	t.opens++
+	return nil
+}
+
+// Unpin release the file pinned, it's closed if no one else pins it
+func (t *Table) Unpin() error {
+	t.fileLock.Lock()
+	defer t.fileLock.Unlock()
+	if t.opens--; t.opens > 0 || t.ss.f == nil {
+		return nil
+	}
+	err := t.ss.Close()
+	t.ss.f = nil
+	return err
+}
+
+// Opened return whether the file of the table is opened
+func (t *Table) Opened() bool {
+	t.fileLock.Lock()
+	defer t.fileLock.Unlock()
+	return t.ss.f != nil
 }
 
 func (t *Table) IncrRef() {
@@ -66,17 +116,51 @@ func (t *Table) DecrRef(fn func() error) error {
 				return err
 			}
 		}
-		if err := t.ss.Detele(); err != nil {
-			return err
-		}
+		return t.Delete()
 	}
 	return nil
 }
 
+// Close close the sst file without removing it
+func (t *Table) Close() error {
+	t.fileLock.Lock()
+	defer t.fileLock.Unlock()
+	if t.ss.f == nil {
+		return nil
+	}
+	err := t.ss.Close()
+	t.ss.f = nil
+	return err
+}
+
 func (t *Table) Delete() error {
 	//t.Lock()
 	//defer t.Unlock()
-	return t.ss.Detele()
+	t.evictBlocks()
+	t.fileLock.Lock()
+	defer t.fileLock.Unlock()
+	if t.ss.f == nil {
+		return os.Remove(file.FileNameSSTable(t.opt.WorkDir, t.fid))
+	}
+	err := t.ss.Detele()
+	t.ss.f = nil
+	return err
+}
+
+// SetBlockCache set the cache of the blocks read from the table, nil means
+// the blocks are not cached
+func (t *Table) SetBlockCache(c *BlockCache) {
+	t.blockCache = c
+}
+
+// evictBlocks remove the blocks of the table from the block cache
+func (t *Table) evictBlocks() {
+	if t.blockCache == nil || t.ss.Indexs() == nil {
+		return
+	}
+	for _, b := range t.ss.Indexs().BlockOffsets {
+		t.blockCache.Delete(t.fid, b.Offset)
+	}
 }
 
 func (t *Table) Rename(filename string) (bool, error) {
@@ -98,49 +182,64 @@ func (t *Table) Rename(filename string) (bool, error) {
 	return true, nil
 }
 
-func (t *Table) Serach(key []byte) (entry *utils.Entry, err error) {
+// Serach search the newest version of key whose seq <= seq in the table. A
+// deleted entry is returned if the key is deleted by a tombstone in the table
+func (t *Table) Serach(key []byte, seq uint64) (entry *utils.Entry, err error) {
 	//t.RLock()
 	//defer t.RUnlock()
 
 	iter := t.NewIterator(t.opt)
 	defer iter.Close()
-	//iter.seekToFirst()
-	iter.Seek(key)
-	//err = iter.err
-	//if err != nil {
-	//	return nil, err
-	//}
-	if !iter.Valid() {
-		//iter.Close()
-		return nil, errs.ErrKeyNotFound
-	}
-	if t.Compare(iter.Item().Entry().Key, key) == 0 {
+	tombSeq := utils.MaxCoveringSeq(t.RangeDels(), t.opt.Comparable, key, seq)
+	filter := utils.Filter(t.ss.Indexs().Filter)
+	if t.ss.HasBloomFilter() && !filter.MayContainKey(key) {
+		iter.err = io.EOF
+	} else {
+		iter.Seek(key)
+	}
+	// skip the versions that are newer than seq
+	for iter.Valid() && t.Compare(iter.Item().Entry().Key, key) == 0 && iter.Item().Entry().Seq > seq {
+		iter.Next()
+	}
+	if iter.Valid() && t.Compare(iter.Item().Entry().Key, key) == 0 &&
+		(tombSeq == 0 || iter.Item().Entry().Seq > tombSeq) {
 		e := iter.Item().Entry()
-		tag := e.Value[0]
-		if tag == utils.VAL {
-			e.Value = e.Value[1:]
-		} else {
-			// val ptr
-			fid := convert.BytesToU64(e.Value[1:])
-			pos := convert.BytesToU32(e.Value[9:])
-			vlog := openVLog(t.opt, fid)
-			val, err := vlog.ReadAt(pos)
-			if err != nil {
-				return nil, err
-			}
-			e.Value = val
-			vlog.Close()
+		// the entry refers to the mmap of the table, which is unmapped when
+		// the table is deleted by compaction
+		e.Key = append([]byte{}, e.Key...)
+		if e.IsDeleted() {
+			e.Value = nil
+			return e, nil
+		}
+		if len(e.Value) > 0 && e.Value[0] == utils.VAL {
+			e.Value = append([]byte{}, e.Value[1:]...)
+		} else if e.Value, err = ReadValue(t.opt, e.Value); err != nil {
+			return nil, err
 		}
-		//iter.Close()
 		return e, nil
 	}
-
-	// TODO cache block
+	if tombSeq > 0 {
+		// deleted by range tombstone
+		return &utils.Entry{Key: key, Seq: tombSeq, Meta: utils.BitDelete}, nil
+	}
 
 	return nil, errs.ErrKeyNotFound
 
 }
 
+// RangeDels return the range tombstones stored in the table
+func (t *Table) RangeDels() []*utils.RangeTombstone {
+	rangeDels := t.ss.Indexs().GetRangeDels()
+	if len(rangeDels) == 0 {
+		return nil
+	}
+	res := make([]*utils.RangeTombstone, len(rangeDels))
+	for i, r := range rangeDels {
+		res[i] = &utils.RangeTombstone{Start: r.Start, End: r.End, Seq: r.Seq}
+	}
+	return res
+}
+
 // findGreaterOrEqual
 func (t *Table) findGreater(index *IndexBlock, key []byte) int {
 	low, high := 0, len(index.BlockOffsets)-1
@@ -173,11 +272,19 @@ func (t *Table) Index() *IndexBlock {
 	return t.ss.Indexs()
 }
 
+// Compression return the codec the blocks of the table are compressed by,
+// the ones that don't shrink are stored as is
+func (t *Table) Compression() compress.Type {
+	return compress.Type(t.ss.Indexs().GetCompression())
+}
+
 func (t *Table) SetIndex(index *IndexBlock) {
 	t.ss.indexBlock = index
 }
 
-func (t *Table) readBlock(idx int) (*Block, error) {
+// readBlock return the block at idx, from the block cache if it's cached.
+// The block read from file is added to the cache if fillCache is true
+func (t *Table) readBlock(idx int, fillCache bool) (*Block, error) {
 	if idx < 0 {
 		return nil, nil
 	}
@@ -189,23 +296,45 @@ func (t *Table) readBlock(idx int) (*Block, error) {
 	blockOffset := index.BlockOffsets[idx]
 	offset := blockOffset.Offset
 	size := blockOffset.Len
+	if t.blockCache != nil {
+		if b := t.blockCache.Get(t.fid, offset); b != nil {
+			return b, nil
+		}
+	}
+	fillCache = fillCache && t.blockCache != nil
 
 	//buf := make([]byte, size)
 	buf, err := f.Bytes(int(offset), int(size))
 	if err != nil {
-
+		return nil, err
+	}
+	if index.GetFormatVersion() >= formatBlockTrailer {
+		raw, err := decompressBlock(buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read block %d of table: %s", idx, t.ss.f.Fd.Name())
+		}
+		// the cached block can't refer to the mmap, which is unmapped when
+		// the table is closed
+		if fillCache && len(raw) > 0 && &raw[0] == &buf[0] {
+			raw = append([]byte{}, raw...)
+		}
+		buf = raw
+	} else if fillCache {
+		buf = append([]byte{}, buf...)
 	}
 	//f.ReadAt(buf, int64(offset))
 
 	block.Offset = int(offset)
 	block.Data = buf
 
-	offset = block.readEntryOffsets(buf)
-	block.entriesIndexStart = int(offset)
+	block.format = index.GetFormatVersion()
+	entriesIndexStart := block.readRestarts(buf)
+	block.entriesIndexStart = int(entriesIndexStart)
 	//buf = buf[:offset]
 
-	// TODO cache block
-
+	if fillCache {
+		t.blockCache.Add(t.fid, offset, block)
+	}
 	return block, nil
 }
 
@@ -243,12 +372,19 @@ type TableIterator struct {
 	blockPos  int
 	blockIter *BlockIterator
 	err       error
+	fillCache bool
+	pinned    bool // whether the file is pinned, the blocks read may refer to it
 }
 
 func (iter *TableIterator) GetFID() uint64 {
 	return iter.t.fid
 }
 
+// RangeDels return the range tombstones of the table
+func (iter *TableIterator) RangeDels() []*utils.RangeTombstone {
+	return iter.t.RangeDels()
+}
+
 func (t *Table) NewIterator(options *utils.Options) TableIterator {
 	//t.RLock()
 	t.IncrRef()
@@ -256,35 +392,30 @@ func (t *Table) NewIterator(options *utils.Options) TableIterator {
 		opt:       options,
 		t:         t,
 		blockIter: &BlockIterator{},
+		fillCache: true,
 	}
 }
 
+// SetFillCache set whether the blocks read by the iterator are added to the
+// block cache, it's true by default. Scans that read each block once should
+// not fill the cache, so that the hot blocks are not evicted
+func (iter *TableIterator) SetFillCache(fill bool) {
+	iter.fillCache = fill
+}
+
 func (iter *TableIterator) Next() {
-	if iter.blockPos >= len(iter.t.ss.Indexs().BlockOffsets) {
-		iter.err = io.EOF
-		return
-	}
-	if len(iter.blockIter.data) == 0 {
-		block, err := iter.t.readBlock(iter.blockPos)
-		if err != nil {
-			iter.err = err
-			return
-		}
-		iter.blockIter.setBlock(block, iter.t.opt.Comparable)
-		iter.blockIter.seekToFirst()
-		iter.err = iter.blockIter.Error()
-		iter.it = iter.blockIter.it
+	if iter.blockIter.block == nil {
+		iter.seekToFirst()
 		return
 	}
 	iter.blockIter.Next()
-	if !iter.blockIter.Valid() {
-		// read next block
-		iter.blockPos++
-		iter.blockIter.data = nil
-		iter.Next()
-		return
-	}
-	iter.it = iter.blockIter.it
+	iter.skipForward()
+}
+
+// Prev move to the previous entry
+func (iter *TableIterator) Prev() {
+	iter.blockIter.Prev()
+	iter.skipBackward()
 }
 
 func (iter *TableIterator) Valid() bool {
@@ -295,6 +426,15 @@ func (iter *TableIterator) Rewind() {
 	iter.seekToFirst()
 }
 
+// Last move to the last entry
+func (iter *TableIterator) Last() {
+	if !iter.loadBlock(len(iter.t.ss.Indexs().BlockOffsets) - 1) {
+		return
+	}
+	iter.blockIter.seekToLast()
+	iter.skipBackward()
+}
+
 func (iter *TableIterator) Item() utils.Item {
 	return iter.it
 }
@@ -302,76 +442,132 @@ func (iter *TableIterator) Item() utils.Item {
 func (iter *TableIterator) Close() error {
 	//iter.t.RUnlock()
 	iter.blockIter.Close()
+	if iter.pinned {
+		iter.pinned = false
+		if err := iter.t.Unpin(); err != nil {
+			iter.t.DecrRef(nil)
+			return err
+		}
+	}
 	return iter.t.DecrRef(nil)
 }
 
+// Seek move to the first entry whose key >= key
 func (iter *TableIterator) Seek(key []byte) {
 	index := iter.t.ss.Indexs()
-	filter := utils.Filter(index.Filter)
-	if iter.t.ss.HasBloomFilter() && !filter.MayContainKey(key) {
-		iter.err = io.EOF
+	// versions of a key may span blocks, so start from the last block whose
+	// first key < key
+	idx := sort.Search(len(index.BlockOffsets), func(i int) bool {
+		return iter.t.Compare(index.BlockOffsets[i].Key, key) >= 0
+	}) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if !iter.loadBlock(idx) {
 		return
 	}
-	idx := iter.t.findGreater(index, key)
-	if idx < 0 {
-		iter.err = io.EOF
+	iter.blockIter.Seek(key)
+	iter.skipForward()
+}
+
+// SeekForPrev move to the last entry whose key <= key
+func (iter *TableIterator) SeekForPrev(key []byte) {
+	index := iter.t.ss.Indexs()
+	idx := sort.Search(len(index.BlockOffsets), func(i int) bool {
+		return iter.t.Compare(index.BlockOffsets[i].Key, key) > 0
+	}) - 1
+	if !iter.loadBlock(idx) {
 		return
 	}
-	if idx > 0 && iter.t.Compare(index.BlockOffsets[idx].Key, key) == 0 {
-		// seek prev block first
-		block, err := iter.t.readBlock(idx - 1)
-		iter.blockIter.setBlock(block, iter.t.opt.Comparable)
-		iter.blockIter.seekToFirst()
-		iter.blockIter.Seek(key)
-		err = iter.blockIter.Error()
-		if err != nil {
-			//	iter.err = err
-			//	return
+	iter.blockIter.seekForPrev(key)
+	iter.skipBackward()
+}
+
+func (iter *TableIterator) seekToFirst() {
+	if !iter.loadBlock(0) {
+		return
+	}
+	iter.blockIter.seekToFirst()
+	iter.skipForward()
+}
+
+// loadBlock read the block at idx, the iterator is invalid if idx is out of
+// range
+func (iter *TableIterator) loadBlock(idx int) bool {
+	iter.blockPos = idx
+	if idx < 0 || idx >= len(iter.t.ss.Indexs().BlockOffsets) {
+		iter.err = io.EOF
+		return false
+	}
+	// the file is pinned until the iterator is closed, since the entries
+	// returned refer to it
+	if !iter.pinned {
+		if err := iter.t.Pin(); err != nil {
+			iter.err = err
+			return false
 		}
-		if iter.t.Compare(iter.blockIter.it.Entry().Key, key) == 0 {
-			iter.it = iter.blockIter.it
+		iter.pinned = true
+	}
+	block, err := iter.t.readBlock(idx, iter.fillCache)
+	if err != nil {
+		iter.err = err
+		return false
+	}
+	iter.blockIter.setBlock(block, iter.t.opt.Comparable)
+	return true
+}
+
+// skipForward move to the following blocks until an entry is found
+func (iter *TableIterator) skipForward() {
+	for !iter.blockIter.Valid() {
+		if !iter.loadBlock(iter.blockPos + 1) {
 			return
 		}
+		iter.blockIter.seekToFirst()
 	}
+	iter.err = nil
+	iter.it = iter.blockIter.it
+}
 
-	// search block
-	block, err := iter.t.readBlock(idx)
-	iter.blockIter.setBlock(block, iter.t.opt.Comparable)
-	iter.blockIter.seekToFirst()
-	iter.blockIter.Seek(key)
-	err = iter.blockIter.Error()
-	if err != nil {
-		//	iter.err = err
-		//	return
+// skipBackward move to the previous blocks until an entry is found
+func (iter *TableIterator) skipBackward() {
+	for !iter.blockIter.Valid() {
+		if !iter.loadBlock(iter.blockPos - 1) {
+			return
+		}
+		iter.blockIter.seekToLast()
 	}
+	iter.err = nil
 	iter.it = iter.blockIter.it
 }
 
-func (iter *TableIterator) seekToFirst() {
-	numBlocks := len(iter.t.ss.Indexs().BlockOffsets)
-	if numBlocks == 0 {
-		iter.err = io.EOF
-		return
+// ReadValue return the real value of the value stored in sst, which is
+// either the value itself or a pointer to the vlog
+func ReadValue(opt *utils.Options, value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
 	}
-	iter.blockPos = 0
-	block, err := iter.t.readBlock(iter.blockPos)
+	if value[0] == utils.VAL {
+		return value[1:], nil
+	}
+	// val ptr
+	fid := convert.BytesToU64(value[1:])
+	pos := convert.BytesToU32(value[9:])
+	vlog, err := openVLog(opt, fid)
 	if err != nil {
-		iter.err = err
-		return
+		return nil, err
 	}
-	iter.blockIter.setBlock(block, iter.t.opt.Comparable)
-	iter.blockIter.seekToFirst()
-	iter.it = iter.blockIter.Item()
-	iter.err = iter.blockIter.Error()
+	defer vlog.Close()
+	return vlog.ReadAt(pos)
 }
 
-func openVLog(opt *utils.Options, fid uint64) *vlog.VLogFile {
+// openVLog open the vlog of fid to read, a missing vlog is not created
+func openVLog(opt *utils.Options, fid uint64) (*vlog.VLogFile, error) {
 	fileOpt := &file.Options{
 		FID:      fid,
 		FileName: filepath.Join(opt.WorkDir, fmt.Sprintf("%05d%s", fid, utils.VLOG_FILE_EXT)),
 		Dir:      opt.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(opt.MemTableSize),
+		Flag:     os.O_RDONLY,
 	}
 	return vlog.OpenVLogFile(fileOpt)
 }
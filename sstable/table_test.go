@@ -1,21 +1,508 @@
 package sstable
 
 import (
+	"ckv/file"
 	"ckv/utils"
+	"ckv/utils/cmp"
+	"ckv/utils/codec"
+	"ckv/utils/compress"
+	"ckv/utils/convert"
+	"ckv/utils/errs"
+	"ckv/vlog"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIter(t *testing.T) {
 	opt := &utils.Options{
-		WorkDir:      "../work_test",
-		SSTableMaxSz: 0,
+		WorkDir:      t.TempDir(),
+		SSTableMaxSz: 1 << 14,
+		BlockSize:    1 << 10,
+		Comparable:   cmp.ByteComparator{},
+	}
+	n := 100
+	builder := NewTableBuiler(opt)
+	for i := 0; i < n; i++ {
+		val := append([]byte{utils.VAL}, []byte(fmt.Sprintf("val%03d", i))...)
+		builder.Add(&utils.Entry{Key: []byte(fmt.Sprintf("key%03d", i)), Value: val, Seq: uint64(i)}, false)
+	}
+	_, err := builder.Flush(file.FileNameSSTable(opt.WorkDir, 15))
+	assert.Nil(t, err)
+
+	table, err := OpenTable(opt, 15)
+	assert.Nil(t, err)
+	index, err := table.ReadIndex()
+	assert.Nil(t, err)
+	table.SetIndex(index)
+	iter := table.NewIterator(opt)
+	defer iter.Close()
+
+	i := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		assert.Equal(t, fmt.Sprintf("key%03d", i), string(e.Key))
+		assert.Equal(t, fmt.Sprintf("val%03d", i), string(e.Value[1:]))
+		i++
+	}
+	assert.Equal(t, n, i)
+
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		i--
+		assert.Equal(t, fmt.Sprintf("key%03d", i), string(iter.Item().Entry().Key))
+	}
+	assert.Equal(t, 0, i)
+
+	iter.Seek([]byte("key050a"))
+	assert.Equal(t, "key051", string(iter.Item().Entry().Key))
+	iter.Prev()
+	assert.Equal(t, "key050", string(iter.Item().Entry().Key))
+	iter.SeekForPrev([]byte("key050a"))
+	assert.Equal(t, "key050", string(iter.Item().Entry().Key))
+	iter.SeekForPrev([]byte("key070"))
+	assert.Equal(t, "key070", string(iter.Item().Entry().Key))
+	iter.Next()
+	assert.Equal(t, "key071", string(iter.Item().Entry().Key))
+	iter.Seek([]byte("key100"))
+	assert.False(t, iter.Valid())
+	iter.SeekForPrev([]byte("a"))
+	assert.False(t, iter.Valid())
+}
+
+func TestTableDelete(t *testing.T) {
+	opt := &utils.Options{
+		WorkDir:      t.TempDir(),
+		SSTableMaxSz: 1 << 14,
+		BlockSize:    1 << 10,
+		Comparable:   cmp.ByteComparator{},
+	}
+	builder := NewTableBuiler(opt)
+	for i := 0; i < 100; i++ {
+		e := &utils.Entry{Key: []byte(fmt.Sprintf("key%03d", i)), Seq: uint64(i + 1)}
+		if i%10 == 0 {
+			e.Meta = utils.BitDelete
+			e.Value = []byte{utils.VAL}
+		} else {
+			e.Value = append([]byte{utils.VAL}, []byte(fmt.Sprintf("val%03d", i))...)
+		}
+		builder.Add(e, false)
+	}
+	builder.AddRangeTombstone(&utils.RangeTombstone{Start: []byte("key050"), End: []byte("key060"), Seq: 100})
+	builder.AddRangeTombstone(&utils.RangeTombstone{Start: []byte("key100"), End: []byte("key200"), Seq: 100})
+	_, err := builder.Flush(file.FileNameSSTable(opt.WorkDir, 1))
+	assert.Nil(t, err)
+
+	table, err := OpenTable(opt, 1)
+	assert.Nil(t, err)
+	index, err := table.ReadIndex()
+	assert.Nil(t, err)
+	table.SetIndex(index)
+	assert.Equal(t, 2, len(table.RangeDels()))
+
+	for i := 0; i < 100; i++ {
+		e, err := table.Serach([]byte(fmt.Sprintf("key%03d", i)), math.MaxUint64)
+		assert.Nil(t, err)
+		if i%10 == 0 || (i >= 50 && i < 60) {
+			assert.True(t, e.IsDeleted(), i)
+			continue
+		}
+		assert.False(t, e.IsDeleted(), i)
+		assert.Equal(t, fmt.Sprintf("val%03d", i), string(e.Value))
+	}
+	// not in table, but deleted by range tombstone
+	e, err := table.Serach([]byte("key150"), math.MaxUint64)
+	assert.Nil(t, err)
+	assert.True(t, e.IsDeleted())
+	_, err = table.Serach([]byte("key200"), math.MaxUint64)
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+}
+
+func TestCompression(t *testing.T) {
+	random := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(random)
+	build := func(opt *utils.Options, fid uint64, incompressible bool) *Table {
+		builder := NewTableBuilerForLevel(opt, 1)
+		for i := 0; i < 300; i++ {
+			val := []byte(fmt.Sprintf(`{"id":%d,"name":"user%03d","active":true}`, i, i%10))
+			if incompressible {
+				val = random[i*100 : i*100+len(val)]
+			}
+			val = append([]byte{utils.VAL}, val...)
+			builder.Add(&utils.Entry{Key: []byte(fmt.Sprintf("key%03d", i)), Value: val, Seq: uint64(i + 1)}, false)
+		}
+		_, err := builder.Flush(file.FileNameSSTable(opt.WorkDir, fid))
+		assert.Nil(t, err)
+		table, err := OpenTable(opt, fid)
+		assert.Nil(t, err)
+		index, err := table.ReadIndex()
+		assert.Nil(t, err)
+		table.SetIndex(index)
+		return table
+	}
+
+	dir := t.TempDir()
+	var sizes []uint64
+	for i, typ := range []compress.Type{compress.None, compress.Flate, compress.LZ4} {
+		opt := &utils.Options{
+			WorkDir:      dir,
+			SSTableMaxSz: 1 << 16,
+			BlockSize:    1 << 10,
+			Comparable:   cmp.ByteComparator{},
+			// level 1 uses the last codec
+			Compression: []compress.Type{compress.None, typ},
+		}
+		for j, incompressible := range []bool{false, true} {
+			table := build(opt, uint64(i*2+j+1), incompressible)
+			assert.Equal(t, typ, table.Compression())
+			if !incompressible {
+				sizes = append(sizes, uint64(len(table.ss.f.Data)))
+			}
+			iter := table.NewIterator(opt)
+			n := 0
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				assert.Equal(t, fmt.Sprintf("key%03d", n), string(iter.Item().Entry().Key))
+				n++
+			}
+			assert.Equal(t, 300, n)
+			iter.Close()
+			e, err := table.Serach([]byte("key123"), math.MaxUint64)
+			assert.Nil(t, err)
+			if !incompressible {
+				assert.Equal(t, `{"id":123,"name":"user003","active":true}`, string(e.Value))
+			}
+			table.Close()
+		}
+	}
+	assert.Less(t, sizes[1], sizes[0]/2)
+	assert.Less(t, sizes[2], sizes[0]/2)
+}
+
+func TestBlockCache(t *testing.T) {
+	opt := &utils.Options{
+		WorkDir:      t.TempDir(),
+		SSTableMaxSz: 1 << 16,
+		BlockSize:    1 << 10,
+		Comparable:   cmp.ByteComparator{},
+	}
+	build := func(fid uint64, compression compress.Type) *Table {
+		opt.Compression = []compress.Type{compression}
+		builder := NewTableBuiler(opt)
+		for i := 0; i < 300; i++ {
+			val := append([]byte{utils.VAL}, []byte(fmt.Sprintf("val%03d", i))...)
+			builder.Add(&utils.Entry{Key: []byte(fmt.Sprintf("key%03d", i)), Value: val, Seq: uint64(i + 1)}, false)
+		}
+		_, err := builder.Flush(file.FileNameSSTable(opt.WorkDir, fid))
+		assert.Nil(t, err)
+		table, err := OpenTable(opt, fid)
+		assert.Nil(t, err)
+		index, err := table.ReadIndex()
+		assert.Nil(t, err)
+		table.SetIndex(index)
+		return table
+	}
+	scan := func(table *Table, fill bool) {
+		iter := table.NewIterator(opt)
+		iter.SetFillCache(fill)
+		n := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, fmt.Sprintf("key%03d", n), string(iter.Item().Entry().Key))
+			n++
+		}
+		assert.Equal(t, 300, n)
+		iter.Close()
+	}
+
+	c := NewBlockCache(1 << 20)
+	t1, t2 := build(1, compress.None), build(2, compress.LZ4)
+	t1.SetBlockCache(c)
+	t2.SetBlockCache(c)
+	blocks := len(t1.Index().BlockOffsets) + len(t2.Index().BlockOffsets)
+
+	// the scans that don't fill the cache
+	scan(t1, false)
+	assert.Equal(t, 0, c.Len())
+	scan(t1, true)
+	scan(t2, true)
+	assert.Equal(t, blocks, c.Len())
+	b1, err := t1.readBlock(0, true)
+	assert.Nil(t, err)
+	b2, err := t1.readBlock(0, true)
+	assert.Nil(t, err)
+	assert.True(t, b1 == b2)
+
+	// the cached blocks are valid after the table is closed
+	assert.Nil(t, t1.Close())
+	iter := &BlockIterator{}
+	iter.setBlock(b1, opt.Comparable)
+	iter.seekToFirst()
+	assert.Equal(t, "key000", string(iter.Item().Entry().Key))
+
+	// the blocks are removed with the table
+	assert.Nil(t, t2.DecrRef(nil))
+	assert.Equal(t, len(t1.Index().BlockOffsets), c.Len())
+
+	// the blocks are evicted when the cache is full
+	capacity := c.UsedBytes() / 2
+	c = NewBlockCache(capacity)
+	t3 := build(3, compress.Flate)
+	t3.SetBlockCache(c)
+	scan(t3, true)
+	assert.LessOrEqual(t, c.UsedBytes(), capacity)
+	assert.Less(t, c.Len(), len(t3.Index().BlockOffsets))
+	assert.Equal(t, uint64(0), c.Hits())
+	assert.Equal(t, uint64(len(t3.Index().BlockOffsets)), c.Misses())
+	assert.Nil(t, NewBlockCache(0))
+	t3.Close()
+}
+
+func TestTableReopen(t *testing.T) {
+	opt := &utils.Options{
+		WorkDir:      t.TempDir(),
+		SSTableMaxSz: 1 << 16,
+		BlockSize:    1 << 10,
+		Comparable:   cmp.ByteComparator{},
+	}
+	builder := NewTableBuiler(opt)
+	for i := 0; i < 300; i++ {
+		val := append([]byte{utils.VAL}, []byte(fmt.Sprintf("val%03d", i))...)
+		builder.Add(&utils.Entry{Key: []byte(fmt.Sprintf("key%03d", i)), Value: val, Seq: uint64(i + 1)}, false)
 	}
-	table := OpenTable(opt, 15)
+	name := file.FileNameSSTable(opt.WorkDir, 1)
+	_, err := builder.Flush(name)
+	assert.Nil(t, err)
+	table, err := OpenTable(opt, 1)
+	assert.Nil(t, err)
+	index, err := table.ReadIndex()
+	assert.Nil(t, err)
+	table.SetIndex(index)
+
+	// the file is closed when the opener unpins it, and the iterator reopens
+	// it until it's closed
+	assert.Nil(t, table.Unpin())
+	assert.False(t, table.Opened())
 	iter := table.NewIterator(opt)
+	assert.False(t, table.Opened())
+	n := 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, fmt.Sprintf("key%03d", n), string(iter.Item().Entry().Key))
+		n++
+	}
+	assert.Equal(t, 300, n)
+	assert.True(t, table.Opened())
+	assert.Nil(t, iter.Close())
+	assert.False(t, table.Opened())
+	e, err := table.Serach([]byte("key123"), math.MaxUint64)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val123"), e.Value)
+	assert.False(t, table.Opened())
+
+	// the closed file is removed by the last ref
+	assert.Nil(t, table.DecrRef(nil))
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
 
+func TestBlockRestarts(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("/tenants/acme/users/%05d/profile", i/3))
+	}
+	// 3 versions of each key, they span restart points
+	build := func(interval int) *Table {
+		opt := &utils.Options{
+			WorkDir:              t.TempDir(),
+			SSTableMaxSz:         1 << 20,
+			BlockSize:            4 << 10,
+			BlockRestartInterval: interval,
+			Comparable:           cmp.ByteComparator{},
+		}
+		builder := NewTableBuiler(opt)
+		for i := 0; i < 3000; i++ {
+			val := append([]byte{utils.VAL}, []byte(fmt.Sprintf("val%d", i))...)
+			builder.Add(&utils.Entry{Key: key(i), Value: val, Seq: uint64(3000 - i)}, false)
+		}
+		_, err := builder.Flush(file.FileNameSSTable(opt.WorkDir, 1))
+		assert.Nil(t, err)
+		table, err := OpenTable(opt, 1)
+		assert.Nil(t, err)
+		index, err := table.ReadIndex()
+		assert.Nil(t, err)
+		table.SetIndex(index)
+		return table
+	}
+
+	var sizes []uint64
+	for _, interval := range []int{1, 4, 16} {
+		table := build(interval)
+		sizes = append(sizes, uint64(len(table.ss.f.Data)))
+		iter := table.NewIterator(table.opt)
+		i := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			e := iter.Item().Entry()
+			assert.Equal(t, key(i), e.Key)
+			assert.Equal(t, fmt.Sprintf("val%d", i), string(e.Value[1:]))
+			i++
+		}
+		assert.Equal(t, 3000, i)
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			i--
+			assert.Equal(t, key(i), iter.Item().Entry().Key)
+			assert.Equal(t, uint64(3000-i), iter.Item().Entry().Seq)
+		}
+		assert.Equal(t, 0, i)
+
+		for _, k := range []int{0, 1, 500, 999} {
+			// the newest version is the first one
+			iter.Seek(key(k * 3))
+			assert.Equal(t, key(k*3), iter.Item().Entry().Key)
+			assert.Equal(t, uint64(3000-k*3), iter.Item().Entry().Seq)
+			// the oldest version is the last one
+			iter.SeekForPrev(key(k * 3))
+			assert.Equal(t, key(k*3), iter.Item().Entry().Key)
+			assert.Equal(t, uint64(3000-k*3-2), iter.Item().Entry().Seq)
+		}
+		iter.Seek(append(key(1500), 0))
+		assert.Equal(t, key(1503), iter.Item().Entry().Key)
+		iter.SeekForPrev([]byte("/tenants/acme/users/"))
+		assert.False(t, iter.Valid())
+		assert.Nil(t, iter.Close())
+
+		e, err := table.Serach(key(1500), 3000-1501)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("val1501"), e.Value)
+		assert.Nil(t, table.DecrRef(nil))
+	}
+	assert.Less(t, sizes[1], sizes[0]*2/3)
+	assert.Less(t, sizes[2], sizes[1])
+}
+
+func TestLargeKey(t *testing.T) {
+	opt := &utils.Options{
+		WorkDir:      t.TempDir(),
+		SSTableMaxSz: 1 << 20,
+		BlockSize:    4 << 10,
+		Comparable:   cmp.ByteComparator{},
+	}
+	// the keys are longer than 64KiB and share a prefix of the same length
+	prefix := make([]byte, 70000)
+	for i := range prefix {
+		prefix[i] = byte('a' + i%26)
+	}
+	key := func(i int) []byte {
+		return append(append([]byte{}, prefix...), fmt.Sprintf("%03d", i)...)
+	}
+	builder := NewTableBuiler(opt)
+	for i := 0; i < 10; i++ {
+		val := append([]byte{utils.VAL}, []byte(fmt.Sprintf("val%03d", i))...)
+		builder.Add(&utils.Entry{Key: key(i), Value: val, Seq: uint64(i + 1)}, false)
+	}
+	_, err := builder.Flush(file.FileNameSSTable(opt.WorkDir, 1))
+	assert.Nil(t, err)
+	table, err := OpenTable(opt, 1)
+	assert.Nil(t, err)
+	index, err := table.ReadIndex()
+	assert.Nil(t, err)
+	table.SetIndex(index)
+
+	iter := table.NewIterator(opt)
+	i := 0
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		e := iter.Item().Entry()
-		fmt.Println(string(e.Key), string(e.Value))
+		assert.Equal(t, key(i), e.Key)
+		assert.Equal(t, fmt.Sprintf("val%03d", i), string(e.Value[1:]))
+		i++
+	}
+	assert.Equal(t, 10, i)
+	iter.Seek(key(5))
+	assert.Equal(t, key(5), iter.Item().Entry().Key)
+	assert.Nil(t, iter.Close())
+	assert.Nil(t, table.DecrRef(nil))
+}
+
+func TestLegacyBlock(t *testing.T) {
+	for _, format := range []uint32{formatLegacy, formatBlockTrailer} {
+		testLegacyBlock(t, format)
+	}
+}
+
+// testLegacyBlock test the block of format before formatRestarts, whose keys
+// are prefix compressed by the first key, and the offsets of all entries are
+// stored
+func testLegacyBlock(t *testing.T, format uint32) {
+	var data []byte
+	var offsets []uint32
+	base := []byte("key000")
+	for i := 0; i < 20; i++ {
+		k := []byte(fmt.Sprintf("key%03d", i))
+		overlap := 0
+		if i > 0 {
+			for overlap < len(k) && k[overlap] == base[overlap] {
+				overlap++
+			}
+		}
+		offsets = append(offsets, uint32(len(data)))
+		data = append(data, Header{Overlap: uint16(overlap), Diff: uint16(len(k) - overlap)}.encode()...)
+		data = append(data, k[overlap:]...)
+		if format == formatLegacy {
+			// the plain seq without expiration
+			data = append(data, convert.U64ToBytes(uint64(i+1))...)
+		} else {
+			data = append(data, convert.U64ToBytes(uint64(i+1)<<8|uint64(utils.TypeValue))...)
+			data = append(data, 0)
+		}
+		data = append(data, fmt.Sprintf("val%03d", i)...)
+	}
+	data = append(data, convert.U32SliceToBytes(offsets)...)
+	data = append(data, convert.U32ToBytes(uint32(len(offsets)))...)
+	checksum := convert.U64ToBytes(codec.CalculateChecksum(data))
+	data = append(data, checksum...)
+	data = append(data, convert.U32ToBytes(uint32(len(checksum)))...)
+
+	block := &Block{format: format}
+	block.entriesIndexStart = int(block.readRestarts(data))
+	iter := &BlockIterator{}
+	iter.setBlock(block, cmp.ByteComparator{})
+	i := 0
+	for iter.seekToFirst(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		assert.Equal(t, fmt.Sprintf("key%03d", i), string(e.Key))
+		assert.Equal(t, fmt.Sprintf("val%03d", i), string(e.Value))
+		assert.Equal(t, uint64(i+1), e.Seq)
+		assert.Equal(t, utils.TypeValue, e.ValueType())
+		i++
 	}
+	assert.Equal(t, 20, i)
+	iter.Seek([]byte("key010a"))
+	assert.Equal(t, "key011", string(iter.Item().Entry().Key))
+	iter.Prev()
+	assert.Equal(t, "key010", string(iter.Item().Entry().Key))
+	iter.seekForPrev([]byte("key010a"))
+	assert.Equal(t, "key010", string(iter.Item().Entry().Key))
+}
+
+func TestReadValue(t *testing.T) {
+	opt := &utils.Options{WorkDir: t.TempDir()}
+	ptr := func(fid uint64, pos uint32) []byte {
+		value := append([]byte{utils.VAL_PTR}, convert.U64ToBytes(fid)...)
+		return append(value, convert.U32ToBytes(pos)...)
+	}
+	name := file.FileNameVLog(opt.WorkDir, 1)
+	vf, err := vlog.OpenVLogFile(&file.Options{FID: 1, FileName: name, Flag: os.O_CREATE | os.O_RDWR})
+	assert.Nil(t, err)
+	assert.Nil(t, vf.Write(&utils.Entry{Key: []byte("key"), Value: []byte("value")}))
+	assert.Nil(t, vf.Close())
+
+	value, err := ReadValue(opt, ptr(1, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	// a missing vlog is an error, and it's not created by the read
+	_, err = ReadValue(opt, ptr(2, 0))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = os.Stat(file.FileNameVLog(opt.WorkDir, 2))
+	assert.True(t, os.IsNotExist(err))
 }
@@ -25,6 +25,9 @@ type Arena struct {
 	buf []byte
 	//remaining uint32 // 剩余可用内存
 	offset uint32
+	// nodes are allocated in go heap, because the gc can't see the pointers
+	// that stored in buf. nodeSize is only used to count the memory usage
+	nodeSize uint32
 	//usage     uint64 // 已经分配的总量
 	//shouldGrow bool
 }
@@ -32,9 +35,11 @@ type Arena struct {
 // newArena returns a new arena.
 func NewArena() *Arena {
 	// Don't store data at position 0 in order to reserve offset=0 as a kind
-	// of nil pointer.
+	// of nil pointer. The first 8 bytes are skipped, so a node without
+	// internal key still could read its seq before value.
 	arena := &Arena{
-		buf: make([]byte, 3*kBlockSize),
+		buf:    make([]byte, 3*kBlockSize),
+		offset: 8,
 		//buf: make([]byte, kBlockSize),
 		//remaining: kBlockSize,
 	}
@@ -61,21 +66,16 @@ func (s *Arena) Allocate(bytes uint32) uint32 {
 
 func (s *Arena) size() int64 {
 	//return int64(atomic.LoadUint64(&s.usage))
-	return int64(atomic.LoadUint32(&s.offset))
+	return int64(atomic.LoadUint32(&s.offset)) + int64(atomic.LoadUint32(&s.nodeSize))
 }
 
-// ------------------------------------------
-// | key length | key | value length | value|
-// ------------------------------------------
-func (s *Arena) putNode(height int) uint32 {
+// putNode allocate a node with the given height
+func (s *Arena) putNode(height int) *Node {
 	//l := nodeSize + (height-1)*nodePtrSize + nodeAlign
 	unusedSize := (kMaxHeight - height) * nodePtrSize
-	l := uint32(MaxNodeSize - unusedSize + nodeAlign)
-	n := s.Allocate(uint32(l))
-
-	// Return the aligned offset.
-	m := (n + uint32(nodeAlign)) & ^uint32(nodeAlign)
-	return m
+	l := uint32(MaxNodeSize - unusedSize)
+	atomic.AddUint32(&s.nodeSize, l)
+	return &Node{}
 }
 
 func (s *Arena) putVal(v []byte) uint32 {
@@ -133,13 +133,6 @@ func (s *Arena) PutVal(val []byte, offset uint32) uint32 {
 	return uint32(w)
 }
 
-func (s *Arena) getNode(offset uint32) *Node {
-	//if offset == 0 {
-	//	return nil
-	//}
-	return (*Node)(unsafe.Pointer(&s.buf[offset]))
-}
-
 func (s *Arena) getVal(offset uint32) ([]byte, int) {
 	//DecodeValue(s.buf[offset : offset+size])
 	buf := s.buf[offset:]
@@ -0,0 +1,46 @@
+package utils
+
+import "sync"
+
+// Closer is used to stop background goroutines and wait until they exit
+type Closer struct {
+	waiting     sync.WaitGroup
+	CloseSignal chan struct{}
+	once        sync.Once
+}
+
+// NewCloser _
+func NewCloser() *Closer {
+	return &Closer{
+		waiting:     sync.WaitGroup{},
+		CloseSignal: make(chan struct{}),
+	}
+}
+
+// Add register n goroutines that should be waited
+func (c *Closer) Add(n int) {
+	c.waiting.Add(n)
+}
+
+// Done mark a goroutine as exited
+func (c *Closer) Done() {
+	c.waiting.Done()
+}
+
+// Close send the close signal and wait for all goroutines to exit
+func (c *Closer) Close() {
+	c.once.Do(func() {
+		close(c.CloseSignal)
+	})
+	c.waiting.Wait()
+}
+
+// Closed return whether the close signal has been sent
+func (c *Closer) Closed() bool {
+	select {
+	case <-c.CloseSignal:
+		return true
+	default:
+		return false
+	}
+}
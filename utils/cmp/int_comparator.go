@@ -13,10 +13,8 @@ func (cmp IntComparator) Compare(a, b []byte) int {
 	}
 	if sa < sb {
 		return -1
-	} else {
-		return 1
 	}
-	return 0
+	return 1
 }
 
 func calc(key []byte) int {
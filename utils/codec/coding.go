@@ -172,5 +172,4 @@ func ReadUVarint32(reader *bufio.Reader) (uint32, error) {
 			return val, nil
 		}
 	}
-	return val, nil
 }
@@ -0,0 +1,23 @@
+package utils
+
+// CompactionDecision is what a CompactionFilter does with an entry
+type CompactionDecision int
+
+const (
+	// CompactionKeep keep the entry as it is
+	CompactionKeep CompactionDecision = iota
+	// CompactionRemove delete the key, the older versions are hidden too
+	CompactionRemove
+	// CompactionChangeValue replace the value with the new value
+	CompactionChangeValue
+)
+
+// CompactionFilter is called for each surviving key in compaction, so that
+// the application can drop or rewrite the entries in background instead of
+// issuing deletes. The versions visible to live snapshots are not filtered
+type CompactionFilter interface {
+	// Filter decide what to do with the entry that is written to level. The
+	// value is read from vlog only when value is called. newValue is used by
+	// CompactionChangeValue
+	Filter(level int, key []byte, value func() ([]byte, error), seq uint64) (decision CompactionDecision, newValue []byte)
+}
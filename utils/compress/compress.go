@@ -0,0 +1,74 @@
+package compress
+
+import (
+	"ckv/utils/errs"
+	"fmt"
+)
+
+// Type identify the codec of a compressed block, it's stored with the block
+type Type byte
+
+const (
+	// None store the block as is
+	None Type = iota
+	// Flate compress the block with compress/flate, it has the best ratio
+	Flate
+	// LZ4 compress the block in the lz4 block format, it's much faster
+	// than Flate with a lower ratio
+	LZ4
+)
+
+// Codec compress and decompress blocks
+type Codec interface {
+	// Name is used in logs and errors
+	Name() string
+	// Encode append the compressed src to dst
+	Encode(dst, src []byte) []byte
+	// Decode append the decompressed src to dst
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+var codecs = map[Type]Codec{
+	None:  noneCodec{},
+	Flate: flateCodec{},
+	LZ4:   lz4Codec{},
+}
+
+// Register add a codec of type t, the types below 16 are reserved for the
+// builtin codecs. It must be called before the db is opened, and the codec
+// must be registered to read the tables built with it
+func Register(t Type, c Codec) {
+	errs.CondPanic(t < 16, fmt.Errorf("compression type %d is reserved", t))
+	codecs[t] = c
+}
+
+// Lookup return the codec of type t
+func Lookup(t Type) (Codec, error) {
+	c, ok := codecs[t]
+	if !ok {
+		return nil, errs.ErrUnknownCompression
+	}
+	return c, nil
+}
+
+// String _
+func (t Type) String() string {
+	if c, ok := codecs[t]; ok {
+		return c.Name()
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) Encode(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noneCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
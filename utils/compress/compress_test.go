@@ -0,0 +1,50 @@
+package compress
+
+import (
+	"bytes"
+	"ckv/utils/errs"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	var json bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&json, `{"id":%d,"name":"user%d","tags":["a","b"],"active":true}`, i, i%7)
+	}
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcdefghijkl"),
+		bytes.Repeat([]byte("a"), 1000),
+		json.Bytes(),
+		random,
+	}
+	for _, typ := range []Type{None, Flate, LZ4} {
+		c, err := Lookup(typ)
+		assert.Nil(t, err)
+		for i, src := range inputs {
+			encoded := c.Encode([]byte("prefix"), src)
+			assert.Equal(t, []byte("prefix"), encoded[:6])
+			decoded, err := c.Decode([]byte("x"), encoded[6:])
+			assert.Nil(t, err, "%s %d", typ, i)
+			assert.Equal(t, append([]byte("x"), src...), decoded, "%s %d", typ, i)
+		}
+		if typ != None {
+			encoded := c.Encode(nil, json.Bytes())
+			assert.Less(t, len(encoded), json.Len()/4, typ.String())
+		}
+	}
+
+	c, _ := Lookup(LZ4)
+	encoded := c.Encode(nil, json.Bytes())
+	_, err := c.Decode(nil, encoded[:len(encoded)/2])
+	assert.Equal(t, errs.ErrCorruptBlock, err)
+	_, err = Lookup(100)
+	assert.Equal(t, errs.ErrUnknownCompression, err)
+}
@@ -0,0 +1,44 @@
+package compress
+
+import (
+	"bytes"
+	"ckv/utils/errs"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// the flate writers allocate hundreds of KB, they are reused across blocks
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Encode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	// writes to a bytes.Buffer never fail
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, errs.ErrCorruptBlock
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+package compress
+
+import (
+	"ckv/utils/errs"
+	"encoding/binary"
+)
+
+// lz4 block format, prefixed by the uvarint length of the raw data. Each
+// sequence is
+//
+//	+-------------------------------------------------------------------+
+//	| token | literal len ... | literals | offset | match len ...         |
+//	+-------------------------------------------------------------------+
+//
+// the high 4 bits of token is the literal length and the low 4 bits is the
+// match length minus 4, 15 means the rest follows in bytes of 255 ended by a
+// smaller one. The last sequence has literals only
+const (
+	lz4MinMatch     = 4
+	lz4HashLog      = 12
+	lz4MaxOffset    = 1<<16 - 1
+	lz4LastLiterals = 5  // the last 5 bytes are always literals
+	lz4MFLimit      = 12 // a match can't start in the last 12 bytes
+)
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string {
+	return "lz4"
+}
+
+func (lz4Codec) Encode(dst, src []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	dst = append(dst, buf[:binary.PutUvarint(buf[:], uint64(len(src)))]...)
+
+	// table hold the last position + 1 of each hashed 4 bytes
+	var table [1 << lz4HashLog]int32
+	anchor := 0
+	for i := 0; i < len(src)-lz4MFLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i, ref = i-1, ref-1
+		}
+		n := lz4MinMatch
+		for end := len(src) - lz4LastLiterals; i+n < end && src[i+n] == src[ref+n]; n++ {
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence append the literals and the match, matchLen 0 means the
+// last sequence
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	var token byte
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	ml := matchLen - lz4MinMatch
+	if matchLen > 0 {
+		if ml >= 15 {
+			token |= 15
+		} else {
+			token |= byte(ml)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLen(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if ml >= 15 {
+		dst = lz4AppendLen(dst, ml-15)
+	}
+	return dst
+}
+
+func lz4AppendLen(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func (lz4Codec) Decode(dst, src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	// a byte expands to 255 bytes at most
+	if n <= 0 || size > uint64(len(src))*255 {
+		return nil, errs.ErrCorruptBlock
+	}
+	src = src[n:]
+	start := len(dst)
+	if cap(dst)-start < int(size) {
+		tmp := make([]byte, start, start+int(size))
+		copy(tmp, dst)
+		dst = tmp
+	}
+	var ok bool
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			if litLen, i, ok = lz4ReadLen(src, i, litLen); !ok {
+				return nil, errs.ErrCorruptBlock
+			}
+		}
+		if i+litLen > len(src) {
+			return nil, errs.ErrCorruptBlock
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return nil, errs.ErrCorruptBlock
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			if matchLen, i, ok = lz4ReadLen(src, i, matchLen); !ok {
+				return nil, errs.ErrCorruptBlock
+			}
+		}
+		matchLen += lz4MinMatch
+		pos := len(dst) - offset
+		if offset == 0 || pos < start {
+			return nil, errs.ErrCorruptBlock
+		}
+		// the match may overlap the bytes it produces, so copy byte by byte
+		for j := 0; j < matchLen; j++ {
+			dst = append(dst, dst[pos+j])
+		}
+	}
+	if len(dst)-start != int(size) {
+		return nil, errs.ErrCorruptBlock
+	}
+	return dst, nil
+}
+
+// lz4ReadLen add the length bytes at i to n, and return the position after
+// them
+func lz4ReadLen(src []byte, i, n int) (int, int, bool) {
+	for {
+		if i >= len(src) {
+			return 0, 0, false
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, true
+		}
+	}
+}
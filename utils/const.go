@@ -9,3 +9,18 @@ const (
 const (
 	VLOG_FILE_EXT string = ".vlog"
 )
+
+// value types, stored in the lowest byte of the tag (seq<<8 | type)
+const (
+	TypeDeletion      byte = 0x0
+	TypeValue         byte = 0x1
+	TypeRangeDeletion byte = 0x2
+	TypeMerge         byte = 0x3
+)
+
+// bits of Entry.Meta
+const (
+	BitDelete      byte = 1 << 0 // the key is deleted
+	BitRangeDelete byte = 1 << 1 // keys in [Key, Value) are deleted
+	BitMerge       byte = 1 << 2 // the value is a merge operand
+)
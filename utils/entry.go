@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"ckv/utils/cmp"
 	"ckv/utils/convert"
 	"encoding/binary"
 	"time"
@@ -70,6 +71,9 @@ type Entry struct {
 	Value     []byte
 	Seq       uint64
 	ExpiresAt uint64
+	// ColumnFamily is the id of the column family that the entry belongs
+	// to, 0 is the default one
+	ColumnFamily uint32
 
 	KeySize uint32
 
@@ -93,12 +97,94 @@ func (e *Entry) Entry() *Entry {
 	return e
 }
 
+// IsDeleted return whether the entry is a deletion tombstone
+func (e *Entry) IsDeleted() bool {
+	return e.Meta&BitDelete > 0
+}
+
+// IsRangeDeleted return whether the entry is a range deletion tombstone
+func (e *Entry) IsRangeDeleted() bool {
+	return e.Meta&BitRangeDelete > 0
+}
+
+// IsMerge return whether the entry is a merge operand
+func (e *Entry) IsMerge() bool {
+	return e.Meta&BitMerge > 0
+}
+
+// ValueType return the value type that stored in tag
+func (e *Entry) ValueType() byte {
+	switch {
+	case e.IsRangeDeleted():
+		return TypeRangeDeletion
+	case e.IsDeleted():
+		return TypeDeletion
+	case e.IsMerge():
+		return TypeMerge
+	default:
+		return TypeValue
+	}
+}
+
+// MetaOfType return the Entry.Meta of value type
+func MetaOfType(typ byte) byte {
+	switch typ {
+	case TypeRangeDeletion:
+		return BitRangeDelete
+	case TypeDeletion:
+		return BitDelete
+	case TypeMerge:
+		return BitMerge
+	default:
+		return 0
+	}
+}
+
+// RangeTombstone deletes keys in [Start, End) whose seq is smaller than Seq
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// Contains return whether key is in [Start, End)
+func (t *RangeTombstone) Contains(cmp cmp.Comparator, key []byte) bool {
+	return cmp.Compare(t.Start, key) <= 0 && cmp.Compare(key, t.End) < 0
+}
+
+// Overlap return whether [Start, End) overlaps with [smallest, largest]
+func (t *RangeTombstone) Overlap(cmp cmp.Comparator, smallest, largest []byte) bool {
+	return cmp.Compare(t.Start, largest) <= 0 && cmp.Compare(smallest, t.End) < 0
+}
+
+// MaxCoveringSeq return the max seq of tombstones that contain key and are
+// visible to seq. 0 means key is not covered.
+func MaxCoveringSeq(tombstones []*RangeTombstone, cmp cmp.Comparator, key []byte, seq uint64) uint64 {
+	var max uint64
+	for _, t := range tombstones {
+		if t.Seq <= seq && t.Seq > max && t.Contains(cmp, key) {
+			max = t.Seq
+		}
+	}
+	return max
+}
+
 // WithTTL _
 func (e *Entry) WithTTL(dur time.Duration) *Entry {
 	e.ExpiresAt = uint64(time.Now().Add(dur).Unix())
 	return e
 }
 
+// IsExpired return whether the entry has expired. 0 means never expire
+func (e *Entry) IsExpired() bool {
+	return IsExpired(e.ExpiresAt)
+}
+
+// IsExpired return whether expiresAt, in unix seconds, has passed
+func IsExpired(expiresAt uint64) bool {
+	return expiresAt > 0 && expiresAt <= uint64(time.Now().Unix())
+}
+
 // EncodedSize is the size of the ValueStruct when encoded
 func (e *Entry) EncodedSize() uint32 {
 	sz := len(e.Value)
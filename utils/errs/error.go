@@ -23,6 +23,60 @@ var (
 
 	// ErrChecksumMismatch is returned at checksum mismatch.
 	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrDBClosed is returned when the database has been closed.
+	ErrDBClosed = errors.New("DB has been closed")
+
+	// ErrBatchCorrupted is returned when a write batch can't be decoded.
+	ErrBatchCorrupted = errors.New("write batch is corrupted")
+
+	// ErrUnknownWALFormat is returned when a wal file is neither in the
+	// current format nor in the legacy one. The file is kept for inspection
+	// instead of being replayed as empty and removed.
+	ErrUnknownWALFormat = errors.New("unknown wal format")
+
+	// ErrUnknownVLogRecord is returned when the type of a vlog record is
+	// not a known record format.
+	ErrUnknownVLogRecord = errors.New("unknown vlog record type")
+
+	// ErrNoMergeOperator is returned when a merge is written or read without
+	// Options.MergeOperator.
+	ErrNoMergeOperator = errors.New("merge operator is not set")
+
+	// ErrMergeOperatorMismatch is returned when the db is opened with a merge
+	// operator other than the one it's created with.
+	ErrMergeOperatorMismatch = errors.New("merge operator does not match")
+
+	// ErrColumnFamilyExists is returned when a column family is created with
+	// the name of a live one.
+	ErrColumnFamilyExists = errors.New("column family already exists")
+
+	// ErrColumnFamilyNotFound is returned when a column family doesn't exist
+	// or has been dropped.
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+
+	// ErrEmptyColumnFamilyName is returned when a column family is created
+	// without name.
+	ErrEmptyColumnFamilyName = errors.New("column family name is empty")
+
+	// ErrDropDefaultColumnFamily is returned when the default column family
+	// is dropped.
+	ErrDropDefaultColumnFamily = errors.New("default column family can't be dropped")
+
+	// ErrConflict is returned when a transaction is committed, but a key it
+	// read or wrote has been written by others after it begins.
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrTxnDone is returned when a transaction is used after it's committed
+	// or discarded.
+	ErrTxnDone = errors.New("transaction has been committed or discarded")
+
+	// ErrUnknownCompression is returned when a block is compressed by a codec
+	// that is not registered, or such a codec is set in the options.
+	ErrUnknownCompression = errors.New("unknown compression type")
+
+	// ErrCorruptBlock is returned when a compressed block can't be decoded.
+	ErrCorruptBlock = errors.New("corrupt compressed block")
 )
 
 // Err err
@@ -8,6 +8,11 @@ type Iterator interface {
 	Item() Item
 	Close() error
 	Seek(key []byte)
+	// SeekForPrev move to the last key <= key
+	SeekForPrev(key []byte)
+	Prev()
+	// Last move to the last key
+	Last()
 }
 
 // Item _
@@ -0,0 +1,67 @@
+package utils
+
+import "ckv/utils/errs"
+
+// MergeOperator resolve the operands written by Merge, so that a read-modify-
+// write, such as increasing a counter, doesn't need a read. The operands are
+// applied to the existing value when the key is read, and they are combined
+// in compaction
+type MergeOperator interface {
+	// Name identify the operator. It's recorded in manifest, the db can't be
+	// opened with an operator of another name
+	Name() string
+	// FullMerge apply the operands, oldest first, to the existing value,
+	// which is nil if the key doesn't exist or is deleted
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge combine two operands into one, left is older than right.
+	// It returns false if they can't be combined without the existing value
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
+
+// MergeContext collect the merge operands of a key from the newest to the
+// oldest, until the version they are applied to is found
+type MergeContext struct {
+	operands [][]byte
+	seq      uint64 // the seq of the newest operand
+}
+
+// Push add an operand that is older than the collected ones
+func (c *MergeContext) Push(e *Entry) {
+	if len(c.operands) == 0 {
+		c.seq = e.Seq
+	}
+	c.operands = append(c.operands, e.Value)
+}
+
+// Empty return whether no operand is collected
+func (c *MergeContext) Empty() bool {
+	return len(c.operands) == 0
+}
+
+// Seq return the seq of the newest operand
+func (c *MergeContext) Seq() uint64 {
+	return c.seq
+}
+
+// Resolve apply the collected operands to base, which is nil if the key
+// doesn't exist. A deleted or expired base is the same as nil. The result has
+// the seq of the newest operand
+func (c *MergeContext) Resolve(op MergeOperator, key []byte, base *Entry) (*Entry, error) {
+	if op == nil {
+		return nil, errs.ErrNoMergeOperator
+	}
+	var existing []byte
+	var expiresAt uint64
+	if base != nil && !base.IsDeleted() && !base.IsExpired() {
+		existing, expiresAt = base.Value, base.ExpiresAt
+	}
+	operands := make([][]byte, len(c.operands))
+	for i, o := range c.operands {
+		operands[len(operands)-1-i] = o
+	}
+	value, err := op.FullMerge(key, existing, operands)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Key: key, Value: value, Seq: c.seq, ExpiresAt: expiresAt}, nil
+}
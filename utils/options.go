@@ -1,6 +1,22 @@
 package utils
 
-import "ckv/utils/cmp"
+import (
+	"ckv/utils/cmp"
+	"ckv/utils/compress"
+	"time"
+)
+
+// WALSyncMode control when the wal is flushed to disk
+type WALSyncMode int
+
+const (
+	// WALSyncNone never sync the wal, the durability depends on the os
+	WALSyncNone WALSyncMode = iota
+	// WALSyncAlways sync the wal before each write is acknowledged
+	WALSyncAlways
+	// WALSyncInterval sync the wal every WALSyncInterval in background
+	WALSyncInterval
+)
 
 // TODO options
 // Options to control the behavior of a database (passed to DB::Open)
@@ -9,19 +25,136 @@ type Options struct {
 	WorkDir        string
 	MemTableSize   int64 // the threshold to turn memTable to immutable memTable
 	SSTableMaxSz   int64 // the threshold to compact
-	TableCacheSize int64 // the size of cache to store table
-	BlockCacheSize int64 // the size of cache size to store block
+	TableCacheSize int64 // the max number of tables whose files are kept opened, 100 by default
+	BlockCacheSize int64 // the bytes of decoded blocks cached, 8MB by default, < 0 means no cache
 	BlockSize      int32 // the size of data block in sst
 
+	// BlockRestartInterval is the number of keys between restart points in
+	// a data block, 16 by default. The keys between them share prefix with
+	// the previous key, a larger interval makes smaller blocks and slower seeks
+	BlockRestartInterval int
+
+	// Compression is the codec of data blocks in each level, the levels
+	// deeper than it use the last one, and memtables are flushed with the
+	// codec of level 0. nil means no compression
+	Compression []compress.Type
+
 	//MaxBatchCount       int64
 	//MaxBatchSize        int64 // max batch size in bytes
 	//ValueLogFileSize    int
 	//VerifyValueChecksum bool
 	//ValueLogMaxEntries  uint32
 	LogRotatesToFlush  int32
-	MaxTableSize       int64
+	MaxTableSize       int64 // the target size of sst built by compaction, 2MB by default
 	BloomFalsePositive float64
 	MaxLevelNum        int // max level of sst
 
+	WALSyncMode     WALSyncMode
+	WALSyncInterval time.Duration // the interval of WALSyncInterval mode, 1s by default
+
+	MaxManifestSize int64 // the manifest is rewritten as a snapshot when it's larger than this, 4MB by default
+	NumCompactors   int   // the number of background compaction workers, 1 by default
+
+	CompactionFilter CompactionFilter // called for each surviving key in compaction, nil means no filter
+	FilterOnFlush    bool             // call CompactionFilter for the entries flushed from memtable too
+
+	MergeOperator MergeOperator // resolve the operands written by Merge, nil means Merge is not supported
+
+	// ColumnFamilies is the options of the column families that are reopened
+	// with the db, the missing ones use the options of the db
+	ColumnFamilies map[string]*Options
+
 	Comparable cmp.Comparator
 }
+
+// ColumnFamilyOptions return the options of the column family name. cfOpt nil
+// means the options in ColumnFamilies. The files, wal and background work are
+// shared by column families, so their settings are taken from opt, as well as
+// the sizes that are not set in cfOpt
+func (opt *Options) ColumnFamilyOptions(name string, cfOpt *Options) *Options {
+	if cfOpt == nil {
+		if cfOpt = opt.ColumnFamilies[name]; cfOpt == nil {
+			cfOpt = opt
+		}
+	}
+	res := *cfOpt
+	res.WorkDir = opt.WorkDir
+	res.WALSyncMode, res.WALSyncInterval = opt.WALSyncMode, opt.WALSyncInterval
+	res.MaxManifestSize, res.NumCompactors = opt.MaxManifestSize, opt.NumCompactors
+	res.ColumnFamilies = nil
+	if res.MemTableSize <= 0 {
+		res.MemTableSize = opt.MemTableSize
+	}
+	if res.SSTableMaxSz <= 0 {
+		res.SSTableMaxSz = opt.SSTableMaxSz
+	}
+	if res.BlockSize <= 0 {
+		res.BlockSize = opt.BlockSize
+	}
+	if res.BlockRestartInterval <= 0 {
+		res.BlockRestartInterval = opt.BlockRestartInterval
+	}
+	if res.MaxLevelNum <= 0 {
+		res.MaxLevelNum = opt.MaxLevelNum
+	}
+	if res.Comparable == nil {
+		res.Comparable = cmp.ByteComparator{}
+	}
+	return &res
+}
+
+// CheckCompression return errs.ErrUnknownCompression if any codec in
+// Compression, or in the options of ColumnFamilies, is not registered
+func (opt *Options) CheckCompression() error {
+	for _, typ := range opt.Compression {
+		if _, err := compress.Lookup(typ); err != nil {
+			return err
+		}
+	}
+	for _, cfOpt := range opt.ColumnFamilies {
+		if cfOpt == nil {
+			continue
+		}
+		if err := cfOpt.CheckCompression(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompressionOfLevel return the codec of data blocks in level
+func (opt *Options) CompressionOfLevel(level int) compress.Type {
+	if len(opt.Compression) == 0 {
+		return compress.None
+	}
+	if level >= len(opt.Compression) {
+		level = len(opt.Compression) - 1
+	}
+	return opt.Compression[level]
+}
+
+// ReadOptions control the behavior of read operations
+type ReadOptions struct {
+	// LowerBound is the inclusive lower bound of iterators, nil means no bound
+	LowerBound []byte
+	// UpperBound is the exclusive upper bound of iterators, nil means no bound
+	UpperBound []byte
+	// Snapshot read the db as of the snapshot, nil means the latest state
+	Snapshot *Snapshot
+	// FillCache add the blocks read by iterators to the block cache. Long
+	// scans should turn it off, so that they don't evict the hot blocks. It's
+	// true in NewReadOptions, and for nil ReadOptions
+	FillCache bool
+}
+
+// NewReadOptions return the default ReadOptions
+func NewReadOptions() *ReadOptions {
+	return &ReadOptions{FillCache: true}
+}
+
+// WriteOptions control the behavior of write operations
+type WriteOptions struct {
+	// Sync flush the wal to disk before the write is acknowledged, so that
+	// the write survives power loss
+	Sync bool
+}
@@ -70,8 +70,7 @@ func NewNode(arena *Arena, key, value []byte, height int) *Node {
 	//arena.PutVal(entry.Value, offset+sw+kw)
 	//arena.PutVal(entry.Value, offset+kw)
 
-	nodeOffset := arena.putNode(height)
-	node := arena.getNode(nodeOffset)
+	node := arena.putNode(height)
 	//node.key = &Key{keyOffset: offset, keySize: uint32(keySize)}
 	node.keyOffset = keyOff
 	//node.seq = uint64(entry.Seq)
@@ -242,6 +241,13 @@ func (list *SkipList) randomHeight() int {
 
 func (s *SkipList) Size() int64 { return s.arena.size() }
 
+// Empty return whether there is no node in the skip list
+func (list *SkipList) Empty() bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.head.next[0] == nil
+}
+
 func (list *SkipList) PrintSkipList() {
 	p := list.head
 	level := list.GetMaxHeight() - 1
@@ -256,6 +262,32 @@ func (list *SkipList) PrintSkipList() {
 	}
 }
 
+// FindLessThan return the last node whose key < key, or head if there is
+// no such node
+func (list *SkipList) FindLessThan(key []byte) *Node {
+	p := list.head
+	for i := list.GetMaxHeight() - 1; i >= 0; i-- {
+		for next := p.next[i]; list.KeyIsAfterNode(key, next); next = p.next[i] {
+			p = next
+		}
+	}
+	return p
+}
+
+// FindLast return the last node, or head if the list is empty
+func (list *SkipList) FindLast() *Node {
+	p := list.head
+	for i := list.GetMaxHeight() - 1; i >= 0; i-- {
+		for next := p.next[i]; next != nil; next = p.next[i] {
+			p = next
+		}
+	}
+	return p
+}
+
+// SkipListIterator iterate the skip list in both directions. It doesn't hold
+// the lock of the skip list, so that writers won't be blocked by the
+// iterator. Each operation holds the read lock instead
 type SkipListIterator struct {
 	list *SkipList
 	node *Node
@@ -264,7 +296,6 @@ type SkipListIterator struct {
 func (list *SkipList) NewIterator() *SkipListIterator {
 	// increase ref first
 	//list.IncrRef()
-	list.lock.RLock()
 	return &SkipListIterator{
 		list: list,
 		node: list.head,
@@ -273,22 +304,52 @@ func (list *SkipList) NewIterator() *SkipListIterator {
 
 func (iter *SkipListIterator) Next() {
 	AssertTrue(iter.Valid())
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
 	iter.node = iter.node.next[0]
 }
 
+// Prev move to the previous node. The iterator is invalid if there is no
+// previous node
+func (iter *SkipListIterator) Prev() {
+	AssertTrue(iter.Valid())
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
+	iter.node = iter.list.FindLessThan(iter.node.getKey(iter.list.arena))
+	if iter.node == iter.list.head {
+		iter.node = nil
+	}
+}
+
 func (iter *SkipListIterator) Valid() bool {
 	return iter.node != nil
 }
 
 func (iter *SkipListIterator) Rewind() {
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
 	iter.node = iter.list.head.next[0]
 }
 
+// Last move to the last node
+func (iter *SkipListIterator) Last() {
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
+	iter.node = iter.list.FindLast()
+	if iter.node == iter.list.head {
+		iter.node = nil
+	}
+}
+
 func (iter *SkipListIterator) Key() []byte {
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
 	return iter.node.getKey(iter.list.arena)
 }
 
 func (iter *SkipListIterator) Value() []byte {
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
 	return iter.node.getValue(iter.list.arena)
 }
 
@@ -296,6 +357,8 @@ func (iter *SkipListIterator) Item() Item {
 	if !iter.Valid() {
 		log.Fatalf("%+v", errors.Errorf("Assert failed"))
 	}
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
 
 	return &Entry{
 		Key:   iter.node.getKey(iter.list.arena),
@@ -308,12 +371,13 @@ func (iter *SkipListIterator) Close() error {
 	// decrease the ref of skip list
 	//iter.list.DecrRef()
 	//iter.list.Close()
-	iter.list.lock.RUnlock()
 	return nil
 }
 
+// Seek move to the first node whose key >= key
 func (iter *SkipListIterator) Seek(key []byte) {
-	iter.Rewind()
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
 	iter.node = iter.list.FindGreaterOrEqual(key, nil)
 	//iter.Next()
 	//for n := iter.Item(); n != nil && bytes.Compare(n.Entry().Key, key) != 0; {
@@ -321,3 +385,17 @@ func (iter *SkipListIterator) Seek(key []byte) {
 	//	iter.Next()
 	//}
 }
+
+// SeekForPrev move to the last node whose key <= key
+func (iter *SkipListIterator) SeekForPrev(key []byte) {
+	iter.list.lock.RLock()
+	defer iter.list.lock.RUnlock()
+	iter.node = iter.list.FindGreaterOrEqual(key, nil)
+	if iter.node != nil && iter.list.comparator.Compare(iter.node.getKey(iter.list.arena), key) == 0 {
+		return
+	}
+	iter.node = iter.list.FindLessThan(key)
+	if iter.node == iter.list.head {
+		iter.node = nil
+	}
+}
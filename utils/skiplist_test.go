@@ -246,3 +246,38 @@ func TestSkipListIterator(t *testing.T) {
 	fmt.Println(list.arena.size() / 1024.0)
 
 }
+
+func TestSkipListIteratorPrev(t *testing.T) {
+	list := NewSkipList(NewArena())
+	iter := list.NewIterator()
+	iter.Last()
+	assert.False(t, iter.Valid())
+
+	for i := 0; i < 1000; i += 2 {
+		key := []byte(fmt.Sprintf("%05d", i))
+		list.Add(key, key)
+	}
+
+	i := 998
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		assert.Equal(t, []byte(fmt.Sprintf("%05d", i)), iter.Item().Entry().Key)
+		i -= 2
+	}
+	assert.Equal(t, -2, i)
+
+	iter.SeekForPrev([]byte("00101"))
+	assert.Equal(t, []byte("00100"), iter.Key())
+	iter.SeekForPrev([]byte("00100"))
+	assert.Equal(t, []byte("00100"), iter.Key())
+	iter.Seek([]byte("00101"))
+	assert.Equal(t, []byte("00102"), iter.Key())
+	iter.SeekForPrev([]byte("0"))
+	assert.False(t, iter.Valid())
+
+	// writers are not blocked by the iterator
+	iter.Rewind()
+	list.Add([]byte("00001"), []byte("00001"))
+	iter.Next()
+	assert.Equal(t, []byte("00001"), iter.Key())
+	assert.Nil(t, iter.Close())
+}
@@ -0,0 +1,69 @@
+package utils
+
+import "sync"
+
+// Snapshot is a consistent point-in-time view of the db. Entries with seq
+// greater than the seq of snapshot are invisible to it
+type Snapshot struct {
+	seq  uint64
+	prev *Snapshot
+	next *Snapshot
+}
+
+// Seq return the seq of the snapshot
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// SnapshotList is a doubly linked list of live snapshots, sorted by seq
+type SnapshotList struct {
+	lock sync.Mutex
+	head Snapshot // dummy head, head.next is the oldest snapshot
+}
+
+// NewSnapshotList _
+func NewSnapshotList() *SnapshotList {
+	l := &SnapshotList{}
+	l.head.prev = &l.head
+	l.head.next = &l.head
+	return l
+}
+
+// New create a snapshot with seq. It's inserted in order of seq, since the
+// seqs of concurrent callers may be loaded out of order
+func (l *SnapshotList) New(seq uint64) *Snapshot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	prev := l.head.prev
+	for prev != &l.head && prev.seq > seq {
+		prev = prev.prev
+	}
+	s := &Snapshot{seq: seq, prev: prev, next: prev.next}
+	s.prev.next = s
+	s.next.prev = s
+	return s
+}
+
+// Release remove the snapshot from the list. Releasing a snapshot twice
+// is a no-op
+func (l *SnapshotList) Release(s *Snapshot) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if s == nil || s.next == nil {
+		return
+	}
+	s.prev.next = s.next
+	s.next.prev = s.prev
+	s.prev, s.next = nil, nil
+}
+
+// Seqs return seqs of all live snapshots in ascending order
+func (l *SnapshotList) Seqs() []uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var seqs []uint64
+	for s := l.head.next; s != &l.head; s = s.next {
+		seqs = append(seqs, s.seq)
+	}
+	return seqs
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSnapshotList(t *testing.T) {
+	l := NewSnapshotList()
+	// the seqs loaded by concurrent callers may arrive out of order
+	var snaps []*Snapshot
+	for _, seq := range []uint64{6, 5, 8, 5, 7, 1} {
+		snaps = append(snaps, l.New(seq))
+	}
+	assert.Equal(t, []uint64{1, 5, 5, 6, 7, 8}, l.Seqs())
+
+	l.Release(snaps[0])
+	l.Release(snaps[3])
+	l.Release(snaps[3])
+	assert.Equal(t, []uint64{1, 5, 7, 8}, l.Seqs())
+	l.New(6)
+	assert.Equal(t, []uint64{1, 5, 6, 7, 8}, l.Seqs())
+}
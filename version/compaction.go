@@ -4,17 +4,28 @@ import (
 	"ckv/file"
 	"ckv/sstable"
 	"ckv/utils"
-	"ckv/utils/errs"
-	"fmt"
+	"ckv/utils/cmp"
+	"ckv/utils/convert"
 	"log"
-	"math/rand"
+	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	kMaxMemCompactLevel = 2
+	// defaultMaxTableSize is the target size of compaction output if
+	// Options.MaxTableSize is not set
+	defaultMaxTableSize = 2 << 20
+	// an output is cut when it overlaps with too many bytes in the level
+	// after target level, to limit the work of compacting it later
+	kMaxGrandParentOverlapFactor = 10
+	// the least seeks allowed for a file before it's compacted
+	kMinAllowedSeeks = 100
+	// the delay before retrying after a compaction failed
+	compactionRetryDelay = time.Second
 )
 
 type CompactStatus struct {
@@ -41,264 +52,768 @@ func NewCompactStatus(option *utils.Options) *CompactStatus {
 }
 
 type Compaction struct {
+	v           *Version // the column family being compacted
 	baseLevel   int
 	targetLevel int
 	base        []*FileMetaData
 	target      []*FileMetaData
+	smallest    []byte // key range of all input files
+	largest     []byte
+
+	grandparents []*FileMetaData // files overlapping in the level after target level
 }
 
-func (vs *VersionSet) RunCompact() int {
-	randomDelay := time.NewTimer(time.Duration(rand.Int31n(1000)) * time.Millisecond)
-	//select {
-	//case <- randomDelay.C:
-	<-randomDelay.C
-	//TODO close case <- close:
+// RunCompact run the compaction scheduler until closer is closed. There are
+// Options.NumCompactors workers, they are woken by MaybeScheduleCompaction
+// and keep compacting until no level needs compaction. A running compaction
+// is finished before the workers exit
+func (vs *VersionSet) RunCompact(closer *utils.Closer) {
+	defer closer.Done()
+	n := vs.current.opt.NumCompactors
+	if n <= 0 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			vs.runCompactor(id, closer)
+		}(i)
+	}
+	// the levels may need compaction after recovery
+	vs.MaybeScheduleCompaction()
+	wg.Wait()
+}
+
+func (vs *VersionSet) runCompactor(id int, closer *utils.Closer) {
+	for {
+		select {
+		case <-vs.compactCh:
+		case <-closer.CloseSignal:
+			return
+		}
+		for {
+			ran, err := vs.compact(id)
+			if err != nil {
+				// wait a little before the failed compaction is picked
+				// again, in case the error is environmental
+				log.Printf("compaction failed: %v\n", err)
+				select {
+				case <-time.After(compactionRetryDelay):
+				case <-closer.CloseSignal:
+					return
+				}
+			} else if !ran {
+				break
+			}
+			select {
+			case <-closer.CloseSignal:
+				return
+			default:
+			}
+		}
+	}
+}
 
-	//}
+// MaybeScheduleCompaction wake a compaction worker, it's called when the
+// scores of levels may change
+func (vs *VersionSet) MaybeScheduleCompaction() {
+	select {
+	case vs.compactCh <- struct{}{}:
+	default:
+	}
+}
 
-	ticker := time.NewTicker(3000 * time.Millisecond)
-	defer ticker.Stop()
-	//for {
+// compact run a compaction if any level needs it, and return whether a
+// compaction is run. The version is unchanged if an error is returned
+func (vs *VersionSet) compact(id int) (bool, error) {
+	c := vs.pickCompaction()
+	if c == nil {
+		return false, nil
+	}
+	// another worker may find a compaction that can run concurrently
+	vs.MaybeScheduleCompaction()
+	defer vs.MaybeScheduleCompaction()
+	if len(c.base) == 1 && len(c.target) == 0 && c.baseLevel != c.targetLevel {
+		return true, vs.moveFile(c)
+	}
+	return true, vs.runCompaction(c)
+}
 
-	//select {
-	//case <- ticker.C:
-	<-ticker.C
-	vs.compact(1)
-	//TODO close case <- close:
+// moveFile move the only input file to target level, since there is no file
+// to merge with
+func (vs *VersionSet) moveFile(c *Compaction) error {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	if c.v.dropped {
+		vs.finishCompaction(c)
+		return vs.removeTables(c.v, c.base)
+	}
+	meta := c.base[0]
+	t, err := vs.findTable(c.v, meta.id)
+	if err != nil {
+		vs.abandonCompaction(c, nil)
+		return err
+	}
+	// the key range of the table is unknown if it's opened from disk, so the
+	// meta is moved instead
+	ve := NewVersionEdit()
+	ve.family = c.v.id
+	ve.adds = append(ve.adds, &TableMeta{f: meta, level: c.targetLevel})
+	ve.deletes = append(ve.deletes, &TableMeta{f: meta, level: c.baseLevel})
+	if err := vs.LogAndApply(ve); err != nil {
+		vs.abandonCompaction(c, nil)
+		return err
+	}
 
-	//}
-	//}
-	return 0
+	// the vlog group of the table is moved together
+	c.v.insertFileMeta(c.targetLevel, meta)
+	c.v.DeleteFileMeta(c.baseLevel, c.targetLevel, t)
+	vs.info.SetTableState(meta.id, NORMAL)
+	vs.finishCompaction(c)
+	log.Printf("move %d from level %d to level %d\n", meta.id, c.baseLevel, c.targetLevel)
+	return nil
 }
 
-func (vs *VersionSet) compact(id int) {
+// abandonCompaction remove c from the running compactions without changing
+// the version. The inputs can be picked again, and the outputs are deleted
+func (vs *VersionSet) abandonCompaction(c *Compaction, outputs []*sstable.Table) {
+	vs.finishCompaction(c)
+	for _, meta := range c.base {
+		vs.info.SetTableState(meta.id, NORMAL)
+	}
+	for _, meta := range c.target {
+		vs.info.SetTableState(meta.id, NORMAL)
+	}
+	// the outputs only reference the vlogs of inputs
+	vs.removeOutputs(outputs, nil)
+}
 
-	opt := vs.current.opt
-	c := vs.pickCompaction()
-	if c == nil || len(c.base)+len(c.target) <= 1 {
-		return
+// finishCompaction remove c from the running compactions
+func (vs *VersionSet) finishCompaction(c *Compaction) {
+	for i := range vs.compactions {
+		if vs.compactions[i] == c {
+			vs.compactions = append(vs.compactions[:i], vs.compactions[i+1:]...)
+			break
+		}
 	}
+}
+
+func (vs *VersionSet) runCompaction(c *Compaction) error {
+	opt := c.v.opt
 	log.Println("Compact begin")
 	defer log.Println("Compaction end")
 
-	var iters []sstable.TableIterator
-	for _, meta := range c.base {
-		id := meta.id
-		t := vs.FindTable(id)
-		iters = append(iters, t.NewIterator(opt))
-	}
-	for _, meta := range c.target {
-		id := meta.id
-		t := vs.FindTable(id)
-		//t := sstable.OpenTable(vs.current.opt, id)
+	// the inputs are read once, they don't fill the block cache
+	var (
+		inputs []*sstable.Table // the tables of base followed by target
+		iters  []sstable.TableIterator
+	)
+	for _, meta := range append(append([]*FileMetaData{}, c.base...), c.target...) {
+		t, err := vs.findTable(c.v, meta.id)
+		if err != nil {
+			for i := range iters {
+				iters[i].Close()
+			}
+			vs.lock.Lock()
+			vs.abandonCompaction(c, nil)
+			vs.lock.Unlock()
+			return err
+		}
+		inputs = append(inputs, t)
 		iters = append(iters, t.NewIterator(opt))
+		iters[len(iters)-1].SetFillCache(false)
 	}
-	newFid := vs.IncreaseNextFileNumber(1)
 
 	iter := NewMergeIterator(iters, opt.Comparable)
-	builder := sstable.NewTableBuiler(opt)
-	var entry *utils.Entry
+	snapshots := vs.snapshots.Seqs()
+	iter.SetSnapshots(snapshots)
+	var rangeDels []*utils.RangeTombstone
+	for _, t := range iter.RangeDels() {
+		if iter.Stripe(t.Seq) == 0 && vs.isBaseLevelForRange(c.v, c.targetLevel, t.Start, t.End) {
+			continue
+		}
+		rangeDels = append(rangeDels, t)
+	}
+	splitter := newOutputSplitter(c, rangeDels, opt)
+
+	var (
+		outputs []*sstable.Table
+		vlogs   [][]uint64 // the vlogs referenced by each output
+		builder = sstable.NewTableBuilerForLevel(opt, c.targetLevel)
+		refs    = make(map[uint64]struct{})
+	)
+	// addRangeDels add the tombstones that start before key to builder, they
+	// end before key since the output is never cut inside a tombstone
+	addRangeDels := func(key []byte) {
+		for len(rangeDels) > 0 && (key == nil || opt.Comparable.Compare(rangeDels[0].Start, key) < 0) {
+			builder.AddRangeTombstone(rangeDels[0])
+			rangeDels = rangeDels[1:]
+		}
+	}
+	// the compaction is abandoned once an output can't be flushed
+	var flushErr error
+	finishOutput := func() {
+		if flushErr != nil || builder.Empty() {
+			return
+		}
+		fid := vs.IncreaseNextFileNumber(1)
+		name := file.FileNameSSTable(opt.WorkDir, fid)
+		t, err := builder.Flush(name)
+		if err != nil {
+			os.Remove(name)
+			flushErr = err
+			return
+		}
+		fids := make([]uint64, 0, len(refs))
+		for fid := range refs {
+			fids = append(fids, fid)
+		}
+		sort.Slice(fids, func(i, j int) bool {
+			return fids[i] < fids[j]
+		})
+		outputs = append(outputs, t)
+		vlogs = append(vlogs, fids)
+		builder = sstable.NewTableBuilerForLevel(opt, c.targetLevel)
+		refs = make(map[uint64]struct{})
+	}
 
-	for iter.Rewind(); iter.Valid(); iter.Next() {
-		entry = iter.Item().Entry()
+	add := func(entry *utils.Entry) {
+		if splitter.shouldCut(entry.Key, builder.EstimatedSize()) {
+			addRangeDels(entry.Key)
+			finishOutput()
+		}
 		builder.Add(entry, false)
+		if len(entry.Value) > 0 && entry.Value[0] == utils.VAL_PTR {
+			refs[convert.BytesToU64(entry.Value[1:])] = struct{}{}
+		}
+	}
 
+	var entry *utils.Entry
+	for iter.Rewind(); iter.Valid() && flushErr == nil; {
+		entry = iter.Item().Entry()
+		if entry.IsMerge() && opt.MergeOperator != nil {
+			for _, e := range vs.mergeOperands(c, iter) {
+				add(e)
+			}
+			continue
+		}
+		iter.Next()
+		// older versions are not in deeper levels and no snapshot can see
+		// them, the tombstone is useless
+		if (entry.IsDeleted() || entry.IsExpired()) && iter.Stripe(entry.Seq) == 0 &&
+			vs.isBaseLevelForRange(c.v, c.targetLevel, entry.Key, entry.Key) {
+			continue
+		}
+		if entry.IsExpired() {
+			// the expired entry still hides older versions, keep it as a
+			// tombstone and drop the value
+			entry = toTombstone(entry)
+		}
+		// the versions visible to snapshots are not filtered, or the reads
+		// of snapshots would change
+		if opt.CompactionFilter != nil && !entry.IsDeleted() && !entry.IsMerge() && iter.Stripe(entry.Seq) == len(snapshots) {
+			if entry = vs.filterEntry(c, entry); entry == nil {
+				continue
+			}
+		}
+		add(entry)
 	}
 	iter.Close()
-
-	sstName := file.FileNameSSTable(opt.WorkDir, newFid)
-	t, err := builder.Flush(sstName)
-	//t.MinKey = firstEntry.Key
-	if err != nil {
-		errs.Panic(err)
+	addRangeDels(nil)
+	finishOutput()
+	if flushErr != nil {
+		vs.lock.Lock()
+		vs.abandonCompaction(c, outputs)
+		vs.lock.Unlock()
+		return flushErr
 	}
-	t.MaxKey = entry.Key
 
 	ve := NewVersionEdit()
-	ve.RecordAddFileMeta(c.targetLevel, t)
-
-	mergeFids := make([]uint64, 0)
-	for _, meta := range c.base {
-		id := meta.id
-		t := vs.FindTable(id)
-		ve.RecordDeleteFileMeta(c.baseLevel, t)
-		mergeFids = append(mergeFids, id)
-	}
-	for _, meta := range c.target {
-		id := meta.id
-		t := vs.FindTable(id)
-		ve.RecordDeleteFileMeta(c.targetLevel, t)
-		mergeFids = append(mergeFids, id)
+	ve.family = c.v.id
+	for i, t := range outputs {
+		ve.RecordAddFileMeta(c.targetLevel, t)
+		ve.RecordNewVLogGroup(t.Fid(), vlogs[i])
 	}
 
-	//TODO: write vgroup to manifest
+	// the vlogs of inputs are obsolete if no output references them
+	var inputVLogs []uint64
+	for i, t := range inputs {
+		level := c.baseLevel
+		if i >= len(c.base) {
+			level = c.targetLevel
+		}
+		ve.RecordDeleteFileMeta(level, t)
+		ve.RecordDropVLogGroup(t.Fid())
+		inputVLogs = append(inputVLogs, vs.info.GetVLogGroup(t.Fid())...)
+	}
 
 	// delete
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
 
-	vs.LogAndApply(ve)
-	vs.addFileMeta(c.targetLevel, t)
-
-	vs.info.MergeVLogGroup(mergeFids, newFid)
-	vs.info.SetTableState(newFid, NORMAL)
+	if c.v.dropped {
+		// the outputs only reference the vlogs of inputs
+		vs.finishCompaction(c)
+		vs.removeOutputs(outputs, nil)
+		return vs.removeTables(c.v, append(append([]*FileMetaData{}, c.base...), c.target...))
+	}
+	if err := vs.LogAndApply(ve); err != nil {
+		vs.abandonCompaction(c, outputs)
+		return err
+	}
+	if err := vs.VLogAndApply(ve); err != nil {
+		// the groups of outputs are rebuilt by recoverVLogGroups
+		log.Printf("write vmanifest failed: %v\n", err)
+	}
+	vs.finishCompaction(c)
+	for _, t := range outputs {
+		vs.addFileMeta(c.v, c.targetLevel, t)
+		vs.info.SetTableState(t.Fid(), NORMAL)
+	}
 
-	for _, meta := range c.base {
-		id := meta.id
-		t := vs.FindTable(id)
-		vs.DeleteFileMeta(c.baseLevel, c.targetLevel, t)
-		vs.info.SetTableState(id, NORMAL)
+	// the obsolete vlogs are removed after all inputs are released, since
+	// they may be read through any of the inputs
+	obsolete := vs.obsoleteVLogs(inputVLogs)
+	pending := int32(len(c.base) + len(c.target))
+	release := func() error {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			vs.removeVLogs(obsolete)
+		}
+		return nil
+	}
+	for i, t := range inputs {
+		level := c.baseLevel
+		if i >= len(c.base) {
+			level = c.targetLevel
+		}
+		c.v.DeleteFileMeta(level, c.targetLevel, t)
+		vs.info.SetTableState(t.Fid(), NORMAL)
 
-		t.DecrRef(nil)
+		vs.releaseTable(c.v, t.Fid(), release)
 	}
-	for _, meta := range c.target {
-		id := meta.id
-		t := vs.FindTable(id)
-		vs.DeleteFileMeta(c.targetLevel, c.targetLevel, t)
-		vs.info.SetTableState(id, NORMAL)
 
-		t.DecrRef(nil)
+	log.Printf("compact from level %d to level %d. create %d files. delete %d files \n",
+		c.baseLevel, c.targetLevel, len(outputs), len(ve.deletes))
+	return nil
+}
 
-	}
+// outputSplitter decide where to cut the output of a compaction
+type outputSplitter struct {
+	cmp          cmp.Comparator
+	maxTableSize int64
+	rangeDels    []*utils.RangeTombstone
 
-	log.Printf("compact from level %d to level %d. create %s. delete %d files \n",
-		c.baseLevel, c.targetLevel, sstName, len(ve.deletes))
+	grandparents []*FileMetaData
+	gpIndex      int
+	seenKey      bool
+	overlapped   int64 // bytes overlapped between current output and grandparents
 
+	lastKey []byte
 }
 
-// pickCompaction method    pick sstables to compact
-func (vs *VersionSet) pickCompaction() *Compaction {
-	vs.lock.Lock()
-	defer vs.lock.Unlock()
+func newOutputSplitter(c *Compaction, rangeDels []*utils.RangeTombstone, opt *utils.Options) *outputSplitter {
+	maxTableSize := opt.MaxTableSize
+	if maxTableSize <= 0 {
+		maxTableSize = defaultMaxTableSize
+	}
+	sort.Slice(rangeDels, func(i, j int) bool {
+		return opt.Comparable.Compare(rangeDels[i].Start, rangeDels[j].Start) < 0
+	})
+	return &outputSplitter{
+		cmp:          opt.Comparable,
+		maxTableSize: maxTableSize,
+		rangeDels:    rangeDels,
+		grandparents: c.grandparents,
+	}
+}
 
-	var c Compaction
-	c.baseLevel = vs.current.pickCompactionLevel()
+// shouldCut return whether to finish current output before key, size is the
+// size of current output. The versions of a key are kept in the same output,
+// and a range tombstone is never split, so that outputs don't overlap
+func (s *outputSplitter) shouldCut(key []byte, size int64) bool {
+	for s.gpIndex < len(s.grandparents) && s.cmp.Compare(key, s.grandparents[s.gpIndex].largest) > 0 {
+		if s.seenKey {
+			s.overlapped += int64(s.grandparents[s.gpIndex].fileSize)
+		}
+		s.gpIndex++
+	}
+	s.seenKey = true
 
-	filter := func(file *FileMetaData) bool {
-		if state, ok := vs.info.GetTableState(file.id); ok && state == NORMAL {
+	sameKey := s.lastKey != nil && s.cmp.Compare(key, s.lastKey) == 0
+	s.lastKey = append(s.lastKey[:0], key...)
+	if size == 0 || sameKey || s.insideRangeDel(key) {
+		return false
+	}
+	if size >= s.maxTableSize || s.overlapped > kMaxGrandParentOverlapFactor*s.maxTableSize {
+		s.overlapped = 0
+		return true
+	}
+	return false
+}
+
+// insideRangeDel return whether key is in (Start, End] of any tombstone,
+// the output can't be cut before it
+func (s *outputSplitter) insideRangeDel(key []byte) bool {
+	for _, t := range s.rangeDels {
+		if s.cmp.Compare(t.Start, key) >= 0 {
+			break
+		}
+		if s.cmp.Compare(key, t.End) <= 0 {
 			return true
 		}
-		return false
 	}
-	// compact itself for max level
-	// TODO: remove?
-	c.base = make([]*FileMetaData, 0)
-	c.target = make([]*FileMetaData, 0)
-	if c.baseLevel == vs.current.opt.MaxLevelNum-1 {
-		for i := range vs.current.files[c.baseLevel] {
-			if filter(vs.current.files[c.baseLevel][i]) {
-				c.target = append(c.target, vs.current.files[c.baseLevel][i])
-			}
+	return false
+}
+
+// filterEntry apply the compaction filter to e, which is written to the target
+// level of c. It returns nil if e is removed and there is no older version in
+// deeper levels
+func (vs *VersionSet) filterEntry(c *Compaction, e *utils.Entry) *utils.Entry {
+	opt, level := c.v.opt, c.targetLevel
+	value := func() ([]byte, error) {
+		return sstable.ReadValue(opt, e.Value)
+	}
+	switch decision, newValue := opt.CompactionFilter.Filter(level, e.Key, value, e.Seq); decision {
+	case utils.CompactionRemove:
+		if vs.isBaseLevelForRange(c.v, level, e.Key, e.Key) {
+			return nil
 		}
-		//c.target = filter(vs.current.files[c.baseLevel])
+		// the tombstone hides the older versions
+		return toTombstone(e)
+	case utils.CompactionChangeValue:
+		val := make([]byte, len(newValue)+1)
+		val[0] = utils.VAL
+		copy(val[1:], newValue)
+		return &utils.Entry{Key: e.Key, Value: val, Seq: e.Seq, ExpiresAt: e.ExpiresAt, Meta: e.Meta}
+	}
+	return e
+}
 
-		c.targetLevel = c.baseLevel
-		return &c
+// mergeOperands combine the merge operands of the current key in the same
+// stripe, and move iter after them. The operands are applied to the version
+// under them if it's in the stripe, or to nil if there is no older version.
+// Otherwise the adjacent operands are combined by PartialMerge. The operands
+// are kept as they are if they can't be merged
+func (vs *VersionSet) mergeOperands(c *Compaction, iter *MergeIterator) []*utils.Entry {
+	opt := c.v.opt
+	first := iter.Item().Entry()
+	key, stripe := first.Key, iter.Stripe(first.Seq)
+	var (
+		entries []*utils.Entry // the operands and the version under them
+		base    *utils.Entry
+		found   bool
+	)
+	for iter.Valid() {
+		e := iter.Item().Entry()
+		if opt.Comparable.Compare(e.Key, key) != 0 || iter.Stripe(e.Seq) != stripe {
+			break
+		}
+		iter.Next()
+		entries = append(entries, e)
+		if !e.IsMerge() {
+			base, found = e, true
+			break
+		}
+	}
+	// the older versions in the stripe are deleted by a range tombstone
+	oldest := entries[len(entries)-1]
+	if tombSeq := utils.MaxCoveringSeq(iter.RangeDels(), opt.Comparable, key, oldest.Seq-1); tombSeq > 0 &&
+		iter.Stripe(tombSeq) == stripe && (base == nil || base.Seq < tombSeq) {
+		base, found = nil, true
+	}
+	if !found && (!iter.Valid() || opt.Comparable.Compare(iter.Item().Entry().Key, key) != 0) &&
+		vs.isBaseLevelForRange(c.v, c.targetLevel, key, key) {
+		// no older version
+		found = true
 	}
-	//c.base = append(c.base, vs.current.files[c.baseLevel]...)
-	// TODO compact to more higher level
-	c.targetLevel = c.baseLevel + 1
 
-	var smallest, largest []byte
-	cmp := vs.current.opt.Comparable
-	if c.baseLevel == 0 {
-		for i := range vs.current.files[c.baseLevel] {
-			if filter(vs.current.files[c.baseLevel][i]) {
-				c.base = append(c.base, vs.current.files[c.baseLevel][i])
-			}
+	operands := entries
+	if base != nil {
+		operands = entries[:len(entries)-1]
+	}
+	if !found && len(operands) == 1 {
+		return entries
+	}
+	values := make([][]byte, len(entries))
+	for i, e := range entries {
+		value, err := sstable.ReadValue(opt, e.Value)
+		if err != nil {
+			log.Printf("read merge operand of %s failed: %v\n", key, err)
+			return entries
 		}
-		//c.base = append(c.base, vs.current.files[0]...)
-		utils.AssertTrue(len(c.base) > 0)
-		if len(c.base) > 0 {
-			smallest, largest = c.base[0].smallest, c.base[0].largest
+		values[i] = value
+	}
+
+	if found {
+		merge := &utils.MergeContext{}
+		for i, e := range operands {
+			merge.Push(&utils.Entry{Key: key, Value: values[i], Seq: e.Seq})
 		}
-		for i := 0; i < len(c.base); i++ {
-			f := c.base[i]
-			if cmp.Compare(f.largest, largest) > 0 {
-				largest = f.largest
-			}
-			if cmp.Compare(f.smallest, smallest) < 0 {
-				smallest = f.smallest
-			}
+		var existing *utils.Entry
+		if base != nil {
+			existing = &utils.Entry{Key: key, Value: values[len(values)-1], Meta: base.Meta, ExpiresAt: base.ExpiresAt}
 		}
-	} else {
-		cmp := vs.current.opt.Comparable
-		// sort by smallest key
-		sort.Slice(vs.current.files[c.baseLevel], func(i, j int) bool {
-			return cmp.Compare(vs.current.files[c.baseLevel][i].smallest,
-				vs.current.files[c.baseLevel][j].smallest) < 0
-		})
-		c.base = make([]*FileMetaData, 0)
-		c.target = make([]*FileMetaData, 0)
-		var pendingGC = vs.pendingGC
-		if pendingGC != nil {
-			if vs.pendingGC.level == c.baseLevel {
-				for i := 0; i < len(vs.current.files[c.baseLevel]); i++ {
-					meta := vs.current.files[c.baseLevel][i]
-					if state, ok := vs.info.GetTableState(meta.id); ok && state == NORMAL && meta.id != vs.pendingGC.sstId {
-						c.base = append(c.base, vs.current.files[c.baseLevel][i])
-						smallest = vs.current.files[c.baseLevel][i].smallest
-						largest = vs.current.files[c.baseLevel][i].largest
-						break
-					}
-				}
-			} else if vs.pendingGC.level == c.targetLevel {
-				for i := 0; i < len(vs.current.files[c.baseLevel]); i++ {
-					meta := vs.current.files[c.baseLevel][i]
-					if cmp.Compare(pendingGC.smallest, meta.largest) > 0 ||
-						cmp.Compare(pendingGC.largest, meta.smallest) < 0 {
-						c.base = append(c.base, vs.current.files[c.baseLevel][i])
-						smallest = vs.current.files[c.baseLevel][i].smallest
-						largest = vs.current.files[c.baseLevel][i].largest
-						break
-					}
-				}
-			}
+		e, err := merge.Resolve(opt.MergeOperator, key, existing)
+		if err != nil {
+			log.Printf("merge %s failed: %v\n", key, err)
+			return entries
 		}
-		if len(c.base) == 0 {
-			return &c
+		e.Value = append([]byte{utils.VAL}, e.Value...)
+		return []*utils.Entry{e}
+	}
+
+	// combine the operands from the newest one, the older ones that can't
+	// be combined start a new operand
+	var res []*utils.Entry
+	acc, seq := values[0], operands[0].Seq
+	for i := 1; i < len(operands); i++ {
+		if v, ok := opt.MergeOperator.PartialMerge(key, values[i], acc); ok {
+			acc = v
+			continue
 		}
+		res = append(res, &utils.Entry{Key: key, Value: append([]byte{utils.VAL}, acc...), Seq: seq, Meta: utils.BitMerge})
+		acc, seq = values[i], operands[i].Seq
+	}
+	return append(res, &utils.Entry{Key: key, Value: append([]byte{utils.VAL}, acc...), Seq: seq, Meta: utils.BitMerge})
+}
 
-		vs.info.SetTableState(c.base[0].id, COMPACTING)
+// toTombstone return a tombstone that replaces the expired or filtered entry
+func toTombstone(e *utils.Entry) *utils.Entry {
+	return &utils.Entry{Key: e.Key, Value: []byte{utils.VAL}, Seq: e.Seq, Meta: utils.BitDelete}
+}
 
-		// append sst that overlap
-		// cannot happen
-		for i := 0; i < len(vs.current.files[c.baseLevel]); i++ {
-			f := vs.current.files[c.baseLevel][i]
-			if state, ok := vs.info.GetTableState(f.id); ok && state != NORMAL {
-				continue
-			}
-			// if there are overlap key, append to base
-			if cmp.Compare(f.smallest, largest) <= 0 {
-				c.base = append(c.base, f)
-				largest = f.largest
-				panic(fmt.Sprintf("overlapped key between SSTable in level %d", c.baseLevel))
+// isBaseLevelForRange return whether there is no file in the levels of v
+// deeper than level overlapping with [smallest, largest]
+func (vs *VersionSet) isBaseLevelForRange(v *Version, level int, smallest, largest []byte) bool {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	cmp := v.opt.Comparable
+	for l := level + 1; l < len(v.files); l++ {
+		for _, f := range v.files[l] {
+			if cmp.Compare(f.smallest, largest) <= 0 && cmp.Compare(smallest, f.largest) <= 0 {
+				return false
 			}
 		}
 	}
-	for i := 0; i < len(vs.current.files[c.targetLevel]); i++ {
-		f := vs.current.files[c.targetLevel][i]
+	return true
+}
 
-		if cmp.Compare(f.largest, smallest) < 0 || cmp.Compare(f.smallest, largest) > 0 {
-			continue
+// pickCompaction pick sstables to compact from the level with the highest
+// score among all column families. The picked files are set COMPACTING, so
+// that compactions running concurrently never share input files. It returns
+// nil if no level needs compaction or all the candidates are being compacted
+func (vs *VersionSet) pickCompaction() *Compaction {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	type candidate struct {
+		v     *Version
+		level int
+	}
+	var candidates []candidate
+	for _, v := range vs.sortedFamilies() {
+		for _, level := range v.compactionLevels() {
+			candidates = append(candidates, candidate{v: v, level: level})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].v.score(candidates[i].level) > candidates[j].v.score(candidates[j].level)
+	})
+	var c *Compaction
+	for _, cand := range candidates {
+		if cand.level == 0 {
+			c = vs.pickLevel0Compaction(cand.v)
 		} else {
-			c.target = append(c.target, f)
-			vs.info.SetTableState(f.id, COMPACTING)
+			c = vs.pickLevelNCompaction(cand.v, cand.level)
+		}
+		if c != nil {
+			cand.v.compactPointer[cand.level] = c.largest
+			break
 		}
 	}
-	return &c
+	if c == nil {
+		c = vs.pickSeekCompaction()
+	}
+	if c == nil {
+		return nil
+	}
+	for _, meta := range c.base {
+		vs.info.SetTableState(meta.id, COMPACTING)
+	}
+	for _, meta := range c.target {
+		vs.info.SetTableState(meta.id, COMPACTING)
+	}
+	vs.compactions = append(vs.compactions, c)
+	return c
 }
 
-func (vs *VersionSet) PickLevelForMemTableOutput(smallest, largest []byte) int {
+// pickSeekCompaction compact the file whose allowed seeks are used up, so
+// that the reads don't need to probe it and the files it overlaps with
+func (vs *VersionSet) pickSeekCompaction() *Compaction {
+	vs.seekLock.Lock()
+	meta, level, v := vs.fileToCompact, vs.fileToCompactLevel, vs.fileToCompactVersion
+	vs.seekLock.Unlock()
+	if meta == nil {
+		return nil
+	}
+	var live bool
+	for _, f := range v.files[level] {
+		if f == meta {
+			live = true
+			break
+		}
+	}
+	if level == v.opt.MaxLevelNum-1 || v.dropped {
+		live = false
+	}
+	var c *Compaction
+	if live && level == 0 {
+		// the older files in level 0 may overlap with it, they are compacted
+		// together to keep the order of versions
+		c = vs.pickLevel0Compaction(v)
+	} else if live && vs.isNormal(meta) {
+		c = &Compaction{v: v, baseLevel: level, targetLevel: level + 1, base: []*FileMetaData{meta}}
+		if !vs.setupTargets(c) {
+			c = nil
+		}
+	}
+	// the file is retried when it's picked again after the running
+	// compactions finish
+	if c != nil || !live {
+		vs.seekLock.Lock()
+		if vs.fileToCompact == meta {
+			vs.fileToCompact = nil
+		}
+		vs.seekLock.Unlock()
+	}
+	return c
+}
+
+func (vs *VersionSet) isNormal(meta *FileMetaData) bool {
+	state, ok := vs.info.GetTableState(meta.id)
+	return ok && state == NORMAL
+}
+
+// pickLevel0Compaction compact all files in level 0 of v, since they may
+// overlap with each other
+func (vs *VersionSet) pickLevel0Compaction(v *Version) *Compaction {
+	c := &Compaction{v: v, baseLevel: 0, targetLevel: 1}
+	for _, meta := range v.files[0] {
+		if !vs.isNormal(meta) {
+			return nil
+		}
+		c.base = append(c.base, meta)
+	}
+	if len(c.base) == 0 {
+		return nil
+	}
+	if !vs.setupTargets(c) {
+		return nil
+	}
+	return c
+}
 
-	return vs.current.pickLevelForMemTableOutput(smallest, largest)
+// pickLevelNCompaction pick the first file after the compact pointer of the
+// level, so that the whole key space is compacted in turn
+func (vs *VersionSet) pickLevelNCompaction(v *Version, level int) *Compaction {
+	files := v.files[level]
+	if len(files) == 0 {
+		return nil
+	}
+	cmp := v.opt.Comparable
+	start := 0
+	if pointer, ok := v.compactPointer[level]; ok {
+		start = sort.Search(len(files), func(i int) bool {
+			return cmp.Compare(files[i].smallest, pointer) > 0
+		})
+	}
+	for i := 0; i < len(files); i++ {
+		meta := files[(start+i)%len(files)]
+		if !vs.isNormal(meta) {
+			continue
+		}
+		c := &Compaction{v: v, baseLevel: level, targetLevel: level + 1}
+		c.base = append(c.base, meta)
+		if vs.setupTargets(c) {
+			return c
+		}
+	}
+	return nil
+}
+
+// setupTargets add the files overlapping with base in target level to c. It
+// returns false if any of them is not NORMAL
+func (vs *VersionSet) setupTargets(c *Compaction) bool {
+	cmp := c.v.opt.Comparable
+	c.smallest, c.largest = c.base[0].smallest, c.base[0].largest
+	for _, f := range c.base[1:] {
+		if cmp.Compare(f.smallest, c.smallest) < 0 {
+			c.smallest = f.smallest
+		}
+		if cmp.Compare(f.largest, c.largest) > 0 {
+			c.largest = f.largest
+		}
+	}
+	for _, f := range c.v.files[c.targetLevel] {
+		if cmp.Compare(f.largest, c.smallest) < 0 || cmp.Compare(f.smallest, c.largest) > 0 {
+			continue
+		}
+		if !vs.isNormal(f) {
+			return false
+		}
+		c.target = append(c.target, f)
+	}
+	for _, f := range c.target {
+		if cmp.Compare(f.smallest, c.smallest) < 0 {
+			c.smallest = f.smallest
+		}
+		if cmp.Compare(f.largest, c.largest) > 0 {
+			c.largest = f.largest
+		}
+	}
+	if c.targetLevel+1 < len(c.v.files) {
+		for _, f := range c.v.files[c.targetLevel+1] {
+			if cmp.Compare(f.largest, c.smallest) >= 0 && cmp.Compare(f.smallest, c.largest) <= 0 {
+				c.grandparents = append(c.grandparents, f)
+			}
+		}
+		sort.Slice(c.grandparents, func(i, j int) bool {
+			return cmp.Compare(c.grandparents[i].smallest, c.grandparents[j].smallest) < 0
+		})
+	}
+	return true
+}
+
+// overlapCompaction return whether [smallest, largest] overlaps with the key
+// range of any running compaction of v
+func (vs *VersionSet) overlapCompaction(v *Version, smallest, largest []byte) bool {
+	cmp := v.opt.Comparable
+	for _, c := range vs.compactions {
+		if c.v == v && cmp.Compare(c.smallest, largest) <= 0 && cmp.Compare(smallest, c.largest) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PickLevelForMemTableOutput return the level that the table flushed from
+// the memtable of column family cf is added to
+func (vs *VersionSet) PickLevelForMemTableOutput(cf uint32, smallest, largest []byte) int {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	v, ok := vs.families[cf]
+	if !ok {
+		return 0
+	}
+	return v.pickLevelForMemTableOutput(smallest, largest)
 }
 
 func (v *Version) pickLevelForMemTableOutput(smallest, largest []byte) int {
-	v.vset.lock.RLock()
-	defer v.vset.lock.RUnlock()
 	level := 0
-	if !v.overlapInLevel(0, smallest, largest) {
+	// the output of a running compaction may be older than the memtable
+	if !v.overlapInLevel(0, smallest, largest) && !v.vset.overlapCompaction(v, smallest, largest) {
 
 		for ; level < kMaxMemCompactLevel; level++ {
 			if v.overlapInLevel(level+1, smallest, largest) {
@@ -0,0 +1,52 @@
+package version
+
+import (
+	"ckv/utils"
+	"ckv/utils/cmp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputSplitterGrandparents(t *testing.T) {
+	opt := &utils.Options{MaxTableSize: 100, Comparable: cmp.ByteComparator{}}
+	// an output is cut once it overlaps with more than 1000 bytes of
+	// grandparents
+	c := &Compaction{grandparents: []*FileMetaData{
+		{id: 1, smallest: []byte("a"), largest: []byte("c"), fileSize: 600},
+		{id: 2, smallest: []byte("d"), largest: []byte("f"), fileSize: 600},
+		{id: 3, smallest: []byte("g"), largest: []byte("i"), fileSize: 600},
+		{id: 4, smallest: []byte("j"), largest: []byte("l"), fileSize: 600},
+	}}
+	s := newOutputSplitter(c, nil, opt)
+	assert.False(t, s.shouldCut([]byte("a"), 0))
+	// the key equal to the largest key of a grandparent is still inside it
+	assert.False(t, s.shouldCut([]byte("c"), 10))
+	assert.Equal(t, int64(0), s.overlapped)
+	assert.False(t, s.shouldCut([]byte("e"), 20))
+	assert.Equal(t, int64(600), s.overlapped)
+	// passing both grandparents makes the output overlap with 1200 bytes
+	assert.True(t, s.shouldCut([]byte("h"), 30))
+	assert.Equal(t, int64(0), s.overlapped)
+	assert.False(t, s.shouldCut([]byte("k"), 10))
+	assert.Equal(t, int64(600), s.overlapped)
+
+	// the grandparents before the first key are not overlapped by the
+	// output
+	s = newOutputSplitter(c, nil, opt)
+	assert.False(t, s.shouldCut([]byte("h"), 0))
+	assert.Equal(t, int64(0), s.overlapped)
+	assert.False(t, s.shouldCut([]byte("j"), 10))
+	assert.Equal(t, int64(600), s.overlapped)
+	assert.True(t, s.shouldCut([]byte("m"), 10))
+	// the versions of a key are never split, even if the output is full
+	assert.False(t, s.shouldCut([]byte("m"), 200))
+	assert.True(t, s.shouldCut([]byte("n"), 200))
+
+	// the output isn't cut inside a range tombstone
+	s = newOutputSplitter(c, []*utils.RangeTombstone{{Start: []byte("b"), End: []byte("h")}}, opt)
+	assert.False(t, s.shouldCut([]byte("a"), 0))
+	assert.False(t, s.shouldCut([]byte("h"), 10))
+	assert.Equal(t, int64(1200), s.overlapped)
+	assert.True(t, s.shouldCut([]byte("i"), 10))
+}
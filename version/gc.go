@@ -14,20 +14,30 @@ import (
 	"time"
 )
 
-func (vs *VersionSet) RunGC() {
+func (vs *VersionSet) RunGC(closer *utils.Closer) {
+	defer closer.Done()
 	randomDelay := time.NewTimer(time.Duration(rand.Int31n(2000)) * time.Millisecond)
+	defer randomDelay.Stop()
 
-	<-randomDelay.C
+	select {
+	case <-randomDelay.C:
+	case <-closer.CloseSignal:
+		return
+	}
 
 	ticker := time.NewTicker(5000 * time.Millisecond)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
-		vs.mergeVLog()
+		select {
+		case <-ticker.C:
+			vs.mergeVLog(closer)
+		case <-closer.CloseSignal:
+			return
+		}
 	}
 }
 
-func (vs *VersionSet) mergeVLog() {
+func (vs *VersionSet) mergeVLog(closer *utils.Closer) {
 
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
@@ -49,6 +59,29 @@ func (vs *VersionSet) mergeVLog() {
 		}
 		return res
 	}
+	var pending *VFileMetaData
+	var v *Version
+	for _, family := range vs.families {
+		for i := range family.files {
+			for j := range family.files[i] {
+				if family.files[i][j].id == fid {
+					pending = &VFileMetaData{
+						sstId:    fid,
+						largest:  family.files[i][j].largest,
+						smallest: family.files[i][j].smallest,
+						level:    i,
+					}
+					v = family
+					break
+				}
+			}
+		}
+	}
+	// files in level 0 are searched by file number, the new sst with a
+	// bigger number would shadow the newer files, so they are skipped
+	if pending == nil || pending.level == 0 {
+		return
+	}
 	if state, ok := vs.info.GetTableState(fid); ok && state == NORMAL {
 		mergeFids := filter(fids)
 		// check whether there is any sst being compacted
@@ -59,69 +92,91 @@ func (vs *VersionSet) mergeVLog() {
 			}
 			// set sst state as GC, it can't be selected to be compacted
 			vs.info.SetTableState(fid, GC)
+			vs.pendingGC = pending
 
-			for i := range vs.current.files {
-				for j := range vs.current.files[i] {
-					if vs.current.files[i][j].id == fid {
-						vs.pendingGC = &VFileMetaData{
-							sstId:    fid,
-							largest:  vs.current.files[i][j].largest,
-							smallest: vs.current.files[i][j].smallest,
-							level:    i,
-						}
-						break
+			closer.Add(1)
+			go func() {
+				defer closer.Done()
+				if err := vs.mergeVLogs(v, fid, mergeFids); err != nil {
+					log.Printf("GC for SSTable %d failed: %v\n", fid, err)
+					vs.lock.Lock()
+					vs.info.SetTableState(fid, NORMAL)
+					for i := range mergeFids {
+						vs.info.SetVTableState(mergeFids[i], NORMAL)
 					}
+					vs.pendingGC = nil
+					vs.lock.Unlock()
 				}
-			}
-
-			go vs.mergeVLogs(fid, mergeFids)
+			}()
 		}
 	}
 
 }
 
-// mergeVLogs merge vlogs that the ssTable refs
-func (vs *VersionSet) mergeVLogs(sstFid uint64, fids []uint64) (*vlog.VLogFile, error) {
-	opt := vs.current.opt
-	table := vs.FindTable(sstFid)
+// mergeVLogs merge vlogs that the ssTable of v refs
+func (vs *VersionSet) mergeVLogs(v *Version, sstFid uint64, fids []uint64) (err error) {
+	opt := v.opt
+	table, err := vs.findTable(v, sstFid)
+	if err != nil {
+		return err
+	}
 	iter := table.NewIterator(opt)
+	iter.SetFillCache(false)
 
 	newFid := vs.IncreaseNextFileNumber(1)
 	sstName := file.FileNameSSTable(opt.WorkDir, newFid)
 
-	newVLog := openVLog(opt, newFid)
+	newVLog, err := openVLog(opt, newFid, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		newVLog.Close()
+		if err != nil {
+			os.Remove(file.FileNameVLog(opt.WorkDir, newFid))
+		}
+	}()
 	vlogs := make(map[uint64]*vlog.VLogFile)
-	//defer func() {
-	//	for _, v := range vlogs {
-	//		v.Close()
-	//	}
-	//}()
-
-	builder := sstable.NewTableBuiler(opt)
-	var entry *utils.Entry
+	defer func() {
+		for _, v := range vlogs {
+			v.Close()
+		}
+	}()
+
+	builder := sstable.NewTableBuilerForLevel(opt, vs.pendingGC.level)
 	// merge vlogs
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		e := iter.Item().Entry()
-		entry = iter.Item().Entry()
+		if e.IsExpired() {
+			// drop the value of expired entry, it's not copied to new vlog
+			e = toTombstone(e)
+		}
 		if e.Value[0] == utils.VAL_PTR {
 			fid := convert.BytesToU64(e.Value[1:])
 			pos := convert.BytesToU32(e.Value[9:])
 			var vlog *vlog.VLogFile
 			if v, ok := vlogs[fid]; !ok {
-				vlog = openVLog(opt, fid)
+				if vlog, err = openVLog(opt, fid, os.O_RDONLY); err != nil {
+					iter.Close()
+					return err
+				}
 				vlogs[fid] = vlog
 			} else {
 				vlog = v
 			}
 			data, _, err := vlog.ReadRecordBytes(pos)
 			if err != nil {
-				return nil, err
+				iter.Close()
+				return err
 			}
 			writeAt := newVLog.Pos()
-			newVLog.WriteData(data)
+			if err = newVLog.WriteData(data); err != nil {
+				iter.Close()
+				return err
+			}
 
 			val := make([]byte, 13)
-			val[1] = utils.VAL_PTR
+			val[0] = utils.VAL_PTR
 			copy(val[1:], convert.U64ToBytes(newFid))
 			copy(val[9:], convert.U32ToBytes(writeAt))
 
@@ -130,12 +185,14 @@ func (vs *VersionSet) mergeVLogs(sstFid uint64, fids []uint64) (*vlog.VLogFile,
 		builder.Add(e, false)
 	}
 	iter.Close()
+	for _, rt := range table.RangeDels() {
+		builder.AddRangeTombstone(rt)
+	}
 
 	t, err := builder.Flush(sstName)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	t.MaxKey = entry.Key
 
 	log.Printf("GC for SSTable %d. Delete %d vlog files. Create new SSTable %d \n",
 		sstFid, len(fids), newFid)
@@ -143,43 +200,71 @@ func (vs *VersionSet) mergeVLogs(sstFid uint64, fids []uint64) (*vlog.VLogFile,
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
 
+	if v.dropped {
+		vs.removeOutputs([]*sstable.Table{t}, []uint64{newFid})
+		vs.pendingGC = nil
+		return vs.removeTables(v, []*FileMetaData{{id: sstFid}})
+	}
 	// write manifest
 	ve := NewVersionEdit()
+	ve.family = v.id
 	ve.RecordAddFileMeta(vs.pendingGC.level, t)
 	ve.DeleteFileMetas(vs.pendingGC.level, []*sstable.Table{table})
-	vs.LogAndApply(ve)
+	ve.RecordNewVLogGroup(newFid, []uint64{newFid})
+	ve.RecordDropVLogGroup(sstFid)
+	if err = vs.LogAndApply(ve); err != nil {
+		vs.removeOutputs([]*sstable.Table{t}, nil)
+		return err
+	}
+	if err := vs.VLogAndApply(ve); err != nil {
+		// the group of the new table is rebuilt by recoverVLogGroups
+		log.Printf("write vmanifest failed: %v\n", err)
+	}
+	// the vlogs shared with other ssts are kept
+	obsolete := vs.obsoleteVLogs(fids)
 
 	// write new meta
-	vs.addFileMeta(vs.pendingGC.level, t)
-
-	//vs.info.MergeVLogGroup(mergeFids, newFid)
-	vs.info.AddNewVLogWithGroup(newFid)
+	vs.addFileMeta(v, vs.pendingGC.level, t)
 	vs.info.SetTableState(newFid, NORMAL)
 
 	// delete old meta
-	vs.DeleteFileMeta(vs.pendingGC.level, vs.pendingGC.level, table)
+	v.DeleteFileMeta(vs.pendingGC.level, vs.pendingGC.level, table)
 	vs.info.SetTableState(sstFid, NORMAL)
-	table.DecrRef(func() error {
-		for i := range fids {
-			vlogName := file.FileNameVLog(opt.WorkDir, fids[i])
-			os.Remove(vlogName)
-		}
+	vs.releaseTable(v, sstFid, func() error {
+		vs.removeVLogs(obsolete)
 		return nil
 	})
 
-	vs.info.RemoveVLogFromGroup(fids)
-
 	vs.pendingGC = nil
-	return newVLog, nil
+	vs.MaybeScheduleCompaction()
+	return nil
+}
+
+// obsoleteVLogs return the vlogs in fids that don't belong to any group
+func (vs *VersionSet) obsoleteVLogs(fids []uint64) []uint64 {
+	var obsolete []uint64
+	for _, fid := range fids {
+		if !vs.info.VLogReferenced(fid) {
+			obsolete = append(obsolete, fid)
+		}
+	}
+	return obsolete
+}
+
+func (vs *VersionSet) removeVLogs(fids []uint64) {
+	for _, fid := range fids {
+		os.Remove(file.FileNameVLog(vs.current.opt.WorkDir, fid))
+	}
 }
 
-func openVLog(opt *utils.Options, fid uint64) *vlog.VLogFile {
+// openVLog open the vlog of fid with flag, the vlogs to read are opened
+// without os.O_CREATE so that a missing one is an error
+func openVLog(opt *utils.Options, fid uint64, flag int) (*vlog.VLogFile, error) {
 	fileOpt := &file.Options{
 		FID:      fid,
 		FileName: filepath.Join(opt.WorkDir, fmt.Sprintf("%05d%s", fid, utils.VLOG_FILE_EXT)),
 		Dir:      opt.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(opt.MemTableSize),
+		Flag:     flag,
 	}
 	return vlog.OpenVLogFile(fileOpt)
 }
@@ -0,0 +1,169 @@
+package version
+
+import (
+	"ckv/sstable"
+	"ckv/utils"
+	"ckv/utils/cmp"
+	"sort"
+)
+
+// LevelIterator iterate the tables of a level > 0 one by one. Tables in
+// such levels are sorted by key and don't overlap with each other
+type LevelIterator struct {
+	cmp   cmp.Comparator
+	files []*FileMetaData
+	iters []*sstable.TableIterator
+	idx   int
+}
+
+func (iter *LevelIterator) Valid() bool {
+	return iter.idx >= 0 && iter.idx < len(iter.iters) && iter.iters[iter.idx].Valid()
+}
+
+func (iter *LevelIterator) Rewind() {
+	iter.idx = 0
+	if iter.idx < len(iter.iters) {
+		iter.iters[iter.idx].Rewind()
+	}
+	iter.skipForward()
+}
+
+// Last move to the last entry of the last table
+func (iter *LevelIterator) Last() {
+	iter.idx = len(iter.iters) - 1
+	if iter.idx >= 0 {
+		iter.iters[iter.idx].Last()
+	}
+	iter.skipBackward()
+}
+
+// Seek move to the first entry whose key >= key
+func (iter *LevelIterator) Seek(key []byte) {
+	iter.idx = sort.Search(len(iter.files), func(i int) bool {
+		return iter.cmp.Compare(iter.files[i].largest, key) >= 0
+	})
+	if iter.idx < len(iter.iters) {
+		iter.iters[iter.idx].Seek(key)
+	}
+	iter.skipForward()
+}
+
+// SeekForPrev move to the last entry whose key <= key
+func (iter *LevelIterator) SeekForPrev(key []byte) {
+	iter.idx = sort.Search(len(iter.files), func(i int) bool {
+		return iter.cmp.Compare(iter.files[i].smallest, key) > 0
+	}) - 1
+	if iter.idx >= 0 {
+		iter.iters[iter.idx].SeekForPrev(key)
+	}
+	iter.skipBackward()
+}
+
+func (iter *LevelIterator) Next() {
+	iter.iters[iter.idx].Next()
+	iter.skipForward()
+}
+
+// Prev move to the previous entry
+func (iter *LevelIterator) Prev() {
+	iter.iters[iter.idx].Prev()
+	iter.skipBackward()
+}
+
+func (iter *LevelIterator) Item() utils.Item {
+	return iter.iters[iter.idx].Item()
+}
+
+func (iter *LevelIterator) Close() error {
+	var err error
+	for _, it := range iter.iters {
+		if e := it.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// skipForward move to the following tables until an entry is found
+func (iter *LevelIterator) skipForward() {
+	for iter.idx < len(iter.iters) && !iter.iters[iter.idx].Valid() {
+		iter.idx++
+		if iter.idx < len(iter.iters) {
+			iter.iters[iter.idx].Rewind()
+		}
+	}
+}
+
+// skipBackward move to the previous tables until an entry is found
+func (iter *LevelIterator) skipBackward() {
+	for iter.idx >= 0 && !iter.iters[iter.idx].Valid() {
+		iter.idx--
+		if iter.idx >= 0 {
+			iter.iters[iter.idx].Last()
+		}
+	}
+}
+
+// NewIterators return an iterator for each table in level 0 and for each
+// non-empty deeper level of column family cf, together with the range
+// tombstones of all tables. Newer tables come first. The tables are held until
+// the iterators are closed. Nothing is returned if cf doesn't exist. The
+// blocks read are added to the block cache if fillCache is true. No iterator
+// is returned if any table can't be opened
+func (vs *VersionSet) NewIterators(cf uint32, fillCache bool) (iters []utils.Iterator, rangeDels []*utils.RangeTombstone, err error) {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+
+	v, ok := vs.families[cf]
+	if !ok {
+		return nil, nil, nil
+	}
+	defer func() {
+		if err != nil {
+			for _, it := range iters {
+				it.Close()
+			}
+			iters, rangeDels = nil, nil
+		}
+	}()
+	opt := v.opt
+
+	l0 := append([]*FileMetaData{}, v.files[0]...)
+	sort.Slice(l0, func(i, j int) bool {
+		return l0[i].id > l0[j].id
+	})
+	for _, meta := range l0 {
+		t, err := vs.findTable(v, meta.id)
+		if err != nil {
+			return iters, rangeDels, err
+		}
+		it := t.NewIterator(opt)
+		it.SetFillCache(fillCache)
+		iters = append(iters, &it)
+		rangeDels = append(rangeDels, t.RangeDels()...)
+	}
+
+	for level := 1; level < len(v.files); level++ {
+		if len(v.files[level]) == 0 {
+			continue
+		}
+		iter := &LevelIterator{
+			cmp:   opt.Comparable,
+			files: append([]*FileMetaData{}, v.files[level]...),
+		}
+		// the iterators of the level are appended first, so that they are
+		// closed on error
+		iters = append(iters, iter)
+		for _, meta := range iter.files {
+			t, err := vs.findTable(v, meta.id)
+			if err != nil {
+				return iters, rangeDels, err
+			}
+			it := t.NewIterator(opt)
+			it.SetFillCache(fillCache)
+			iter.iters = append(iter.iters, &it)
+			rangeDels = append(rangeDels, t.RangeDels()...)
+		}
+	}
+	return iters, rangeDels, nil
+}
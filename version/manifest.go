@@ -1,18 +1,93 @@
 package version
 
 import (
+	"ckv/file"
 	"ckv/sstable"
 	"ckv/utils"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
 )
 
 const (
 	ManifestFilename        = "MANIFEST"
 	VManifestFilename       = "VMANIFEST"
 	ManifestRewriteFilename = "REWRITEMANIFEST"
+	// CurrentFilename is the file that holds the name of the current manifest
+	CurrentFilename     = "CURRENT"
+	currentTempFilename = "CURRENT.tmp"
+
+	// defaultMaxManifestSize is the size that triggers rewriting manifest if
+	// Options.MaxManifestSize is not set
+	defaultMaxManifestSize = 4 << 20
 )
 
+// manifestName return the name of the manifest with number num. Number 0 is
+// the manifest created before CURRENT is introduced
+func manifestName(num uint64) string {
+	if num == 0 {
+		return ManifestFilename
+	}
+	return fmt.Sprintf("%s-%06d", ManifestFilename, num)
+}
+
+// vmanifestName return the name of the vmanifest that goes with the manifest
+// with number num
+func vmanifestName(num uint64) string {
+	if num == 0 {
+		return VManifestFilename
+	}
+	return fmt.Sprintf("%s-%06d", VManifestFilename, num)
+}
+
+// readCurrent return the number of the current manifest. 0 is returned if
+// there is no CURRENT file
+func readCurrent(dir string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, CurrentFilename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	name := strings.TrimSuffix(string(data), "\n")
+	num, err := strconv.ParseUint(strings.TrimPrefix(name, ManifestFilename+"-"), 10, 64)
+	if err != nil || num == 0 || manifestName(num) != name {
+		return 0, errors.Errorf("corrupted CURRENT file: %q", data)
+	}
+	return num, nil
+}
+
+// setCurrent point CURRENT to the manifest with number num. CURRENT is
+// replaced by rename, so it always holds a complete name
+func setCurrent(dir string, num uint64) error {
+	tmp := filepath.Join(dir, currentTempFilename)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(manifestName(num) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, CurrentFilename)); err != nil {
+		return err
+	}
+	return file.SyncDir(dir)
+}
+
 type Manifest struct {
 	opt    *utils.Options
 	f      *os.File
@@ -23,12 +98,25 @@ type Manifest struct {
 // FileMetaData sstable info
 type FileMetaData struct {
 	//refs int
-	allowedSeeks int // seeks allowed until compaction
+	allowedSeeks int32 // seeks allowed until compaction, atomic
 	number       uint64
 	id           uint64
 	fileSize     uint64 // file size in bytes
 	largest      []byte // largest key served by table
 	smallest     []byte // smallest key served by table
+	smallestSeq  uint64 // seq range of the entries and range tombstones
+	largestSeq   uint64
+}
+
+// resetAllowedSeeks set the seeks allowed for the file. A seek costs about
+// the same as compacting 16KB data, so the file is compacted after one seek
+// per 16KB is wasted on it
+func (f *FileMetaData) resetAllowedSeeks() {
+	seeks := int32(f.fileSize / 16384)
+	if seeks < kMinAllowedSeeks {
+		seeks = kMinAllowedSeeks
+	}
+	atomic.StoreInt32(&f.allowedSeeks, seeks)
 }
 
 type VFileMetaData struct {
@@ -50,6 +138,8 @@ func (meta *FileMetaData) UpdateMeta(t *sstable.Table) {
 	meta.largest = t.MaxKey
 	meta.fileSize = t.Size()
 	meta.id = t.Fid()
+	meta.smallestSeq = t.MinSeq
+	meta.largestSeq = t.MaxSeq
 }
 
 func NewManifest(opt *utils.Options) (*Manifest, error) {
@@ -4,23 +4,73 @@ import (
 	"ckv/sstable"
 	"ckv/utils"
 	"ckv/utils/cmp"
+	"math"
 	"sort"
 )
 
 type MergeIterator struct {
-	list []sstable.TableIterator
-	it   utils.Item
-	curr sstable.TableIterator
-	cmp  cmp.Comparator
+	list      []sstable.TableIterator
+	it        utils.Item
+	curr      sstable.TableIterator
+	cmp       cmp.Comparator
+	rangeDels []*utils.RangeTombstone
+	snapshots []uint64
 }
 
 func NewMergeIterator(iters []sstable.TableIterator, cmp cmp.Comparator) *MergeIterator {
 	sort.Slice(iters, func(i, j int) bool {
 		return iters[i].GetFID()-iters[j].GetFID() > 0
 	})
+	var rangeDels []*utils.RangeTombstone
+	for i := range iters {
+		rangeDels = append(rangeDels, iters[i].RangeDels()...)
+	}
 	return &MergeIterator{
-		list: iters,
-		cmp:  cmp,
+		list:      iters,
+		cmp:       cmp,
+		rangeDels: rangeDels,
+	}
+}
+
+// RangeDels return range tombstones of all tables
+func (iter *MergeIterator) RangeDels() []*utils.RangeTombstone {
+	return iter.rangeDels
+}
+
+// SetSnapshots set the seqs of live snapshots in ascending order. The newest
+// version of a key visible to each snapshot is kept, instead of only the
+// newest version
+func (iter *MergeIterator) SetSnapshots(seqs []uint64) {
+	iter.snapshots = seqs
+}
+
+// Stripe return the index of the oldest snapshot that can see seq. Versions
+// in the same stripe are visible to the same snapshots, so only the newest
+// one of them is needed
+func (iter *MergeIterator) Stripe(seq uint64) int {
+	return sort.Search(len(iter.snapshots), func(i int) bool {
+		return iter.snapshots[i] >= seq
+	})
+}
+
+// stripeUpper return the largest seq in the stripe
+func (iter *MergeIterator) stripeUpper(stripe int) uint64 {
+	if stripe < len(iter.snapshots) {
+		return iter.snapshots[stripe]
+	}
+	return math.MaxUint64
+}
+
+// skipCovered skip the entries that deleted by newer range tombstones in the
+// same stripe
+func (iter *MergeIterator) skipCovered() {
+	for iter.Valid() {
+		e := iter.Item().Entry()
+		upper := iter.stripeUpper(iter.Stripe(e.Seq))
+		if utils.MaxCoveringSeq(iter.rangeDels, iter.cmp, e.Key, upper) <= e.Seq {
+			return
+		}
+		iter.next()
 	}
 }
 
@@ -32,8 +82,16 @@ func merge(iter1 utils.Iterator, iter2 utils.Iterator) utils.Iterator {
 }
 
 func (iter *MergeIterator) Next() {
+	iter.next()
+	iter.skipCovered()
+}
+
+func (iter *MergeIterator) next() {
 	var smallest []byte
 	k := iter.curr.Item().Entry().Key
+	stripe := iter.Stripe(iter.curr.Item().Entry().Seq)
+	// the older versions are needed to resolve the merge operand
+	merging := iter.curr.Item().Entry().IsMerge()
 	var seq uint64
 
 	n := 0
@@ -41,8 +99,9 @@ func (iter *MergeIterator) Next() {
 		if iter.curr == iter.list[i] {
 			iter.list[i].Next()
 		}
-		// skip keys that equal with k
-		for iter.list[i].Valid() && iter.cmp.Compare(iter.list[i].Item().Entry().Key, k) == 0 {
+		// skip older versions of k in the same stripe
+		for !merging && iter.list[i].Valid() && iter.cmp.Compare(iter.list[i].Item().Entry().Key, k) == 0 &&
+			iter.Stripe(iter.list[i].Item().Entry().Seq) == stripe {
 			iter.list[i].Next()
 		}
 		// find next key
@@ -89,6 +148,11 @@ func (iter *MergeIterator) Valid() bool {
 }
 
 func (iter *MergeIterator) Rewind() {
+	iter.rewind()
+	iter.skipCovered()
+}
+
+func (iter *MergeIterator) rewind() {
 	var key []byte
 	var seq uint64
 	for i, it := range iter.list {
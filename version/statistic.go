@@ -57,38 +57,36 @@ func (ts *TableStatus) setTableState(fid uint64, state tableState) {
 	ts.statusMap[fid] = state
 }
 
+// VLogGroup is the vlog files referenced by each sst, the id of group is the
+// fid of the sst. A vlog may be referenced by the ssts split from the same
+// compaction, so it can belong to more than one group
 type VLogGroup struct {
-	group  map[uint64][]uint64
-	vgfids map[uint64]uint64
+	group map[uint64][]uint64
+	refs  map[uint64]int // the number of groups that each vlog belongs to
 	sync.RWMutex
 }
 
 func newVLogGroup() *VLogGroup {
 	return &VLogGroup{
 		group:   make(map[uint64][]uint64),
-		vgfids:  make(map[uint64]uint64),
+		refs:    make(map[uint64]int),
 		RWMutex: sync.RWMutex{},
 	}
 }
 
-// get_ get group of fid
-func (vg *VLogGroup) get(fid uint64) ([]uint64, bool) {
+// get_ get vlogs of group
+func (vg *VLogGroup) get(group uint64) ([]uint64, bool) {
 	vg.RLock()
 	defer vg.RUnlock()
-	if group, ok := vg.vgfids[fid]; ok {
-		v, b := vg.group[group]
-		return v, b
-	}
-	return nil, false
+	v, b := vg.group[group]
+	return v, b
 }
 
-func (vg *VLogGroup) getGroup(fid uint64) (uint64, bool) {
+// referenced return whether the vlog belongs to any group
+func (vg *VLogGroup) referenced(fid uint64) bool {
 	vg.RLock()
 	defer vg.RUnlock()
-	if g, ok := vg.vgfids[fid]; ok {
-		return g, ok
-	}
-	return 0, false
+	return vg.refs[fid] > 0
 }
 
 func (vg *VLogGroup) pickGroupForMerge() ([]uint64, uint64) {
@@ -118,24 +116,90 @@ func (vg *VLogGroup) mergeGroup(fids []uint64, newGroup uint64) {
 			panic("Merged group doesn't exist")
 		} else {
 			group = append(group, g...)
-			delete(vg.group, oldGroup)
+			vg.dropGroup(oldGroup)
 		}
 	}
 
 	if _, ok := vg.group[newGroup]; ok {
 		panic("Target group already exist")
 	}
-	vg.group[newGroup] = group
+	vg.setGroup(newGroup, group)
+}
+
+// addNewGroup create a group that contains fids, the group is replaced if
+// it exists
+func (vg *VLogGroup) addNewGroup(newGroup uint64, fids []uint64) {
+	vg.Lock()
+	defer vg.Unlock()
+
+	vg.dropGroup(newGroup)
+	vg.setGroup(newGroup, fids)
+}
+
+// setGroup set the vlogs of group, the duplicated fids are ignored
+func (vg *VLogGroup) setGroup(group uint64, fids []uint64) {
+	seen := make(map[uint64]struct{}, len(fids))
+	vfids := make([]uint64, 0, len(fids))
+	for _, fid := range fids {
+		if _, ok := seen[fid]; ok {
+			continue
+		}
+		seen[fid] = struct{}{}
+		vfids = append(vfids, fid)
+		vg.refs[fid]++
+	}
+	vg.group[group] = vfids
+}
 
-	vg.updateBelongGroup(fids, newGroup)
+// dropGroup delete group and release its vlogs
+func (vg *VLogGroup) dropGroup(group uint64) {
+	for _, fid := range vg.group[group] {
+		vg.unref(fid)
+	}
+	delete(vg.group, group)
 }
 
-func (vg *VLogGroup) addNewGroupWith(newGroup uint64) {
+func (vg *VLogGroup) unref(fid uint64) {
+	if vg.refs[fid]--; vg.refs[fid] <= 0 {
+		delete(vg.refs, fid)
+	}
+}
+
+// snapshot return a copy of all groups
+func (vg *VLogGroup) snapshot() map[uint64][]uint64 {
+	vg.RLock()
+	defer vg.RUnlock()
+	groups := make(map[uint64][]uint64, len(vg.group))
+	for g, fids := range vg.group {
+		groups[g] = append([]uint64{}, fids...)
+	}
+	return groups
+}
+
+func (vg *VLogGroup) hasGroup(group uint64) bool {
+	vg.RLock()
+	defer vg.RUnlock()
+	_, ok := vg.group[group]
+	return ok
+}
+
+// removeGroup delete group and release its vlogs
+func (vg *VLogGroup) removeGroup(group uint64) {
 	vg.Lock()
 	defer vg.Unlock()
+	vg.dropGroup(group)
+}
 
-	vg.group[newGroup] = []uint64{newGroup}
-	vg.vgfids[newGroup] = newGroup
+// dropGroups delete the groups that drop returns true for. The vlogs that
+// belong to them don't belong to any group any more
+func (vg *VLogGroup) dropGroups(drop func(group uint64) bool) {
+	vg.Lock()
+	defer vg.Unlock()
+	for g := range vg.group {
+		if drop(g) {
+			vg.dropGroup(g)
+		}
+	}
 }
 
 func (vg *VLogGroup) print() {
@@ -147,54 +211,31 @@ func (vg *VLogGroup) print() {
 }
 
 // deleteFromGroup delete fids from group
-func (vg *VLogGroup) deleteFromGroup(removed []uint64) {
+func (vg *VLogGroup) deleteFromGroup(group uint64, removed []uint64) {
 	if len(removed) == 0 {
 		return
 	}
 	vg.Lock()
 	defer vg.Unlock()
-	if g, ok := vg.vgfids[removed[0]]; !ok {
+	fids, ok := vg.group[group]
+	if !ok {
 		panic("Target group doesn't exist")
-	} else {
-		var count int
-		for i := range removed {
-			removeFid := removed[i]
-			delete(vg.vgfids, removeFid)
-			fids := vg.group[g]
-			for j := range fids {
-				if fids[j] == removeFid {
-					fids = append(fids[0:j], fids[j+1:]...)
-					count += 1
-					break
-				}
+	}
+	for _, removeFid := range removed {
+		for j := range fids {
+			if fids[j] == removeFid {
+				fids = append(fids[0:j], fids[j+1:]...)
+				vg.unref(removeFid)
+				break
 			}
-			vg.group[g] = fids
 		}
 	}
-
-}
-
-func (vg *VLogGroup) moveToGroup(fids []uint64, fid uint64) {
-
-	vg.Lock()
-	defer vg.Unlock()
-	if g, ok := vg.vgfids[fid]; ok {
-		// move to group g
-		vg.group[g] = append(vg.group[g], fids...)
-	} else {
-		// create new group
-	}
+	vg.group[group] = fids
 }
 
-func (vg *VLogGroup) updateBelongGroup(fids []uint64, newGroup uint64) {
-	vg.vgfids[newGroup] = newGroup
-	for i := range fids {
-		vg.vgfids[fids[i]] = newGroup
-	}
-}
-
-func (info *Statistic) Group(fid uint64) (uint64, bool) {
-	return info.vlogGroup.getGroup(fid)
+// VLogReferenced return whether the vlog belongs to any group
+func (info *Statistic) VLogReferenced(fid uint64) bool {
+	return info.vlogGroup.referenced(fid)
 }
 
 func (info *Statistic) GetVLogGroup(group uint64) []uint64 {
@@ -209,15 +250,36 @@ func (info *Statistic) MergeVLogGroup(base []uint64, target uint64) {
 }
 
 func (info *Statistic) AddNewVLogWithGroup(fid uint64) {
-	info.vlogGroup.addNewGroupWith(fid)
+	info.vlogGroup.addNewGroup(fid, []uint64{fid})
+}
+
+// AddVLogGroup create a group that contains fids
+func (info *Statistic) AddVLogGroup(group uint64, fids []uint64) {
+	info.vlogGroup.addNewGroup(group, fids)
+}
+
+// VLogGroups return a copy of all vlog groups
+func (info *Statistic) VLogGroups() map[uint64][]uint64 {
+	return info.vlogGroup.snapshot()
+}
+
+// HasVLogGroup return whether the group exists
+func (info *Statistic) HasVLogGroup(group uint64) bool {
+	return info.vlogGroup.hasGroup(group)
+}
+
+// DropVLogGroup delete the group
+func (info *Statistic) DropVLogGroup(group uint64) {
+	info.vlogGroup.removeGroup(group)
 }
 
-func (info *Statistic) RemoveVLogFromGroup(removed []uint64) {
-	info.vlogGroup.deleteFromGroup(removed)
+// DropVLogGroups delete the groups that drop returns true for
+func (info *Statistic) DropVLogGroups(drop func(group uint64) bool) {
+	info.vlogGroup.dropGroups(drop)
 }
 
-func (info *Statistic) MoveToGroup(fids []uint64, fid uint64) {
-	info.vlogGroup.moveToGroup(fids, fid)
+func (info *Statistic) RemoveVLogFromGroup(group uint64, removed []uint64) {
+	info.vlogGroup.deleteFromGroup(group, removed)
 }
 
 func (info *Statistic) PickGroupForMerge() ([]uint64, uint64) {
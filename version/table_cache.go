@@ -1,6 +1,128 @@
 package version
 
-import "ckv/sstable"
+import (
+	"ckv/cache"
+	"ckv/sstable"
+	"ckv/utils/errs"
+	"sync"
+)
+
+const (
+	// defaultTableCacheSize is the number of opened tables if
+	// Options.TableCacheSize is not set
+	defaultTableCacheSize = 100
+	// tablesPerShard is the least tables held by a shard of table cache
+	tablesPerShard = 32
+)
+
+// tableCache keep a table for each live sst file, and bound the number of
+// them whose files are opened. The file of an evicted table is closed after
+// the iterators reading it are closed, and it's reopened when the table is
+// found again. There is only one table of a file, so that the file is
+// removed once by the last ref
+type tableCache struct {
+	lock      sync.Mutex
+	tables    map[uint64]*sstable.Table
+	opened    *cache.Cache // the tables pinned by the cache, each is charged 1
+	index     map[uint64]*sstable.IndexBlock
+	indexLock sync.RWMutex
+}
+
+// newTableCache return a cache that keeps capacity tables opened at most
+func newTableCache(capacity int64) *tableCache {
+	if capacity <= 0 {
+		capacity = defaultTableCacheSize
+	}
+	shards := capacity / tablesPerShard
+	if shards < 1 {
+		shards = 1
+	}
+	return &tableCache{
+		tables: make(map[uint64]*sstable.Table),
+		opened: cache.NewCache(cache.Options{
+			Capacity:  capacity,
+			NumShards: int(shards),
+			Policy:    cache.PolicyLRU,
+			OnEvict: func(_ uint64, value interface{}) {
+				errs.Err(value.(*sstable.Table).Unpin())
+			},
+		}),
+		index: make(map[uint64]*sstable.IndexBlock),
+	}
+}
+
+// FindTable return the table of fid, it's opened by open if the cache has
+// no table of fid. The file of the table is reopened if it has been closed
+func (c *tableCache) FindTable(fid uint64, open func() (*sstable.Table, error)) (*sstable.Table, error) {
+	if t, ok := c.opened.Get(fid); ok {
+		return t.(*sstable.Table), nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, ok := c.tables[fid]
+	if ok {
+		if err := t.Pin(); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if t, err = open(); err != nil {
+			return nil, err
+		}
+		c.tables[fid] = t
+	}
+	// the table pinned is unpinned when it's evicted
+	c.opened.Set(fid, t, 1)
+	return t, nil
+}
+
+// Drop remove the table of fid, whose file is no longer in any version. The
+// table is returned to be released, it's nil if the table is never opened
+func (c *tableCache) Drop(fid uint64) *sstable.Table {
+	c.lock.Lock()
+	t := c.tables[fid]
+	delete(c.tables, fid)
+	c.lock.Unlock()
+	c.opened.Delete(fid)
+	c.DeleteIndex(fid)
+	return t
+}
+
+// Opened return the number of tables pinned by the cache
+func (c *tableCache) Opened() int {
+	return c.opened.Len()
+}
+
+// Close close the files of all tables
+func (c *tableCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var err error
+	for _, t := range c.tables {
+		if e := t.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (c *tableCache) AddIndex(fid uint64, index *sstable.IndexBlock) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+	c.index[fid] = index
+}
+
+func (c *tableCache) DeleteIndex(fid uint64) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+	delete(c.index, fid)
+}
+
+func (c *tableCache) GetIndex(fid uint64) *sstable.IndexBlock {
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+	return c.index[fid]
+}
 
 func (vs *VersionSet) GetIndex(fid uint64) *sstable.IndexBlock {
 	return vs.tableCache.GetIndex(fid)
@@ -3,20 +3,35 @@ package version
 import (
 	"bytes"
 	"ckv/utils"
+	"ckv/utils/codec"
+	"ckv/version/pb"
 	"encoding/binary"
 	"io"
 	"os"
+	"sort"
 	"sync"
+
+	"github.com/golang/protobuf/proto"
 )
 
 const (
 	L0_CompactionTrigger = 5
+	// DefaultColumnFamilyName is the name of the column family 0, which
+	// always exists
+	DefaultColumnFamilyName = "default"
 )
 
+// Version is the files of a column family. The versions of all column
+// families share the manifest files held by the default one
 type Version struct {
-	opt *utils.Options
-	f   *os.File
-	vf  *os.File
+	id   uint32
+	name string
+	opt  *utils.Options
+	f    *os.File
+	vf   *os.File
+
+	compactPointer map[int][]byte // the largest key of last compaction in each level
+	dropped        bool
 
 	//refs int
 	vset *VersionSet
@@ -38,45 +53,78 @@ func NewVersion(opt *utils.Options) *Version {
 		vfiles[i] = make([]*VFileGroupMetaData, 0)
 	}
 	return &Version{
-		opt:     opt,
-		files:   files,
-		vfiles:  vfiles,
-		RWMutex: sync.RWMutex{},
+		name:           DefaultColumnFamilyName,
+		opt:            opt,
+		files:          files,
+		vfiles:         vfiles,
+		compactPointer: make(map[int][]byte),
+		RWMutex:        sync.RWMutex{},
 	}
 }
 
-func (v *Version) log(level int, fileMetaData *FileMetaData, op byte) {
+// ID return the id of the column family
+func (v *Version) ID() uint32 {
+	return v.id
+}
 
-	buf := make([]byte, 11)
-	//binary.BigEndian.PutUint16(buf[0:1], op)
-	buf[0] = op
-	binary.BigEndian.PutUint16(buf[1:3], uint16(level))
-	binary.BigEndian.PutUint64(buf[3:11], fileMetaData.id)
-	if _, err := v.f.Write(buf); err != nil {
-		panic(err)
-	}
-	ssz := len(fileMetaData.smallest)
-	lsz := len(fileMetaData.largest)
-	buf = make([]byte, ssz+lsz+8)
-	binary.BigEndian.PutUint32(buf[0:4], uint32(ssz))
-	copy(buf[4:4+ssz], fileMetaData.smallest)
-	binary.BigEndian.PutUint32(buf[4+ssz:8+ssz], uint32(lsz))
-	copy(buf[8+ssz:8+ssz+lsz], fileMetaData.largest)
-	if _, err := v.f.Write(buf); err != nil {
-		panic(err)
-	}
+// Name _
+func (v *Version) Name() string {
+	return v.name
+}
 
+// Options return the options of the column family
+func (v *Version) Options() *utils.Options {
+	return v.opt
 }
 
-func (v *Version) readLog() {
+// manifestRecordHeaderSize checksum(4) | length(4)
+const manifestRecordHeaderSize = 8
+
+// logEdit write the edit to f as a record. The record is written at once,
+// so that a torn record can be detected by the checksum
+//
+//	| checksum | length | data |
+//
+// the data is the encoded pb.VersionEdit, and the checksum covers the
+// length and data
+func (v *Version) logEdit(f *os.File, edit *pb.VersionEdit) error {
+	data, err := proto.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, manifestRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(data)))
+	copy(buf[manifestRecordHeaderSize:], data)
+	binary.BigEndian.PutUint32(buf[0:4], codec.CalculateU32Checksum(buf[4:]))
+	_, err = f.Write(buf)
+	return err
+}
 
-	magic := []byte(VersionEdit_BEGIN_MAGIC)
-	buf := make([]byte, 2+len(magic))
-	binary.BigEndian.PutUint16(buf[0:2], VersionEdit_BEGIN)
-	copy(buf[2:], magic)
-	if _, err := v.f.Write(buf); err != nil {
-		panic(err)
+// decodeEdit decode an edit from buf, and return the size of the record.
+// io.EOF is returned if there is no complete record
+func decodeEdit(buf []byte) (*pb.VersionEdit, int, error) {
+	if len(buf) < manifestRecordHeaderSize {
+		return nil, 0, io.EOF
+	}
+	sz := manifestRecordHeaderSize + int(binary.BigEndian.Uint32(buf[4:8]))
+	if sz > len(buf) {
+		return nil, 0, io.EOF
+	}
+	if err := codec.VerifyU32Checksum(buf[4:sz], binary.BigEndian.Uint32(buf[0:4])); err != nil {
+		return nil, 0, err
 	}
+	edit := &pb.VersionEdit{}
+	if err := proto.Unmarshal(buf[manifestRecordHeaderSize:sz], edit); err != nil {
+		return nil, 0, err
+	}
+	return edit, sz, nil
+}
+
+// isLegacyManifest return whether the manifest is written in the old format
+// that frames an edit with BEGIN_MAGIC and END_MAGIC
+func isLegacyManifest(data []byte) bool {
+	magic := append([]byte{VersionEdit_BEGIN}, VersionEdit_BEGIN_MAGIC...)
+	return bytes.HasPrefix(data, magic)
 }
 
 func (v *Version) checkBeginLog(r io.Reader) error {
@@ -106,41 +154,6 @@ func (v *Version) checkEndLog(r io.Reader) error {
 	return nil
 }
 
-func (v *Version) logBegin() {
-	magic := []byte(VersionEdit_BEGIN_MAGIC)
-	buf := make([]byte, 1+len(magic))
-	buf[0] = VersionEdit_BEGIN
-	//binary.BigEndian.PutUint16(buf[0:2], VersionEdit_BEGIN)
-	copy(buf[1:], magic)
-	if _, err := v.f.Write(buf); err != nil {
-		panic(err)
-	}
-}
-
-func (v *Version) logEnd() {
-	magic := []byte(VersionEdit_END_MAGIC)
-	buf := make([]byte, 1+len(magic))
-	buf[0] = VersionEdit_END
-	//binary.BigEndian.PutUint16(buf[0:2], VersionEdit_BEGIN)
-	copy(buf[1:], magic)
-	if _, err := v.f.Write(buf); err != nil {
-		panic(err)
-	}
-}
-
-func (v *Version) vlog(level int, fileMetaData *FileMetaData, op uint16) {
-
-	// | op | level | fid |
-	buf := make([]byte, 12)
-	binary.BigEndian.PutUint16(buf[0:2], op)
-	binary.BigEndian.PutUint16(buf[2:4], uint16(level))
-	binary.BigEndian.PutUint64(buf[4:12], fileMetaData.id)
-
-	if _, err := v.f.Write(buf); err != nil {
-		panic(err)
-	}
-}
-
 func (v *Version) deleteFile(level uint16, meta *FileMetaData) {
 	numFiles := len(v.files[level])
 	for i := 0; i < numFiles; i++ {
@@ -151,36 +164,41 @@ func (v *Version) deleteFile(level uint16, meta *FileMetaData) {
 	}
 }
 
-// pickCompactionLevel method    pick level that has the highest score
-// if best score < 1 , if score > 0.6, try to compact highest level, if score
-// for L0 score = len(files) / L0_CompactionTrigger
-// for Li score = totalFileSize / maxBytesForLevel
-func (v *Version) pickCompactionLevel() int {
-
-	baseLevel := 0
-	var score float64
-	var bestScore float64
-	var maxLevelScore float64
-	for i := 0; i < v.opt.MaxLevelNum; i++ {
-		if i == 0 {
-			score = float64(len(v.files[0])) / float64(L0_CompactionTrigger)
-		} else {
-			score = float64(totalFileSize(v.files[i])) / maxBytesForLevel(i)
-		}
-		maxLevelScore = score
-		if score > bestScore {
-			bestScore = score
-			baseLevel = i
-		}
+// sortFiles sort the files in level > 0 by smallest key, the edits replayed
+// add them in the order they are built
+func (v *Version) sortFiles() {
+	cmp := v.opt.Comparable
+	for level := 1; level < len(v.files); level++ {
+		files := v.files[level]
+		sort.Slice(files, func(i, j int) bool {
+			return cmp.Compare(files[i].smallest, files[j].smallest) < 0
+		})
 	}
-	if bestScore < 0.6 {
-		if maxLevelScore > 0.5 {
-			return v.opt.MaxLevelNum - 1
-		} else if len(v.files[0]) > L0_CompactionTrigger/2 {
-			return 0
+}
+
+// compactionLevels return the levels whose score >= 1, the level with higher
+// score comes first. The max level isn't included since its size is unbounded
+func (v *Version) compactionLevels() []int {
+	levels := make([]int, 0)
+	for i := 0; i < v.opt.MaxLevelNum-1; i++ {
+		if v.score(i) >= 1 {
+			levels = append(levels, i)
 		}
 	}
-	return baseLevel
+	sort.SliceStable(levels, func(i, j int) bool {
+		return v.score(levels[i]) > v.score(levels[j])
+	})
+	return levels
+}
+
+// score return how much the level needs compaction
+// for L0 score = len(files) / L0_CompactionTrigger
+// for Li score = totalFileSize / maxBytesForLevel
+func (v *Version) score(level int) float64 {
+	if level == 0 {
+		return float64(len(v.files[0])) / float64(L0_CompactionTrigger)
+	}
+	return float64(totalFileSize(v.files[level])) / maxBytesForLevel(level)
 }
 
 func maxBytesForLevel(level int) float64 {
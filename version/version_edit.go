@@ -1,15 +1,34 @@
 package version
 
-import "ckv/sstable"
+import (
+	"ckv/sstable"
+	"ckv/version/pb"
+)
 
 type VersionEdit struct {
-	//logNumber      uint64
-	//logNumber      uint64
+	logNumber uint64 // wal files whose number < logNumber are obsolete, 0 means unset
 	//prevFileNumber uint64
-	//nextFileNumber uint64
+	nextFileNumber uint64
+	lastSequence   uint64
+	mergeOperator  string // the name of the merge operator, empty means unset
+
+	// the column family that the files and family changes belong to
+	family     uint32
+	familyAdd  string // the name of the created column family
+	familyDrop bool
+	maxFamily  uint32 // the max id of column families, 0 means unset
 
 	deletes []*TableMeta
 	adds    []*TableMeta
+	vgroups []*VLogGroupMeta
+}
+
+// VLogGroupMeta is a change of vlog groups. A vlog group is the vlog files
+// referenced by a sst, and the id of group is the fid of the sst
+type VLogGroupMeta struct {
+	op    byte
+	group uint64
+	fids  []uint64 // vlog fids for new and remove, group ids for merge, empty for drop
 }
 
 type TableMeta struct {
@@ -17,6 +36,7 @@ type TableMeta struct {
 	level int
 }
 
+// NewVersionEdit return an edit of the default column family
 func NewVersionEdit() *VersionEdit {
 	return &VersionEdit{
 		deletes: make([]*TableMeta, 0),
@@ -24,29 +44,115 @@ func NewVersionEdit() *VersionEdit {
 	}
 }
 
+// SetLogNumber record that the wal files whose number < num are obsolete,
+// because their data has been written to sst files
+func (ve *VersionEdit) SetLogNumber(num uint64) {
+	ve.logNumber = num
+}
+
 func (ve *VersionEdit) RecordAddFileMeta(level int, t *sstable.Table) {
 	fm := &FileMetaData{
-		id:       t.Fid(),
-		largest:  t.MaxKey,
-		smallest: t.MinKey,
-		fileSize: t.Size(),
+		id:          t.Fid(),
+		largest:     t.MaxKey,
+		smallest:    t.MinKey,
+		fileSize:    t.Size(),
+		smallestSeq: t.MinSeq,
+		largestSeq:  t.MaxSeq,
 	}
 	ve.adds = append(ve.adds, &TableMeta{f: fm, level: level})
 }
 
 func (ve *VersionEdit) RecordDeleteFileMeta(level int, t *sstable.Table) {
 	fm := &FileMetaData{
-		id:       t.Fid(),
-		largest:  t.MaxKey,
-		smallest: t.MinKey,
-		fileSize: t.Size(),
+		id:          t.Fid(),
+		largest:     t.MaxKey,
+		smallest:    t.MinKey,
+		fileSize:    t.Size(),
+		smallestSeq: t.MinSeq,
+		largestSeq:  t.MaxSeq,
 	}
 	ve.deletes = append(ve.deletes, &TableMeta{f: fm, level: level})
 }
 
+// RecordNewVLogGroup record a new group that contains fids
+func (ve *VersionEdit) RecordNewVLogGroup(group uint64, fids []uint64) {
+	ve.vgroups = append(ve.vgroups, &VLogGroupMeta{op: VLogEdit_NEW_GROUP, group: group, fids: fids})
+}
+
+// RecordMergeVLogGroup record that groups are merged into a new group
+func (ve *VersionEdit) RecordMergeVLogGroup(groups []uint64, newGroup uint64) {
+	ve.vgroups = append(ve.vgroups, &VLogGroupMeta{op: VLogEdit_MERGE_GROUP, group: newGroup, fids: groups})
+}
+
+// RecordRemoveVLog record that vlog files are removed from group
+func (ve *VersionEdit) RecordRemoveVLog(group uint64, fids []uint64) {
+	ve.vgroups = append(ve.vgroups, &VLogGroupMeta{op: VLogEdit_REMOVE, group: group, fids: fids})
+}
+
+// RecordDropVLogGroup record that the group is deleted, its vlog files are
+// obsolete unless they belong to other groups
+func (ve *VersionEdit) RecordDropVLogGroup(group uint64) {
+	ve.vgroups = append(ve.vgroups, &VLogGroupMeta{op: VLogEdit_DROP_GROUP, group: group})
+}
+
 func (ve *VersionEdit) DeleteFileMetas(level int, tables []*sstable.Table) {
 
 	for _, table := range tables {
 		ve.RecordDeleteFileMeta(level, table)
 	}
 }
+
+// encode convert the edit to pb.VersionEdit, the changes of vlog groups are
+// included if vlog is true
+func (ve *VersionEdit) encode(vlog bool) *pb.VersionEdit {
+	edit := &pb.VersionEdit{
+		LogNumber:      ve.logNumber,
+		NextFileNumber: ve.nextFileNumber,
+		LastSequence:   ve.lastSequence,
+		MergeOperator:  ve.mergeOperator,
+
+		ColumnFamily:     ve.family,
+		ColumnFamilyAdd:  ve.familyAdd,
+		ColumnFamilyDrop: ve.familyDrop,
+		MaxColumnFamily:  ve.maxFamily,
+	}
+	for _, m := range ve.adds {
+		edit.Adds = append(edit.Adds, encodeFileMeta(m))
+	}
+	for _, m := range ve.deletes {
+		edit.Deletes = append(edit.Deletes, encodeFileMeta(m))
+	}
+	if vlog {
+		for _, g := range ve.vgroups {
+			edit.VlogGroups = append(edit.VlogGroups, &pb.VLogGroupEdit{
+				Op:    uint32(g.op),
+				Group: g.group,
+				Fids:  g.fids,
+			})
+		}
+	}
+	return edit
+}
+
+func encodeFileMeta(m *TableMeta) *pb.FileMetaData {
+	return &pb.FileMetaData{
+		Id:          m.f.id,
+		Smallest:    m.f.smallest,
+		Largest:     m.f.largest,
+		Level:       uint32(m.level),
+		FileSize:    m.f.fileSize,
+		SmallestSeq: m.f.smallestSeq,
+		LargestSeq:  m.f.largestSeq,
+	}
+}
+
+func decodeFileMeta(m *pb.FileMetaData) *FileMetaData {
+	return &FileMetaData{
+		id:          m.Id,
+		smallest:    m.Smallest,
+		largest:     m.Largest,
+		fileSize:    m.FileSize,
+		smallestSeq: m.SmallestSeq,
+		largestSeq:  m.LargestSeq,
+	}
+}
@@ -2,64 +2,137 @@ package version
 
 import (
 	"bufio"
-	"ckv/cache"
+	"bytes"
+	"ckv/file"
 	"ckv/sstable"
 	"ckv/utils"
 	"ckv/utils/convert"
 	"ckv/utils/errs"
+	"ckv/version/pb"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
 
 const (
-	VersionEdit_CREATE      = 0
-	VersionEdit_DELETE      = 1
-	VersionEdit_BEGIN       = 2
-	VersionEdit_END         = 3
-	VersionEdit_BEGIN_MAGIC = "BEGIN_MAGIC"
-	VersionEdit_END_MAGIC   = "END_MAGIC"
+	VersionEdit_CREATE           = 0
+	VersionEdit_DELETE           = 1
+	VersionEdit_BEGIN            = 2
+	VersionEdit_END              = 3
+	VersionEdit_LOG_NUMBER       = 4
+	VersionEdit_NEXT_FILE_NUMBER = 5
+	VersionEdit_LAST_SEQUENCE    = 6
+	VersionEdit_BEGIN_MAGIC      = "BEGIN_MAGIC"
+
+	VLogEdit_NEW_GROUP    = 0
+	VLogEdit_MERGE_GROUP  = 1
+	VLogEdit_REMOVE       = 2
+	VLogEdit_DROP_GROUP   = 3
+	VersionEdit_END_MAGIC = "END_MAGIC"
+
+	// defaultBlockCacheSize is the capacity of block cache if
+	// Options.BlockCacheSize is not set
+	defaultBlockCacheSize = 8 << 20
 )
 
 type VersionSet struct {
 	NextFileNumber     uint64
 	manifestFileNumber uint64
+	manifestBaseSize   int64 // the size of the snapshot in current manifest
 	logNumber          uint64
+	lastSequence       uint64
+	mergeOperator      string // the name of the merge operator the db is created with
 
 	head       *Version
-	current    *Version
-	tableCache *cache.Cache
+	current    *Version // the default column family, it holds the manifest files
+	families   map[uint32]*Version
+	maxFamily  uint32 // the max id of column families ever created
+	tableCache *tableCache
+	blockCache *sstable.BlockCache // shared by the tables of all column families
 	info       *Statistic
 	lock       sync.RWMutex
 	pendingGC  *VFileMetaData
+	snapshots  *utils.SnapshotList
+
+	compactCh   chan struct{} // wake a compaction worker
+	compactions []*Compaction // running compactions
+
+	seekLock             sync.Mutex
+	fileToCompact        *FileMetaData // the file whose allowed seeks are used up
+	fileToCompactLevel   int
+	fileToCompactVersion *Version
 }
 
 func Open(opt *utils.Options) (*VersionSet, error) {
-	path := filepath.Join(opt.WorkDir, ManifestFilename)
-	f, err := os.OpenFile(path, os.O_RDWR, 0)
-	vs := NewVersionSet(opt)
+	vs, err := NewVersionSet(opt)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return vs, err
+		return nil, err
+	}
+	if err := vs.Replay(); err != nil {
+		vs.Close()
+		return nil, err
+	}
+	for _, v := range vs.families {
+		for _, files := range v.files {
+			for _, f := range files {
+				f.resetAllowedSeeks()
+			}
 		}
-
-		return vs, nil
 	}
-	vs.current.f = f
-	vs.Replay()
+	if err := vs.ReplayVLog(); err != nil {
+		vs.Close()
+		return nil, err
+	}
+	if err := vs.recoverVLogGroups(); err != nil {
+		vs.Close()
+		return nil, err
+	}
+	if err := vs.checkMergeOperator(); err != nil {
+		vs.Close()
+		return nil, err
+	}
+	// switch the manifest created before CURRENT is introduced
+	if vs.manifestFileNumber == 0 {
+		err = vs.rotateManifest()
+	} else {
+		err = vs.maybeRotateManifest()
+	}
+	if err == nil {
+		err = vs.removeObsoleteManifests()
+	}
+	if err != nil {
+		vs.Close()
+		return nil, err
+	}
 
-	return vs, err
+	return vs, nil
 }
 
-func NewVersionSet(opt *utils.Options) *VersionSet {
-	manifestPath := filepath.Join(opt.WorkDir, ManifestFilename)
-	vmanifestPath := filepath.Join(opt.WorkDir, VManifestFilename)
+// blockCacheSize return the capacity of block cache in opt
+func blockCacheSize(opt *utils.Options) int64 {
+	if opt.BlockCacheSize == 0 {
+		return defaultBlockCacheSize
+	}
+	return opt.BlockCacheSize
+}
+
+func NewVersionSet(opt *utils.Options) (*VersionSet, error) {
+	num, err := readCurrent(opt.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+	manifestPath := filepath.Join(opt.WorkDir, manifestName(num))
+	vmanifestPath := filepath.Join(opt.WorkDir, vmanifestName(num))
 	f, err := os.OpenFile(manifestPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	//vs := &VersionSet{Lock: sync.RWMutex{}}
 
@@ -67,50 +140,582 @@ func NewVersionSet(opt *utils.Options) *VersionSet {
 	current.f = f
 	vf, err := os.OpenFile(vmanifestPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
 	if err != nil {
-		return nil
+		f.Close()
+		return nil, err
 	}
 	current.vf = vf
 
 	vs := &VersionSet{
 		NextFileNumber:     0,
-		manifestFileNumber: 0,
+		manifestFileNumber: num,
 		logNumber:          0,
 		head:               &Version{},
 		current:            current,
-		tableCache:         cache.NewCache(100, 100),
+		families:           map[uint32]*Version{0: current},
+		tableCache:         newTableCache(opt.TableCacheSize),
+		blockCache:         sstable.NewBlockCache(blockCacheSize(opt)),
 		info:               NewStatistic(),
 		lock:               sync.RWMutex{},
+		snapshots:          utils.NewSnapshotList(),
+		compactCh:          make(chan struct{}, 1),
 	}
 	current.vset = vs
 
-	return vs
+	return vs, nil
+}
+
+// Close sync and close the manifest files and all opened tables.
+// Background compaction and gc must be stopped before calling Close
+func (vs *VersionSet) Close() error {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	err := vs.tableCache.Close()
+	for _, f := range []*os.File{vs.current.f, vs.current.vf} {
+		if f == nil {
+			continue
+		}
+		if e := f.Sync(); e != nil && err == nil {
+			err = e
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// LogAndApply write the edit to manifest. The next file number and the last
+// sequence are recorded in each edit, so that they can be restored exactly.
+// The caller must not apply the edit to memory if an error is returned
+func (vs *VersionSet) LogAndApply(ve *VersionEdit) error {
+	if err := vs.maybeRotateManifest(); err != nil {
+		return err
+	}
+	ve.nextFileNumber = atomic.LoadUint64(&vs.NextFileNumber)
+	ve.lastSequence = atomic.LoadUint64(&vs.lastSequence)
+	if err := vs.current.logEdit(vs.current.f, ve.encode(false)); err != nil {
+		return err
+	}
+	if err := vs.current.f.Sync(); err != nil {
+		return err
+	}
+	if ve.logNumber > 0 {
+		vs.logNumber = ve.logNumber
+	}
+	return nil
+}
+
+// VLogAndApply write the changes of vlog groups to vmanifest and apply them
+func (vs *VersionSet) VLogAndApply(ve *VersionEdit) error {
+	if len(ve.vgroups) == 0 {
+		return nil
+	}
+	edit := &pb.VersionEdit{VlogGroups: ve.encode(true).VlogGroups}
+	if err := vs.current.logEdit(vs.current.vf, edit); err != nil {
+		return err
+	}
+	for _, g := range edit.VlogGroups {
+		vs.applyVLog(g)
+	}
+	return nil
+}
+
+func (vs *VersionSet) applyVLog(g *pb.VLogGroupEdit) {
+	switch g.Op {
+	case VLogEdit_NEW_GROUP:
+		vs.info.AddVLogGroup(g.Group, g.Fids)
+	case VLogEdit_MERGE_GROUP:
+		vs.info.MergeVLogGroup(g.Fids, g.Group)
+	case VLogEdit_REMOVE:
+		vs.info.RemoveVLogFromGroup(g.Group, g.Fids)
+	case VLogEdit_DROP_GROUP:
+		vs.info.DropVLogGroup(g.Group)
+	}
+}
+
+// ReplayVLog restore the vlog groups from vmanifest
+func (vs *VersionSet) ReplayVLog() error {
+	return vs.replayEdits(vs.current.vf, func(edit *pb.VersionEdit) {
+		for _, g := range edit.VlogGroups {
+			vs.applyVLog(g)
+		}
+	})
+}
+
+// replayEdits call apply for each edit in f. A torn or corrupted record at
+// the end is truncated, so that the records appended later can be read
+func (vs *VersionSet) replayEdits(f *os.File, apply func(edit *pb.VersionEdit)) error {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	off := 0
+	for off < len(data) {
+		edit, n, err := decodeEdit(data[off:])
+		if err != nil {
+			log.Printf("ignore the corrupted tail of %s at %d: %v\n", f.Name(), off, err)
+			break
+		}
+		apply(edit)
+		off += n
+	}
+	if off < len(data) {
+		return f.Truncate(int64(off))
+	}
+	return nil
+}
+
+// recoverVLogGroups make the vlog groups consistent with the tables after
+// replay. The group of a table is missing if the db crashed before the
+// vmanifest was written, then it's rebuilt from the value pointers in the
+// table. Groups of deleted tables are dropped, and the vlog files that don't
+// belong to any group are removed
+func (vs *VersionSet) recoverVLogGroups() error {
+	live := make(map[uint64]struct{})
+	for _, v := range vs.families {
+		for _, files := range v.files {
+			for _, meta := range files {
+				live[meta.id] = struct{}{}
+				vs.info.SetTableState(meta.id, NORMAL)
+				if vs.info.HasVLogGroup(meta.id) {
+					continue
+				}
+				fids, err := vs.referencedVLogs(v, meta.id)
+				if err != nil {
+					return err
+				}
+				ve := NewVersionEdit()
+				ve.RecordNewVLogGroup(meta.id, fids)
+				if err := vs.VLogAndApply(ve); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	vs.info.DropVLogGroups(func(group uint64) bool {
+		_, ok := live[group]
+		return !ok
+	})
+
+	files, err := ioutil.ReadDir(vs.current.opt.WorkDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), utils.VLOG_FILE_EXT) {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), utils.VLOG_FILE_EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		if !vs.info.VLogReferenced(fid) {
+			log.Printf("remove orphaned vlog %s\n", f.Name())
+			if err := os.Remove(filepath.Join(vs.current.opt.WorkDir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// referencedVLogs return the fids of vlog files that the table of v refs
+func (vs *VersionSet) referencedVLogs(v *Version, fid uint64) ([]uint64, error) {
+	table, err := vs.findTable(v, fid)
+	if err != nil {
+		return nil, err
+	}
+	iter := table.NewIterator(v.opt)
+	iter.SetFillCache(false)
+	defer iter.Close()
+	seen := make(map[uint64]struct{})
+	var fids []uint64
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		if len(e.Value) == 0 || e.Value[0] != utils.VAL_PTR {
+			continue
+		}
+		vfid := convert.BytesToU64(e.Value[1:])
+		if _, ok := seen[vfid]; !ok {
+			seen[vfid] = struct{}{}
+			fids = append(fids, vfid)
+		}
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	return fids, nil
+}
+
+// Replay restore the version from manifest. Each edit is a checksummed
+// record, so a crash in the middle of LogAndApply leaves a torn record at the
+// end, which is dropped
+func (vs *VersionSet) Replay() error {
+	current := vs.current
+	data, err := ioutil.ReadAll(current.f)
+	if err != nil {
+		return err
+	}
+	if isLegacyManifest(data) {
+		// the manifest is rewritten in the new format by rotation
+		vs.replayLegacy(bufio.NewReader(bytes.NewReader(data)))
+		vs.current.sortFiles()
+		return nil
+	}
+	if _, err := current.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var maxFid uint64
+	var dropped []*Version
+	err = vs.replayEdits(current.f, func(edit *pb.VersionEdit) {
+		if edit.LogNumber > 0 {
+			vs.logNumber = edit.LogNumber
+		}
+		if edit.NextFileNumber > maxFid {
+			maxFid = edit.NextFileNumber
+		}
+		if edit.LastSequence > vs.lastSequence {
+			vs.lastSequence = edit.LastSequence
+		}
+		if edit.MergeOperator != "" {
+			vs.mergeOperator = edit.MergeOperator
+		}
+		if edit.MaxColumnFamily > vs.maxFamily {
+			vs.maxFamily = edit.MaxColumnFamily
+		}
+		for _, m := range edit.Adds {
+			if m.Id > maxFid {
+				maxFid = m.Id
+			}
+		}
+		if edit.ColumnFamilyAdd != "" {
+			vs.addFamily(edit.ColumnFamily, edit.ColumnFamilyAdd)
+		}
+		v, ok := vs.families[edit.ColumnFamily]
+		if !ok {
+			// the files of a dropped column family
+			return
+		}
+		if edit.ColumnFamilyDrop {
+			delete(vs.families, edit.ColumnFamily)
+			dropped = append(dropped, v)
+			return
+		}
+		for _, m := range edit.Adds {
+			v.files[m.Level] = append(v.files[m.Level], decodeFileMeta(m))
+		}
+		for _, m := range edit.Deletes {
+			v.deleteFile(uint16(m.Level), decodeFileMeta(m))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	vs.NextFileNumber = maxFid
+	for _, v := range vs.families {
+		v.sortFiles()
+	}
+	// the files are left if the db crashed before they are deleted, their
+	// vlogs are removed by recoverVLogGroups
+	for _, v := range dropped {
+		for _, files := range v.files {
+			for _, meta := range files {
+				os.Remove(file.FileNameSSTable(v.opt.WorkDir, meta.id))
+			}
+		}
+	}
+	return nil
+}
+
+// addFamily add the column family created by an edit. Its options are taken
+// from Options.ColumnFamilies
+func (vs *VersionSet) addFamily(id uint32, name string) *Version {
+	v := NewVersion(vs.current.opt.ColumnFamilyOptions(name, nil))
+	v.id, v.name, v.vset = id, name, vs
+	vs.families[id] = v
+	return v
+}
+
+// sortedFamilies return the live column families ordered by id, the default
+// one comes first
+func (vs *VersionSet) sortedFamilies() []*Version {
+	families := make([]*Version, 0, len(vs.families))
+	for _, v := range vs.families {
+		families = append(families, v)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+	return families
+}
+
+// ColumnFamilies return the live column families ordered by id
+func (vs *VersionSet) ColumnFamilies() []*Version {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	return vs.sortedFamilies()
+}
+
+// CreateColumnFamily create a column family with its own levels and options.
+// opt nil means the options in Options.ColumnFamilies
+func (vs *VersionSet) CreateColumnFamily(name string, opt *utils.Options) (*Version, error) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	for _, v := range vs.families {
+		if v.name == name {
+			return nil, errs.ErrColumnFamilyExists
+		}
+	}
+	v := NewVersion(vs.current.opt.ColumnFamilyOptions(name, opt))
+	v.id, v.name, v.vset = vs.maxFamily+1, name, vs
+
+	ve := NewVersionEdit()
+	ve.family, ve.familyAdd, ve.maxFamily = v.id, name, v.id
+	if err := vs.LogAndApply(ve); err != nil {
+		return nil, err
+	}
+	vs.maxFamily = v.id
+	vs.families[v.id] = v
+	return v, nil
+}
+
+// DropColumnFamily drop the column family and delete its files. The files
+// being compacted or gc are deleted when the work is finished
+func (vs *VersionSet) DropColumnFamily(id uint32) error {
+	if id == 0 {
+		return errs.ErrDropDefaultColumnFamily
+	}
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	v, ok := vs.families[id]
+	if !ok {
+		return errs.ErrColumnFamilyNotFound
+	}
+	ve := NewVersionEdit()
+	ve.family, ve.familyDrop = id, true
+	if err := vs.LogAndApply(ve); err != nil {
+		return err
+	}
+	v.dropped = true
+	delete(vs.families, id)
+
+	var metas []*FileMetaData
+	for _, files := range v.files {
+		for _, meta := range files {
+			if vs.isNormal(meta) {
+				metas = append(metas, meta)
+			}
+		}
+	}
+	return vs.removeTables(v, metas)
+}
+
+// removeTables drop the vlog groups of the tables of a dropped column family
+// and delete the tables. The vlogs that are no longer referenced are removed
+// after all tables are released. The tables are deleted even if vmanifest
+// can't be written, their groups are dropped by recoverVLogGroups
+func (vs *VersionSet) removeTables(v *Version, metas []*FileMetaData) error {
+	if len(metas) == 0 {
+		return nil
+	}
+	ve := NewVersionEdit()
+	var vlogs []uint64
+	for _, meta := range metas {
+		ve.RecordDropVLogGroup(meta.id)
+		vlogs = append(vlogs, vs.info.GetVLogGroup(meta.id)...)
+	}
+	err := vs.VLogAndApply(ve)
+	obsolete := vs.obsoleteVLogs(vlogs)
+	pending := int32(len(metas))
+	release := func() error {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			vs.removeVLogs(obsolete)
+		}
+		return nil
+	}
+	for _, meta := range metas {
+		vs.info.SetTableState(meta.id, NORMAL)
+		vs.releaseTable(v, meta.id, release)
+	}
+	return err
 }
 
-func (vs *VersionSet) LogAndApply(ve *VersionEdit) {
-	vs.current.logBegin()
-	for _, tableMeta := range ve.adds {
-		vs.current.log(tableMeta.level, tableMeta.f, VersionEdit_CREATE)
+// removeOutputs delete the tables written for a dropped column family, and
+// the vlogs that are only referenced by them
+func (vs *VersionSet) removeOutputs(tables []*sstable.Table, vlogs []uint64) {
+	for _, t := range tables {
+		os.Remove(file.FileNameSSTable(vs.current.opt.WorkDir, t.Fid()))
 	}
-	for _, tableMeta := range ve.deletes {
-		vs.current.log(tableMeta.level, tableMeta.f, VersionEdit_DELETE)
+	vs.removeVLogs(vlogs)
+}
+
+// checkMergeOperator check that the merge operator has the name recorded in
+// manifest, the name is recorded by the first open with an operator. The db
+// can be opened without operator, but the merge operands can't be read then
+func (vs *VersionSet) checkMergeOperator() error {
+	op := vs.current.opt.MergeOperator
+	if op == nil {
+		return nil
 	}
-	vs.current.logEnd()
+	if vs.mergeOperator != "" {
+		if vs.mergeOperator != op.Name() {
+			return errs.ErrMergeOperatorMismatch
+		}
+		return nil
+	}
+	vs.mergeOperator = op.Name()
+	if vs.manifestFileNumber == 0 {
+		// recorded by the snapshot of the manifest rotated by Open
+		return nil
+	}
+	ve := NewVersionEdit()
+	ve.mergeOperator = vs.mergeOperator
+	if err := vs.current.logEdit(vs.current.f, ve.encode(false)); err != nil {
+		return err
+	}
+	return vs.current.f.Sync()
 }
 
-func (vs *VersionSet) VLogAndApply(ve *VersionEdit) {
-	for _, tableMeta := range ve.adds {
-		vs.current.vlog(tableMeta.level, tableMeta.f, VersionEdit_CREATE)
+// rotateManifest write the current version and vlog groups to new manifest
+// files as snapshots, and switch to them through CURRENT. The old manifest
+// files are removed after the switch, so that the manifest won't grow without
+// bound and replay only applies the snapshot and the edits after it
+func (vs *VersionSet) rotateManifest() error {
+	dir := vs.current.opt.WorkDir
+	num := vs.manifestFileNumber + 1
+
+	ve := NewVersionEdit()
+	ve.logNumber = vs.logNumber
+	ve.nextFileNumber = atomic.LoadUint64(&vs.NextFileNumber)
+	ve.lastSequence = atomic.LoadUint64(&vs.lastSequence)
+	ve.mergeOperator = vs.mergeOperator
+	ve.maxFamily = vs.maxFamily
+	for level, files := range vs.current.files {
+		for _, f := range files {
+			ve.adds = append(ve.adds, &TableMeta{f: f, level: level})
+		}
+	}
+	for group, fids := range vs.info.VLogGroups() {
+		ve.RecordNewVLogGroup(group, fids)
+	}
+	// each column family is recreated by an edit with its files
+	edits := []*pb.VersionEdit{ve.encode(false)}
+	for _, v := range vs.sortedFamilies()[1:] {
+		cfe := NewVersionEdit()
+		cfe.family, cfe.familyAdd = v.id, v.name
+		for level, files := range v.files {
+			for _, f := range files {
+				cfe.adds = append(cfe.adds, &TableMeta{f: f, level: level})
+			}
+		}
+		edits = append(edits, cfe.encode(false))
+	}
+
+	f, err := vs.writeSnapshot(manifestName(num), edits...)
+	if err != nil {
+		return err
 	}
-	for _, tableMeta := range ve.deletes {
-		vs.current.vlog(tableMeta.level, tableMeta.f, VersionEdit_DELETE)
+	vf, err := vs.writeSnapshot(vmanifestName(num), &pb.VersionEdit{VlogGroups: ve.encode(true).VlogGroups})
+	if err != nil {
+		f.Close()
+		os.Remove(filepath.Join(dir, manifestName(num)))
+		return err
 	}
+	if err := setCurrent(dir, num); err != nil {
+		f.Close()
+		vf.Close()
+		// CURRENT may have been renamed, the files are left to
+		// removeObsoleteManifests
+		return err
+	}
+
+	vs.current.f.Close()
+	vs.current.vf.Close()
+	os.Remove(filepath.Join(dir, manifestName(vs.manifestFileNumber)))
+	os.Remove(filepath.Join(dir, vmanifestName(vs.manifestFileNumber)))
+	vs.current.f, vs.current.vf = f, vf
+	vs.manifestFileNumber = num
+	if info, err := f.Stat(); err == nil {
+		vs.manifestBaseSize = info.Size()
+	}
+	return nil
 }
 
-func (vs *VersionSet) Replay() {
+// writeSnapshot create the file and write the edits to it
+func (vs *VersionSet) writeSnapshot(name string, edits ...*pb.VersionEdit) (*os.File, error) {
+	path := filepath.Join(vs.current.opt.WorkDir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	for _, edit := range edits {
+		if err := vs.current.logEdit(f, edit); err != nil {
+			f.Close()
+			os.Remove(path)
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return f, nil
+}
+
+// maybeRotateManifest rotate the manifest if it's too large. The manifest
+// should at least double the snapshot, otherwise a large version would be
+// rewritten for each edit
+func (vs *VersionSet) maybeRotateManifest() error {
+	max := vs.current.opt.MaxManifestSize
+	if max <= 0 {
+		max = defaultMaxManifestSize
+	}
+	info, err := vs.current.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < max || info.Size() < 2*vs.manifestBaseSize {
+		return nil
+	}
+	return vs.rotateManifest()
+}
+
+// removeObsoleteManifests remove the manifest files left by a crash in the
+// middle of rotation
+func (vs *VersionSet) removeObsoleteManifests() error {
+	dir := vs.current.opt.WorkDir
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	current := map[string]struct{}{
+		manifestName(vs.manifestFileNumber):  {},
+		vmanifestName(vs.manifestFileNumber): {},
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, ManifestFilename) && !strings.HasPrefix(name, VManifestFilename) &&
+			name != currentTempFilename {
+			continue
+		}
+		if _, ok := current[name]; !ok {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replayLegacy restore the version from the manifest in the old format
+func (vs *VersionSet) replayLegacy(r *bufio.Reader) {
 	current := vs.current
-	r := bufio.NewReader(current.f)
 	var maxFid uint64
 	var adds, deletes [][]*FileMetaData
+	// numbers of the edit being read, indexed by op
+	var numbers map[byte]uint64
 	begin, end := false, false
 
 	for {
@@ -131,6 +736,7 @@ func (vs *VersionSet) Replay() {
 					break
 				}
 				begin = true
+				numbers = make(map[byte]uint64)
 				adds = make([][]*FileMetaData, vs.current.opt.MaxLevelNum)
 				deletes = make([][]*FileMetaData, vs.current.opt.MaxLevelNum)
 			case VersionEdit_END:
@@ -139,6 +745,17 @@ func (vs *VersionSet) Replay() {
 					break
 				}
 				end = true
+			case VersionEdit_LOG_NUMBER, VersionEdit_NEXT_FILE_NUMBER, VersionEdit_LAST_SEQUENCE:
+				buf := make([]byte, 8)
+				if !begin || end {
+					flag = true
+					break
+				}
+				if _, err := io.ReadFull(r, buf); err != nil {
+					flag = true
+					break
+				}
+				numbers[op] = convert.BytesToU64(buf)
 			default:
 				if !begin || end {
 					flag = true
@@ -196,6 +813,15 @@ func (vs *VersionSet) Replay() {
 		}
 		begin, end = false, false
 
+		if num, ok := numbers[VersionEdit_LOG_NUMBER]; ok {
+			vs.logNumber = num
+		}
+		if num := numbers[VersionEdit_NEXT_FILE_NUMBER]; num > maxFid {
+			maxFid = num
+		}
+		if num := numbers[VersionEdit_LAST_SEQUENCE]; num > vs.lastSequence {
+			vs.lastSequence = num
+		}
 		for i := range adds {
 			if adds[i] != nil {
 				current.files[i] = append(current.files[i], adds[i]...)
@@ -213,19 +839,52 @@ func (vs *VersionSet) Replay() {
 	vs.NextFileNumber = maxFid
 }
 
-func (vs *VersionSet) AddFileMetaWithGroup(level int, t *sstable.Table) {
+// AddFileMetaWithGroup add the table flushed from a memtable of column family
+// cf. The wal files whose number < logNumber are recorded as obsolete
+func (vs *VersionSet) AddFileMetaWithGroup(cf uint32, level int, t *sstable.Table, logNumber uint64) error {
 	vs.lock.Lock()
 	defer vs.lock.Unlock()
 
+	v, ok := vs.families[cf]
+	if !ok {
+		// the column family is dropped while the memtable is flushed
+		vs.removeOutputs([]*sstable.Table{t}, []uint64{t.Fid()})
+		if logNumber > 0 {
+			return vs.setLogNumber(logNumber)
+		}
+		return nil
+	}
 	ve := NewVersionEdit()
+	ve.family = cf
+	ve.SetLogNumber(logNumber)
 	ve.RecordAddFileMeta(level, t)
-	vs.LogAndApply(ve)
+	if err := vs.LogAndApply(ve); err != nil {
+		return err
+	}
+
+	vs.addFileMeta(v, level, t)
+	if err := vs.AddNewVLogGroup(t.Fid()); err != nil {
+		// the group of the table is rebuilt by recoverVLogGroups
+		log.Printf("write vmanifest failed: %v\n", err)
+	}
+	vs.MaybeScheduleCompaction()
+	return nil
+}
+
+// SetLogNumber record that the wal files whose number < num are obsolete
+func (vs *VersionSet) SetLogNumber(num uint64) error {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	return vs.setLogNumber(num)
+}
 
-	vs.addFileMeta(level, t)
-	vs.AddNewVLogGroup(t.Fid())
+func (vs *VersionSet) setLogNumber(num uint64) error {
+	ve := NewVersionEdit()
+	ve.SetLogNumber(num)
+	return vs.LogAndApply(ve)
 }
 
-func (vs *VersionSet) addFileMeta(level int, t *sstable.Table) {
+func (vs *VersionSet) addFileMeta(v *Version, level int, t *sstable.Table) {
 
 	meta := &FileMetaData{
 		id:       t.Fid(),
@@ -233,114 +892,283 @@ func (vs *VersionSet) addFileMeta(level int, t *sstable.Table) {
 		smallest: t.MinKey,
 		fileSize: t.Size(),
 	}
-	vs.current.files[level] = append(vs.current.files[level], meta)
-	vs.current.vfiles[level] = append(vs.current.vfiles[level], &VFileGroupMetaData{
+	v.insertFileMeta(level, meta)
+	vs.tableCache.AddIndex(t.Fid(), t.Index())
+}
+
+// insertFileMeta add meta to level
+func (v *Version) insertFileMeta(level int, meta *FileMetaData) {
+	meta.resetAllowedSeeks()
+	files := v.files[level]
+	// files in level > 0 are sorted by smallest key for binary search
+	i := len(files)
+	if level > 0 {
+		cmp := v.opt.Comparable
+		i = sort.Search(len(files), func(i int) bool {
+			return cmp.Compare(files[i].smallest, meta.smallest) > 0
+		})
+	}
+	files = append(files, nil)
+	copy(files[i+1:], files[i:])
+	files[i] = meta
+	v.files[level] = files
+	v.vfiles[level] = append(v.vfiles[level], &VFileGroupMetaData{
 		sstId: meta.id,
 		vfids: make([]uint64, 0),
 	})
-	vs.tableCache.AddIndex(t.Fid(), t.Index())
 }
 
-func (vs *VersionSet) DeleteFileMeta(level, targetLevel int, t *sstable.Table) {
+func (v *Version) DeleteFileMeta(level, targetLevel int, t *sstable.Table) {
 	var vfileMeta *VFileGroupMetaData
-	for i := 0; i < len(vs.current.files[level]); i++ {
-		if vs.current.files[level][i].id == t.Fid() {
-			vs.current.files[level] = append(vs.current.files[level][0:i], vs.current.files[level][i+1:]...)
-			// delete from old level
-			vfileMeta = vs.current.vfiles[level][i]
-			vs.current.vfiles[level] = append(vs.current.vfiles[level][0:i], vs.current.vfiles[level][i+1:]...)
+	for i := 0; i < len(v.files[level]); i++ {
+		if v.files[level][i].id == t.Fid() {
+			v.files[level] = append(v.files[level][0:i], v.files[level][i+1:]...)
 			break
 		}
 	}
-	for i := 0; i < len(vs.current.vfiles[targetLevel]); i++ {
-		if vs.current.vfiles[targetLevel][i].sstId == t.Fid() {
-			vs.current.vfiles[targetLevel][i].vfids = append(vs.current.vfiles[targetLevel][i].vfids, vfileMeta.vfids...)
+	// delete from old level
+	for i := 0; i < len(v.vfiles[level]); i++ {
+		if v.vfiles[level][i].sstId == t.Fid() {
+			vfileMeta = v.vfiles[level][i]
+			v.vfiles[level] = append(v.vfiles[level][0:i], v.vfiles[level][i+1:]...)
+			break
+		}
+	}
+	for i := 0; vfileMeta != nil && i < len(v.vfiles[targetLevel]); i++ {
+		if v.vfiles[targetLevel][i].sstId == t.Fid() {
+			v.vfiles[targetLevel][i].vfids = append(v.vfiles[targetLevel][i].vfids, vfileMeta.vfids...)
 			break
 		}
 	}
 	//vs.tableCache.AddIndex(t.Fid(), t.Index())
 }
 
-func (vs *VersionSet) FindTable(fid uint64) *sstable.Table {
-	table := vs.tableCache.GetTable(fid)
-	if table == nil {
-		table = sstable.OpenTable(vs.current.opt, fid)
-		vs.tableCache.AddTable(fid, table)
-	}
-	index := vs.tableCache.GetIndex(fid)
-	if index == nil {
-		if idx, err := table.ReadIndex(); err != nil {
-			panic(err)
-		} else {
+// FindTable return the table of the default column family
+func (vs *VersionSet) FindTable(fid uint64) (*sstable.Table, error) {
+	return vs.findTable(vs.current, fid)
+}
+
+// findTable return the table of v, it's opened with the options of v
+func (vs *VersionSet) findTable(v *Version, fid uint64) (*sstable.Table, error) {
+	return vs.tableCache.FindTable(fid, func() (*sstable.Table, error) {
+		table, err := sstable.OpenTable(v.opt, fid)
+		if err != nil {
+			return nil, err
+		}
+		table.SetBlockCache(vs.blockCache)
+		index := vs.tableCache.GetIndex(fid)
+		if index == nil {
+			idx, err := table.ReadIndex()
+			if err != nil {
+				table.Close()
+				return nil, err
+			}
 			index = idx
 		}
+		table.SetIndex(index)
+		return table, nil
+	})
+}
+
+// releaseTable drop the table of v that is no longer in any version. The
+// file is removed after the iterators reading it are closed, fn is called
+// before that
+func (vs *VersionSet) releaseTable(v *Version, fid uint64, fn func() error) error {
+	t := vs.tableCache.Drop(fid)
+	if t == nil {
+		// the table is never opened, so no iterator reads it
+		if fn != nil {
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+		return os.Remove(file.FileNameSSTable(v.opt.WorkDir, fid))
 	}
-	table.SetIndex(index)
-	return table
+	return t.DecrRef(fn)
 }
 
-func (vs *VersionSet) Get(key []byte) (*utils.Entry, error) {
+// getStats record the tables probed by a Get
+type getStats struct {
+	seekFile      *FileMetaData // the first file probed, if the key isn't in it
+	seekFileLevel int
+	probes        int
+}
+
+// probe record the search in the file, err is the result of it
+func (s *getStats) probe(meta *FileMetaData, level int, err error) {
+	if s.probes == 0 && err == errs.ErrKeyNotFound {
+		s.seekFile, s.seekFileLevel = meta, level
+	}
+	s.probes++
+}
+
+// seekCharged return the file to charge a seek. The seek on the first file
+// is wasted if the key isn't found in it and more files are probed
+func (s *getStats) seekCharged() (*FileMetaData, int) {
+	if s.seekFile == nil || s.probes < 2 {
+		return nil, 0
+	}
+	return s.seekFile, s.seekFileLevel
+}
+
+// Get return the newest version of key whose seq <= seq in column family cf.
+// The merge operands on top of it are pushed to merge, the older versions are
+// searched in the same version, so that they won't be combined by compaction
+// in between
+func (vs *VersionSet) Get(cf uint32, key []byte, seq uint64, merge *utils.MergeContext) (*utils.Entry, error) {
 	vs.lock.RLock()
 	defer vs.lock.RUnlock()
-	if entry, err := vs.searchL0SST(key); err == nil && entry != nil {
-		return entry, nil
+	v, ok := vs.families[cf]
+	if !ok {
+		return nil, errs.ErrColumnFamilyNotFound
 	}
-	// TODO serach LN
+	var stats getStats
+	defer func() {
+		if meta, level := stats.seekCharged(); meta != nil {
+			vs.chargeSeek(v, meta, level)
+		}
+	}()
+	for {
+		entry, err := vs.searchL0SST(v, key, seq, &stats)
+		if err == errs.ErrKeyNotFound {
+			entry, err = vs.searchLNSST(v, key, seq, &stats)
+		}
+		if err != nil || !entry.IsMerge() {
+			return entry, err
+		}
+		merge.Push(entry)
+		seq = entry.Seq - 1
+	}
+}
 
-	if entry, err := vs.searchLNSST(key); err == nil && entry != nil {
-		return entry, nil
+// chargeSeek charge a seek to the file, and schedule a compaction for it
+// once its allowed seeks are used up
+func (vs *VersionSet) chargeSeek(v *Version, meta *FileMetaData, level int) {
+	if atomic.AddInt32(&meta.allowedSeeks, -1) != 0 {
+		return
 	}
-	return &utils.Entry{Key: key, Value: nil}, nil
+	vs.seekLock.Lock()
+	if vs.fileToCompact == nil {
+		vs.fileToCompact, vs.fileToCompactLevel, vs.fileToCompactVersion = meta, level, v
+	}
+	vs.seekLock.Unlock()
+	vs.MaybeScheduleCompaction()
 }
 
-func (vs *VersionSet) searchL0SST(key []byte) (*utils.Entry, error) {
-	var target []uint64
-	cmp := vs.current.opt.Comparable
-	for _, fileMeta := range vs.current.files[0] {
+func (vs *VersionSet) searchL0SST(v *Version, key []byte, seq uint64, stats *getStats) (*utils.Entry, error) {
+	var target []*FileMetaData
+	cmp := v.opt.Comparable
+	for _, fileMeta := range v.files[0] {
 		if cmp.Compare(fileMeta.smallest, key) <= 0 && cmp.Compare(fileMeta.largest, key) >= 0 {
-			target = append(target, fileMeta.id)
+			target = append(target, fileMeta)
 		}
 	}
 	sort.Slice(target, func(i, j int) bool {
-		return target[i] > target[j]
+		return target[i].id > target[j].id
 	})
 
 	for i := 0; i < len(target); i++ {
-		fid := target[i]
-		table := vs.FindTable(fid)
-		if entry, err := table.Serach(key); err == nil && entry != nil {
-			return entry, nil
+		table, err := vs.findTable(v, target[i].id)
+		if err != nil {
+			return nil, err
+		}
+		// the tombstone or newer value shadows the older tables
+		entry, err := table.Serach(key, seq)
+		stats.probe(target[i], 0, err)
+		if err != errs.ErrKeyNotFound {
+			return entry, err
 		}
 	}
 
 	return nil, errs.ErrKeyNotFound
 }
 
-func (vs *VersionSet) searchLNSST(key []byte) (*utils.Entry, error) {
-	current := vs.current
-	//cmp := current.opt.Comparable
+func (vs *VersionSet) searchLNSST(v *Version, key []byte, seq uint64, stats *getStats) (*utils.Entry, error) {
+	current := v
+	cmp := current.opt.Comparable
 	for level := 1; level < current.opt.MaxLevelNum; level++ {
 		idx := current.findFile(current.files[level], key)
 		if idx >= len(current.files[level]) {
 			continue
 		}
 		meta := current.files[level][idx]
-		table := vs.FindTable(meta.id)
-		if entry, err := table.Serach(key); err == nil && entry != nil {
-			return entry, nil
+		if cmp.Compare(key, meta.smallest) < 0 {
+			continue
+		}
+		table, err := vs.findTable(v, meta.id)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := table.Serach(key, seq)
+		stats.probe(meta, level, err)
+		if err != errs.ErrKeyNotFound {
+			return entry, err
 		}
 	}
 	return nil, errs.ErrKeyNotFound
 }
 
+// Snapshots return the live snapshots, compaction keeps the versions
+// visible to them
+func (vs *VersionSet) Snapshots() *utils.SnapshotList {
+	return vs.snapshots
+}
+
+// LastSequence return the last sequence recorded in manifest
+func (vs *VersionSet) LastSequence() uint64 {
+	return atomic.LoadUint64(&vs.lastSequence)
+}
+
+// SetLastSequence set the last sequence that will be recorded by the next
+// edit. The sequence never goes backward
+func (vs *VersionSet) SetLastSequence(seq uint64) {
+	for {
+		old := atomic.LoadUint64(&vs.lastSequence)
+		if seq <= old || atomic.CompareAndSwapUint64(&vs.lastSequence, old, seq) {
+			return
+		}
+	}
+}
+
+// LogNumber return the number of the oldest wal file that is not obsolete
+func (vs *VersionSet) LogNumber() uint64 {
+	return vs.logNumber
+}
+
 func (vs *VersionSet) IncreaseNextFileNumber(delta uint64) uint64 {
 
 	newFid := atomic.AddUint64(&(vs.NextFileNumber), delta)
 	return newFid
 }
 
-func (vs *VersionSet) AddNewVLogGroup(fid uint64) {
-
-	vs.info.AddNewVLogWithGroup(fid)
+// AddNewVLogGroup add a group that contains the vlog with the same fid as
+// the table, and record it in vmanifest
+func (vs *VersionSet) AddNewVLogGroup(fid uint64) error {
 	vs.info.SetTableState(fid, NORMAL)
+	ve := NewVersionEdit()
+	ve.RecordNewVLogGroup(fid, []uint64{fid})
+	return vs.VLogAndApply(ve)
+}
+
+// NumLevelFiles return the number of files in level
+func (vs *VersionSet) NumLevelFiles(level int) int {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	return len(vs.current.files[level])
+}
+
+// LevelKeyRanges return the key range of each file in level, sorted by the
+// smallest key
+func (vs *VersionSet) LevelKeyRanges(level int) [][2][]byte {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	ranges := make([][2][]byte, 0, len(vs.current.files[level]))
+	for _, f := range vs.current.files[level] {
+		ranges = append(ranges, [2][]byte{f.smallest, f.largest})
+	}
+	cmp := vs.current.opt.Comparable
+	sort.Slice(ranges, func(i, j int) bool {
+		return cmp.Compare(ranges[i][0], ranges[j][0]) < 0
+	})
+	return ranges
 }
@@ -0,0 +1,77 @@
+package version
+
+import (
+	"ckv/utils"
+	"ckv/utils/errs"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionSetRotateTornTail(t *testing.T) {
+	opt := &utils.Options{WorkDir: t.TempDir(), MaxLevelNum: 7, MaxManifestSize: 256}
+	vs, err := Open(opt)
+	assert.Nil(t, err)
+	n := 100
+	for i := 1; i <= n; i++ {
+		assert.Nil(t, vs.SetLogNumber(uint64(i)))
+	}
+	// the manifest is switched more than once by the edits
+	num := vs.manifestFileNumber
+	assert.Greater(t, num, uint64(2))
+	assert.Nil(t, vs.Close())
+
+	// a crash in the middle of LogAndApply leaves a torn record
+	name := filepath.Join(opt.WorkDir, manifestName(num))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Nil(t, err)
+	header := make([]byte, manifestRecordHeaderSize)
+	binary.BigEndian.PutUint32(header[4:], 100)
+	_, err = f.Write(append(header, "torn"...))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// the tail is dropped, and the edits written after it are replayed
+	opt.MaxManifestSize = 1 << 20
+	vs, err = Open(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, num, vs.manifestFileNumber)
+	assert.Equal(t, uint64(n), vs.LogNumber())
+	assert.Nil(t, vs.SetLogNumber(uint64(n+1)))
+	assert.Nil(t, vs.Close())
+
+	vs, err = Open(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, num, vs.manifestFileNumber)
+	assert.Equal(t, uint64(n+1), vs.LogNumber())
+	assert.Nil(t, vs.Close())
+
+	// only the manifest files in CURRENT are left
+	manifests, err := filepath.Glob(filepath.Join(opt.WorkDir, ManifestFilename+"*"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name}, manifests)
+}
+
+func TestGetStatsSeekCharged(t *testing.T) {
+	a, b := &FileMetaData{id: 1}, &FileMetaData{id: 2}
+	// the key isn't found in the first file
+	var stats getStats
+	stats.probe(a, 0, errs.ErrKeyNotFound)
+	meta, _ := stats.seekCharged()
+	assert.Nil(t, meta)
+	stats.probe(b, 1, nil)
+	meta, level := stats.seekCharged()
+	assert.Equal(t, a, meta)
+	assert.Equal(t, 0, level)
+
+	// the first file has a merge operand of the key, the files below it are
+	// probed for the older versions
+	stats = getStats{}
+	stats.probe(a, 0, nil)
+	stats.probe(b, 1, nil)
+	meta, _ = stats.seekCharged()
+	assert.Nil(t, meta)
+}
@@ -0,0 +1,118 @@
+package version
+
+import (
+	"bytes"
+	"ckv/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionEditEncode(t *testing.T) {
+	meta := func(id uint64, smallest, largest string) *FileMetaData {
+		return &FileMetaData{
+			id:          id,
+			fileSize:    id * 100,
+			smallest:    []byte(smallest),
+			largest:     []byte(largest),
+			smallestSeq: id,
+			largestSeq:  id * 10,
+		}
+	}
+	ve := NewVersionEdit()
+	ve.SetLogNumber(7)
+	ve.nextFileNumber, ve.lastSequence = 12, 345
+	ve.mergeOperator = "uint64add"
+	ve.family, ve.familyAdd, ve.maxFamily = 3, "cf", 3
+	ve.adds = append(ve.adds, &TableMeta{f: meta(10, "a", "f"), level: 0}, &TableMeta{f: meta(11, "g", "k"), level: 2})
+	ve.deletes = append(ve.deletes, &TableMeta{f: meta(5, "a", "k"), level: 1})
+	ve.RecordNewVLogGroup(10, []uint64{10, 4})
+	ve.RecordMergeVLogGroup([]uint64{4, 5}, 11)
+	ve.RecordRemoveVLog(6, []uint64{2})
+	ve.RecordDropVLogGroup(5)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "MANIFEST"))
+	assert.Nil(t, err)
+	defer f.Close()
+	v := NewVersion(&utils.Options{MaxLevelNum: 7})
+	assert.Nil(t, v.logEdit(f, ve.encode(true)))
+	assert.Nil(t, v.logEdit(f, ve.encode(false)))
+	_, err = f.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+
+	edit, n, err := decodeEdit(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), edit.LogNumber)
+	assert.Equal(t, uint64(12), edit.NextFileNumber)
+	assert.Equal(t, uint64(345), edit.LastSequence)
+	assert.Equal(t, "uint64add", edit.MergeOperator)
+	assert.Equal(t, uint32(3), edit.ColumnFamily)
+	assert.Equal(t, "cf", edit.ColumnFamilyAdd)
+	assert.False(t, edit.ColumnFamilyDrop)
+	assert.Equal(t, uint32(3), edit.MaxColumnFamily)
+	assert.Equal(t, 2, len(edit.Adds))
+	for i, m := range edit.Adds {
+		assert.Equal(t, ve.adds[i].f, decodeFileMeta(m))
+		assert.Equal(t, uint32(ve.adds[i].level), m.Level)
+	}
+	assert.Equal(t, 1, len(edit.Deletes))
+	assert.Equal(t, ve.deletes[0].f, decodeFileMeta(edit.Deletes[0]))
+	assert.Equal(t, uint32(1), edit.Deletes[0].Level)
+	assert.Equal(t, len(ve.vgroups), len(edit.VlogGroups))
+	for i, g := range edit.VlogGroups {
+		assert.Equal(t, uint32(ve.vgroups[i].op), g.Op)
+		assert.Equal(t, ve.vgroups[i].group, g.Group)
+		assert.Equal(t, ve.vgroups[i].fids, g.Fids)
+	}
+
+	// the vlog groups are only written to vmanifest
+	edit, m, err := decodeEdit(data[n:])
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n+m)
+	assert.Equal(t, 2, len(edit.Adds))
+	assert.Equal(t, 0, len(edit.VlogGroups))
+
+	// a torn record is incomplete, and a corrupted one fails the checksum
+	_, _, err = decodeEdit(data[:n-1])
+	assert.Equal(t, io.EOF, err)
+	corrupted := append([]byte{}, data[:n]...)
+	corrupted[n-1] ^= 0xff
+	_, _, err = decodeEdit(corrupted)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+// reverseComparator order keys in descending bytes
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func TestVersionSortFiles(t *testing.T) {
+	v := NewVersion(&utils.Options{MaxLevelNum: 3, Comparable: reverseComparator{}})
+	for i, key := range []string{"b", "d", "a", "c"} {
+		meta := &FileMetaData{id: uint64(i), smallest: []byte(key), largest: []byte(key)}
+		v.files[0] = append(v.files[0], meta)
+		v.files[2] = append(v.files[2], meta)
+	}
+	v.sortFiles()
+
+	// level 0 keeps the order the files are added
+	var keys []string
+	for _, meta := range v.files[0] {
+		keys = append(keys, string(meta.smallest))
+	}
+	assert.Equal(t, []string{"b", "d", "a", "c"}, keys)
+	keys = keys[:0]
+	for _, meta := range v.files[2] {
+		keys = append(keys, string(meta.smallest))
+	}
+	assert.Equal(t, []string{"d", "c", "b", "a"}, keys)
+}
@@ -2,12 +2,12 @@ package vlog
 
 import (
 	"bufio"
-	"bytes"
 	"ckv/file"
 	"ckv/utils"
 	"ckv/utils/codec"
 	"ckv/utils/convert"
 	"ckv/utils/errs"
+	"encoding/binary"
 	"io"
 	"os"
 	"sync"
@@ -15,55 +15,61 @@ import (
 
 // VLogFile
 type VLogFile struct {
-	f    *file.MmapFile
+	f    *file.AppendFile
 	lock *sync.RWMutex
 
-	opt     *file.Options
-	buf     *bytes.Buffer
-	writeAt uint32
-	size    uint32
+	opt *file.Options
 }
 
 type VLogHeader struct {
-	checksum uint32
-	keyLen   uint32
-	ValueLen uint32
-	types    uint8
+	checksum  uint32
+	keyLen    uint32
+	ValueLen  uint32
+	types     uint8
+	expiresAt uint64
 }
 
+// the type of record is its format, the records written before a format change
+// remain readable
+const (
+	// recordLegacy records have no expiration
+	recordLegacy = 1
+	// recordExpiresAt records store the expiration after the type
+	recordExpiresAt = 2
+
+	currentRecord = recordExpiresAt
+)
+
 type VLogRecord struct {
 	VLogHeader
 	key   []byte
 	value []byte
 }
 
-// OpenvlogFile _
-func OpenVLogFile(opt *file.Options) *VLogFile {
-	omf, err := file.OpenMmapFile(opt.FileName, opt.Flag, opt.MaxSz)
+// OpenVLogFile open the vlog file, new records are appended to the end of it.
+// The file grows as needed, opt.MaxSz is only the initial size
+func OpenVLogFile(opt *file.Options) (*VLogFile, error) {
+	af, err := file.OpenAppendFile(opt)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	vlog := &VLogFile{f: omf, lock: &sync.RWMutex{}, opt: opt}
-	vlog.buf = &bytes.Buffer{}
-	vlog.size = uint32(len(vlog.f.Data))
-	errs.Err(err)
-
-	return vlog
+	return &VLogFile{f: af, lock: &sync.RWMutex{}, opt: opt}, nil
 }
 
 // Write
-// +---------------------------------------------------+
-// | checksum | key len | value len | type | key:value |
-// +---------------------------------------------------+
+// +----------------------------------------------------------------+
+// | checksum | key len | value len | type | expires at | key:value |
+// +----------------------------------------------------------------+
 func (vlog *VLogFile) Write(entry *utils.Entry) error {
 	vlog.lock.Lock()
 	defer vlog.lock.Unlock()
 
 	keyLen := codec.VarintLength(uint64(len(entry.Key)))
 	valLen := codec.VarintLength(uint64(len(entry.Value)))
+	expiresAtLen := codec.VarintLength(entry.ExpiresAt)
 
-	// checksum + key len + value len + type  + seq(8)
-	total := 4 + keyLen + valLen + 1 + len(entry.Key) + len(entry.Value)
+	// checksum + key len + value len + type + expires at
+	total := 4 + keyLen + valLen + 1 + expiresAtLen + len(entry.Key) + len(entry.Value)
 
 	buf := make([]byte, total)
 	off := 4
@@ -71,10 +77,10 @@ func (vlog *VLogFile) Write(entry *utils.Entry) error {
 	off += codec.EncodeVarint32(buf[off:], uint32(len(entry.Key)))
 	off += codec.EncodeVarint32(buf[off:], uint32(len(entry.Value)))
 
-	buf[off] = 1
+	buf[off] = currentRecord
 	off += 1
+	off += binary.PutUvarint(buf[off:], entry.ExpiresAt)
 
-	vlog.buf.Bytes()
 	// write key value
 	copy(buf[off:off+len(entry.Key)], entry.Key)
 	off += len(entry.Key)
@@ -83,25 +89,15 @@ func (vlog *VLogFile) Write(entry *utils.Entry) error {
 	checksum := codec.CalculateU32Checksum(buf[4:])
 	copy(buf[:4], convert.U32ToBytes(checksum)) // write checksum
 
-	dst, err := vlog.f.Bytes(int(vlog.writeAt), int(total))
-	if err != nil {
-		return err
-	}
-	copy(dst, buf)
-	vlog.writeAt += uint32(total)
-	return nil
+	_, err := vlog.f.Append(buf)
+	return err
 }
 
 func (vlog *VLogFile) WriteData(data []byte) error {
-	vlog.lock.RLock()
-	defer vlog.lock.RUnlock()
-	dst, err := vlog.f.Bytes(int(vlog.writeAt), len(data))
-	if err != nil {
-		return err
-	}
-	copy(dst, data)
-	vlog.writeAt += uint32(len(data))
-	return nil
+	vlog.lock.Lock()
+	defer vlog.lock.Unlock()
+	_, err := vlog.f.Append(data)
+	return err
 }
 
 func (vlog *VLogFile) ReadAt(pos uint32) ([]byte, error) {
@@ -110,7 +106,10 @@ func (vlog *VLogFile) ReadAt(pos uint32) ([]byte, error) {
 	reader := bufio.NewReader(vlog.f.NewReader(int(pos)))
 
 	record, _, err := vlog.readRecord(reader)
-	return record.value, err
+	if err != nil {
+		return nil, err
+	}
+	return record.value, nil
 }
 
 func (vlog *VLogFile) ReadRecord(pos uint32) (*VLogRecord, int, error) {
@@ -143,17 +142,30 @@ func (vlog *VLogFile) readRecord(reader *bufio.Reader) (*VLogRecord, int, error)
 		return nil, 0, err
 	}
 
+	types, err := reader.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	record.types = types
 	length := codec.VarintLength(uint64(keySz)) + codec.VarintLength(uint64(valSz)) + 1
+	switch types {
+	case recordLegacy:
+	case recordExpiresAt:
+		if record.expiresAt, err = binary.ReadUvarint(reader); err != nil {
+			return nil, 0, err
+		}
+		length += codec.VarintLength(record.expiresAt)
+	default:
+		return nil, 0, errs.ErrUnknownVLogRecord
+	}
+
 	buf := make([]byte, uint32(length)+keySz+valSz)
 	off := codec.EncodeVarint32(buf, uint32(keySz))
 	off += codec.EncodeVarint32(buf[off:], uint32(valSz))
-
-	if types, err := reader.ReadByte(); err != nil {
-		return nil, 0, err
-	} else {
-		buf[off] = types
-		off += 1
-		record.types = types
+	buf[off] = types
+	off += 1
+	if types == recordExpiresAt {
+		binary.PutUvarint(buf[off:], record.expiresAt)
 	}
 
 	//io.ReadFull(reader, buf)
@@ -201,17 +213,30 @@ func (vlog *VLogFile) readRecordBytes(reader *bufio.Reader) ([]byte, int, error)
 		return nil, 0, err
 	}
 
+	types, err := reader.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	record.types = types
 	length := codec.VarintLength(uint64(keySz)) + codec.VarintLength(uint64(valSz)) + 1
+	switch types {
+	case recordLegacy:
+	case recordExpiresAt:
+		if record.expiresAt, err = binary.ReadUvarint(reader); err != nil {
+			return nil, 0, err
+		}
+		length += codec.VarintLength(record.expiresAt)
+	default:
+		return nil, 0, errs.ErrUnknownVLogRecord
+	}
+
 	buf := make([]byte, uint32(length)+keySz+valSz)
 	off := codec.EncodeVarint32(buf, uint32(keySz))
 	off += codec.EncodeVarint32(buf[off:], uint32(valSz))
-
-	if types, err := reader.ReadByte(); err != nil {
-		return nil, 0, err
-	} else {
-		buf[off] = types
-		off += 1
-		record.types = types
+	buf[off] = types
+	off += 1
+	if types == recordExpiresAt {
+		binary.PutUvarint(buf[off:], record.expiresAt)
 	}
 
 	//io.ReadFull(reader, buf)
@@ -233,7 +258,9 @@ func (vlog *VLogFile) readRecordBytes(reader *bufio.Reader) ([]byte, int, error)
 }
 
 func (vlog *VLogFile) Pos() uint32 {
-	return vlog.writeAt
+	vlog.lock.RLock()
+	defer vlog.lock.RUnlock()
+	return uint32(vlog.f.Size())
 }
 
 func (vlog *VLogFile) Iterate(fn func(e *utils.Entry) error) error {
@@ -252,8 +279,9 @@ func (vlog *VLogFile) Iterate(fn func(e *utils.Entry) error) error {
 		}
 		pos += uint32(n)
 		e := &utils.Entry{
-			Key:   record.key,
-			Value: record.value,
+			Key:       record.key,
+			Value:     record.value,
+			ExpiresAt: record.expiresAt,
 		}
 		fn(e)
 	}
@@ -289,5 +317,5 @@ func (vlog *VLogFile) Name() string {
 }
 
 func (vlog *VLogFile) Size() uint32 {
-	return vlog.writeAt
+	return vlog.Pos()
 }